@@ -0,0 +1,108 @@
+package aof
+
+import (
+	"os"
+	"sync"
+)
+
+// Fsync policies, as configured by `appendfsync`
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+// File is an append only file, the write commands being appended to it as they run
+type File struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// pending is set when commands were written since the last fsync
+	pending bool
+	// lastErr is the error of the last write or fsync, nil when it succeeded
+	lastErr error
+}
+
+// Open opens the file at path for appending, creating it when missing
+func Open(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &File{file: file, size: info.Size()}, nil
+}
+
+// Append writes the command to the file. With the always policy the file is
+// synced to disk before returning, otherwise it is left to Sync or to the
+// operating system.
+func (f *File) Append(command string, fsync string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.file.WriteString(command)
+	if err != nil {
+		// a partial command would break the file, so it is removed
+		if n > 0 {
+			f.file.Truncate(f.size)
+		}
+		f.lastErr = err
+		return err
+	}
+	f.size += int64(n)
+	f.pending = true
+	f.lastErr = nil
+
+	if fsync == FsyncAlways {
+		return f.sync()
+	}
+	return nil
+}
+
+// Sync flushes to disk the commands written since the last time
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.pending {
+		return nil
+	}
+	return f.sync()
+}
+
+func (f *File) sync() error {
+	if err := f.file.Sync(); err != nil {
+		f.lastErr = err
+		return err
+	}
+	f.pending = false
+	return nil
+}
+
+// Size returns the size of the file in bytes
+func (f *File) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.size
+}
+
+// LastError returns the error of the last write or fsync, nil when it succeeded
+func (f *File) LastError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.lastErr
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sync()
+	return f.file.Close()
+}
@@ -0,0 +1,251 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// Types of the files listed in a manifest
+const (
+	TypeBase    = 'b'
+	TypeIncr    = 'i'
+	TypeHistory = 'h'
+)
+
+// Info is a file of a multi part append only file
+type Info struct {
+	Name string
+	Seq  int
+	Type byte
+}
+
+/*
+Manifest lists the files making an append only file, kept in its directory
+as `<appendfilename>.manifest`, one line per file:
+
+	file appendonly.aof.1.base.rdb seq 1 type b
+	file appendonly.aof.1.incr.aof seq 1 type i
+
+The base file holds the dataset as of the last rewrite, either in the RDB
+format or as commands. The incremental files hold the commands run since,
+in the order they are listed. History files were replaced by a rewrite,
+and are deleted once the manifest no longer needs them.
+*/
+type Manifest struct {
+	// Name is the appendfilename the files are named after
+	Name    string
+	Base    *Info
+	Incrs   []Info
+	History []Info
+	// the sequence numbers of the last base and incremental files created
+	baseSeq int
+	incrSeq int
+}
+
+func NewManifest(name string) *Manifest {
+	return &Manifest{Name: name}
+}
+
+// ManifestName returns the name of the manifest of the append only file
+func ManifestName(name string) string {
+	return name + ".manifest"
+}
+
+// ParseManifest parses the lines of a manifest, ignoring empty and comment lines
+func ParseManifest(name string, data []byte) (*Manifest, error) {
+	m := NewManifest(name)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %s", line, text)
+		}
+		info := Info{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.Name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil || seq < 1 {
+					return nil, fmt.Errorf("invalid manifest line %d: %s", line, text)
+				}
+				info.Seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid manifest line %d: %s", line, text)
+				}
+				info.Type = fields[i+1][0]
+			}
+			// unknown fields are left for newer versions
+		}
+		if info.Name == "" || info.Seq == 0 || strings.ContainsAny(info.Name, "/\\") {
+			return nil, fmt.Errorf("invalid manifest line %d: %s", line, text)
+		}
+
+		switch info.Type {
+		case TypeBase:
+			if m.Base != nil {
+				return nil, fmt.Errorf("found duplicate base file information in the manifest")
+			}
+			m.Base = &info
+			m.baseSeq = info.Seq
+		case TypeIncr:
+			if info.Seq <= m.incrSeq {
+				return nil, fmt.Errorf("found a non-monotonic sequence number in the manifest")
+			}
+			m.Incrs = append(m.Incrs, info)
+			m.incrSeq = info.Seq
+		case TypeHistory:
+			m.History = append(m.History, info)
+		default:
+			return nil, fmt.Errorf("unknown file type in the manifest line %d: %s", line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadManifest reads the manifest of the append only file in dir
+func LoadManifest(dir, name string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName(name)))
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(name, data)
+}
+
+// Encode returns the manifest in the format read by ParseManifest
+func (m *Manifest) Encode() []byte {
+	buf := &bytes.Buffer{}
+	write := func(info Info) {
+		fmt.Fprintf(buf, "file %s seq %d type %c\n", info.Name, info.Seq, info.Type)
+	}
+	if m.Base != nil {
+		write(*m.Base)
+	}
+	for _, info := range m.History {
+		write(info)
+	}
+	for _, info := range m.Incrs {
+		write(info)
+	}
+	return buf.Bytes()
+}
+
+// Save writes the manifest into dir, through a temporary file renamed once
+// complete so the manifest is always valid
+func (m *Manifest) Save(dir string) error {
+	temp, err := os.CreateTemp(dir, "temp-*.manifest")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(m.Encode()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(dir, ManifestName(m.Name)))
+}
+
+// Clone returns a copy of the manifest, which can be changed on its own
+func (m *Manifest) Clone() *Manifest {
+	clone := *m
+	if m.Base != nil {
+		base := *m.Base
+		clone.Base = &base
+	}
+	clone.Incrs = slices.Clone(m.Incrs)
+	clone.History = slices.Clone(m.History)
+	return &clone
+}
+
+// Files returns the base and incremental files, in the order they are loaded in
+func (m *Manifest) Files() []Info {
+	files := []Info{}
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+// IsRDBFile reports whether the file is in the RDB format, rather than made of commands
+func IsRDBFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(rdb.MAGIC_NUMBER))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+	return string(magic) == rdb.MAGIC_NUMBER, nil
+}
+
+// NewIncr adds a new incremental file, the one commands are appended to from now on
+func (m *Manifest) NewIncr() Info {
+	m.incrSeq++
+	info := Info{Name: fmt.Sprintf("%s.%d.incr.aof", m.Name, m.incrSeq), Seq: m.incrSeq, Type: TypeIncr}
+	m.Incrs = append(m.Incrs, info)
+	return info
+}
+
+// NewBase returns the name of the next base file, in the RDB format or
+// made of commands
+func (m *Manifest) NewBase(rdbFormat bool) Info {
+	extension := "aof"
+	if rdbFormat {
+		extension = "rdb"
+	}
+	seq := m.baseSeq + 1
+	return Info{Name: fmt.Sprintf("%s.%d.base.%s", m.Name, seq, extension), Seq: seq, Type: TypeBase}
+}
+
+// Rewritten replaces the base file with a new one holding the dataset as of
+// the creation of the incremental file of sequence number firstIncr. The
+// previous base and the incremental files created before become history.
+func (m *Manifest) Rewritten(base Info, firstIncr int) {
+	if m.Base != nil {
+		m.Base.Type = TypeHistory
+		m.History = append(m.History, *m.Base)
+	}
+	m.Base = &base
+	m.baseSeq = base.Seq
+
+	incrs := []Info{}
+	for _, info := range m.Incrs {
+		if info.Seq < firstIncr {
+			info.Type = TypeHistory
+			m.History = append(m.History, info)
+		} else {
+			incrs = append(incrs, info)
+		}
+	}
+	m.Incrs = incrs
+}
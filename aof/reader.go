@@ -0,0 +1,110 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrTruncated is returned when the file ends in the middle of a command
+var ErrTruncated = errors.New("unexpected end of the append only file")
+
+// Reader reads the commands of an append only file, each one an array of
+// bulk strings as sent by the clients
+type Reader struct {
+	r *bufio.Reader
+	// offset is the number of bytes of the commands read so far
+	offset int64
+	// read is the number of bytes read of the command being read
+	read int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Offset returns the number of bytes of the complete commands read so far,
+// where the file is truncated when it ends with a partial command
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the arguments of the next command, io.EOF once every command
+// was read, and ErrTruncated when the file ends in the middle of a command
+func (r *Reader) Next() ([]string, error) {
+	r.read = 0
+	line, err := r.readLine()
+	if err == io.EOF && r.read == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := r.parseHeader(line, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.parseHeader(line, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		n, err := io.ReadFull(r.r, data)
+		r.read += int64(n)
+		if err != nil {
+			return nil, ErrTruncated
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, r.formatError()
+		}
+		args = append(args, string(data[:size]))
+	}
+
+	r.offset += r.read
+	return args, nil
+}
+
+// readLine reads a line ended by CRLF, returning it without the CRLF
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	r.read += int64(len(line))
+	if err == io.EOF {
+		if len(line) == 0 && r.read == 0 {
+			return "", io.EOF
+		}
+		return "", ErrTruncated
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", r.formatError()
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseHeader parses the line giving the number of arguments of a command,
+// or the size of an argument, which starts with the given prefix
+func (r *Reader) parseHeader(line string, prefix byte) (int, error) {
+	if len(line) < 2 || line[0] != prefix {
+		return 0, r.formatError()
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 && prefix == '*' || n < 0 {
+		return 0, r.formatError()
+	}
+	return n, nil
+}
+
+func (r *Reader) formatError() error {
+	return fmt.Errorf("bad file format reading the append only file at offset %d", r.offset)
+}
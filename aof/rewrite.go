@@ -0,0 +1,198 @@
+package aof
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// Command formats the arguments as a command of an append only file
+func Command(args ...string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// itemsPerCommand is the number of elements added by each command rebuilding
+// a collection, so no command gets too large
+const itemsPerCommand = 64
+
+// Rewritable reports whether the server can rebuild the keys from commands.
+// It has no commands creating lists, sets, sorted sets and hashes, nor empty
+// streams and consumer groups, so these are only kept in the RDB format.
+func Rewritable(keys []rdb.Key) bool {
+	for _, key := range keys {
+		switch value := key.Value.(type) {
+		case string:
+		case *rdb.Stream:
+			if len(value.Entries) == 0 || len(value.Groups) > 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WriteCommands writes the commands rebuilding the function libraries and the
+// keys. Expire times are given as absolute times, so they don't move when
+// the file is loaded later.
+func WriteCommands(w io.Writer, keys []rdb.Key, functions []string) error {
+	out := bufio.NewWriter(w)
+	for _, code := range functions {
+		out.WriteString(Command("FUNCTION", "LOAD", code))
+	}
+
+	keys = slices.Clone(keys)
+	slices.SortStableFunc(keys, func(a, b rdb.Key) int {
+		return cmp.Compare(a.DB, b.DB)
+	})
+	db := -1
+	for _, key := range keys {
+		if key.DB != db {
+			db = key.DB
+			out.WriteString(Command("SELECT", strconv.Itoa(db)))
+		}
+
+		commands, err := keyCommands(key)
+		if err != nil {
+			return err
+		}
+		for _, args := range commands {
+			out.WriteString(Command(args...))
+		}
+	}
+	return out.Flush()
+}
+
+// keyCommands returns the commands creating the key with its value, the
+// elements of collections being added by batches of itemsPerCommand
+func keyCommands(key rdb.Key) ([][]string, error) {
+	commands := [][]string{}
+	batches := func(name string, items [][]string) {
+		for start := 0; start < len(items); start += itemsPerCommand {
+			args := []string{name, key.Key}
+			for _, item := range items[start:min(start+itemsPerCommand, len(items))] {
+				args = append(args, item...)
+			}
+			commands = append(commands, args)
+		}
+	}
+	single := func(elements []string) [][]string {
+		items := make([][]string, len(elements))
+		for i, element := range elements {
+			items[i] = []string{element}
+		}
+		return items
+	}
+
+	switch value := key.Value.(type) {
+	case string:
+		args := []string{"SET", key.Key, value}
+		if key.Expires {
+			args = append(args, "PXAT", strconv.FormatInt(key.ExpireAt, 10))
+		}
+		// the expire time is set along with the value
+		return [][]string{args}, nil
+	case rdb.List:
+		batches("RPUSH", single(value))
+	case rdb.Set:
+		batches("SADD", single(value))
+	case rdb.SortedSet:
+		items := make([][]string, len(value))
+		for i, member := range value {
+			items[i] = []string{strconv.FormatFloat(member.Score, 'g', -1, 64), member.Member}
+		}
+		batches("ZADD", items)
+	case rdb.Hash:
+		items := make([][]string, len(value))
+		for i, field := range value {
+			items[i] = []string{field.Field, field.Value}
+		}
+		batches("HSET", items)
+		for _, field := range value {
+			if field.ExpireAt != 0 {
+				commands = append(commands, []string{"HPEXPIREAT", key.Key,
+					strconv.FormatInt(field.ExpireAt, 10), "FIELDS", "1", field.Field})
+			}
+		}
+	case *rdb.Stream:
+		commands = append(commands, streamCommands(key.Key, value)...)
+	default:
+		return nil, fmt.Errorf("can't rewrite a value of type %T as commands", value)
+	}
+
+	if key.Expires {
+		commands = append(commands, []string{"PEXPIREAT", key.Key, strconv.FormatInt(key.ExpireAt, 10)})
+	}
+	return commands, nil
+}
+
+// streamCommands returns the commands creating a stream with its entries and
+// consumer groups, the entries pending in a group being claimed by their consumer
+func streamCommands(key string, stream *rdb.Stream) [][]string {
+	commands := [][]string{}
+	for _, entry := range stream.Entries {
+		commands = append(commands, append([]string{"XADD", key, entry.Id.String()}, entry.Fields...))
+	}
+	if len(stream.Entries) == 0 {
+		// an entry is added and trimmed right away, creating an empty stream
+		commands = append(commands, []string{"XADD", key, "MAXLEN", "0", stream.LastId.String(), "x", "y"})
+	}
+	commands = append(commands, []string{"XSETID", key, stream.LastId.String(),
+		"ENTRIESADDED", strconv.FormatUint(stream.EntriesAdded, 10),
+		"MAXDELETEDID", stream.MaxDeletedId.String()})
+
+	for _, group := range stream.Groups {
+		args := []string{"XGROUP", "CREATE", key, group.Name, group.LastId.String()}
+		if group.EntriesRead >= 0 {
+			args = append(args, "ENTRIESREAD", strconv.FormatInt(group.EntriesRead, 10))
+		}
+		commands = append(commands, args)
+		for _, consumer := range group.Consumers {
+			commands = append(commands, []string{"XGROUP", "CREATECONSUMER", key, group.Name, consumer.Name})
+		}
+		for _, pending := range group.Pending {
+			commands = append(commands, []string{"XCLAIM", key, group.Name, pending.Consumer, "0", pending.Id.String(),
+				"TIME", strconv.FormatInt(pending.DeliveryTime, 10),
+				"RETRYCOUNT", strconv.FormatUint(pending.DeliveryCount, 10),
+				"JUSTID", "FORCE", "LASTID", group.LastId.String()})
+		}
+	}
+	return commands
+}
+
+// WriteCommandsFile writes the commands rebuilding the keys into the file at
+// path, through a temporary file renamed once complete
+func WriteCommandsFile(path string, keys []rdb.Key, functions []string) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := WriteCommands(temp, keys, functions); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
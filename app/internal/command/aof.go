@@ -0,0 +1,562 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// rewriteRetryDelay is how long a failed rewrite waits before being
+// triggered again by the growth of the append only file
+const rewriteRetryDelay = 5 * time.Second
+
+// appendOnly is the append only file every write command is logged to, nil
+// when appendonly is off. It is opened before the server accepts connections.
+var appendOnly *appendOnlyFile
+
+// appendOnlyFile is a multi part append only file: a base file holding the
+// dataset as of the last rewrite, and the incremental files the commands are
+// appended to, listed by a manifest. The manifest only changes while holding
+// the execution lock, the other fields are guarded by mu as they are also
+// read by INFO and by the goroutine syncing the file.
+type appendOnlyFile struct {
+	dir      string
+	manifest *aof.Manifest
+
+	mu sync.Mutex
+	// incr is the incremental file the commands are appended to
+	incr *aof.File
+	// size is the size of the base file and of the incremental files before incr
+	size     int64
+	baseSize int64
+	// rewriteBaseSize is the size of the file after the last rewrite, its
+	// growth since triggering the next one
+	rewriteBaseSize int64
+	rewriting       bool
+	// scheduled is set by BGREWRITEAOF while a background save is running
+	scheduled     bool
+	started       time.Time
+	lastRewriteOk bool
+	// lastRewriteTaken is how long the last rewrite took, -1 when there was none
+	lastRewriteTaken time.Duration
+}
+
+// LoadAOF replays the files of the append only file into the databases. The
+// last file ending with a partial command, or with a transaction missing its
+// EXEC, is truncated to its last complete command when aof-load-truncated is
+// enabled. A single append only file, as written before the manifest was
+// introduced, is moved into the directory of the append only file as its base.
+func LoadAOF(cfg *config.Config, dbs []*store.Store) error {
+	dir, name := cfg.AOFDir(), cfg.AppendFilename()
+	manifest, err := aof.LoadManifest(dir, name)
+	if os.IsNotExist(err) {
+		manifest, err = upgradeAOF(cfg)
+	}
+	if err != nil {
+		return err
+	}
+	if manifest == nil || len(manifest.Files()) == 0 {
+		log.Println("no append only file found, starting with empty data...")
+		return nil
+	}
+
+	// the commands run as if sent by a client, their replies being discarded
+	lock := util.NewLock()
+	lock.Lock()
+	defer lock.Unlock()
+	h := &Handler{
+		dbs:      dbs,
+		db:       dbs[0],
+		cfg:      cfg,
+		execLock: lock,
+		writer:   bufio.NewWriter(io.Discard),
+		closed:   make(chan struct{}),
+		watch:    store.NewWatch(),
+		loading:  true,
+	}
+
+	files := manifest.Files()
+	for i, info := range files {
+		path := filepath.Join(dir, info.Name)
+		isRDB, err := aof.IsRDBFile(path)
+		if err != nil {
+			return err
+		}
+		if isRDB {
+			libraries, err := store.ReadRDBFile(path, dbs)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", info.Name, err)
+			}
+			if err := LoadLibraries(libraries); err != nil {
+				return fmt.Errorf("failed to load the function libraries of %s: %w", info.Name, err)
+			}
+			continue
+		}
+		if err := replayAOF(h, path, i == len(files)-1); err != nil {
+			return err
+		}
+	}
+	persistence.loaded()
+	return nil
+}
+
+// upgradeAOF moves a single append only file into the directory of the
+// append only file, as the base of a new manifest. It returns nil when
+// there is no append only file.
+func upgradeAOF(cfg *config.Config) (*aof.Manifest, error) {
+	dir, name := cfg.AOFDir(), cfg.AppendFilename()
+	old := filepath.Join(cfg.Dir(), name)
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(old, filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
+	manifest := aof.NewManifest(name)
+	manifest.Rewritten(aof.Info{Name: name, Seq: 1, Type: aof.TypeBase}, 0)
+	if err := manifest.Save(dir); err != nil {
+		return nil, err
+	}
+	log.Printf("moved the append only file %s into %s\n", old, dir)
+	return manifest, nil
+}
+
+// replayAOF runs the commands of a file, which may be truncated when it is
+// the last one
+func replayAOF(h *Handler, path string, last bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := aof.NewReader(file)
+	// valid is the size of the file up to the last command outside of a transaction
+	valid, commands, truncated := int64(0), 0, false
+	for {
+		args, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, aof.ErrTruncated) {
+			truncated = true
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err := h.dispatch(&Command{Args: args}); err != nil {
+			return fmt.Errorf("failed to run %s from the append only file: %w", args[0], err)
+		}
+		if !h.multi {
+			valid = reader.Offset()
+		}
+		commands++
+	}
+
+	if truncated || h.multi {
+		if !last || !h.cfg.AOFLoadTruncated() {
+			return fmt.Errorf("the append only file %s ends with a partial command at offset %d, enable aof-load-truncated to load it", path, valid)
+		}
+		log.Printf("!!! Warning: short read while loading the append only file %s !!!\n", path)
+		if err := os.Truncate(path, valid); err != nil {
+			return fmt.Errorf("failed to truncate the append only file: %w", err)
+		}
+		log.Printf("append only file truncated to %d bytes, its last command being incomplete\n", valid)
+		h.discardTransaction()
+	}
+	log.Printf("loaded %d commands from %s\n", commands, filepath.Base(path))
+	return nil
+}
+
+// OpenAOF opens the append only file the write commands are logged to, when
+// appendonly is enabled. Without a base file nor incremental files, the base
+// is written right away from the databases.
+func OpenAOF(cfg *config.Config, dbs []*store.Store) error {
+	if !cfg.AppendOnly() {
+		return nil
+	}
+
+	dir, name := cfg.AOFDir(), cfg.AppendFilename()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	manifest, err := aof.LoadManifest(dir, name)
+	if os.IsNotExist(err) {
+		manifest, err = aof.NewManifest(name), nil
+	}
+	if err != nil {
+		return err
+	}
+	a := &appendOnlyFile{dir: dir, manifest: manifest, lastRewriteOk: true, lastRewriteTaken: -1}
+
+	if manifest.Base == nil && len(manifest.Incrs) == 0 {
+		data := snapshot(dbs)
+		base, err := writeBase(cfg, manifest, data.keys(), data.libraries)
+		if err != nil {
+			return err
+		}
+		manifest.Rewritten(base, 0)
+	}
+	// the commands are appended to the last incremental file
+	if len(manifest.Incrs) == 0 {
+		manifest.NewIncr()
+	}
+	if err := manifest.Save(dir); err != nil {
+		return err
+	}
+	a.deleteHistory()
+
+	files := manifest.Files()
+	for _, info := range files[:len(files)-1] {
+		size, err := fileSize(filepath.Join(dir, info.Name))
+		if err != nil {
+			return err
+		}
+		a.size += size
+		if info.Type == aof.TypeBase {
+			a.baseSize = size
+		}
+	}
+	if a.incr, err = aof.Open(filepath.Join(dir, files[len(files)-1].Name)); err != nil {
+		return err
+	}
+	a.rewriteBaseSize = a.currentSize()
+
+	appendOnly = a
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// writeBase writes the keys into the next base file of the manifest, in the
+// RDB format unless configured otherwise and the keys can be rebuilt with commands
+func writeBase(cfg *config.Config, manifest *aof.Manifest, keys []rdb.Key, libraries []string) (aof.Info, error) {
+	rdbFormat := cfg.AOFUseRDBPreamble()
+	if !rdbFormat && !aof.Rewritable(keys) {
+		log.Println("the dataset has values that can't be rebuilt with commands, writing the base of the append only file in the RDB format")
+		rdbFormat = true
+	}
+
+	base := manifest.NewBase(rdbFormat)
+	path := filepath.Join(cfg.AOFDir(), base.Name)
+	if rdbFormat {
+		return base, store.WriteRDBFile(path, keys, libraries)
+	}
+	return base, aof.WriteCommandsFile(path, keys, libraries)
+}
+
+// currentSize returns the size of all the files, mu must be held by the caller
+// unless the file isn't shared yet
+func (a *appendOnlyFile) currentSize() int64 {
+	return a.size + a.incr.Size()
+}
+
+// deleteHistory deletes the files replaced by a rewrite
+func (a *appendOnlyFile) deleteHistory() {
+	if len(a.manifest.History) == 0 {
+		return
+	}
+	for _, info := range a.manifest.History {
+		if err := os.Remove(filepath.Join(a.dir, info.Name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to delete the history file %s: %s\n", info.Name, err.Error())
+		}
+	}
+	a.manifest.History = nil
+	if err := a.manifest.Save(a.dir); err != nil {
+		log.Printf("failed to save the manifest of the append only file: %s\n", err.Error())
+	}
+}
+
+// aofRewriting reports whether the append only file is being rewritten
+func aofRewriting() bool {
+	if appendOnly == nil {
+		return false
+	}
+	appendOnly.mu.Lock()
+	defer appendOnly.mu.Unlock()
+
+	return appendOnly.rewriting
+}
+
+/*
+bgrewrite rewrites the append only file in the background, so clients keep
+running commands meanwhile:
+- a new incremental file is opened, the commands run from now on being
+appended to it
+- the dataset is copied, and written as the new base file in the background
+- once written, the base replaces the previous one in the manifest, along
+with the incremental files before the new one
+The execution lock must be held by the caller, and is taken again to update
+the manifest once the base is written.
+*/
+func (a *appendOnlyFile) bgrewrite(cfg *config.Config, dbs []*store.Store, lock util.Lock) error {
+	a.mu.Lock()
+	rewriting := a.rewriting
+	a.mu.Unlock()
+	if rewriting {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+
+	manifest := a.manifest.Clone()
+	incr := manifest.NewIncr()
+	file, err := aof.Open(filepath.Join(a.dir, incr.Name))
+	if err != nil {
+		return err
+	}
+	// the manifest lists the new file before anything is appended to it
+	if err := manifest.Save(a.dir); err != nil {
+		file.Close()
+		os.Remove(filepath.Join(a.dir, incr.Name))
+		return err
+	}
+	a.manifest = manifest
+	// the new file starts by selecting the database of its first command
+	propagatedDB = -1
+
+	a.mu.Lock()
+	previous := a.incr
+	a.size += previous.Size()
+	a.incr = file
+	a.rewriting, a.scheduled = true, false
+	a.started = time.Now()
+	a.mu.Unlock()
+	if err := previous.Close(); err != nil {
+		log.Printf("failed to close the incremental file of the append only file: %s\n", err.Error())
+	}
+
+	data := snapshot(dbs)
+	log.Println("Background append only file rewriting started")
+	go func() {
+		base, err := writeBase(cfg, manifest.Clone(), data.keys(), data.libraries)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil {
+			err = a.rewritten(base, incr.Seq)
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.rewriting = false
+		a.lastRewriteOk = err == nil
+		a.lastRewriteTaken = time.Since(a.started)
+		if err != nil {
+			log.Printf("background append only file rewriting error: %s\n", err.Error())
+			return
+		}
+		a.rewriteBaseSize = a.size + a.incr.Size()
+		log.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// rewritten replaces the base file with the one just written, the execution
+// lock being held by the caller
+func (a *appendOnlyFile) rewritten(base aof.Info, firstIncr int) error {
+	manifest := a.manifest.Clone()
+	manifest.Rewritten(base, firstIncr)
+	if err := manifest.Save(a.dir); err != nil {
+		os.Remove(filepath.Join(a.dir, base.Name))
+		return err
+	}
+	a.manifest = manifest
+	a.deleteHistory()
+
+	size := int64(0)
+	for _, info := range manifest.Files()[:len(manifest.Files())-1] {
+		fileSize, err := fileSize(filepath.Join(a.dir, info.Name))
+		if err != nil {
+			return err
+		}
+		size += fileSize
+		if info.Type == aof.TypeBase {
+			a.mu.Lock()
+			a.baseSize = fileSize
+			a.mu.Unlock()
+		}
+	}
+	a.mu.Lock()
+	a.size = size
+	a.mu.Unlock()
+	return nil
+}
+
+// due reports whether a scheduled rewrite or the growth of the file triggers a rewrite
+func (a *appendOnlyFile) due(cfg *config.Config) bool {
+	persistence.mu.Lock()
+	saving := persistence.saving
+	persistence.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting || saving {
+		return false
+	}
+	if a.scheduled {
+		return true
+	}
+	// a failed rewrite is only retried after a while
+	if !a.lastRewriteOk && time.Since(a.started) < rewriteRetryDelay {
+		return false
+	}
+
+	percentage, minSize := cfg.AutoAOFRewrite()
+	size := a.currentSize()
+	if percentage == 0 || size <= minSize {
+		return false
+	}
+	base := max(a.rewriteBaseSize, 1)
+	growth := size*100/base - 100
+	if growth < int64(percentage) {
+		return false
+	}
+	log.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+	return true
+}
+
+// RunAOFRewrites periodically starts a rewrite of the append only file when
+// it grew enough, holding the lock while the dataset is copied.
+func RunAOFRewrites(cfg *config.Config, dbs []*store.Store, lock util.Lock) {
+	for {
+		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
+		if appendOnly != nil && appendOnly.due(cfg) {
+			if err := appendOnly.bgrewrite(cfg, dbs, lock); err != nil {
+				log.Printf("failed to start rewriting the append only file: %s\n", err.Error())
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func handleBgrewriteaof(h *Handler, _ *Command) error {
+	if appendOnly == nil {
+		h.WriteResponse(encoder.NewError("Background append only file rewriting requires appendonly to be enabled"))
+		return nil
+	}
+
+	// like a background save, the rewrite copies the whole dataset, so
+	// both never run at the same time
+	persistence.mu.Lock()
+	saving := persistence.saving
+	persistence.mu.Unlock()
+	if saving && !aofRewriting() {
+		appendOnly.mu.Lock()
+		appendOnly.scheduled = true
+		appendOnly.mu.Unlock()
+		h.WriteResponse(encoder.NewString("Background append only file rewriting scheduled"))
+		return nil
+	}
+
+	if err := appendOnly.bgrewrite(h.cfg, h.dbs, h.execLock); err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+	h.WriteResponse(encoder.NewString("Background append only file rewriting started"))
+	return nil
+}
+
+// feedAppendOnly logs a command, or a MULTI/EXEC block, to the append only file
+func feedAppendOnly(cfg *config.Config, command string) {
+	if appendOnly == nil {
+		return
+	}
+	appendOnly.mu.Lock()
+	file := appendOnly.incr
+	appendOnly.mu.Unlock()
+
+	policy := cfg.AppendFsync()
+	if err := file.Append(command, policy); err != nil {
+		// the command already ran, so it would be lost on restart
+		if policy == aof.FsyncAlways {
+			log.Fatalf("can't recover from an append only file write error with the always fsync policy: %s", err.Error())
+		}
+		log.Printf("error writing to the append only file: %s\n", err.Error())
+	}
+}
+
+// SyncAOF syncs the append only file to disk every second, with the everysec policy
+func SyncAOF(cfg *config.Config) {
+	for {
+		time.Sleep(time.Second)
+		if appendOnly == nil || cfg.AppendFsync() != aof.FsyncEverysec {
+			continue
+		}
+		appendOnly.mu.Lock()
+		file := appendOnly.incr
+		appendOnly.mu.Unlock()
+		if err := file.Sync(); err != nil {
+			log.Printf("error syncing the append only file: %s\n", err.Error())
+		}
+	}
+}
+
+// aofInfo returns the fields of the persistence section of INFO about the
+// append only file
+func aofInfo() []string {
+	if appendOnly == nil {
+		return []string{
+			"aof_enabled:0",
+			"aof_rewrite_in_progress:0",
+			"aof_rewrite_scheduled:0",
+			"aof_last_bgrewrite_status:ok",
+			"aof_last_write_status:ok",
+		}
+	}
+
+	a := appendOnly
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rewriteStatus, writeStatus := "ok", "ok"
+	if !a.lastRewriteOk {
+		rewriteStatus = "err"
+	}
+	if a.incr.LastError() != nil {
+		writeStatus = "err"
+	}
+	lastTaken, current := -1, -1
+	if a.lastRewriteTaken >= 0 {
+		lastTaken = int(a.lastRewriteTaken.Seconds())
+	}
+	if a.rewriting {
+		current = int(time.Since(a.started).Seconds())
+	}
+	return []string{
+		"aof_enabled:1",
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(a.rewriting)),
+		fmt.Sprintf("aof_rewrite_scheduled:%d", boolToInt(a.scheduled)),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", lastTaken),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", current),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", rewriteStatus),
+		fmt.Sprintf("aof_last_write_status:%s", writeStatus),
+		fmt.Sprintf("aof_current_size:%d", a.currentSize()),
+		fmt.Sprintf("aof_base_size:%d", a.baseSize),
+	}
+}
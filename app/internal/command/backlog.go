@@ -0,0 +1,184 @@
+package command
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// backlogMinSize is the smallest replication backlog, whatever repl-backlog-size is
+const backlogMinSize = 16 * 1024
+
+// backlog keeps the last bytes of the replication stream, so a replica
+// reconnecting after missing some of it only receives what it missed. It
+// is created when the first replica connects.
+var backlog = &replBacklog{}
+
+// replBacklog is a circular buffer holding the bytes of the replication
+// stream before the offset end, length of them at most
+type replBacklog struct {
+	mu     sync.Mutex
+	data   []byte
+	end    int
+	length int
+	// lastSlave is when the last replica disconnected, the backlog being
+	// freed once there were no replicas for repl-backlog-ttl
+	lastSlave time.Time
+}
+
+// create makes the backlog when missing, the stream continuing from offset
+func (b *replBacklog) create(cfg *config.Config, offset int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data != nil {
+		return
+	}
+	size, _ := cfg.ReplBacklog()
+	b.data = make([]byte, max(size, backlogMinSize))
+	b.end, b.length = offset, 0
+	b.lastSlave = time.Now()
+}
+
+func (b *replBacklog) free() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = nil
+	b.end, b.length = 0, 0
+}
+
+func (b *replBacklog) exists() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.data != nil
+}
+
+// feed appends bytes of the replication stream, dropping the oldest ones
+// once the backlog is full. It returns false when there is no backlog, the
+// stream then not being kept.
+func (b *replBacklog) feed(cfg *config.Config, stream string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data == nil {
+		return false
+	}
+	if size, _ := cfg.ReplBacklog(); max(size, backlogMinSize) != int64(len(b.data)) {
+		b.resize(int(max(size, backlogMinSize)))
+	}
+
+	for len(stream) > 0 {
+		start := b.end % len(b.data)
+		n := copy(b.data[start:], stream)
+		stream = stream[n:]
+		b.end += n
+		b.length = min(b.length+n, len(b.data))
+	}
+	return true
+}
+
+// resize changes the size of the buffer, keeping the most recent bytes
+func (b *replBacklog) resize(size int) {
+	kept := b.read(b.end - min(b.length, size))
+	b.data = make([]byte, size)
+	b.length = len(kept)
+	// an offset is kept at its position modulo the size of the buffer
+	start := b.end - b.length
+	for i := range kept {
+		b.data[(start+i)%size] = kept[i]
+	}
+}
+
+// read returns the bytes from offset to the end, which must be held
+func (b *replBacklog) read(offset int) []byte {
+	out := make([]byte, 0, b.end-offset)
+	for offset < b.end {
+		start := offset % len(b.data)
+		n := min(len(b.data)-start, b.end-offset)
+		out = append(out, b.data[start:start+n]...)
+		offset += n
+	}
+	return out
+}
+
+// stats returns whether there is a backlog, the offset of its first byte
+// counting from 1, and the number of bytes it holds
+func (b *replBacklog) stats() (bool, int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data == nil {
+		return false, 0, 0
+	}
+	return true, b.end - b.length + 1, b.length
+}
+
+// since returns the bytes of the stream after offset, false when the
+// backlog doesn't hold all of them
+func (b *replBacklog) since(offset int) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data == nil || offset < b.end-b.length || offset > b.end {
+		return nil, false
+	}
+	return b.read(offset), true
+}
+
+// RunReplicationCron does the periodic replication work, once a second:
+//   - a master pings its replicas every repl-ping-replica-period
+//   - the replicas that didn't acknowledge their offset for repl-timeout
+//     are disconnected
+//   - a master frees its backlog when it had no replicas for repl-backlog-ttl,
+//     changing its replication ID as nobody can continue from its offsets
+//     anymore
+func RunReplicationCron(cfg *config.Config, lock util.Lock) {
+	lastPing := time.Now()
+	for {
+		time.Sleep(time.Second)
+		lock.Lock()
+		// a replica passes the pings of its master to its own replicas
+		if cfg.Role() == config.RoleMaster {
+			if time.Since(lastPing) >= cfg.ReplPingPeriod() {
+				pingSlaves(cfg)
+				lastPing = time.Now()
+			}
+			backlog.expire(cfg)
+		}
+		for _, slave := range cfg.Slaves() {
+			if slave.Online() && slave.Lag() > cfg.ReplTimeout() {
+				ip, port := slave.Addr()
+				log.Printf("disconnecting the replica %s:%d, timed out\n", ip, port)
+				slave.Disconnect()
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func (b *replBacklog) expire(cfg *config.Config) {
+	b.mu.Lock()
+	if b.data == nil {
+		b.mu.Unlock()
+		return
+	}
+	if len(cfg.Slaves()) > 0 {
+		b.lastSlave = time.Now()
+		b.mu.Unlock()
+		return
+	}
+	_, ttl := cfg.ReplBacklog()
+	expired := ttl > 0 && time.Since(b.lastSlave) > ttl
+	b.mu.Unlock()
+
+	if expired {
+		cfg.ResetReplID()
+		b.free()
+		log.Printf("replication backlog freed after %d seconds without replicas\n", int(ttl.Seconds()))
+	}
+}
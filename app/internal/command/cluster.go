@@ -0,0 +1,56 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+func handleCluster(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	subcommand := strings.ToLower(userCommand.Args[1])
+	switch subcommand {
+	default:
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(subcommand))
+	case Keyslot:
+		if len(userCommand.Args) != 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		h.WriteResponse(encoder.NewInteger(util.KeyHashSlot(userCommand.Args[2])))
+	case Addslots, Delslots:
+		if len(userCommand.Args) < 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		slots := []int{}
+		for _, arg := range userCommand.Args[2:] {
+			slot, err := strconv.Atoi(arg)
+			if err != nil {
+				h.WriteResponse(encoder.NewError("Invalid or out of range slot"))
+				return nil
+			}
+			slots = append(slots, slot)
+		}
+
+		var err error
+		if subcommand == Addslots {
+			err = h.cfg.AddSlots(slots)
+		} else {
+			err = h.cfg.DelSlots(slots)
+		}
+		if err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
+		}
+		if subcommand == Delslots {
+			evictShardChannels(slots)
+		}
+		h.WriteResponse(encoder.Ok)
+	}
+	return nil
+}
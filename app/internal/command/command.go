@@ -1,24 +1,51 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
-	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
+// ps wakes up the clients blocked on streams, and acks the ones blocked in
+// WAIT, while clientPubSub and shardPubSub hold the channels and shard
+// channels clients subscribe to.
 var ps util.PubSub
+var acks util.PubSub
+var clientPubSub util.PubSub
+var shardPubSub util.PubSub
+
+// ackTopic is published to when a replica acknowledges an offset
+const ackTopic = "ack"
 
 func init() {
 	ps = util.NewPubSub()
+	acks = util.NewPubSub()
+	clientPubSub = util.NewPubSub()
+	shardPubSub = util.NewShardedPubSub()
 }
-func handlePing(h *Handler, _ *Command) error {
+func handlePing(h *Handler, userCommand *Command) error {
+	if h.subscribed() {
+		message := ""
+		if len(userCommand.Args) > 1 {
+			message = userCommand.Args[1]
+		}
+		h.WriteResponse(encoder.NewArray([]string{"pong", message}))
+		return nil
+	}
+
+	if len(userCommand.Args) > 1 {
+		h.WriteResponse(encoder.NewBulkString(userCommand.Args[1]))
+		return nil
+	}
+
 	pingMsg := encoder.Pong
 	h.WriteResponse(pingMsg)
 	return nil
@@ -42,6 +69,7 @@ func handleGet(h *Handler, userCommand *Command) error {
 	key := userCommand.Args[1]
 	value, err := h.db.Get(key)
 	if err != nil {
+		h.notify(config.NotifyKeyMiss, "keymiss", key)
 		h.writer.WriteString(encoder.Null)
 	} else {
 		h.writer.WriteString(encoder.NewBulkString(value))
@@ -63,50 +91,70 @@ func handleSet(h *Handler, userCommand *Command) error {
 
 	if len(userCommand.Args) == 5 {
 		expInstruction := strings.ToLower(userCommand.Args[3])
-		if expInstruction != Px {
-			return fmt.Errorf("the command %s only allows the %s as a complimenting command",
-				strings.ToUpper(Set), strings.ToUpper(Px))
+		if expInstruction != Px && expInstruction != Pxat {
+			return fmt.Errorf("the command %s only allows the %s or %s as a complimenting command",
+				strings.ToUpper(Set), strings.ToUpper(Px), strings.ToUpper(Pxat))
 		}
 
-		time := userCommand.Args[4]
 		var err error
 		expires = true
-		expTime, err = strconv.ParseInt(time, 10, 64)
+		expTime, err = strconv.ParseInt(userCommand.Args[4], 10, 64)
 		if err != nil {
-			return fmt.Errorf("the argument after %s should be an integer number", strings.ToUpper(Px))
+			return fmt.Errorf("the argument after %s should be an integer number", strings.ToUpper(expInstruction))
+		}
+		// the expire time is kept as a unix time, so it doesn't move when
+		// the command is propagated or loaded from the append only file
+		if expInstruction == Px {
+			expTime += time.Now().UnixMilli()
 		}
 	}
 
-	h.db.StringType.Set(key, value, expires, expTime)
-	if h.cfg.Role() == config.RoleMaster {
-		wg := sync.WaitGroup{}
-		command := encoder.NewArray(userCommand.Args)
-		for _, slave := range h.cfg.Slaves() {
-			wg.Add(1)
-			go slave.PropagateCommand(command, &wg)
-		}
-		wg.Wait()
-		h.UpdateSlavesOffset(len([]byte(command)))
+	_, err := h.db.Get(key)
+	isNew := err != nil
+
+	h.db.StringType.Load(key, value, expires, expTime)
+	if isNew {
+		h.notify(config.NotifyNew, "new", key)
+	}
+	h.notify(config.NotifyString, "set", key)
+	if expires {
+		h.notify(config.NotifyGeneric, "expire", key)
+		h.rewriteCommand([]string{userCommand.Args[0], key, value, strings.ToUpper(Pxat), strconv.FormatInt(expTime, 10)})
 	}
+	persistence.changed()
 	h.WriteResponse(encoder.Ok)
 
 	return nil
 }
 
+// handleDel removes the keys whatever their type, replying with the number
+// of keys that existed
+func handleDel(h *Handler, userCommand *Command) error {
+	deleted := 0
+	for _, key := range userCommand.Args[1:] {
+		if h.db.Delete(key) {
+			h.notify(config.NotifyGeneric, "del", key)
+			persistence.changed()
+			deleted++
+		}
+	}
+	h.WriteResponse(encoder.NewInteger(deleted))
+	return nil
+}
+
 func handleInfo(h *Handler, userCommand *Command) error {
-	infoOf := strings.ToLower(userCommand.Args[1])
+	// replication is the only section so far, so it is also the default one
+	infoOf := Replication
+	if len(userCommand.Args) > 1 {
+		infoOf = strings.ToLower(userCommand.Args[1])
+	}
 	switch infoOf {
 	default:
 		return fmt.Errorf("%s is an invalid argument", infoOf)
 	case Replication:
-		info := strings.Join(
-			[]string{
-				fmt.Sprintf("role:%s", h.cfg.Role()),
-				fmt.Sprintf("master_replid:%s", h.cfg.ReplID()),
-				fmt.Sprintf("master_repl_offset:%d", h.cfg.ReplOffset()),
-			},
-			"\n",
-		)
+		h.writer.WriteString(encoder.NewBulkString(strings.Join(replicationInfo(h.cfg), "\n")))
+	case Persistence:
+		info := strings.Join(append(persistenceInfo(), aofInfo()...), "\n")
 		h.writer.WriteString(encoder.NewBulkString(info))
 	}
 
@@ -118,6 +166,21 @@ func handleReplconf(h *Handler, userCommand *Command) error {
 	switch confOf {
 	default:
 		h.WriteResponse(encoder.Ok)
+	case Capa:
+		for i := 2; i < len(userCommand.Args); i += 2 {
+			if strings.ToLower(userCommand.Args[i]) == EOF {
+				h.capaEOF = true
+			}
+		}
+		h.WriteResponse(encoder.Ok)
+	case ListeningPort:
+		port, err := strconv.Atoi(userCommand.Args[len(userCommand.Args)-1])
+		if err != nil {
+			h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+			return nil
+		}
+		h.listeningPort = port
+		h.WriteResponse(encoder.Ok)
 	case GetAck:
 		if h.cfg.Role() == config.RoleMaster {
 			info := strings.ToUpper(strings.Join(userCommand.Args, " "))
@@ -133,106 +196,256 @@ func handleReplconf(h *Handler, userCommand *Command) error {
 		)
 		h.writer.WriteString(response)
 	case Ack:
-		if h.cfg.Role() == config.RoleSlave {
+		if h.masterLink {
 			info := strings.ToUpper(strings.Join(userCommand.Args, " "))
 			return fmt.Errorf("the %s command is only available for master", info)
 		}
-		//offSet, _ := strconv.Atoi(userCommand.Args[2])
-		h.NotifyAckSlaves()
+		if offset, err := strconv.Atoi(userCommand.Args[len(userCommand.Args)-1]); err == nil && h.slave != nil {
+			h.slave.Ack(offset)
+			acks.Publish(ackTopic, "")
+		}
 	}
 
 	return nil
 }
 
 func handleConfig(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
 	config := strings.ToLower(userCommand.Args[1])
 	switch config {
 	default:
 		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(config))
 	case Get:
+		params := []string{}
+		seen := make(map[string]bool)
 		for _, arg := range userCommand.Args[2:] {
-			configOf := strings.ToLower(arg)
-			if configOf == Dir {
-				dir := h.cfg.Dir()
-				h.WriteResponse(encoder.NewArray([]string{configOf, dir}))
+			matches := h.cfg.GetParameters(arg)
+			for i := 0; i < len(matches); i += 2 {
+				if !seen[matches[i]] {
+					seen[matches[i]] = true
+					params = append(params, matches[i], matches[i+1])
+				}
 			}
-			if configOf == DBfilename {
-				fileName := h.cfg.RDBFileName()
-				h.WriteResponse(encoder.NewArray([]string{configOf, fileName}))
+		}
+		h.WriteResponse(encoder.NewArray(params))
+	case Set:
+		if len(userCommand.Args) < 4 || len(userCommand.Args)%2 != 0 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		for i := 2; i < len(userCommand.Args); i += 2 {
+			err := h.cfg.SetParameter(userCommand.Args[i], userCommand.Args[i+1])
+			if err != nil {
+				h.WriteResponse(encoder.NewError(err.Error()))
+				return nil
 			}
 		}
+		h.WriteResponse(encoder.Ok)
 	}
 	return nil
 }
 
-func handlePsync(h *Handler, _ *Command) error {
+/*
+handlePsync synchronizes a replica:
+
+	PSYNC replicationid offset
+
+The replica continues from the offset when it follows the current
+replication ID, or the former one up to where it was valid, and the backlog
+still holds the stream from there. Otherwise it receives a snapshot of the
+whole dataset, followed by the commands propagated since. A replica serves
+its own replicas the same way, under the replication ID of its master, once
+it is linked to it.
+*/
+func handlePsync(h *Handler, userCommand *Command) error {
+	if h.cfg.Role() == config.RoleSlave && !replLink.connected() {
+		h.rejectEncoded("-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+		return nil
+	}
+	if continued, err := h.tryPartialResync(userCommand.Args[1], userCommand.Args[2]); continued || err != nil {
+		return err
+	}
+
+	if !backlog.exists() {
+		// the offsets only count while there is a backlog, a new replication
+		// ID makes sure no replica continues from a stream it didn't receive
+		h.cfg.ResetReplID()
+		backlog.create(h.cfg, h.cfg.ReplOffset())
+	}
+	// replicas able to read a snapshot of unknown size have it streamed,
+	// along with the ones joining within the delay
+	if diskless, delay := h.cfg.ReplDisklessSync(); diskless && h.capaEOF {
+		h.slave = config.NewSlave(h.conn, h.listeningPort, h.cfg.ReplicaBufferLimit())
+		disklessSyncs.add(h, delay)
+		log.Printf("the replica %s waits %s for a diskless full resynchronization\n", h.conn.RemoteAddr(), delay)
+		return nil
+	}
 	h.writer.WriteString(
 		encoder.NewString(
-			fmt.Sprintf("%s %s %d", encoder.Fullsync, "REPL_ID", 0),
+			fmt.Sprintf("%s %s %d", encoder.Fullsync, h.cfg.ReplID(), h.cfg.ReplOffset()),
 		),
 	)
-
-	dbData, err := rdb.GetEmptyRDBContent()
-	if err != nil {
-		return fmt.Errorf("failed to read rdb file, error: %w", err)
+	// the reply must reach the replica before the snapshot
+	if err := h.writer.Flush(); err != nil {
+		return err
 	}
-	h.writer.WriteString(encoder.NewRDBFile(dbData))
 
-	slave := config.NewSlave(h.conn)
+	data := snapshot(h.dbs)
+	streamDB := syncStreamDB(h.cfg)
+	slave := config.NewSlave(h.conn, h.listeningPort, h.cfg.ReplicaBufferLimit())
 	h.cfg.AddSlave(slave)
+	h.slave = slave
+
+	log.Printf("starting a full resynchronization of the replica %s\n", h.conn.RemoteAddr())
+	go func() {
+		rdbFile := bytes.Buffer{}
+		err := store.WriteReplicationRDB(&rdbFile, data.keys(), data.libraries, streamDB)
+		if err == nil {
+			err = slave.SendSnapshot(rdbFile.Bytes())
+		}
+		if err != nil {
+			log.Printf("failed to send the snapshot to the replica %s: %s\n", h.conn.RemoteAddr(), err.Error())
+			h.conn.Close()
+			return
+		}
+		log.Printf("synchronization with the replica %s succeeded\n", h.conn.RemoteAddr())
+	}()
 	return nil
 }
 
-func handleWait(h *Handler, userCommand *Command) error {
-	if h.cfg.Role() != config.RoleMaster {
-		return fmt.Errorf("the %s command is only available for %s servers",
-			strings.ToUpper(userCommand.Args[0]),
-			strings.ToUpper(config.RoleMaster))
+// syncStreamDB returns the database the replication stream goes on with,
+// after a snapshot taken now. A master selects one in the next command it
+// propagates, while a replica passes the stream of its master as it is.
+func syncStreamDB(cfg *config.Config) int {
+	if cfg.Role() == config.RoleSlave {
+		return masterLinkDB
 	}
+	propagatedDB = -1
+	return 0
+}
 
-	if len(userCommand.Args) != 3 {
-		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+// tryPartialResync continues the replication stream from the offset the
+// replica asked for, reporting false when it needs a full resynchronization
+func (h *Handler) tryPartialResync(replID, offset string) (bool, error) {
+	psyncOffset, err := strconv.Atoi(offset)
+	if err != nil {
+		return false, nil
+	}
+	replID2, secondReplOffset := h.cfg.ReplID2()
+	if replID != h.cfg.ReplID() && (replID != replID2 || psyncOffset > secondReplOffset) {
+		return false, nil
+	}
+	// the offset is the one of the next byte the replica expects
+	missed, ok := backlog.since(psyncOffset - 1)
+	if !ok {
+		log.Printf("the replica %s asked for offset %d, not in the backlog anymore\n", h.conn.RemoteAddr(), psyncOffset)
+		return false, nil
 	}
 
-	numReplicas, err := strconv.Atoi(userCommand.Args[1])
-	if err != nil {
-		return err
+	h.writer.WriteString(encoder.NewString(fmt.Sprintf("%s %s", encoder.Continue, h.cfg.ReplID())))
+	if err := h.writer.Flush(); err != nil {
+		return true, err
 	}
+	slave := config.NewSlave(h.conn, h.listeningPort, h.cfg.ReplicaBufferLimit())
+	h.cfg.AddSlave(slave)
+	h.slave = slave
+	// nothing is propagated meanwhile, as the execution lock is held
+	if err := slave.Resume(missed); err != nil {
+		return true, err
+	}
+	log.Printf("partial resynchronization of the replica %s accepted, sending %d bytes of backlog\n", h.conn.RemoteAddr(), len(missed))
+	return true, nil
+}
 
-	if numReplicas == 0 {
-		h.WriteResponse(encoder.NewInteger(0))
+/*
+handleWait blocks until the replicas acknowledged the writes of the client:
+
+	WAIT numreplicas timeout
+
+It replies with the number of replicas whose acknowledged offset reached the
+one after the last write of the client, once there are numreplicas of them
+or after the timeout in milliseconds, 0 waiting forever.
+*/
+func handleWait(h *Handler, userCommand *Command) error {
+	if h.cfg.Role() != config.RoleMaster {
+		h.WriteResponse(encoder.NewError("WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated."))
 		return nil
 	}
 
+	numReplicas, err := strconv.Atoi(userCommand.Args[1])
+	if err != nil {
+		h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+		return nil
+	}
 	waitTime, err := strconv.Atoi(userCommand.Args[2])
 	if err != nil {
-		return err
+		h.WriteResponse(encoder.NewError("timeout is not an integer or out of range"))
+		return nil
+	}
+	if waitTime < 0 {
+		h.WriteResponse(encoder.NewError("timeout is negative"))
+		return nil
+	}
+
+	// a transaction never blocks, so there is no time to wait for acks
+	acked := ackedSlaves(h.cfg, h.woff)
+	if acked >= numReplicas || h.inExec {
+		h.WriteResponse(encoder.NewInteger(acked))
+		return nil
 	}
 
+	sub := util.NewSubscriber(1)
+	acks.Subscribe(sub, ackTopic)
+	defer acks.Unsubscribe(sub, ackTopic)
+	// the replicas acknowledge their offset right away instead of within a second
 	h.sendGetAckToSlaves()
-	acks := 0
+
+	var timeout <-chan time.Time
+	if waitTime > 0 {
+		timer := time.NewTimer(time.Duration(waitTime) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	closed, stopWatching := h.watchDisconnect()
+	defer stopWatching()
 
 	for {
-		select {
-		case <-h.acksChan:
-			acks++
-			if acks >= numReplicas {
-				h.WriteResponse(encoder.NewInteger(acks))
-				return nil
-			}
-		case <-time.After(time.Duration(waitTime) * time.Millisecond):
-			if acks > 0 {
-				h.WriteResponse(encoder.NewInteger(acks))
-			} else {
-				h.WriteResponse(encoder.NewInteger(len(h.cfg.Slaves())))
+		timedOut, disconnected := false, false
+		h.unlocked(func() {
+			select {
+			case <-sub.C:
+			case <-timeout:
+				timedOut = true
+			case <-closed:
+				disconnected = true
 			}
+		})
+		if disconnected {
+			return nil
+		}
+		acked = ackedSlaves(h.cfg, h.woff)
+		if acked >= numReplicas || timedOut {
+			h.WriteResponse(encoder.NewInteger(acked))
 			return nil
 		}
 	}
 }
 
+// ackedSlaves counts the replicas that acknowledged the offset
+func ackedSlaves(cfg *config.Config, offset int) int {
+	acked := 0
+	for _, slave := range cfg.Slaves() {
+		if slave.AckOffset() >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
 func handleKeys(h *Handler, userCommand *Command) error {
-	keys := h.db.StringType.GetKeys()
+	keys := h.db.Keys()
 	h.WriteResponse(encoder.NewArray(keys))
 	return nil
 }
@@ -242,18 +455,25 @@ func handleType(h *Handler, userCommand *Command) error {
 		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
 	}
 
-	key := userCommand.Args[1]
+	h.WriteResponse(encoder.NewString(h.db.Type(userCommand.Args[1])))
+	return nil
+}
 
-	if h.db.StreamType.ExistsStream(key) == nil {
-		h.WriteResponse(encoder.NewString("stream"))
+func handleSelect(h *Handler, userCommand *Command) error {
+	index, err := strconv.Atoi(userCommand.Args[1])
+	if err != nil {
+		h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
 		return nil
 	}
-
-	if _, err := h.db.StringType.Get(key); err == nil {
-		h.WriteResponse(encoder.NewString("string"))
+	if index < 0 || index >= len(h.dbs) {
+		h.WriteResponse(encoder.NewError("DB index is out of range"))
 		return nil
 	}
 
-	h.WriteResponse(encoder.NewString("none"))
+	h.db = h.dbs[index]
+	if h.masterLink {
+		masterLinkDB = index
+	}
+	h.WriteResponse(encoder.Ok)
 	return nil
 }
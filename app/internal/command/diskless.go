@@ -0,0 +1,106 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// disklessSyncs gathers the replicas waiting for a diskless full
+// resynchronization, which starts repl-diskless-sync-delay after the first
+// of them asked for it so the others joining meanwhile share its snapshot
+var disklessSyncs = &disklessQueue{}
+
+type disklessQueue struct {
+	mu      sync.Mutex
+	waiting []*Handler
+}
+
+// add queues the replica, starting the synchronization after the delay when
+// it is the first one
+func (q *disklessQueue) add(h *Handler, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.waiting = append(q.waiting, h)
+	if len(q.waiting) == 1 {
+		time.AfterFunc(delay, func() {
+			q.start(h.cfg, h.dbs, h.execLock)
+		})
+	}
+}
+
+// start takes the snapshot and streams it to every replica waiting, which
+// are told the offset it was taken at
+func (q *disklessQueue) start(cfg *config.Config, dbs []*store.Store, lock util.Lock) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	q.mu.Lock()
+	waiting := q.waiting
+	q.waiting = nil
+	q.mu.Unlock()
+
+	data := snapshot(dbs)
+	reply := encoder.NewString(fmt.Sprintf("%s %s %d", encoder.Fullsync, cfg.ReplID(), cfg.ReplOffset()))
+	streamDB := syncStreamDB(cfg)
+
+	for _, h := range waiting {
+		slave := h.slave
+		if slave.Closed() {
+			continue
+		}
+		cfg.AddSlave(slave)
+		addr := h.conn.RemoteAddr()
+		log.Printf("starting a diskless full resynchronization of the replica %s\n", addr)
+		go func() {
+			err := slave.StreamSnapshot(reply, func(w io.Writer) error {
+				return store.WriteReplicationRDB(w, data.keys(), data.libraries, streamDB)
+			})
+			if err != nil {
+				log.Printf("failed to stream the snapshot to the replica %s: %s\n", addr, err.Error())
+				cfg.RemoveSlave(slave)
+				slave.Disconnect()
+				return
+			}
+			log.Printf("diskless synchronization with the replica %s succeeded\n", addr)
+		}()
+	}
+}
+
+// readUntilMark copies the snapshot of a diskless synchronization to w, up
+// to the mark ending it, leaving the commands following it in r
+func readUntilMark(r *bufio.Reader, mark string, w io.Writer) error {
+	// held are the last bytes read, which may be the start of the mark
+	held := []byte{}
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return err
+		}
+		chunk, _ := r.Peek(r.Buffered())
+		data := append(append([]byte{}, held...), chunk...)
+		if i := bytes.Index(data, []byte(mark)); i >= 0 {
+			if _, err := w.Write(data[:i]); err != nil {
+				return err
+			}
+			_, err := r.Discard(i + len(mark) - len(held))
+			return err
+		}
+
+		keep := min(len(data), len(mark)-1)
+		if _, err := w.Write(data[:len(data)-keep]); err != nil {
+			return err
+		}
+		held = data[len(data)-keep:]
+		r.Discard(len(chunk))
+	}
+}
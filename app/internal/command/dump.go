@@ -0,0 +1,136 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func handleDump(h *Handler, userCommand *Command) error {
+	key, ok := h.db.Dump(userCommand.Args[1])
+	if !ok {
+		h.WriteResponse(encoder.Null)
+		return nil
+	}
+	payload, err := rdb.DumpValue(key.Value)
+	if err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+	h.WriteResponse(encoder.NewBulkString(string(payload)))
+	return nil
+}
+
+/*
+handleRestore creates a key from the payload of DUMP:
+
+	RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+
+The ttl is in milliseconds, 0 for a key without expire time, or a unix time
+in milliseconds with ABSTTL. The key isn't created when it already expired.
+IDLETIME and FREQ are checked, but there is no eviction they would matter to.
+*/
+func handleRestore(h *Handler, userCommand *Command) error {
+	args := userCommand.Args
+	key := args[1]
+	replace, absttl := false, false
+	idletime, freq := int64(-1), int64(-1)
+	for i := 4; i < len(args); i++ {
+		option, additional := strings.ToLower(args[i]), len(args)-i-1
+		switch {
+		case option == Replace:
+			replace = true
+		case option == Absttl:
+			absttl = true
+		case option == Idletime && additional >= 1 && freq == -1:
+			value, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+				return nil
+			}
+			if value < 0 {
+				h.WriteResponse(encoder.NewError("Invalid IDLETIME value, must be >= 0"))
+				return nil
+			}
+			idletime = value
+			i++
+		case option == Freq && additional >= 1 && idletime == -1:
+			value, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+				return nil
+			}
+			if value < 0 || value > 255 {
+				h.WriteResponse(encoder.NewError("Invalid FREQ value, must be >= 0 and <= 255"))
+				return nil
+			}
+			freq = value
+			i++
+		default:
+			h.WriteResponse(encoder.NewError("syntax error"))
+			return nil
+		}
+	}
+
+	if !replace && h.db.Type(key) != "none" {
+		h.WriteResponse("-BUSYKEY Target key name already exists.\r\n")
+		return nil
+	}
+	ttl, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+		return nil
+	}
+	if ttl < 0 {
+		h.WriteResponse(encoder.NewError("Invalid TTL value, must be >= 0"))
+		return nil
+	}
+	value, err := rdb.ReadValue([]byte(args[3]))
+	if errors.Is(err, rdb.ErrBadPayload) {
+		h.WriteResponse(encoder.NewError("DUMP payload version or checksum are wrong"))
+		return nil
+	}
+	if err != nil {
+		h.WriteResponse(encoder.NewError("Bad data format"))
+		return nil
+	}
+
+	deleted := false
+	if replace {
+		deleted = h.db.Delete(key)
+	}
+	// the expire time is kept as a unix time, so it doesn't move when the
+	// command is propagated or loaded from the append only file
+	if ttl > 0 && !absttl {
+		ttl += time.Now().UnixMilli()
+	}
+	propagated := []string{args[0], key, strconv.FormatInt(ttl, 10), args[3]}
+	if ttl > 0 {
+		propagated = append(propagated, strings.ToUpper(Absttl))
+	}
+	if replace {
+		propagated = append(propagated, strings.ToUpper(Replace))
+	}
+	h.rewriteCommand(propagated)
+
+	if ttl > 0 && ttl <= time.Now().UnixMilli() {
+		// the key already expired, it only replaced the existing one
+		if deleted {
+			h.notify(config.NotifyGeneric, "del", key)
+			persistence.changed()
+		}
+		h.WriteResponse(encoder.Ok)
+		return nil
+	}
+
+	h.db.Restore(rdb.Key{DB: h.db.Index(), Key: key, Value: value, Expires: ttl > 0, ExpireAt: ttl})
+	h.notify(config.NotifyGeneric, "restore", key)
+	persistence.changed()
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
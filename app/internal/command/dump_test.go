@@ -0,0 +1,68 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// lzfBomb is a string LZF compressed into a single byte, whose size is the
+// largest length that can be encoded
+var lzfBomb = []byte{rdb.ENC_LZF<<6 | rdb.ENC_STR_LZF, 1, 0x81, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0}
+
+func TestRestoreMalformedPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{
+			name:    "wrong checksum",
+			payload: append(rdb.DumpPayload([]byte{rdb.TYPE_STRING, 1, 'v'})[:12], 0),
+			want:    "-ERR DUMP payload version or checksum are wrong",
+		},
+		{
+			name:    "LZF size out of range",
+			payload: rdb.DumpPayload(append([]byte{rdb.TYPE_STRING}, lzfBomb...)),
+			want:    "-ERR Bad data format",
+		},
+		{
+			name:    "truncated list",
+			payload: rdb.DumpPayload([]byte{rdb.TYPE_LIST, 3, 1, 'a'}),
+			want:    "-ERR Bad data format",
+		},
+		{
+			name:    "truncated listpack",
+			payload: rdb.DumpPayload([]byte{rdb.TYPE_SET_LISTPACK, 7, 0xFF, 0xFF, 0, 0, 1, 0}),
+			want:    "-ERR Bad data format",
+		},
+	}
+
+	server := newTestServer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := server.connect(t)
+			if got := client.do("RESTORE", "key", "0", string(tt.payload)); got != tt.want {
+				t.Errorf("RESTORE = %v, want %v", got, tt.want)
+			}
+			// the server keeps serving the client
+			if got := client.do("TYPE", "key"); got != "+none" {
+				t.Errorf("TYPE = %v, want +none", got)
+			}
+		})
+	}
+}
+
+func TestFunctionRestoreMalformedPayload(t *testing.T) {
+	server := newTestServer()
+	client := server.connect(t)
+
+	payload := rdb.DumpPayload(append([]byte{rdb.OPCODE_FUNCTION2}, lzfBomb...))
+	got, ok := client.do("FUNCTION", "RESTORE", string(payload)).(string)
+	if !ok || len(got) == 0 || got[0] != '-' {
+		t.Errorf("FUNCTION RESTORE = %v, want an error", got)
+	}
+	if got := client.do("PING"); got != "+PONG" {
+		t.Errorf("PING = %v, want +PONG", got)
+	}
+}
@@ -0,0 +1,526 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/lua"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// functionLoadTimeout is how long the code of a library may run while it
+// registers its functions
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionFlags are the flags a function may be registered with
+var functionFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// functions keeps the function libraries, shared by every client
+var functions = newFunctionEngine()
+
+type library struct {
+	name      string
+	code      string
+	functions map[string]*function
+}
+
+type function struct {
+	name     string
+	library  *library
+	callback *lua.Function
+	// description is nil when the function was registered without one
+	description lua.Value
+	flags       []string
+}
+
+func (f *function) hasFlag(flag string) bool {
+	return slices.Contains(f.flags, flag)
+}
+
+// functionEngine keeps the libraries loaded by FUNCTION LOAD, in a lua state
+// of their own. The libraries are only used while holding the execution lock,
+// but mu also guards them against FUNCTION STATS, served while a script runs.
+type functionEngine struct {
+	state *lua.State
+	// loading is the library whose code is running, where redis.register_function
+	// adds the functions
+	loading *library
+
+	mu        sync.Mutex
+	libraries map[string]*library
+	functions map[string]*function
+}
+
+func newFunctionEngine() *functionEngine {
+	e := &functionEngine{
+		libraries: make(map[string]*library),
+		functions: make(map[string]*function),
+	}
+	e.state = lua.NewState()
+	lib := scripting.redisLib()
+	lib.Set("register_function", lua.NewFunction("register_function", e.registerFunction))
+	e.state.Globals.Set("redis", lib)
+	e.state.ProtectGlobals()
+	return e
+}
+
+// registerFunction is redis.register_function, called either with the name
+// and the callback of the function or with a table also giving its flags
+// and description
+func (e *functionEngine) registerFunction(s *lua.State, args []lua.Value) []lua.Value {
+	if e.loading == nil {
+		s.Errorf("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+
+	f := &function{library: e.loading}
+	var name, callback lua.Value
+	switch len(args) {
+	case 1:
+		t, ok := args[0].(*lua.Table)
+		if !ok {
+			s.Errorf("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+		}
+		var key, value lua.Value
+		for {
+			key, value, _ = t.Next(key)
+			if key == nil {
+				break
+			}
+			switch key {
+			case "function_name":
+				name = value
+			case "callback":
+				callback = value
+			case "description":
+				if _, ok := value.(string); !ok {
+					s.Errorf("description argument given to redis.register_function must be a string")
+				}
+				f.description = value
+			case "flags":
+				f.flags = parseFunctionFlags(s, value)
+			default:
+				s.Errorf("unknown argument given to redis.register_function")
+			}
+		}
+	case 2:
+		name, callback = args[0], args[1]
+	default:
+		s.Errorf("wrong number of arguments to redis.register_function")
+	}
+
+	fname, ok := name.(string)
+	if !ok {
+		s.Errorf("function_name argument given to redis.register_function must be a string")
+	}
+	if !validName(fname) {
+		s.Errorf("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	f.name = fname
+	if f.callback, ok = callback.(*lua.Function); !ok {
+		s.Errorf("callback argument given to redis.register_function must be a function")
+	}
+	if _, ok := e.loading.functions[fname]; ok {
+		s.Errorf("Function already exists in the library")
+	}
+	e.loading.functions[fname] = f
+	return nil
+}
+
+func parseFunctionFlags(s *lua.State, value lua.Value) []string {
+	t, ok := value.(*lua.Table)
+	if !ok {
+		s.Errorf("flags argument to redis.register_function must be a table representing function flags")
+	}
+	flags := []string{}
+	for i := 1; i <= t.Len(); i++ {
+		flag, ok := t.GetInt(i).(string)
+		if !ok || !slices.Contains(functionFlags, flag) {
+			s.Errorf("unknown flag given")
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// validName reports whether the name of a library or a function is made of
+// letters, numbers and underscores only
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata reads the `#!lua name=<library>` line the code of a
+// library starts with, returning the library name and the code following it
+func parseLibraryMetadata(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", fmt.Errorf("Missing library metadata")
+	}
+	shebang, body, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(shebang[2:])
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("Missing library metadata")
+	}
+	if engine := fields[0]; strings.ToLower(engine) != "lua" {
+		return "", "", fmt.Errorf("Engine '%s' not found", engine)
+	}
+
+	name := ""
+	for _, field := range fields[1:] {
+		value, ok := strings.CutPrefix(field, "name=")
+		if !ok {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("Library name was not given")
+	}
+	if !validName(name) {
+		return "", "", fmt.Errorf("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	// the metadata line is kept empty, so errors report the lines of the code
+	return name, "\n" + body, nil
+}
+
+// load runs the code of a library, registering its functions. An existing
+// library with the same name is only replaced when replace is set.
+func (e *functionEngine) load(code string, replace bool) (string, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return "", err
+	}
+	old, exists := e.libraries[name]
+	if exists && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", name)
+	}
+
+	chunk, err := e.state.Load("@user_function", body)
+	if err != nil {
+		return "", fmt.Errorf("Error compiling function: %s", err.Error())
+	}
+
+	lib := &library{name: name, code: code, functions: make(map[string]*function)}
+	e.loading = lib
+	deadline := time.Now().Add(functionLoadTimeout)
+	e.state.Interrupt = func() error {
+		if time.Now().After(deadline) {
+			return errors.New("FUNCTION LOAD timeout")
+		}
+		return nil
+	}
+	_, err = e.state.Call(chunk)
+	e.loading = nil
+	e.state.Interrupt = nil
+	if err != nil {
+		return "", fmt.Errorf("Error registering functions: %s", err.Error())
+	}
+
+	if len(lib.functions) == 0 {
+		return "", fmt.Errorf("No functions registered")
+	}
+	for fname := range lib.functions {
+		if f, ok := e.functions[fname]; ok && f.library != old {
+			return "", fmt.Errorf("Function %s already exists", fname)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if exists {
+		e.unlink(old)
+	}
+	e.libraries[name] = lib
+	for fname, f := range lib.functions {
+		e.functions[fname] = f
+	}
+	return name, nil
+}
+
+// unlink removes the library and its functions, e.mu must be held
+func (e *functionEngine) unlink(lib *library) {
+	delete(e.libraries, lib.name)
+	for fname := range lib.functions {
+		delete(e.functions, fname)
+	}
+}
+
+func (e *functionEngine) delete(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	lib, ok := e.libraries[name]
+	if ok {
+		e.unlink(lib)
+	}
+	return ok
+}
+
+func (e *functionEngine) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	clear(e.libraries)
+	clear(e.functions)
+}
+
+// codes returns the code of every library, sorted by library name
+func (e *functionEngine) codes() []string {
+	codes := []string{}
+	for _, name := range e.libraryNames() {
+		codes = append(codes, e.libraries[name].code)
+	}
+	return codes
+}
+
+func (e *functionEngine) libraryNames() []string {
+	names := []string{}
+	for name := range e.libraries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// restore loads the libraries of a FUNCTION DUMP payload with the policy
+// given to FUNCTION RESTORE, keeping the libraries as they were on failure
+func (e *functionEngine) restore(codes []string, policy string) error {
+	e.mu.Lock()
+	libraries, fns := e.libraries, e.functions
+	e.libraries, e.functions = make(map[string]*library), make(map[string]*function)
+	if policy != Flush {
+		for name, lib := range libraries {
+			e.libraries[name] = lib
+		}
+		for name, f := range fns {
+			e.functions[name] = f
+		}
+	}
+	e.mu.Unlock()
+
+	for _, code := range codes {
+		if _, err := e.load(code, policy == Replace); err != nil {
+			e.mu.Lock()
+			e.libraries, e.functions = libraries, fns
+			e.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadLibraries loads the function libraries read from the RDB file
+func LoadLibraries(codes []string) error {
+	for _, code := range codes {
+		if _, err := functions.load(code, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleFunction(h *Handler, userCommand *Command) error {
+	subcommand := strings.ToLower(userCommand.Args[1])
+	args := userCommand.Args[2:]
+	switch subcommand {
+	default:
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(subcommand))
+	case Load:
+		replace := len(args) == 2 && strings.ToLower(args[0]) == Replace
+		if len(args) != 1 && !replace {
+			h.WriteResponse(encoder.NewError("Unknown option given: " + args[0]))
+			return nil
+		}
+		name, err := functions.load(args[len(args)-1], replace)
+		if err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
+		}
+		persistence.changed()
+		h.WriteResponse(encoder.NewBulkString(name))
+	case List:
+		return functionList(h, args)
+	case Delete:
+		if len(args) != 1 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		if !functions.delete(args[0]) {
+			h.WriteResponse(encoder.NewError("Library not found"))
+			return nil
+		}
+		persistence.changed()
+		h.WriteResponse(encoder.Ok)
+	case Flush:
+		if len(args) > 1 || len(args) == 1 && !slices.Contains([]string{"async", "sync"}, strings.ToLower(args[0])) {
+			h.WriteResponse(encoder.NewError("FUNCTION FLUSH only supports SYNC|ASYNC option"))
+			return nil
+		}
+		functions.flush()
+		persistence.changed()
+		h.WriteResponse(encoder.Ok)
+	case Dump:
+		h.WriteResponse(encoder.NewBulkString(string(rdb.DumpFunctions(functions.codes()))))
+	case Restore:
+		if len(args) == 0 || len(args) > 2 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		policy := Append
+		if len(args) == 2 {
+			policy = strings.ToLower(args[1])
+		}
+		if !slices.Contains([]string{Flush, Append, Replace}, policy) {
+			h.WriteResponse(encoder.NewError("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."))
+			return nil
+		}
+		codes, err := rdb.ReadFunctions([]byte(args[0]))
+		if err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
+		}
+		if err := functions.restore(codes, policy); err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
+		}
+		persistence.changed()
+		h.WriteResponse(encoder.Ok)
+	case Stats:
+		h.WriteResponse(functionStats())
+	case Kill:
+		// FUNCTION KILL runs without the execution lock, held by the function
+		h.WriteResponse(scripting.kill(true))
+	}
+	return nil
+}
+
+// functionList replies to FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func functionList(h *Handler, args []string) error {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case Withcode:
+			withCode = true
+		case Libraryname:
+			if i+1 == len(args) {
+				h.WriteResponse(encoder.NewError("library name argument was not given"))
+				return nil
+			}
+			i++
+			pattern = args[i]
+		default:
+			h.WriteResponse(encoder.NewError("Unknown argument " + args[i]))
+			return nil
+		}
+	}
+
+	reply := []string{}
+	for _, name := range functions.libraryNames() {
+		if pattern != "" && !util.GlobMatch(pattern, name) {
+			continue
+		}
+		lib := functions.libraries[name]
+
+		fnames := []string{}
+		for fname := range lib.functions {
+			fnames = append(fnames, fname)
+		}
+		slices.Sort(fnames)
+		fns := []string{}
+		for _, fname := range fnames {
+			f := lib.functions[fname]
+			description := encoder.Null
+			if d, ok := f.description.(string); ok {
+				description = encoder.NewBulkString(d)
+			}
+			fns = append(fns, encoder.NewEncodedArray([]string{
+				encoder.NewBulkString("name"), encoder.NewBulkString(f.name),
+				encoder.NewBulkString("description"), description,
+				encoder.NewBulkString("flags"), encoder.NewArray(f.flags),
+			}))
+		}
+
+		item := []string{
+			encoder.NewBulkString("library_name"), encoder.NewBulkString(name),
+			encoder.NewBulkString("engine"), encoder.NewBulkString("LUA"),
+			encoder.NewBulkString("functions"), encoder.NewEncodedArray(fns),
+		}
+		if withCode {
+			item = append(item, encoder.NewBulkString("library_code"), encoder.NewBulkString(lib.code))
+		}
+		reply = append(reply, encoder.NewEncodedArray(item))
+	}
+	h.WriteResponse(encoder.NewEncodedArray(reply))
+	return nil
+}
+
+// functionStats replies to FUNCTION STATS with the function being run, if
+// any, and the number of libraries and functions loaded
+func functionStats() string {
+	running := encoder.Null
+	if run := scripting.runningScript(); run != nil && run.function != "" {
+		running = encoder.NewEncodedArray([]string{
+			encoder.NewBulkString("name"), encoder.NewBulkString(run.function),
+			encoder.NewBulkString("command"), encoder.NewArray(run.command),
+			encoder.NewBulkString("duration_ms"), encoder.NewInteger(int(time.Since(run.started).Milliseconds())),
+		})
+	}
+
+	functions.mu.Lock()
+	defer functions.mu.Unlock()
+
+	return encoder.NewEncodedArray([]string{
+		encoder.NewBulkString("running_script"), running,
+		encoder.NewBulkString("engines"), encoder.NewEncodedArray([]string{
+			encoder.NewBulkString("LUA"), encoder.NewEncodedArray([]string{
+				encoder.NewBulkString("libraries_count"), encoder.NewInteger(len(functions.libraries)),
+				encoder.NewBulkString("functions_count"), encoder.NewInteger(len(functions.functions)),
+			}),
+		}),
+	})
+}
+
+func handleFcall(h *Handler, userCommand *Command) error {
+	return fcall(h, userCommand, false)
+}
+
+func handleFcallRo(h *Handler, userCommand *Command) error {
+	return fcall(h, userCommand, true)
+}
+
+// fcall runs a function with `numkeys key [key ...] arg [arg ...]`, giving it
+// the keys and the arguments as two tables. Read only calls and functions
+// flagged no-writes can't run write commands.
+func fcall(h *Handler, userCommand *Command, readOnly bool) error {
+	f, ok := functions.functions[userCommand.Args[1]]
+	if !ok {
+		h.WriteResponse(encoder.NewError("Function not found"))
+		return nil
+	}
+	if readOnly && !f.hasFlag("no-writes") {
+		h.WriteResponse(encoder.NewError("Can not execute a script with write flag using *_ro command."))
+		return nil
+	}
+
+	keys, argv, ok := scriptArgs(h, userCommand.Args[2:])
+	if !ok {
+		return nil
+	}
+	run := &scriptRun{
+		function: f.name,
+		command:  userCommand.Args,
+		readOnly: readOnly || f.hasFlag("no-writes"),
+	}
+	return runScript(h, functions.state, run, f.callback, f.name, keys, argv)
+}
@@ -2,87 +2,299 @@ package command
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
 const (
-	Ping     = "ping"
-	Echo     = "echo"
-	Set      = "set"
-	Get      = "get"
-	Info     = "info"
-	Replconf = "replconf"
-	Psync    = "psync"
-	Wait     = "wait"
-	Config   = "config"
-	Keys     = "keys"
-	Type     = "type"
-	Xadd     = "xadd"
-	Xrange   = "xrange"
-	Xread    = "xread"
+	Ping         = "ping"
+	Echo         = "echo"
+	Set          = "set"
+	Get          = "get"
+	Del          = "del"
+	Info         = "info"
+	Replconf     = "replconf"
+	Psync        = "psync"
+	Wait         = "wait"
+	Config       = "config"
+	Keys         = "keys"
+	Type         = "type"
+	Xadd         = "xadd"
+	Xrange       = "xrange"
+	Xread        = "xread"
+	Xrevrange    = "xrevrange"
+	Xinfo        = "xinfo"
+	Xsetid       = "xsetid"
+	Subscribe    = "subscribe"
+	Unsubscribe  = "unsubscribe"
+	Psubscribe   = "psubscribe"
+	Punsubscribe = "punsubscribe"
+	Publish      = "publish"
+	Pubsub       = "pubsub"
+	Ssubscribe   = "ssubscribe"
+	Sunsubscribe = "sunsubscribe"
+	Spublish     = "spublish"
+	Cluster      = "cluster"
+	Quit         = "quit"
+	Reset        = "reset"
+	Multi        = "multi"
+	Exec         = "exec"
+	Discard      = "discard"
+	Watch        = "watch"
+	Unwatch      = "unwatch"
+	Eval         = "eval"
+	Evalsha      = "evalsha"
+	Script       = "script"
+	Function     = "function"
+	Fcall        = "fcall"
+	FcallRo      = "fcall_ro"
+	Select       = "select"
+	Replicaof    = "replicaof"
+	Slaveof      = "slaveof"
+	Role         = "role"
+	Save         = "save"
+	Bgsave       = "bgsave"
+	Lastsave     = "lastsave"
+	Bgrewriteaof = "bgrewriteaof"
 )
 
 const (
-	Replication = "replication"
-	GetAck      = "getack"
-	Ack         = "ack"
-	Px          = "px"
-	Dir         = "dir"
-	DBfilename  = "dbfilename"
+	Replication   = "replication"
+	GetAck        = "getack"
+	Ack           = "ack"
+	ListeningPort = "listening-port"
+	Capa          = "capa"
+	EOF           = "eof"
+	Px            = "px"
+	Pxat          = "pxat"
+	Dir           = "dir"
+	DBfilename    = "dbfilename"
+	Stream        = "stream"
+	Groups        = "groups"
+	Consumers     = "consumers"
+	Full          = "full"
+	Count         = "count"
+	Block         = "block"
+	Streams       = "streams"
+	EntriesAdded  = "entriesadded"
+	MaxDeletedId  = "maxdeletedid"
+	Channels      = "channels"
+	Numsub        = "numsub"
+	Numpat        = "numpat"
+	Shardchannels = "shardchannels"
+	Shardnumsub   = "shardnumsub"
+	Keyslot       = "keyslot"
+	Addslots      = "addslots"
+	Delslots      = "delslots"
+	Load          = "load"
+	Exists        = "exists"
+	Flush         = "flush"
+	Kill          = "kill"
+	List          = "list"
+	Delete        = "delete"
+	Dump          = "dump"
+	Restore       = "restore"
+	Stats         = "stats"
+	Withcode      = "withcode"
+	Libraryname   = "libraryname"
+	Append        = "append"
+	Replace       = "replace"
+	Absttl        = "absttl"
+	Idletime      = "idletime"
+	Freq          = "freq"
+	Schedule      = "schedule"
+	Persistence   = "persistence"
+	No            = "no"
+	One           = "one"
 )
 
 type Handler struct {
-	db           *store.Store
-	conn         net.Conn
-	cfg          *config.Config
-	reader       *bufio.Reader
-	writer       *bufio.Writer
-	slavesOffset int
-	acksLock     *sync.RWMutex
-	acksChan     chan struct{}
-}
-
-var commandHandlers = map[string]func(*Handler, *Command) error{
-	Ping:     handlePing,
-	Echo:     handleEcho,
-	Get:      handleGet,
-	Set:      handleSet,
-	Info:     handleInfo,
-	Replconf: handleReplconf,
-	Psync:    handlePsync,
-	Wait:     handleWait,
-	Config:   handleConfig,
-	Keys:     handleKeys,
-	Type:     handleType,
-	Xadd:     handleXadd,
-	Xrange:   handleXrange,
-	Xread:    handleXread,
-}
-
-func NewHandler(db *store.Store, conn net.Conn, cfg *config.Config, acksChan chan struct{}, locker *sync.RWMutex) *Handler {
+	// db is the database selected with SELECT, one of dbs
+	dbs    []*store.Store
+	db     *store.Store
+	conn   net.Conn
+	cfg    *config.Config
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// execLock is shared by every handler, a command runs while holding it
+	execLock util.Lock
+	// writeMu guards the writer, shared with the goroutine pushing pub/sub messages
+	writeMu    sync.Mutex
+	subscriber *util.Subscriber
+	channels   map[string]struct{}
+	patterns   map[string]struct{}
+	// shard channels are kept apart, as their count is reported on their own
+	shardChannels map[string]struct{}
+	// masterLink is set on the connection a replica keeps with its master,
+	// and slave on the connection of a replica of this server
+	masterLink bool
+	slave      *config.Slave
+	// dropped is set on the link with a former master, so the commands it
+	// already received aren't run
+	dropped bool
+	// listeningPort is the port a replica serves its clients on, capaEOF
+	// being set when it can read a snapshot ending with a mark
+	listeningPort int
+	capaEOF       bool
+	// woff is the replication offset after the last write of the client,
+	// which WAIT waits for the replicas to acknowledge
+	woff int
+	// loading is set on the handler replaying the append only file, whose
+	// commands are already logged and aren't propagated again
+	loading bool
+	quit    bool
+	closed  chan struct{}
+	// commands queued between MULTI and EXEC, multiFailed is set when any of
+	// them was rejected so EXEC discards the whole transaction
+	multi       bool
+	queued      []*Command
+	multiFailed bool
+	watch       *store.Watch
+	// inExec is set while EXEC or a script runs commands, which never block
+	// and whose propagation to the replicas is held back in execPropagation
+	inExec          bool
+	execPropagation []string
+	// rewritten replaces the arguments of the running write command when it
+	// is propagated, set by commands whose effect isn't deterministic
+	rewritten []string
+	// script is the script whose commands run through this handler
+	script *scriptRun
+}
+
+type commandFlags int
+
+const (
+	// flagWrite commands may modify the dataset
+	flagWrite commandFlags = 1 << iota
+	// flagNoScript commands can't be called from scripts
+	flagNoScript
+)
+
+type commandSpec struct {
+	handler func(*Handler, *Command) error
+	// arity is the number of arguments including the command name, a negative
+	// arity means at least that number of arguments
+	arity int
+	flags commandFlags
+}
+
+var commandTable map[string]commandSpec
+
+// writeSubcommands are the subcommands modifying the dataset, for commands
+// with both read and write subcommands
+var writeSubcommands = map[string]map[string]bool{
+	Function: {Load: true, Delete: true, Flush: true, Restore: true},
+}
+
+// isWrite reports whether the command may modify the dataset
+func isWrite(spec commandSpec, args []string) bool {
+	if spec.flags&flagWrite != 0 {
+		return true
+	}
+	subcommands, ok := writeSubcommands[strings.ToLower(args[0])]
+	return ok && len(args) > 1 && subcommands[strings.ToLower(args[1])]
+}
+
+func init() {
+	// the table is filled on init, as EXEC refers back to it to run its commands
+	commandTable = map[string]commandSpec{
+		Ping:         {handlePing, -1, 0},
+		Echo:         {handleEcho, 2, 0},
+		Get:          {handleGet, 2, 0},
+		Set:          {handleSet, -3, flagWrite},
+		Del:          {handleDel, -2, flagWrite},
+		Info:         {handleInfo, -1, 0},
+		Replconf:     {handleReplconf, -2, flagNoScript},
+		Psync:        {handlePsync, -3, flagNoScript},
+		Wait:         {handleWait, 3, flagNoScript},
+		Config:       {handleConfig, -2, flagNoScript},
+		Keys:         {handleKeys, 2, 0},
+		Type:         {handleType, 2, 0},
+		Xadd:         {handleXadd, -5, flagWrite},
+		Xrange:       {handleXrange, -4, 0},
+		Xread:        {handleXread, -4, 0},
+		Xrevrange:    {handleXrevrange, -4, 0},
+		Xinfo:        {handleXinfo, -2, 0},
+		Xsetid:       {handleXsetid, -3, flagWrite},
+		Subscribe:    {handleSubscribe, -2, flagNoScript},
+		Unsubscribe:  {handleUnsubscribe, -1, flagNoScript},
+		Psubscribe:   {handlePsubscribe, -2, flagNoScript},
+		Punsubscribe: {handlePunsubscribe, -1, flagNoScript},
+		Publish:      {handlePublish, 3, 0},
+		Pubsub:       {handlePubsub, -2, 0},
+		Ssubscribe:   {handleSsubscribe, -2, flagNoScript},
+		Sunsubscribe: {handleSunsubscribe, -1, flagNoScript},
+		Spublish:     {handleSpublish, 3, 0},
+		Cluster:      {handleCluster, -2, 0},
+		Quit:         {handleQuit, -1, flagNoScript},
+		Reset:        {handleReset, 1, flagNoScript},
+		Multi:        {handleMulti, 1, flagNoScript},
+		Exec:         {handleExec, 1, flagNoScript},
+		Discard:      {handleDiscard, 1, flagNoScript},
+		Watch:        {handleWatch, -2, flagNoScript},
+		Unwatch:      {handleUnwatch, 1, flagNoScript},
+		Eval:         {handleEval, -3, flagNoScript},
+		Evalsha:      {handleEvalsha, -3, flagNoScript},
+		Script:       {handleScript, -2, flagNoScript},
+		Function:     {handleFunction, -2, flagNoScript},
+		Fcall:        {handleFcall, -3, flagNoScript},
+		FcallRo:      {handleFcallRo, -3, flagNoScript},
+		Select:       {handleSelect, 2, 0},
+		Replicaof:    {handleReplicaof, 3, flagNoScript},
+		Slaveof:      {handleReplicaof, 3, flagNoScript},
+		Role:         {handleRole, 1, flagNoScript},
+		Save:         {handleSave, 1, flagNoScript},
+		Bgsave:       {handleBgsave, -1, flagNoScript},
+		Lastsave:     {handleLastsave, 1, 0},
+		Bgrewriteaof: {handleBgrewriteaof, 1, flagNoScript},
+		Dump:         {handleDump, 2, 0},
+		Restore:      {handleRestore, -4, flagWrite},
+	}
+}
+
+func NewHandler(dbs []*store.Store, conn net.Conn, cfg *config.Config, execLock util.Lock) *Handler {
 	return &Handler{
-		db:           db,
-		conn:         conn,
-		cfg:          cfg,
-		reader:       bufio.NewReader(conn),
-		writer:       bufio.NewWriter(conn),
-		slavesOffset: 0,
-		acksLock:     locker,
-		acksChan:     acksChan,
+		dbs:           dbs,
+		db:            dbs[0],
+		conn:          conn,
+		cfg:           cfg,
+		reader:        bufio.NewReader(conn),
+		writer:        bufio.NewWriter(conn),
+		execLock:      execLock,
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+		closed:        make(chan struct{}),
+		watch:         store.NewWatch(),
 	}
 }
 
 func (h *Handler) HandleClientConnection() error {
 	defer h.conn.Close()
+	defer close(h.closed)
+	defer h.closePubSub()
+	defer h.watch.Unwatch()
+	defer func() {
+		if h.slave != nil {
+			h.cfg.RemoveSlave(h.slave)
+			h.slave.Close()
+		}
+	}()
 
 	for {
 		userCommand, err := NewCommand(h.reader)
@@ -93,18 +305,31 @@ func (h *Handler) HandleClientConnection() error {
 			return fmt.Errorf("failed to read command, error: %w", err)
 		}
 
-		err = h.handleCommand(userCommand)
+		h.writeMu.Lock()
+		if h.masterLink {
+			// every command of the replication stream counts, whatever its
+			// outcome
+			err = h.handleReplicated(userCommand, h.conn.(*linkConn).consume(userCommand.Size))
+		} else {
+			err = h.handleCommand(userCommand)
+		}
 		if err != nil {
+			h.writeMu.Unlock()
 			return fmt.Errorf("error: %w", err)
 		}
 
-		h.cfg.UpdateOffset(userCommand.Size)
-
 		h.writer.Flush()
+		h.writeMu.Unlock()
+
+		if h.quit {
+			return nil
+		}
 	}
 }
 
 func (h *Handler) Handshake() error {
+	h.masterLink = true
+
 	h.writer.WriteString(encoder.NewArray([]string{"PING"}))
 	h.writer.Flush()
 
@@ -115,7 +340,7 @@ func (h *Handler) Handshake() error {
 
 	h.writer.WriteString(encoder.NewArray([]string{
 		Replconf,
-		"listening-port",
+		ListeningPort,
 		strconv.Itoa(h.cfg.Port()),
 	}))
 	h.writer.Flush()
@@ -127,7 +352,9 @@ func (h *Handler) Handshake() error {
 
 	h.writer.WriteString(encoder.NewArray([]string{
 		Replconf,
-		"capa",
+		Capa,
+		EOF,
+		Capa,
 		"psync2",
 	}))
 	h.writer.Flush()
@@ -137,62 +364,474 @@ func (h *Handler) Handshake() error {
 		return fmt.Errorf("incorrect master response")
 	}
 
-	h.writer.WriteString(encoder.NewArray([]string{
-		Psync,
-		"?",
-		"-1",
-	}))
+	// a replica that synchronized once asks to continue from its offset
+	psync := []string{Psync, "?", "-1"}
+	if replID, replOffset, ok := h.cfg.CachedMaster(); ok {
+		psync = []string{Psync, replID, strconv.Itoa(replOffset + 1)}
+	}
+	h.writer.WriteString(encoder.NewArray(psync))
 	h.writer.Flush()
 
 	response, err = h.reader.ReadString('\n')
-	responseCommand := strings.Split(response, " ")[0]
-	if err != nil || responseCommand != "+"+encoder.Fullsync {
+	fields := strings.Fields(response)
+	if err == nil && len(fields) > 0 && fields[0] == "+"+encoder.Continue {
+		h.continueReplication(fields[1:])
+		h.conn.(*linkConn).record(h.reader)
+		return nil
+	}
+	if err != nil || len(fields) != 3 || fields[0] != "+"+encoder.Fullsync {
 		return fmt.Errorf("incorrect master response")
 	}
-
-	// Skip the RDB file sent by the master during the handshake phase.
-	_, err = h.reader.ReadBytes(162)
+	replID, offset := fields[1], fields[2]
+	replOffset, err := strconv.Atoi(offset)
 	if err != nil {
-		return err
+		return fmt.Errorf("incorrect master response")
 	}
 
+	streamDB, err := h.loadSnapshot()
+	if err != nil {
+		return fmt.Errorf("failed to load the snapshot of the master: %w", err)
+	}
+	h.cfg.SetReplication(replID, replOffset)
+	// the stream goes on with the database the master had selected, and the
+	// backlog starts from the offset of the snapshot
+	masterLinkDB = streamDB
+	h.db = h.dbs[masterLinkDB]
+	backlog.free()
+	backlog.create(h.cfg, replOffset)
+	// the replicas of the replica resynchronize with the new dataset
+	disconnectSlaves(h.cfg)
+	h.conn.(*linkConn).record(h.reader)
+	log.Printf("full resynchronization with the master succeeded, replication id %s offset %d\n", replID, replOffset)
 	return nil
 }
 
+// continueReplication resumes the replication stream where it stopped, on
+// the database it had selected. The master may have changed its replication
+// ID, when it was promoted, which replaces ours.
+func (h *Handler) continueReplication(fields []string) {
+	replID, replOffset, _ := h.cfg.CachedMaster()
+	if len(fields) > 0 && fields[0] != replID {
+		h.cfg.ShiftReplID(fields[0])
+		replID = fields[0]
+		// the replicas of the replica continue under the new ID once they
+		// reconnect
+		disconnectSlaves(h.cfg)
+	}
+	h.db = h.dbs[masterLinkDB]
+	log.Printf("partial resynchronization with the master succeeded, replication id %s offset %d\n", replID, replOffset)
+}
+
+// loadSnapshot reads the RDB file sent by the master on a full
+// resynchronization, replacing the whole dataset with its content. The
+// commands the master propagates next follow it on the connection. It is
+// either preceded by its size, or streamed and followed by the mark given
+// instead. As set by repl-diskless-load, it is received in full before the
+// dataset is replaced, or parsed straight from the connection, either into
+// an empty dataset or aside while the former dataset is still served. It
+// returns the database the commands following it apply to.
+func (h *Handler) loadSnapshot() (int, error) {
+	header, err := h.reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	header = strings.TrimSuffix(header, "\r\n")
+	if len(header) < 2 || header[0] != BulkString {
+		return 0, fmt.Errorf("expected the size of the snapshot, got %q", header)
+	}
+	mark, size := "", int64(-1)
+	if strings.HasPrefix(header[1:], "EOF:") {
+		mark = header[5:]
+		if len(mark) != 40 {
+			return 0, fmt.Errorf("invalid snapshot mark %q", header)
+		}
+	} else if size, err = strconv.ParseInt(header[1:], 10, 64); err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid snapshot size %q", header)
+	}
+	replLink.startTransfer(size)
+
+	mode := h.cfg.ReplDisklessLoad()
+	if mode == config.DisklessLoadOnEmptyDB && !emptyDatabases(h.dbs) {
+		mode = config.DisklessLoadDisabled
+	}
+	var content *rdb.File
+	switch mode {
+	case config.DisklessLoadDisabled:
+		payload := bytes.Buffer{}
+		if mark != "" {
+			err = readUntilMark(h.reader, mark, &transferWriter{&payload})
+		} else {
+			_, err = io.CopyN(&transferWriter{&payload}, h.reader, size)
+		}
+		if err != nil {
+			return 0, err
+		}
+		content, err = rdb.Parse(&payload)
+	case config.DisklessLoadSwapDB:
+		content, err = h.readSnapshot(mark, size)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	h.execLock.Lock()
+	defer h.execLock.Unlock()
+	if h.dropped {
+		return 0, fmt.Errorf("the link with the master was dropped")
+	}
+	if mode == config.DisklessLoadOnEmptyDB {
+		// the dataset is empty, nobody is served anything while it loads
+		if content, err = h.readSnapshot(mark, size); err != nil {
+			return 0, err
+		}
+	}
+	for _, db := range h.dbs {
+		db.Flush()
+	}
+	libraries, err := store.LoadContent(content, h.dbs)
+	if err != nil {
+		return 0, err
+	}
+	if err := functions.restore(libraries, Flush); err != nil {
+		return 0, err
+	}
+	streamDB, err := strconv.Atoi(content.Aux[store.ReplStreamDB])
+	if err != nil || streamDB < 0 || streamDB >= len(h.dbs) {
+		streamDB = 0
+	}
+	// the snapshot isn't in the append only file, so it is rewritten
+	if appendOnly != nil {
+		if err := appendOnly.bgrewrite(h.cfg, h.dbs, h.execLock); err != nil {
+			log.Printf("failed to rewrite the append only file after the resynchronization: %s\n", err.Error())
+		}
+	}
+	return streamDB, nil
+}
+
+// readSnapshot parses the snapshot straight from the connection, checking
+// it ends where the master said it would
+func (h *Handler) readSnapshot(mark string, size int64) (*rdb.File, error) {
+	if mark == "" {
+		payload := io.LimitReader(io.TeeReader(h.reader, &transferWriter{io.Discard}), size)
+		content, err := rdb.Parse(payload)
+		if err != nil {
+			return nil, err
+		}
+		// the commands start right after the payload
+		_, err = io.Copy(io.Discard, payload)
+		return content, err
+	}
+
+	// the parser reads through the reader of the connection, as it is
+	// buffered enough, so it stops right after the snapshot
+	content, err := rdb.Parse(h.reader)
+	if err != nil {
+		return nil, err
+	}
+	end := make([]byte, len(mark))
+	if _, err := io.ReadFull(h.reader, end); err != nil {
+		return nil, err
+	}
+	if string(end) != mark {
+		return nil, fmt.Errorf("the snapshot doesn't end with its mark")
+	}
+	return content, nil
+}
+
+// emptyDatabases tells whether there is no key in any database
+func emptyDatabases(dbs []*store.Store) bool {
+	for _, db := range dbs {
+		if len(db.Keys()) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // Handles responses to commands sent to the master server.
 // Only slaves send responses to `REPLCONF GETACK` commands.
 // This function writes the response to the client connection
-// if the server is a master.
+// unless the connection is the replication link with the master.
 func (h *Handler) WriteResponse(msg string) {
-	if h.cfg.Role() == config.RoleMaster {
+	if !h.masterLink {
 		h.writer.WriteString(msg)
 	}
 }
 
-func (h *Handler) UpdateSlavesOffset(commandBytes int) {
-	h.slavesOffset += commandBytes
-}
+// watchDisconnect reports through the returned channel when the client closes
+// the connection while its command is blocked waiting for something else.
+// The returned function stops watching and must be called before the handler
+// reads from the connection again.
+func (h *Handler) watchDisconnect() (<-chan struct{}, func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
 
-func (h *Handler) NotifyAckSlaves() {
-	h.acksChan <- struct{}{}
+	go func() {
+		defer close(done)
+		_, err := h.reader.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(closed)
+		}
+	}()
+
+	return closed, func() {
+		// unblock the pending peek, keeping any data the client already sent
+		h.conn.SetReadDeadline(time.Now())
+		<-done
+		h.conn.SetReadDeadline(time.Time{})
+	}
 }
 
 func (h *Handler) handleCommand(userCommand *Command) error {
+	if allowedWhileBusy(userCommand) {
+		return h.dispatch(userCommand)
+	}
+	// clients stop waiting for a script running longer than the busy threshold
+	if !h.execLock.LockOrCancel(scripting.busySignal()) {
+		h.WriteResponse(busyError)
+		return nil
+	}
+	defer h.execLock.Unlock()
+
+	return h.dispatch(userCommand)
+}
+
+// handleReplicated runs a command of the replication stream, stream being
+// its bytes. The stream waits for a running script, as none of its commands
+// may be left out. A replica counts the bytes of the commands it processed,
+// and passes them as they are to its own replicas, while holding the lock
+// so their snapshots match its offset.
+func (h *Handler) handleReplicated(userCommand *Command, stream string) error {
+	h.execLock.Lock()
+	defer h.execLock.Unlock()
+	if h.dropped {
+		return fmt.Errorf("the link with the master was dropped")
+	}
+
+	// the offset acknowledged by REPLCONF GETACK doesn't count it
+	defer proxyStream(h.cfg, stream)
+	return h.dispatch(userCommand)
+}
+
+// dispatch runs the command, or queues it when the client is inside MULTI.
+// The execution lock must be held by the caller.
+func (h *Handler) dispatch(userCommand *Command) error {
+	if len(userCommand.Args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
 	instruction := strings.ToLower(userCommand.Args[0])
-	handler, exist := commandHandlers[instruction]
+	spec, exist := commandTable[instruction]
 	if !exist {
-		return fmt.Errorf("unknown command: %s", strings.ToUpper(instruction))
+		args := []string{}
+		for _, arg := range userCommand.Args[1:] {
+			args = append(args, fmt.Sprintf("'%s'", arg))
+		}
+		h.rejectCommand(fmt.Sprintf("unknown command '%s', with args beginning with: %s",
+			userCommand.Args[0], strings.Join(args, " ")))
+		return nil
+	}
+	if spec.arity > 0 && len(userCommand.Args) != spec.arity ||
+		spec.arity < 0 && len(userCommand.Args) < -spec.arity {
+		h.rejectCommand(fmt.Sprintf("wrong number of arguments for '%s' command", instruction))
+		return nil
+	}
+	if h.subscribed() && !subscribedCommands[instruction] {
+		h.WriteResponse(encoder.NewError(fmt.Sprintf(
+			"Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+			instruction)))
+		return nil
+	}
+	if isWrite(spec, userCommand.Args) {
+		if reply := h.rejectWrite(); reply != "" {
+			h.rejectEncoded(reply)
+			return nil
+		}
 	}
-	return handler(h, userCommand)
+	if h.multi && !transactionCommands[instruction] {
+		h.queued = append(h.queued, userCommand)
+		h.WriteResponse(encoder.NewString("QUEUED"))
+		return nil
+	}
+	if !isWrite(spec, userCommand.Args) {
+		return spec.handler(h, userCommand)
+	}
+
+	// a write command is propagated when it changed the dataset
+	changes := persistence.changeCount()
+	h.rewritten = nil
+	if err := spec.handler(h, userCommand); err != nil {
+		return err
+	}
+	if persistence.changeCount() != changes {
+		args := userCommand.Args
+		if h.rewritten != nil {
+			args = h.rewritten
+		}
+		h.propagate(args)
+	}
+	return nil
 }
 
-func (h *Handler) sendGetAckToSlaves() {
-	wg := &sync.WaitGroup{}
-	command := encoder.NewArray([]string{"REPLCONF", "GETACK", "*"})
+// rewriteCommand sets the arguments the running write command is propagated
+// with, making the replicas and the append only file get the same result,
+// such as an explicit ID instead of one generated, or an absolute expire time
+// instead of a relative one
+func (h *Handler) rewriteCommand(args []string) {
+	h.rewritten = args
+}
+
+// rejectCommand replies with the error, failing the transaction being queued
+func (h *Handler) rejectCommand(msg string) {
+	h.rejectEncoded(encoder.NewError(msg))
+}
+
+// rejectEncoded is rejectCommand for an error with its own prefix
+func (h *Handler) rejectEncoded(reply string) {
+	if h.multi {
+		h.multiFailed = true
+	}
+	h.WriteResponse(reply)
+}
+
+// rejectWrite returns the error a write command is rejected with, empty
+// when it can run:
+//   - a read only replica only accepts the writes of its master
+//   - a master needs min-replicas-to-write replicas with a lag under
+//     min-replicas-max-lag
+func (h *Handler) rejectWrite() string {
+	if h.masterLink || h.loading {
+		return ""
+	}
+	if h.cfg.Role() == config.RoleSlave {
+		if h.cfg.ReplicaReadOnly() {
+			return "-READONLY You can't write against a read only replica.\r\n"
+		}
+		return ""
+	}
+
+	minReplicas, maxLag := h.cfg.MinReplicas()
+	if minReplicas == 0 {
+		return ""
+	}
+	good := 0
 	for _, slave := range h.cfg.Slaves() {
-		wg.Add(1)
-		go slave.PropagateCommand(command, wg)
+		if slave.Online() && slave.Lag().Truncate(time.Second) <= maxLag {
+			good++
+		}
+	}
+	if good < minReplicas {
+		return "-NOREPLICAS Not enough good replicas to write.\r\n"
+	}
+	return ""
+}
+
+// unlocked runs fn without holding the execution lock, letting the other
+// clients run their commands while this one is blocked waiting for them.
+func (h *Handler) unlocked(fn func()) {
+	h.execLock.Unlock()
+	defer h.execLock.Lock()
+
+	fn()
+}
+
+// propagatedDB is the database the propagated commands run on, -1 until one
+// is selected. It is guarded by the execution lock.
+var propagatedDB = -1
+
+// masterLinkDB is the database selected by the replication stream of the
+// master, kept so a partial resynchronization continues on it
+var masterLinkDB = 0
+
+// propagate logs a write command to the append only file and sends it to the
+// replicas, selecting its database first when it changed. The commands run
+// by EXEC are held back, so the transaction is propagated as a MULTI/EXEC
+// block.
+func (h *Handler) propagate(args []string) {
+	command := encoder.NewArray(args)
+	if h.db.Index() != propagatedDB {
+		// the command runs on the same database
+		propagatedDB = h.db.Index()
+		command = encodeSelect(propagatedDB) + command
+	}
+	if h.inExec {
+		h.execPropagation = append(h.execPropagation, command)
+		return
+	}
+	h.propagateCommand(command)
+}
+
+// PropagateExpired logs the deletion of a key whose time to live expired to
+// the append only file and sends it to the replicas, which don't expire keys
+// on their own clock. The database selected by the stream is selected again
+// afterwards, as the commands of a transaction may be held back meanwhile.
+// The execution lock must be held by the caller.
+func PropagateExpired(cfg *config.Config, db int, key string) {
+	command := encoder.NewArray([]string{strings.ToUpper(Del), key})
+	if db != propagatedDB {
+		command = encodeSelect(db) + command
+		if propagatedDB >= 0 {
+			command += encodeSelect(propagatedDB)
+		}
+	}
+	feedAppendOnly(cfg, command)
+	if cfg.Role() == config.RoleMaster {
+		sendToSlaves(cfg, command)
+	}
+}
+
+func encodeSelect(db int) string {
+	return encoder.NewArray([]string{strings.ToUpper(Select), strconv.Itoa(db)})
+}
+
+// propagateTransaction propagates the commands run by EXEC or by a script as
+// a MULTI/EXEC block, or holds them back when run inside EXEC.
+func (h *Handler) propagateTransaction(commands []string) {
+	if len(commands) == 0 {
+		return
+	}
+	if h.inExec {
+		h.execPropagation = append(h.execPropagation, commands...)
+		return
 	}
-	wg.Wait()
-	h.UpdateSlavesOffset(len([]byte(command)))
+	h.propagateCommand(encoder.NewArray([]string{strings.ToUpper(Multi)}) +
+		strings.Join(commands, "") +
+		encoder.NewArray([]string{strings.ToUpper(Exec)}))
+}
+
+func (h *Handler) propagateCommand(command string) {
+	if h.loading {
+		return
+	}
+	feedAppendOnly(h.cfg, command)
+	if h.cfg.Role() != config.RoleMaster {
+		return
+	}
+	sendToSlaves(h.cfg, command)
+	h.woff = h.cfg.ReplOffset()
+}
+
+func sendToSlaves(cfg *config.Config, command string) {
+	for _, slave := range cfg.Slaves() {
+		slave.PropagateCommand(command)
+	}
+	// the offset counts the bytes of the stream kept by the backlog
+	if backlog.feed(cfg, command) {
+		cfg.UpdateOffset(len(command))
+	}
+}
+
+// proxyStream passes the replication stream received from the master to the
+// replicas of a replica, keeping it in its backlog, so the offsets are the
+// same along the chain
+func proxyStream(cfg *config.Config, stream string) {
+	for _, slave := range cfg.Slaves() {
+		slave.PropagateCommand(stream)
+	}
+	backlog.feed(cfg, stream)
+	cfg.UpdateOffset(len(stream))
+}
+
+func (h *Handler) sendGetAckToSlaves() {
+	sendToSlaves(h.cfg, encoder.NewArray([]string{"REPLCONF", "GETACK", "*"}))
 }
@@ -0,0 +1,107 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// testServer serves clients connected through pipes, sharing its databases
+// and execution lock like the clients of the server
+type testServer struct {
+	cfg  *config.Config
+	dbs  []*store.Store
+	lock util.Lock
+}
+
+func newTestServer(options ...config.Option) *testServer {
+	cfg := config.NewConfig(options...)
+	return &testServer{cfg: cfg, dbs: store.NewDatabases(cfg.Databases()), lock: util.NewLock()}
+}
+
+// testClient sends commands to a handler and reads its replies
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *testServer) connect(t *testing.T) *testClient {
+	t.Helper()
+	server, client := net.Pipe()
+	go NewHandler(s.dbs, server, s.cfg, s.lock).HandleClientConnection()
+	t.Cleanup(func() { client.Close() })
+	return &testClient{t: t, conn: client, reader: bufio.NewReader(client)}
+}
+
+// do sends the command and returns its reply, see readReply
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(encoder.NewArray(args))); err != nil {
+		c.t.Fatalf("failed to send %q: %v", args, err)
+	}
+}
+
+func (c *testClient) read() any {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("failed to read the reply: %v", err)
+	}
+	return reply
+}
+
+// readReply reads a RESP reply. Simple strings, errors and integers are
+// returned as they are sent, such as "+OK", "-ERR ..." or ":1", bulk strings
+// as their content, nil bulk strings and arrays as nil, and arrays as []any.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elements := make([]any, n)
+		for i := range elements {
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
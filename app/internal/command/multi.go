@@ -0,0 +1,101 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+)
+
+// Commands run at once even inside MULTI, instead of being queued
+var transactionCommands = map[string]bool{
+	Multi:   true,
+	Exec:    true,
+	Discard: true,
+	Watch:   true,
+	Quit:    true,
+	Reset:   true,
+}
+
+func handleMulti(h *Handler, _ *Command) error {
+	if h.multi {
+		h.WriteResponse(encoder.NewError("MULTI calls can not be nested"))
+		return nil
+	}
+
+	h.multi = true
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+// handleExec runs the queued commands one after the other. As the execution
+// lock is held all along, no other client runs a command in between.
+func handleExec(h *Handler, _ *Command) error {
+	if !h.multi {
+		h.WriteResponse(encoder.NewError("EXEC without MULTI"))
+		return nil
+	}
+
+	queued, failed := h.queued, h.multiFailed
+	h.discardTransaction()
+	defer h.watch.Unwatch()
+
+	if failed {
+		h.WriteResponse("-EXECABORT Transaction discarded because of previous errors.\r\n")
+		return nil
+	}
+	// a watched key was modified, so the transaction is not run at all
+	if h.watch.Dirty() {
+		h.WriteResponse(encoder.NullArray)
+		return nil
+	}
+
+	h.WriteResponse(fmt.Sprintf("*%d\r\n", len(queued)))
+	h.inExec = true
+	for _, userCommand := range queued {
+		// a failing command does not stop the transaction, its error is its reply
+		if err := h.dispatch(userCommand); err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+		}
+	}
+	h.inExec = false
+
+	commands := h.execPropagation
+	h.execPropagation = nil
+	h.propagateTransaction(commands)
+	return nil
+}
+
+func handleDiscard(h *Handler, _ *Command) error {
+	if !h.multi {
+		h.WriteResponse(encoder.NewError("DISCARD without MULTI"))
+		return nil
+	}
+
+	h.discardTransaction()
+	h.watch.Unwatch()
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+func handleWatch(h *Handler, userCommand *Command) error {
+	if h.multi {
+		h.WriteResponse(encoder.NewError("WATCH inside MULTI is not allowed"))
+		return nil
+	}
+
+	h.db.Watch(h.watch, userCommand.Args[1:]...)
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+func handleUnwatch(h *Handler, _ *Command) error {
+	h.watch.Unwatch()
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+func (h *Handler) discardTransaction() {
+	h.multi = false
+	h.queued = nil
+	h.multiFailed = false
+}
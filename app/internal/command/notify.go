@@ -0,0 +1,29 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+)
+
+// NotifyKeyspaceEvent publishes the event to the clients subscribed to
+// `__keyspace@<db>__:<key>` and the key to the ones subscribed to
+// `__keyevent@<db>__:<event>`, as long as the class of the event is
+// enabled by `notify-keyspace-events`.
+func NotifyKeyspaceEvent(cfg *config.Config, db int, class config.KeyspaceEvents, event, key string) {
+	events := cfg.KeyspaceEvents()
+	if events&class == 0 {
+		return
+	}
+
+	if events&config.NotifyKeyspace != 0 {
+		clientPubSub.Publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+	}
+	if events&config.NotifyKeyevent != 0 {
+		clientPubSub.Publish(fmt.Sprintf("__keyevent@%d__:%s", db, event), key)
+	}
+}
+
+func (h *Handler) notify(class config.KeyspaceEvents, event, key string) {
+	NotifyKeyspaceEvent(h.cfg, h.db.Index(), class, event, key)
+}
@@ -0,0 +1,284 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// bgsaveRetryDelay is how long a failed background save waits before being
+// triggered again by the save points
+const bgsaveRetryDelay = 5 * time.Second
+
+// persistence tracks the snapshots of the dataset into the RDB file, shared
+// by every client and by the save points
+var persistence = &snapshotter{lastSave: time.Now(), lastBgsaveOk: true, lastBgsaveTaken: -1}
+
+// snapshotter counts the changes made since the last snapshot, and runs the
+// background saves. Its fields are guarded by mu, as background saves
+// complete without holding the execution lock.
+type snapshotter struct {
+	mu sync.Mutex
+	// dirty is the number of changes since the last successful snapshot
+	dirty    int
+	lastSave time.Time
+	// changes is the number of changes since the server started, telling
+	// whether a command changed the dataset
+	changes int
+	// saving is set while a background save runs, dirtyAtStart being the
+	// changes it saves
+	saving       bool
+	dirtyAtStart int
+	started      time.Time
+	// scheduled is set by BGSAVE SCHEDULE while another save is running
+	scheduled     bool
+	lastBgsaveOk  bool
+	lastBgsaveTry time.Time
+	// lastBgsaveTaken is how long the last background save took, -1 when
+	// there was none
+	lastBgsaveTaken time.Duration
+}
+
+// changed records a change of the dataset
+func (s *snapshotter) changed() {
+	s.mu.Lock()
+	s.dirty++
+	s.changes++
+	s.mu.Unlock()
+}
+
+// loaded forgets the changes made while loading the dataset from disk, so the
+// save points don't write it again right after a restart
+func (s *snapshotter) loaded() {
+	s.mu.Lock()
+	s.dirty = 0
+	s.mu.Unlock()
+}
+
+func (s *snapshotter) changeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changes
+}
+
+// dataset is a view of the keys of every database along with the code of
+// the function libraries. Its keys are read once, when first asked for.
+type dataset struct {
+	keys      func() []rdb.Key
+	libraries []string
+}
+
+// snapshot takes a view of the dataset, without copying the keys, so it can
+// be saved in the background while the databases keep changing. The
+// execution lock must be held by the caller.
+func snapshot(dbs []*store.Store) dataset {
+	snapshots := make([]*store.Snapshot, len(dbs))
+	for i, db := range dbs {
+		snapshots[i] = db.Snapshot()
+	}
+	keys := sync.OnceValue(func() []rdb.Key {
+		keys := []rdb.Key{}
+		for _, snapshot := range snapshots {
+			keys = append(keys, snapshot.Keys()...)
+		}
+		return keys
+	})
+	return dataset{keys: keys, libraries: functions.codes()}
+}
+
+// save writes the RDB file while holding the execution lock
+func (s *snapshotter) save(cfg *config.Config, dbs []*store.Store) error {
+	s.mu.Lock()
+	if s.saving {
+		s.mu.Unlock()
+		return fmt.Errorf("Background save already in progress")
+	}
+	dirty := s.dirty
+	s.mu.Unlock()
+
+	data := snapshot(dbs)
+	if err := store.WriteRDBFile(cfg.RDBFilePath(), data.keys(), data.libraries); err != nil {
+		log.Printf("failed to save the RDB file: %s\n", err.Error())
+		return err
+	}
+
+	s.mu.Lock()
+	s.dirty -= dirty
+	s.lastSave = time.Now()
+	s.mu.Unlock()
+	log.Println("DB saved on disk")
+	return nil
+}
+
+// bgsave takes a view of the dataset and writes it in the background, so
+// clients keep running commands meanwhile. The execution lock must be held by the caller.
+func (s *snapshotter) bgsave(cfg *config.Config, dbs []*store.Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saving {
+		return fmt.Errorf("Background save already in progress")
+	}
+	s.saving, s.scheduled = true, false
+	s.dirtyAtStart = s.dirty
+	s.started = time.Now()
+	s.lastBgsaveTry = s.started
+
+	data := snapshot(dbs)
+	path := cfg.RDBFilePath()
+	log.Println("Background saving started")
+	go func() {
+		err := store.WriteRDBFile(path, data.keys(), data.libraries)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.saving = false
+		s.lastBgsaveTaken = time.Since(s.started)
+		s.lastBgsaveOk = err == nil
+		if err != nil {
+			log.Printf("background saving error: %s\n", err.Error())
+			return
+		}
+		s.dirty -= s.dirtyAtStart
+		s.lastSave = time.Now()
+		log.Println("Background saving terminated with success")
+	}()
+	return nil
+}
+
+// due reports whether a scheduled save or one of the save points triggers a
+// background save
+func (s *snapshotter) due(points []config.SavePoint) bool {
+	rewriting := aofRewriting()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saving || rewriting {
+		return false
+	}
+	if s.scheduled {
+		return true
+	}
+	// a failed save is only retried after a while
+	if !s.lastBgsaveOk && time.Since(s.lastBgsaveTry) < bgsaveRetryDelay {
+		return false
+	}
+	for _, point := range points {
+		if s.dirty >= point.Changes && time.Since(s.lastSave) >= time.Duration(point.Seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...\n", point.Changes, point.Seconds)
+			return true
+		}
+	}
+	return false
+}
+
+// RunSavePoints periodically starts a background save when a save point is
+// reached, holding the lock while the dataset is copied.
+func RunSavePoints(cfg *config.Config, dbs []*store.Store, lock util.Lock) {
+	for {
+		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
+		if persistence.due(cfg.SavePoints()) {
+			persistence.bgsave(cfg, dbs)
+		}
+		lock.Unlock()
+	}
+}
+
+func handleSave(h *Handler, _ *Command) error {
+	if err := persistence.save(h.cfg, h.dbs); err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+func handleBgsave(h *Handler, userCommand *Command) error {
+	schedule := false
+	if len(userCommand.Args) > 1 {
+		if len(userCommand.Args) > 2 || strings.ToLower(userCommand.Args[1]) != Schedule {
+			h.WriteResponse(encoder.NewError("syntax error"))
+			return nil
+		}
+		schedule = true
+	}
+
+	// a save can't start while the append only file is rewritten, as both
+	// copy the whole dataset
+	rewriting := aofRewriting()
+	if rewriting && !schedule {
+		h.WriteResponse(encoder.NewError("An AOF log rewriting in progress: can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible."))
+		return nil
+	}
+	persistence.mu.Lock()
+	busy := persistence.saving || rewriting
+	if busy && schedule {
+		persistence.scheduled = true
+	}
+	persistence.mu.Unlock()
+	if busy && schedule {
+		h.WriteResponse(encoder.NewString("Background saving scheduled"))
+		return nil
+	}
+
+	if err := persistence.bgsave(h.cfg, h.dbs); err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+	h.WriteResponse(encoder.NewString("Background saving started"))
+	return nil
+}
+
+func handleLastsave(h *Handler, _ *Command) error {
+	persistence.mu.Lock()
+	lastSave := persistence.lastSave
+	persistence.mu.Unlock()
+
+	h.WriteResponse(encoder.NewInteger(int(lastSave.Unix())))
+	return nil
+}
+
+// persistenceInfo returns the fields of the persistence section of INFO
+func persistenceInfo() []string {
+	s := persistence
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := "ok"
+	if !s.lastBgsaveOk {
+		status = "err"
+	}
+	lastTaken, current := -1, -1
+	if s.lastBgsaveTaken >= 0 {
+		lastTaken = int(s.lastBgsaveTaken.Seconds())
+	}
+	if s.saving {
+		current = int(time.Since(s.started).Seconds())
+	}
+	return []string{
+		"loading:0",
+		fmt.Sprintf("rdb_changes_since_last_save:%d", s.dirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(s.saving)),
+		fmt.Sprintf("rdb_last_save_time:%d", s.lastSave.Unix()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", status),
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", lastTaken),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", current),
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
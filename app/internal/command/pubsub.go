@@ -0,0 +1,365 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// Messages a subscribed client may have waiting to be written to its connection
+const subscriberQueueSize = 1024
+
+// Commands a client is allowed to run while subscribed to any channel or pattern
+var subscribedCommands = map[string]bool{
+	Subscribe:    true,
+	Unsubscribe:  true,
+	Psubscribe:   true,
+	Punsubscribe: true,
+	Ssubscribe:   true,
+	Sunsubscribe: true,
+	Ping:         true,
+	Quit:         true,
+	Reset:        true,
+}
+
+func handleSubscribe(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	for _, channel := range userCommand.Args[1:] {
+		if _, ok := h.channels[channel]; !ok {
+			h.channels[channel] = struct{}{}
+			clientPubSub.Subscribe(h.pubsubSubscriber(), channel)
+		}
+		h.WriteResponse(encodeSubscription(Subscribe, channel, h.subscriptions()))
+	}
+	return nil
+}
+
+func handleUnsubscribe(h *Handler, userCommand *Command) error {
+	channels := userCommand.Args[1:]
+	if len(channels) == 0 {
+		channels = sortedKeys(h.channels)
+	}
+	if len(channels) == 0 {
+		h.WriteResponse(encodeNoSubscription(Unsubscribe, h.subscriptions()))
+		return nil
+	}
+
+	for _, channel := range channels {
+		if _, ok := h.channels[channel]; ok {
+			delete(h.channels, channel)
+			clientPubSub.Unsubscribe(h.subscriber, channel)
+		}
+		h.WriteResponse(encodeSubscription(Unsubscribe, channel, h.subscriptions()))
+	}
+	return nil
+}
+
+func handlePsubscribe(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	for _, pattern := range userCommand.Args[1:] {
+		if _, ok := h.patterns[pattern]; !ok {
+			h.patterns[pattern] = struct{}{}
+			clientPubSub.PSubscribe(h.pubsubSubscriber(), pattern)
+		}
+		h.WriteResponse(encodeSubscription(Psubscribe, pattern, h.subscriptions()))
+	}
+	return nil
+}
+
+func handlePunsubscribe(h *Handler, userCommand *Command) error {
+	patterns := userCommand.Args[1:]
+	if len(patterns) == 0 {
+		patterns = sortedKeys(h.patterns)
+	}
+	if len(patterns) == 0 {
+		h.WriteResponse(encodeNoSubscription(Punsubscribe, h.subscriptions()))
+		return nil
+	}
+
+	for _, pattern := range patterns {
+		if _, ok := h.patterns[pattern]; ok {
+			delete(h.patterns, pattern)
+			clientPubSub.PUnsubscribe(h.subscriber, pattern)
+		}
+		h.WriteResponse(encodeSubscription(Punsubscribe, pattern, h.subscriptions()))
+	}
+	return nil
+}
+
+func handlePublish(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) != 3 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	receivers := clientPubSub.Publish(userCommand.Args[1], userCommand.Args[2])
+	h.WriteResponse(encoder.NewInteger(receivers))
+	return nil
+}
+
+func handlePubsub(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	subcommand := strings.ToLower(userCommand.Args[1])
+	switch subcommand {
+	default:
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(subcommand))
+	case Channels:
+		if len(userCommand.Args) > 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		pattern := "*"
+		if len(userCommand.Args) == 3 {
+			pattern = userCommand.Args[2]
+		}
+		h.WriteResponse(encoder.NewArray(clientPubSub.Topics(pattern)))
+	case Numsub:
+		reply := []string{}
+		for _, channel := range userCommand.Args[2:] {
+			reply = append(reply,
+				encoder.NewBulkString(channel),
+				encoder.NewInteger(clientPubSub.NumSub(channel)),
+			)
+		}
+		h.WriteResponse(encoder.NewEncodedArray(reply))
+	case Numpat:
+		h.WriteResponse(encoder.NewInteger(clientPubSub.NumPat()))
+	case Shardchannels:
+		if len(userCommand.Args) > 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		pattern := "*"
+		if len(userCommand.Args) == 3 {
+			pattern = userCommand.Args[2]
+		}
+		h.WriteResponse(encoder.NewArray(shardPubSub.Topics(pattern)))
+	case Shardnumsub:
+		reply := []string{}
+		for _, channel := range userCommand.Args[2:] {
+			reply = append(reply,
+				encoder.NewBulkString(channel),
+				encoder.NewInteger(shardPubSub.NumSub(channel)),
+			)
+		}
+		h.WriteResponse(encoder.NewEncodedArray(reply))
+	}
+	return nil
+}
+
+func handleSsubscribe(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+	if !h.sameSlot(userCommand.Args[1:]) || !h.ownsSlots(userCommand.Args[1:]) {
+		return nil
+	}
+
+	for _, channel := range userCommand.Args[1:] {
+		if _, ok := h.shardChannels[channel]; !ok {
+			h.shardChannels[channel] = struct{}{}
+			shardPubSub.Subscribe(h.pubsubSubscriber(), channel)
+		}
+		h.WriteResponse(encodeSubscription(Ssubscribe, channel, len(h.shardChannels)))
+	}
+	return nil
+}
+
+func handleSunsubscribe(h *Handler, userCommand *Command) error {
+	channels := userCommand.Args[1:]
+	if !h.sameSlot(channels) {
+		return nil
+	}
+	if len(channels) == 0 {
+		channels = sortedKeys(h.shardChannels)
+	}
+	if len(channels) == 0 {
+		h.WriteResponse(encodeNoSubscription(Sunsubscribe, len(h.shardChannels)))
+		return nil
+	}
+
+	for _, channel := range channels {
+		if _, ok := h.shardChannels[channel]; ok {
+			delete(h.shardChannels, channel)
+			shardPubSub.Unsubscribe(h.subscriber, channel)
+		}
+		h.WriteResponse(encodeSubscription(Sunsubscribe, channel, len(h.shardChannels)))
+	}
+	return nil
+}
+
+// handleSpublish delivers the message to the shard channel subscribers of this
+// node only, as shard messages never leave the node serving the channel slot.
+func handleSpublish(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) != 3 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+	if !h.ownsSlots(userCommand.Args[1:2]) {
+		return nil
+	}
+
+	receivers := shardPubSub.Publish(userCommand.Args[1], userCommand.Args[2])
+	h.WriteResponse(encoder.NewInteger(receivers))
+	return nil
+}
+
+func handleQuit(h *Handler, _ *Command) error {
+	h.quit = true
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+func handleReset(h *Handler, _ *Command) error {
+	h.unsubscribeAll()
+	h.discardTransaction()
+	h.watch.Unwatch()
+	h.db = h.dbs[0]
+	h.WriteResponse(encoder.NewString("RESET"))
+	return nil
+}
+
+// subscriptions returns the number of channels and patterns the client listens to
+func (h *Handler) subscriptions() int {
+	return len(h.channels) + len(h.patterns)
+}
+
+// subscribed reports whether the client is in pub/sub mode, where only a few
+// commands are allowed
+func (h *Handler) subscribed() bool {
+	return h.subscriptions() > 0 || len(h.shardChannels) > 0
+}
+
+// ownsSlots checks the shard channels hash to slots served by this node,
+// replying with an error otherwise.
+func (h *Handler) ownsSlots(channels []string) bool {
+	for _, channel := range channels {
+		if !h.cfg.OwnsSlot(util.KeyHashSlot(channel)) {
+			h.WriteResponse("-CLUSTERDOWN Hash slot not served\r\n")
+			return false
+		}
+	}
+	return true
+}
+
+// sameSlot checks the shard channels hash to a single slot, as a cluster node
+// would have to serve them all, replying with an error otherwise.
+func (h *Handler) sameSlot(channels []string) bool {
+	for _, channel := range channels {
+		if util.KeyHashSlot(channel) != util.KeyHashSlot(channels[0]) {
+			h.WriteResponse("-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+			return false
+		}
+	}
+	return true
+}
+
+// evictShardChannels unsubscribes the clients of the shard channels hashing to
+// slots that are no longer served by this node.
+func evictShardChannels(slots []int) {
+	moved := make(map[int]bool)
+	for _, slot := range slots {
+		moved[slot] = true
+	}
+	for _, channel := range shardPubSub.Topics("*") {
+		if moved[util.KeyHashSlot(channel)] {
+			shardPubSub.Evict(channel)
+		}
+	}
+}
+
+// pubsubSubscriber returns the subscriber of the client, creating it on the first
+// subscription along with the goroutine that pushes its messages to the client.
+func (h *Handler) pubsubSubscriber() *util.Subscriber {
+	if h.subscriber == nil {
+		h.subscriber = util.NewLimitedSubscriber(
+			subscriberQueueSize,
+			int64(h.cfg.PubSubBufferLimit()),
+			// a client that does not keep up with its messages is disconnected
+			func() { h.conn.Close() },
+		)
+		go h.deliverMessages(h.subscriber)
+	}
+	return h.subscriber
+}
+
+func (h *Handler) deliverMessages(sub *util.Subscriber) {
+	for {
+		select {
+		case <-h.closed:
+			return
+		case msg := <-sub.C:
+			h.writeMu.Lock()
+			if msg.Kind == util.KindSUnsubscribe {
+				// the slot of the shard channel moved away from this node
+				delete(h.shardChannels, msg.Topic)
+				h.writer.WriteString(encodeSubscription(Sunsubscribe, msg.Topic, len(h.shardChannels)))
+			} else {
+				h.writer.WriteString(encodeMessage(msg))
+			}
+			h.writer.Flush()
+			h.writeMu.Unlock()
+			sub.Done(msg)
+		}
+	}
+}
+
+func (h *Handler) unsubscribeAll() {
+	if h.subscriber == nil {
+		return
+	}
+	clientPubSub.Unsubscribe(h.subscriber, sortedKeys(h.channels)...)
+	clientPubSub.PUnsubscribe(h.subscriber, sortedKeys(h.patterns)...)
+	shardPubSub.Unsubscribe(h.subscriber, sortedKeys(h.shardChannels)...)
+	clear(h.channels)
+	clear(h.patterns)
+	clear(h.shardChannels)
+}
+
+// closePubSub drops the subscriptions of a client that is going away
+func (h *Handler) closePubSub() {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	h.unsubscribeAll()
+}
+
+func encodeMessage(msg util.PubSubMessage) string {
+	if msg.Kind == util.KindPMessage {
+		return encoder.NewArray([]string{msg.Kind, msg.Pattern, msg.Topic, msg.Message})
+	}
+	return encoder.NewArray([]string{msg.Kind, msg.Topic, msg.Message})
+}
+
+func encodeSubscription(kind, channel string, count int) string {
+	return encoder.NewEncodedArray([]string{
+		encoder.NewBulkString(kind),
+		encoder.NewBulkString(channel),
+		encoder.NewInteger(count),
+	})
+}
+
+func encodeNoSubscription(kind string, count int) string {
+	return encoder.NewEncodedArray([]string{
+		encoder.NewBulkString(kind),
+		encoder.Null,
+		encoder.NewInteger(count),
+	})
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,495 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+const (
+	// a replica that failed to connect to its master tries again after a
+	// delay, doubled on every failure up to the maximum
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 10 * time.Second
+)
+
+// replState is the state of a replica's link with its master
+type replState int
+
+const (
+	// replStateConnect is waiting to connect, after a failure or a dropped link
+	replStateConnect replState = iota
+	replStateConnecting
+	// replStateHandshake exchanges PING, REPLCONF and PSYNC with the master
+	replStateHandshake
+	// replStateTransfer receives the snapshot of a full resynchronization
+	replStateTransfer
+	// replStateConnected processes the replication stream
+	replStateConnected
+)
+
+// replLink is the link of a replica with its master, shared by the
+// goroutine keeping it up and INFO
+var replLink = &replicaLink{downSince: time.Now()}
+
+type replicaLink struct {
+	mu     sync.Mutex
+	state  replState
+	lastIO time.Time
+	// downSince is when the link went down, or when the replica started
+	downSince time.Time
+	// running is set while the goroutine keeping the link up runs, handler
+	// being the connection with the master once established
+	running bool
+	handler *Handler
+	// the size of the snapshot being transferred, and the bytes received
+	syncTotal int64
+	syncRead  int64
+}
+
+// StartReplication keeps the replica linked to its master, unless it already is
+func StartReplication(cfg *config.Config, dbs []*store.Store, lock util.Lock) {
+	replLink.mu.Lock()
+	defer replLink.mu.Unlock()
+
+	if !replLink.running {
+		replLink.running = true
+		go runReplication(cfg, dbs, lock)
+	}
+}
+
+// keepRunning tells the goroutine keeping the link up whether to go on,
+// which it doesn't once the server is a master
+func (l *replicaLink) keepRunning(cfg *config.Config) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running = cfg.Role() == config.RoleSlave
+	return l.running
+}
+
+// attach makes h the connection with the master at the address, false when
+// the server isn't its replica anymore
+func (l *replicaLink) attach(cfg *config.Config, h *Handler, master string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.Role() != config.RoleSlave || cfg.ReplicaOf() != master {
+		return false
+	}
+	l.handler = h
+	return true
+}
+
+func (l *replicaLink) detach(h *Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.handler == h {
+		l.handler = nil
+	}
+}
+
+// drop closes the connection with the master, after the server changed its
+// master or became one. The execution lock must be held by the caller.
+func (l *replicaLink) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.handler != nil {
+		l.handler.dropped = true
+		l.handler.conn.Close()
+		l.handler = nil
+	}
+}
+
+func (l *replicaLink) setState(state replState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state != replStateConnected && l.state == replStateConnected {
+		l.downSince = time.Now()
+	}
+	l.state = state
+}
+
+func (l *replicaLink) connected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state == replStateConnected
+}
+
+func (l *replicaLink) touch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastIO = time.Now()
+}
+
+func (l *replicaLink) startTransfer(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.state = replStateTransfer
+	l.syncTotal, l.syncRead = size, 0
+}
+
+// transferWriter counts the bytes of the snapshot received
+type transferWriter struct {
+	w io.Writer
+}
+
+func (t *transferWriter) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	replLink.mu.Lock()
+	replLink.syncRead += int64(n)
+	replLink.mu.Unlock()
+	return n, err
+}
+
+// info returns the fields of INFO replication about the link
+func (l *replicaLink) info(cfg *config.Config) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(cfg.ReplicaOf())
+	status, lastIO, syncing := "down", -1, 0
+	if l.state == replStateConnected {
+		status, lastIO = "up", int(time.Since(l.lastIO).Seconds())
+	}
+	if l.state == replStateTransfer {
+		syncing = 1
+	}
+	info := []string{
+		fmt.Sprintf("master_host:%s", host),
+		fmt.Sprintf("master_port:%s", port),
+		fmt.Sprintf("master_link_status:%s", status),
+		fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+		fmt.Sprintf("master_sync_in_progress:%d", syncing),
+		fmt.Sprintf("slave_read_repl_offset:%d", cfg.ReplOffset()),
+		fmt.Sprintf("slave_repl_offset:%d", cfg.ReplOffset()),
+	}
+	if l.state == replStateTransfer {
+		perc := 0.0
+		if l.syncTotal > 0 {
+			perc = float64(l.syncRead) * 100 / float64(l.syncTotal)
+		}
+		info = append(info,
+			fmt.Sprintf("master_sync_total_bytes:%d", l.syncTotal),
+			fmt.Sprintf("master_sync_read_bytes:%d", l.syncRead),
+			fmt.Sprintf("master_sync_left_bytes:%d", l.syncTotal-l.syncRead),
+			fmt.Sprintf("master_sync_perc:%.2f", perc),
+			fmt.Sprintf("master_sync_last_io_seconds_ago:%d", int(time.Since(l.lastIO).Seconds())),
+		)
+	}
+	if l.state != replStateConnected {
+		info = append(info, fmt.Sprintf("master_link_down_since_seconds:%d", int(time.Since(l.downSince).Seconds())))
+	}
+	readOnly := 0
+	if cfg.ReplicaReadOnly() {
+		readOnly = 1
+	}
+	return append(info,
+		"slave_priority:100",
+		fmt.Sprintf("slave_read_only:%d", readOnly),
+		"replica_announced:1",
+	)
+}
+
+// replicationInfo returns the fields of INFO replication
+func replicationInfo(cfg *config.Config) []string {
+	info := []string{fmt.Sprintf("role:%s", cfg.Role())}
+	if cfg.Role() == config.RoleSlave {
+		info = append(info, replLink.info(cfg)...)
+	}
+	info = append(info, slavesInfo(cfg)...)
+
+	replID2, secondReplOffset := cfg.ReplID2()
+	active, firstByte, histlen := backlog.stats()
+	size, _ := cfg.ReplBacklog()
+	backlogActive := 0
+	if active {
+		backlogActive = 1
+	}
+	return append(info,
+		"master_failover_state:no-failover",
+		fmt.Sprintf("master_replid:%s", cfg.ReplID()),
+		fmt.Sprintf("master_replid2:%s", replID2),
+		fmt.Sprintf("master_repl_offset:%d", cfg.ReplOffset()),
+		fmt.Sprintf("second_repl_offset:%d", secondReplOffset),
+		fmt.Sprintf("repl_backlog_active:%d", backlogActive),
+		fmt.Sprintf("repl_backlog_size:%d", size),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", firstByte),
+		fmt.Sprintf("repl_backlog_histlen:%d", histlen),
+	)
+}
+
+// slavesInfo returns the fields of INFO replication about the replicas,
+// their lag being the seconds since they acknowledged their offset
+func slavesInfo(cfg *config.Config) []string {
+	slaves := cfg.Slaves()
+	info := []string{fmt.Sprintf("connected_slaves:%d", len(slaves))}
+	for i, slave := range slaves {
+		ip, port := slave.Addr()
+		state := "wait_bgsave"
+		if slave.Online() {
+			state = "online"
+		}
+		info = append(info, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, ip, port, state, slave.AckOffset(), int(slave.Lag().Seconds())))
+	}
+	return info
+}
+
+// role returns the state of the link as reported by ROLE, and the offset
+// of the replication stream, -1 until the replica synchronized
+func (l *replicaLink) role(cfg *config.Config) (string, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	offset := -1
+	if _, replOffset, ok := cfg.CachedMaster(); ok {
+		offset = replOffset
+	}
+	switch l.state {
+	case replStateConnecting:
+		return "connecting", offset
+	case replStateHandshake:
+		return "handshake", offset
+	case replStateTransfer:
+		return "sync", offset
+	case replStateConnected:
+		return "connected", offset
+	default:
+		return "connect", offset
+	}
+}
+
+// linkConn is the connection with the master, failing a read once nothing
+// was received for repl-timeout, and recording when something was. Once
+// synchronized, it keeps the replication stream read, until the commands it
+// holds are processed and passed to the replicas of the replica.
+type linkConn struct {
+	net.Conn
+	cfg       *config.Config
+	recording bool
+	stream    bytes.Buffer
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.cfg.ReplTimeout()))
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		replLink.touch()
+		if c.recording {
+			c.stream.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// record starts keeping the replication stream, from what the reader
+// already buffered
+func (c *linkConn) record(r *bufio.Reader) {
+	buffered, _ := r.Peek(r.Buffered())
+	c.stream.Write(buffered)
+	c.recording = true
+}
+
+// consume returns the next size bytes of the replication stream, the ones
+// of the command processed
+func (c *linkConn) consume(size int) string {
+	return string(c.stream.Next(size))
+}
+
+/*
+runReplication keeps a replica linked to its master, going through the
+states of the link:
+
+	connect -> connecting -> handshake -> [transfer] -> connected
+
+The snapshot is only transferred on a full resynchronization. When the link
+fails or drops, the replica connects again after a delay growing with each
+failure, asking to continue from where it stopped.
+*/
+func runReplication(cfg *config.Config, dbs []*store.Store, lock util.Lock) {
+	delay := reconnectMinDelay
+	for replLink.keepRunning(cfg) {
+		err := replicate(cfg, dbs, lock)
+		if err == nil {
+			// the link was up, it is connected again right away
+			delay = reconnectMinDelay
+		} else {
+			log.Printf("replication with the master %s failed: %s, retrying in %s\n", cfg.ReplicaOf(), err.Error(), delay)
+		}
+		time.Sleep(delay)
+		if err != nil {
+			delay = min(delay*2, reconnectMaxDelay)
+		}
+	}
+}
+
+// replicate connects to the master and processes its replication stream
+// until the link drops, returning an error when it couldn't synchronize
+func replicate(cfg *config.Config, dbs []*store.Store, lock util.Lock) error {
+	defer replLink.setState(replStateConnect)
+
+	replLink.setState(replStateConnecting)
+	master := cfg.ReplicaOf()
+	conn, err := net.DialTimeout("tcp", master, cfg.ReplTimeout())
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	h := NewHandler(dbs, &linkConn{Conn: conn, cfg: cfg}, cfg, lock)
+	if !replLink.attach(cfg, h, master) {
+		conn.Close()
+		return nil
+	}
+	defer replLink.detach(h)
+	replLink.setState(replStateHandshake)
+	if err := h.Handshake(); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to handshake: %w", err)
+	}
+
+	replLink.setState(replStateConnected)
+	log.Printf("connected to the master %s\n", master)
+	go h.sendAcks()
+	if err := h.HandleClientConnection(); err != nil {
+		log.Printf("lost the connection with the master: %s\n", err.Error())
+	}
+	return nil
+}
+
+// sendAcks reports the offset of a replica to its master every second,
+// until the link is closed
+func (h *Handler) sendAcks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		h.writeMu.Lock()
+		h.writer.WriteString(encoder.NewArray([]string{
+			strings.ToUpper(Replconf), strings.ToUpper(Ack), strconv.Itoa(h.cfg.ReplOffset()),
+		}))
+		err := h.writer.Flush()
+		h.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-h.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// disconnectSlaves closes the connections with the replicas, which
+// synchronize again once they reconnect
+func disconnectSlaves(cfg *config.Config) {
+	for _, slave := range cfg.Slaves() {
+		slave.Disconnect()
+	}
+}
+
+// pingSlaves keeps the replication links up while there are no writes,
+// through the replication stream so the pings count in the offsets
+func pingSlaves(cfg *config.Config) {
+	if len(cfg.Slaves()) == 0 {
+		return
+	}
+	sendToSlaves(cfg, encoder.NewArray([]string{"PING"}))
+}
+
+/*
+handleReplicaof changes the master of the server:
+
+	REPLICAOF host port
+	REPLICAOF NO ONE
+
+The server becomes a replica of the master at host:port, its dataset being
+replaced by the one of the master. NO ONE makes a replica a master, keeping
+its dataset, under a new replication ID. The former one is kept so the other
+replicas of its former master can continue from it.
+*/
+func handleReplicaof(h *Handler, userCommand *Command) error {
+	host, port := userCommand.Args[1], userCommand.Args[2]
+	if strings.ToLower(host) == No && strings.ToLower(port) == One {
+		if h.cfg.Role() == config.RoleSlave {
+			h.cfg.PromoteToMaster()
+			// the replicas continue under the new replication ID once they
+			// reconnect
+			disconnectSlaves(h.cfg)
+			replLink.drop()
+			// the stream of the replicas starts with the selection of a database
+			propagatedDB = -1
+			backlog.create(h.cfg, h.cfg.ReplOffset())
+			log.Printf("MASTER MODE enabled, replication id %s\n", h.cfg.ReplID())
+		}
+		h.WriteResponse(encoder.Ok)
+		return nil
+	}
+
+	if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		h.WriteResponse(encoder.NewError("Invalid master port"))
+		return nil
+	}
+	master := net.JoinHostPort(host, port)
+	if h.cfg.Role() == config.RoleSlave && h.cfg.ReplicaOf() == master {
+		h.WriteResponse(encoder.NewString("OK Already connected to specified master"))
+		return nil
+	}
+
+	// the replicas resynchronize once they reconnect
+	disconnectSlaves(h.cfg)
+	h.cfg.SetReplicaOf(master)
+	replLink.drop()
+	StartReplication(h.cfg, h.dbs, h.execLock)
+	log.Printf("REPLICAOF %s enabled\n", master)
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
+
+// handleRole describes the replication role of the server: a master with its
+// offset and replicas, or a replica with its master and the state of the link
+func handleRole(h *Handler, _ *Command) error {
+	if h.cfg.Role() == config.RoleMaster {
+		slaves := []string{}
+		for _, slave := range h.cfg.Slaves() {
+			ip, port := slave.Addr()
+			slaves = append(slaves, encoder.NewArray([]string{ip, strconv.Itoa(port), strconv.Itoa(slave.AckOffset())}))
+		}
+		h.WriteResponse(encoder.NewEncodedArray([]string{
+			encoder.NewBulkString(config.RoleMaster),
+			encoder.NewInteger(h.cfg.ReplOffset()),
+			encoder.NewEncodedArray(slaves),
+		}))
+		return nil
+	}
+
+	host, port, _ := net.SplitHostPort(h.cfg.ReplicaOf())
+	portNumber, _ := strconv.Atoi(port)
+	state, offset := replLink.role(h.cfg)
+	h.WriteResponse(encoder.NewEncodedArray([]string{
+		encoder.NewBulkString(config.RoleSlave),
+		encoder.NewBulkString(host),
+		encoder.NewInteger(portNumber),
+		encoder.NewBulkString(state),
+		encoder.NewInteger(offset),
+	}))
+	return nil
+}
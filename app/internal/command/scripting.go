@@ -0,0 +1,595 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/lua"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+)
+
+const busyError = "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"
+
+var errScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL...")
+
+// scripting is the engine running EVAL scripts, shared by every client. It
+// also keeps track of the functions being run by FCALL.
+var scripting = newScriptEngine()
+
+// scriptRun is a script or a function being run, which SCRIPT KILL or
+// FUNCTION KILL may stop
+type scriptRun struct {
+	// function is the name of the function run by FCALL, empty for EVAL scripts
+	function string
+	command  []string
+	// readOnly scripts can't run write commands
+	readOnly bool
+	started  time.Time
+
+	killed atomic.Bool
+	// a script that already wrote to the dataset can't be killed, as that
+	// would leave its writes half done
+	wrote atomic.Bool
+	busy  bool
+	timer *time.Timer
+}
+
+// scriptEngine keeps the lua state and the scripts loaded into it. Both are
+// only used while holding the execution lock, while running and busy are
+// guarded by mu as SCRIPT KILL and the clients waiting for the lock read them.
+type scriptEngine struct {
+	state   *lua.State
+	scripts map[string]*lua.Function
+	// caller is the handler the running script sends its commands through
+	caller *Handler
+
+	mu      sync.Mutex
+	running *scriptRun
+	// busy is closed when the running script goes past the busy threshold
+	busy chan struct{}
+}
+
+func newScriptEngine() *scriptEngine {
+	e := &scriptEngine{
+		scripts: make(map[string]*lua.Function),
+		busy:    make(chan struct{}),
+	}
+	e.reset()
+	return e
+}
+
+// reset creates a new lua state, forgetting every script loaded
+func (e *scriptEngine) reset() {
+	e.state = lua.NewState()
+	e.state.Globals.Set("redis", e.redisLib())
+	e.state.Globals.Set("KEYS", lua.NewTable())
+	e.state.Globals.Set("ARGV", lua.NewTable())
+	e.state.ProtectGlobals()
+	clear(e.scripts)
+}
+
+func (e *scriptEngine) redisLib() *lua.Table {
+	lib := lua.NewTable()
+	lib.Set("call", lua.NewFunction("call", e.redisCall(true)))
+	lib.Set("pcall", lua.NewFunction("pcall", e.redisCall(false)))
+	lib.Set("error_reply", lua.NewFunction("error_reply", func(s *lua.State, args []lua.Value) []lua.Value {
+		msg, ok := firstArg(args).(string)
+		if !ok {
+			s.Errorf("wrong number or type of arguments")
+		}
+		return []lua.Value{replyTable("err", msg)}
+	}))
+	lib.Set("status_reply", lua.NewFunction("status_reply", func(s *lua.State, args []lua.Value) []lua.Value {
+		msg, ok := firstArg(args).(string)
+		if !ok {
+			s.Errorf("wrong number or type of arguments")
+		}
+		return []lua.Value{replyTable("ok", msg)}
+	}))
+	lib.Set("sha1hex", lua.NewFunction("sha1hex", func(s *lua.State, args []lua.Value) []lua.Value {
+		if len(args) != 1 {
+			s.Errorf("wrong number of arguments")
+		}
+		return []lua.Value{sha1hex(lua.ToString(args[0]))}
+	}))
+	// scripts always replicate their effects, so there is nothing to turn on
+	lib.Set("replicate_commands", lua.NewFunction("replicate_commands", func(s *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{true}
+	}))
+
+	levels := []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"}
+	for i, level := range levels {
+		lib.Set(level, float64(i))
+	}
+	lib.Set("log", lua.NewFunction("log", func(s *lua.State, args []lua.Value) []lua.Value {
+		if len(args) < 2 {
+			s.Errorf("redis.log() requires two arguments or more.")
+		}
+		level, ok := args[0].(float64)
+		if !ok || level < 0 || int(level) >= len(levels) {
+			s.Errorf("Invalid debug level.")
+		}
+		parts := []string{}
+		for _, arg := range args[1:] {
+			parts = append(parts, lua.ToString(arg))
+		}
+		log.Println(strings.Join(parts, " "))
+		return nil
+	}))
+	return lib
+}
+
+// redisCall returns redis.call, which raises the errors replied by the
+// commands, or redis.pcall when raise is false, which returns them.
+func (e *scriptEngine) redisCall(raise bool) lua.GoFunction {
+	return func(s *lua.State, args []lua.Value) []lua.Value {
+		if e.caller == nil {
+			s.Errorf("redis.call can only be called while running a script")
+		}
+		if len(args) == 0 {
+			s.Errorf("Please specify at least one argument for this redis lib call")
+		}
+		commandArgs := make([]string, len(args))
+		for i, arg := range args {
+			switch v := arg.(type) {
+			case string:
+				commandArgs[i] = v
+			case float64:
+				commandArgs[i] = formatScriptNumber(v)
+			default:
+				s.Errorf("Lua redis lib command arguments must be strings or integers")
+			}
+		}
+
+		reply := e.caller.scriptCommand(commandArgs)
+		if t, ok := reply.(*lua.Table); ok && raise && t.Get("err") != nil {
+			s.RaiseError(t)
+		}
+		return []lua.Value{reply}
+	}
+}
+
+// start marks the script as running, and as busy once it runs longer than threshold
+func (e *scriptEngine) start(run *scriptRun, threshold time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	run.started = time.Now()
+	e.running = run
+	run.timer = time.AfterFunc(threshold, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.running == run && !run.busy {
+			run.busy = true
+			close(e.busy)
+		}
+	})
+}
+
+func (e *scriptEngine) finish(run *scriptRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	run.timer.Stop()
+	if run.busy {
+		e.busy = make(chan struct{})
+	}
+	e.running = nil
+}
+
+// busySignal returns a channel closed when a script keeps the server busy
+func (e *scriptEngine) busySignal() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.busy
+}
+
+// runningScript returns the script being run, nil when there is none
+func (e *scriptEngine) runningScript() *scriptRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.running
+}
+
+// kill stops the running script, a function when called by FUNCTION KILL
+func (e *scriptEngine) kill(function bool) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running == nil || (e.running.function != "") != function {
+		return "-NOTBUSY No scripts in execution right now.\r\n"
+	}
+	if e.running.wrote.Load() {
+		return "-UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n"
+	}
+	e.running.killed.Store(true)
+	return encoder.Ok
+}
+
+// load compiles the script, keeping it by its SHA1 digest
+func (e *scriptEngine) load(body string) (string, error) {
+	sha := sha1hex(body)
+	if _, ok := e.scripts[sha]; ok {
+		return sha, nil
+	}
+	fn, err := e.state.Load("user_script", body)
+	if err != nil {
+		return "", fmt.Errorf("Error compiling script (new function): %s", err.Error())
+	}
+	e.scripts[sha] = fn
+	return sha, nil
+}
+
+func handleEval(h *Handler, userCommand *Command) error {
+	sha, err := scripting.load(userCommand.Args[1])
+	if err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+	return evalScript(h, sha, userCommand.Args[2:])
+}
+
+func handleEvalsha(h *Handler, userCommand *Command) error {
+	sha := strings.ToLower(userCommand.Args[1])
+	if _, ok := scripting.scripts[sha]; !ok {
+		h.WriteResponse("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+		return nil
+	}
+	return evalScript(h, sha, userCommand.Args[2:])
+}
+
+func handleScript(h *Handler, userCommand *Command) error {
+	subcommand := strings.ToLower(userCommand.Args[1])
+	switch subcommand {
+	default:
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(subcommand))
+	case Load:
+		if len(userCommand.Args) != 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		sha, err := scripting.load(userCommand.Args[2])
+		if err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
+		}
+		h.WriteResponse(encoder.NewBulkString(sha))
+	case Exists:
+		if len(userCommand.Args) < 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		reply := []string{}
+		for _, sha := range userCommand.Args[2:] {
+			exists := 0
+			if _, ok := scripting.scripts[strings.ToLower(sha)]; ok {
+				exists = 1
+			}
+			reply = append(reply, encoder.NewInteger(exists))
+		}
+		h.WriteResponse(encoder.NewEncodedArray(reply))
+	case Flush:
+		// ASYNC and SYNC are accepted, the flush is always synchronous
+		if len(userCommand.Args) > 3 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		scripting.reset()
+		h.WriteResponse(encoder.Ok)
+	case Kill:
+		// SCRIPT KILL runs without the execution lock, held by the script
+		h.WriteResponse(scripting.kill(false))
+	}
+	return nil
+}
+
+// allowedWhileBusy reports whether the command is SCRIPT KILL, FUNCTION KILL
+// or FUNCTION STATS, the only ones served while a script is running, or
+// REPLCONF, so the replicas keep acknowledging their offset without getting
+// an error in their replication stream
+func allowedWhileBusy(userCommand *Command) bool {
+	if len(userCommand.Args) == 0 {
+		return false
+	}
+	instruction := strings.ToLower(userCommand.Args[0])
+	if instruction == Replconf {
+		return true
+	}
+	if len(userCommand.Args) != 2 {
+		return false
+	}
+	subcommand := strings.ToLower(userCommand.Args[1])
+	return instruction == Script && subcommand == Kill ||
+		instruction == Function && (subcommand == Kill || subcommand == Stats)
+}
+
+// evalScript runs a script loaded by EVAL, which finds its keys and
+// arguments in the KEYS and ARGV globals
+func evalScript(h *Handler, sha string, args []string) error {
+	keys, argv, ok := scriptArgs(h, args)
+	if !ok {
+		return nil
+	}
+	e := scripting
+	e.state.Globals.Set("KEYS", keys)
+	e.state.Globals.Set("ARGV", argv)
+	return runScript(h, e.state, &scriptRun{}, e.scripts[sha], sha)
+}
+
+// scriptArgs splits `numkeys key [key ...] arg [arg ...]` into the keys and
+// the arguments of a script, replying with an error when they are invalid
+func scriptArgs(h *Handler, args []string) (*lua.Table, *lua.Table, bool) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		h.WriteResponse(encoder.NewError("value is not an integer or out of range"))
+		return nil, nil, false
+	}
+	if numKeys < 0 {
+		h.WriteResponse(encoder.NewError("Number of keys can't be negative"))
+		return nil, nil, false
+	}
+	if numKeys > len(args)-1 {
+		h.WriteResponse(encoder.NewError("Number of keys can't be greater than number of args"))
+		return nil, nil, false
+	}
+
+	keys := make([]lua.Value, numKeys)
+	for i, key := range args[1 : numKeys+1] {
+		keys[i] = key
+	}
+	argv := make([]lua.Value, len(args)-1-numKeys)
+	for i, arg := range args[numKeys+1:] {
+		argv[i] = arg
+	}
+	return lua.NewArray(keys), lua.NewArray(argv), true
+}
+
+// runScript calls fn in the lua state, replying with what it returns. The
+// writes of the script reach the replicas as the commands it ran, in a
+// MULTI/EXEC block. name identifies the script in the errors it raises.
+func runScript(h *Handler, state *lua.State, run *scriptRun, fn *lua.Function, name string, args ...lua.Value) error {
+	e := scripting
+	caller := h.scriptHandler()
+	e.caller = caller
+	e.start(run, h.cfg.BusyReplyThreshold())
+	caller.script = run
+	state.Interrupt = func() error {
+		if run.killed.Load() {
+			return errScriptKilled
+		}
+		return nil
+	}
+
+	results, err := callScript(state, fn, args)
+	state.Interrupt = nil
+	e.finish(run)
+	e.caller = nil
+	h.propagateTransaction(caller.execPropagation)
+
+	if err != nil {
+		var luaErr *lua.Error
+		if errors.As(err, &luaErr) && luaErr.Fatal {
+			h.WriteResponse("-" + err.Error() + "\r\n")
+			return nil
+		}
+		h.WriteResponse(encodeScriptError(err, name))
+		return nil
+	}
+
+	var result lua.Value
+	if len(results) > 0 {
+		result = results[0]
+	}
+	h.WriteResponse(encodeScriptValue(result))
+	return nil
+}
+
+// callScript calls fn, turning a panic of the interpreter or of a command run
+// by the script into an error, so a bug fails the script and not the server
+func callScript(state *lua.State, fn *lua.Function, args []lua.Value) (results []lua.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic running a script: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("internal error running the script: %v", r)
+		}
+	}()
+
+	return state.Call(fn, args...)
+}
+
+// scriptHandler creates the handler a script runs its commands through,
+// writing their replies to a buffer the script reads them from
+func (h *Handler) scriptHandler() *Handler {
+	replies := &bytes.Buffer{}
+	return &Handler{
+		dbs:           h.dbs,
+		db:            h.db,
+		cfg:           h.cfg,
+		execLock:      h.execLock,
+		reader:        bufio.NewReader(replies),
+		writer:        bufio.NewWriter(replies),
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+		closed:        h.closed,
+		watch:         store.NewWatch(),
+		// scripts never block, and their writes are propagated all together
+		inExec: true,
+	}
+}
+
+// scriptCommand runs a command called from a script, returning its reply
+// as a lua value
+func (h *Handler) scriptCommand(args []string) lua.Value {
+	spec, exist := commandTable[strings.ToLower(args[0])]
+	switch {
+	case !exist:
+		return replyTable("err", "ERR Unknown Redis command called from script")
+	case spec.arity > 0 && len(args) != spec.arity || spec.arity < 0 && len(args) < -spec.arity:
+		return replyTable("err", "ERR Wrong number of args calling Redis command from script")
+	case spec.flags&flagNoScript != 0:
+		return replyTable("err", "ERR This Redis command is not allowed from script")
+	}
+	if spec.flags&flagWrite != 0 {
+		if h.script.readOnly {
+			return replyTable("err", "ERR Write commands are not allowed from read-only scripts.")
+		}
+		h.script.wrote.Store(true)
+	}
+
+	if err := h.dispatch(&Command{Args: args}); err != nil {
+		return replyTable("err", "ERR "+err.Error())
+	}
+	h.writer.Flush()
+	reply, err := readScriptReply(h.reader)
+	if err != nil {
+		return replyTable("err", "ERR "+err.Error())
+	}
+	return reply
+}
+
+// readScriptReply converts a RESP reply into a lua value, the way redis does:
+// status and error replies become tables with an ok or err field, and nulls
+// become false.
+func readScriptReply(reader *bufio.Reader) (lua.Value, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return replyTable("ok", line[1:]), nil
+	case '-':
+		return replyTable("err", line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return float64(n), nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return false, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return false, nil
+		}
+		t := lua.NewTable()
+		for i := 1; i <= size; i++ {
+			v, err := readScriptReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			t.Set(float64(i), v)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// encodeScriptValue converts the value returned by a script into a reply
+func encodeScriptValue(v lua.Value) string {
+	switch x := v.(type) {
+	case string:
+		return encoder.NewBulkString(x)
+	case float64:
+		return encoder.NewInteger(int(x))
+	case bool:
+		if x {
+			return encoder.NewInteger(1)
+		}
+		return encoder.Null
+	case *lua.Table:
+		if msg, ok := x.Get("err").(string); ok {
+			return "-" + msg + "\r\n"
+		}
+		if msg, ok := x.Get("ok").(string); ok {
+			return encoder.NewString(msg)
+		}
+		// only the values before the first nil make it into the array
+		items := []string{}
+		for i := 1; ; i++ {
+			item := x.GetInt(i)
+			if item == nil {
+				break
+			}
+			items = append(items, encodeScriptValue(item))
+		}
+		return encoder.NewEncodedArray(items)
+	}
+	return encoder.Null
+}
+
+func encodeScriptError(err error, sha string) string {
+	var luaErr *lua.Error
+	if errors.As(err, &luaErr) {
+		// errors replied by redis.call keep their own error code
+		if t, ok := luaErr.Value.(*lua.Table); ok {
+			if msg, ok := t.Get("err").(string); ok {
+				return "-" + msg + "\r\n"
+			}
+		}
+	}
+	return encoder.NewError(fmt.Sprintf("%s script: %s", err.Error(), sha))
+}
+
+func replyTable(field, msg string) *lua.Table {
+	t := lua.NewTable()
+	t.Set(field, msg)
+	return t
+}
+
+func firstArg(args []lua.Value) lua.Value {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[0]
+}
+
+// formatScriptNumber turns the numbers scripts pass to commands into their
+// arguments, integers without any decimals
+func formatScriptNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e17 {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', 17, 64)
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package command
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/lua"
+)
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   any
+	}{
+		{
+			name:   "redis.call raises the error of the command",
+			script: "redis.call('XADD', KEYS[1], '0-0', 'f', 'v') return 'not reached'",
+			want:   "-ERR The ID specified in XADD must be greater than 0-0",
+		},
+		{
+			name:   "redis.pcall returns the error",
+			script: "local reply = redis.pcall('SELECT', '99') return reply.err",
+			want:   "ERR DB index is out of range",
+		},
+		{
+			name:   "pcall catches the error of redis.call",
+			script: "local ok, err = pcall(redis.call, 'XADD', KEYS[1], '0-0', 'f', 'v') if not ok then return err.err end",
+			want:   "ERR The ID specified in XADD must be greater than 0-0",
+		},
+		{
+			name:   "unknown command",
+			script: "return redis.call('NOSUCHCOMMAND')",
+			want:   "-ERR Unknown Redis command called from script",
+		},
+		{
+			name:   "wrong number of arguments",
+			script: "return redis.call('GET')",
+			want:   "-ERR Wrong number of args calling Redis command from script",
+		},
+		{
+			name:   "error reply",
+			script: "return redis.error_reply('MY custom error')",
+			want:   "-MY custom error",
+		},
+		{
+			name:   "status reply",
+			script: "return redis.status_reply('DONE')",
+			want:   "+DONE",
+		},
+		{
+			name:   "replies of commands",
+			script: "return {redis.call('GET', KEYS[1]), redis.call('GET', 'missing')}",
+			want:   []any{"text", nil},
+		},
+	}
+
+	server := newTestServer()
+	setup := server.connect(t)
+	if got := setup.do("SET", "key", "text"); got != "+OK" {
+		t.Fatalf("SET = %v, want +OK", got)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := server.connect(t)
+			got := client.do("EVAL", tt.script, "1", "key")
+			if want, ok := tt.want.([]any); ok {
+				if reply, ok := got.([]any); !ok || len(reply) != len(want) || reply[0] != want[0] || reply[1] != want[1] {
+					t.Errorf("EVAL = %v, want %v", got, want)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("EVAL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalRuntimeError(t *testing.T) {
+	server := newTestServer()
+	client := server.connect(t)
+
+	script := "local t = nil return t.x"
+	got, _ := client.do("EVAL", script, "0").(string)
+	want := "-ERR user_script:1: attempt to index local 't' (a nil value) script: " + sha1hex(script)
+	if got != want {
+		t.Errorf("EVAL = %v, want %v", got, want)
+	}
+	if got := client.do("EVAL", "return 1", "0"); got != ":1" {
+		t.Errorf("EVAL after an error = %v, want :1", got)
+	}
+}
+
+// waitForScript waits until a script sent by another client runs
+func waitForScript(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for scripting.runningScript() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the script didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	server := newTestServer()
+	admin := server.connect(t)
+	if got := admin.do("CONFIG", "SET", "busy-reply-threshold", "50"); got != "+OK" {
+		t.Fatalf("CONFIG SET = %v, want +OK", got)
+	}
+	if got := admin.do("SCRIPT", "KILL"); got != "-NOTBUSY No scripts in execution right now." {
+		t.Errorf("SCRIPT KILL with no script = %v, want NOTBUSY", got)
+	}
+
+	runner := server.connect(t)
+	runner.send("EVAL", "while true do end", "0")
+	waitForScript(t)
+
+	// other clients wait for the script until it goes past the threshold,
+	// then get BUSY
+	other := server.connect(t)
+	start := time.Now()
+	got, _ := other.do("GET", "key").(string)
+	if !strings.HasPrefix(got, "-BUSY ") {
+		t.Fatalf("GET while a script runs = %v, want BUSY", got)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("BUSY replied after %s, before the threshold", elapsed)
+	}
+	if got := admin.do("FUNCTION", "KILL"); got != "-NOTBUSY No scripts in execution right now." {
+		t.Errorf("FUNCTION KILL of a script = %v, want NOTBUSY", got)
+	}
+
+	if got := admin.do("SCRIPT", "KILL"); got != "+OK" {
+		t.Fatalf("SCRIPT KILL = %v, want +OK", got)
+	}
+	if got := runner.read(); got != "-ERR Script killed by user with SCRIPT KILL..." {
+		t.Errorf("EVAL = %v, want the script to be killed", got)
+	}
+	if got := other.do("PING"); got != "+PONG" {
+		t.Errorf("PING after the kill = %v, want +PONG", got)
+	}
+}
+
+func TestScriptKillAfterWrite(t *testing.T) {
+	server := newTestServer()
+	admin := server.connect(t)
+	if got := admin.do("CONFIG", "SET", "busy-reply-threshold", "50"); got != "+OK" {
+		t.Fatalf("CONFIG SET = %v, want +OK", got)
+	}
+
+	// the script writes, then loops long enough to go past the threshold
+	runner := server.connect(t)
+	runner.send("EVAL", "redis.call('SET', KEYS[1], 'v') local n = 0 while n < 5e6 do n = n + 1 end return n", "1", "key")
+	waitForScript(t)
+
+	other := server.connect(t)
+	if got, _ := other.do("PING").(string); !strings.HasPrefix(got, "-BUSY ") {
+		t.Fatalf("PING while a script runs = %v, want BUSY", got)
+	}
+	got, _ := admin.do("SCRIPT", "KILL").(string)
+	if !strings.HasPrefix(got, "-UNKILLABLE ") {
+		t.Errorf("SCRIPT KILL after a write = %v, want UNKILLABLE", got)
+	}
+	if got := runner.read(); got != ":5000000" {
+		t.Errorf("EVAL = %v, want the script to finish", got)
+	}
+	if got := other.do("GET", "key"); got != "v" {
+		t.Errorf("GET = %v, want v", got)
+	}
+}
+
+func TestCallScriptRecoversPanics(t *testing.T) {
+	state := lua.NewState()
+	fn := lua.NewFunction("broken", func(s *lua.State, args []lua.Value) []lua.Value {
+		var t *lua.Table
+		return []lua.Value{t.Len()}
+	})
+
+	_, err := callScript(state, fn, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "internal error running the script: ") {
+		t.Errorf("callScript: err = %v, want an internal error", err)
+	}
+
+	// the state still runs scripts
+	ok, err := state.Load("test", "return 1 + 1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if results, err := callScript(state, ok, nil); err != nil || len(results) != 1 || results[0] != 2.0 {
+		t.Errorf("callScript = %v, %v, want [2]", results, err)
+	}
+}
@@ -2,9 +2,9 @@ package command
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
 )
@@ -36,19 +36,30 @@ func handleXadd(h *Handler, userCommand *Command) error {
 		}
 	// user command specifies entry id
 	default:
-		sequence, err := strconv.Atoi(splitUserCommandEntryId[1])
+		entryId, err = store.ToEntryId(userCommand.Args[2], 0)
 		if err != nil {
-			return err
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
 		}
-		entryId = store.NewEntryId(splitUserCommandEntryId[0], sequence)
 		if err := h.db.StreamType.ValidateEntryId(streamId, entryId); err != nil {
 			h.WriteResponse(encoder.NewError(err.Error()))
 			return nil
 		}
 	}
 
+	isNew := h.db.StreamType.ExistsStream(string(streamId)) != nil
+
 	h.db.StreamType.Set(streamId, entryId, entries)
-	ps.Publish("xadd", string(streamId))
+	// the entry is propagated with its id, which may have been generated
+	args := append([]string{}, userCommand.Args...)
+	args[2] = entryId.String()
+	h.rewriteCommand(args)
+	persistence.changed()
+	ps.Publish(string(streamId), entryId.String())
+	if isNew {
+		h.notify(config.NotifyNew, "new", string(streamId))
+	}
+	h.notify(config.NotifyStream, "xadd", string(streamId))
 
 	h.WriteResponse(encoder.NewString(entryId.String()))
 
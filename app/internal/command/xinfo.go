@@ -0,0 +1,277 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+)
+
+// Number of entries listed by XINFO STREAM FULL when COUNT is not given
+const defaultXinfoFullCount = 10
+
+func handleXinfo(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 3 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	subcommand := strings.ToLower(userCommand.Args[1])
+	streamId := store.StreamId(userCommand.Args[2])
+
+	switch subcommand {
+	default:
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(subcommand))
+	case Stream:
+		return xinfoStream(h, streamId, userCommand.Args[3:])
+	case Groups:
+		return xinfoGroups(h, streamId)
+	case Consumers:
+		if len(userCommand.Args) != 4 {
+			return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+		}
+		return xinfoConsumers(h, streamId, userCommand.Args[3])
+	}
+}
+
+func xinfoStream(h *Handler, streamId store.StreamId, args []string) error {
+	full := false
+	count := defaultXinfoFullCount
+
+	if len(args) > 0 {
+		if strings.ToLower(args[0]) != Full {
+			return fmt.Errorf("invalid command arguments for XINFO STREAM")
+		}
+		full = true
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		if len(args) != 2 || strings.ToLower(args[0]) != Count {
+			return fmt.Errorf("invalid command arguments for XINFO STREAM")
+		}
+		var err error
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return fmt.Errorf("the COUNT of XINFO STREAM should be a positive integer number")
+		}
+	}
+
+	info, err := h.db.StreamType.Info(streamId)
+	if err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+
+	lastEntryId := h.db.StreamType.FindLastEntryId(streamId)
+	entries := h.db.StreamType.FindStarEnd(streamId, store.EntryId{}, lastEntryId)
+
+	// the entries aren't kept in a radix tree, so radix-tree-keys and
+	// radix-tree-nodes are left out
+	reply := []string{
+		encoder.NewBulkString("length"),
+		encoder.NewInteger(info.Length),
+		encoder.NewBulkString("last-generated-id"),
+		encoder.NewBulkString(info.LastGeneratedId.String()),
+		encoder.NewBulkString("max-deleted-entry-id"),
+		encoder.NewBulkString(info.MaxDeletedId.String()),
+		encoder.NewBulkString("entries-added"),
+		encoder.NewInteger(info.EntriesAdded),
+		encoder.NewBulkString("recorded-first-entry-id"),
+		encoder.NewBulkString(info.FirstEntryId.String()),
+	}
+
+	if !full {
+		firstEntry, lastEntry := encoder.Null, encoder.Null
+		if len(entries) > 0 {
+			firstEntry = encodeStreamEntry(entries[0])
+			lastEntry = encodeStreamEntry(entries[len(entries)-1])
+		}
+		reply = append(reply,
+			encoder.NewBulkString("groups"),
+			encoder.NewInteger(len(info.Groups)),
+			encoder.NewBulkString("first-entry"),
+			firstEntry,
+			encoder.NewBulkString("last-entry"),
+			lastEntry,
+		)
+		h.WriteResponse(encoder.NewEncodedArray(reply))
+		return nil
+	}
+
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	encodedEntries := []string{}
+	for _, entry := range entries {
+		encodedEntries = append(encodedEntries, encodeStreamEntry(entry))
+	}
+
+	groups := []string{}
+	for _, group := range info.Groups {
+		groups = append(groups, encodeFullGroup(info, group, count))
+	}
+
+	reply = append(reply,
+		encoder.NewBulkString("entries"),
+		encoder.NewEncodedArray(encodedEntries),
+		encoder.NewBulkString("groups"),
+		encoder.NewEncodedArray(groups),
+	)
+	h.WriteResponse(encoder.NewEncodedArray(reply))
+	return nil
+}
+
+func xinfoGroups(h *Handler, streamId store.StreamId) error {
+	info, err := h.db.StreamType.Info(streamId)
+	if err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+
+	groups := []string{}
+	for _, group := range info.Groups {
+		groups = append(groups, encoder.NewEncodedArray([]string{
+			encoder.NewBulkString("name"),
+			encoder.NewBulkString(group.Name),
+			encoder.NewBulkString("consumers"),
+			encoder.NewInteger(len(group.Consumers)),
+			encoder.NewBulkString("pending"),
+			encoder.NewInteger(len(group.Pending)),
+			encoder.NewBulkString("last-delivered-id"),
+			encoder.NewBulkString(group.LastDeliveredId.String()),
+			encoder.NewBulkString("entries-read"),
+			encodeEntriesRead(group),
+			encoder.NewBulkString("lag"),
+			encodeLag(info, group),
+		}))
+	}
+
+	h.WriteResponse(encoder.NewEncodedArray(groups))
+	return nil
+}
+
+func xinfoConsumers(h *Handler, streamId store.StreamId, groupName string) error {
+	group, err := h.db.StreamType.FindGroup(streamId, groupName)
+	if err != nil {
+		h.WriteResponse(fmt.Sprintf("-NOGROUP %s\r\n", err.Error()))
+		return nil
+	}
+
+	now := time.Now()
+	consumers := []string{}
+	for _, consumer := range group.Consumers {
+		consumers = append(consumers, encoder.NewEncodedArray([]string{
+			encoder.NewBulkString("name"),
+			encoder.NewBulkString(consumer.Name),
+			encoder.NewBulkString("pending"),
+			encoder.NewInteger(len(group.PendingOf(consumer.Name))),
+			encoder.NewBulkString("idle"),
+			encoder.NewInteger(int(now.Sub(consumer.SeenTime).Milliseconds())),
+			encoder.NewBulkString("inactive"),
+			encodeInactive(now, consumer),
+		}))
+	}
+
+	h.WriteResponse(encoder.NewEncodedArray(consumers))
+	return nil
+}
+
+func encodeFullGroup(info store.StreamInfo, group *store.ConsumerGroup, count int) string {
+	pending := group.Pending
+	if count > 0 && len(pending) > count {
+		pending = pending[:count]
+	}
+	pel := []string{}
+	for _, p := range pending {
+		pel = append(pel, encoder.NewEncodedArray([]string{
+			encoder.NewBulkString(p.EntryId.String()),
+			encoder.NewBulkString(p.Consumer),
+			encoder.NewInteger(int(p.DeliveryTime.UnixMilli())),
+			encoder.NewInteger(p.DeliveryCount),
+		}))
+	}
+
+	consumers := []string{}
+	for _, consumer := range group.Consumers {
+		consumerPending := group.PendingOf(consumer.Name)
+		consumerPel := []string{}
+		for i, p := range consumerPending {
+			if count > 0 && i == count {
+				break
+			}
+			consumerPel = append(consumerPel, encoder.NewEncodedArray([]string{
+				encoder.NewBulkString(p.EntryId.String()),
+				encoder.NewInteger(int(p.DeliveryTime.UnixMilli())),
+				encoder.NewInteger(p.DeliveryCount),
+			}))
+		}
+		consumers = append(consumers, encoder.NewEncodedArray([]string{
+			encoder.NewBulkString("name"),
+			encoder.NewBulkString(consumer.Name),
+			encoder.NewBulkString("seen-time"),
+			encoder.NewInteger(int(consumer.SeenTime.UnixMilli())),
+			encoder.NewBulkString("active-time"),
+			encodeActiveTime(consumer),
+			encoder.NewBulkString("pel-count"),
+			encoder.NewInteger(len(consumerPending)),
+			encoder.NewBulkString("pending"),
+			encoder.NewEncodedArray(consumerPel),
+		}))
+	}
+
+	return encoder.NewEncodedArray([]string{
+		encoder.NewBulkString("name"),
+		encoder.NewBulkString(group.Name),
+		encoder.NewBulkString("last-delivered-id"),
+		encoder.NewBulkString(group.LastDeliveredId.String()),
+		encoder.NewBulkString("entries-read"),
+		encodeEntriesRead(group),
+		encoder.NewBulkString("lag"),
+		encodeLag(info, group),
+		encoder.NewBulkString("pel-count"),
+		encoder.NewInteger(len(group.Pending)),
+		encoder.NewBulkString("pending"),
+		encoder.NewEncodedArray(pel),
+		encoder.NewBulkString("consumers"),
+		encoder.NewEncodedArray(consumers),
+	})
+}
+
+func encodeStreamEntry(entry store.Entry) string {
+	return encoder.NewListEntry(encoder.ListEntry{
+		EntryId: entry.EntryId.String(),
+		Facts:   store.ListEntriesFacts(entry.Facts),
+	})
+}
+
+func encodeEntriesRead(group *store.ConsumerGroup) string {
+	if group.EntriesRead < 0 {
+		return encoder.Null
+	}
+	return encoder.NewInteger(int(group.EntriesRead))
+}
+
+func encodeLag(info store.StreamInfo, group *store.ConsumerGroup) string {
+	lag, ok := info.Lag(group)
+	if !ok {
+		return encoder.Null
+	}
+	return encoder.NewInteger(lag)
+}
+
+// A consumer that never attempted a read reports -1 as its activity
+func encodeActiveTime(consumer *store.Consumer) string {
+	if consumer.ActiveTime.IsZero() {
+		return encoder.NewInteger(-1)
+	}
+	return encoder.NewInteger(int(consumer.ActiveTime.UnixMilli()))
+}
+
+func encodeInactive(now time.Time, consumer *store.Consumer) string {
+	if consumer.ActiveTime.IsZero() {
+		return encoder.NewInteger(-1)
+	}
+	return encoder.NewInteger(int(now.Sub(consumer.ActiveTime).Milliseconds()))
+}
@@ -2,46 +2,64 @@ package command
 
 import (
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
 )
 
 func handleXrange(h *Handler, userCommand *Command) error {
-
-	var input struct {
-		streamId string
-		start    string
-		end      string
+	if len(userCommand.Args) < 4 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
 	}
 
+	return writeXrangeResponse(h, userCommand, userCommand.Args[2], userCommand.Args[3], false)
+}
+
+func handleXrevrange(h *Handler, userCommand *Command) error {
 	if len(userCommand.Args) < 4 {
 		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
 	}
 
-	input.streamId = userCommand.Args[1]
-	input.start = userCommand.Args[2]
-	input.end = userCommand.Args[3]
-
-	streamId := store.StreamId(input.streamId)
+	// XREVRANGE receives the end of the range before its start
+	return writeXrangeResponse(h, userCommand, userCommand.Args[3], userCommand.Args[2], true)
+}
 
-	if input.start == "-" {
-		input.start = "0"
-	}
+func writeXrangeResponse(h *Handler, userCommand *Command, startArg, endArg string, reverse bool) error {
+	streamId := store.StreamId(userCommand.Args[1])
 
-	if input.end == "+" {
-		input.end = "9999999999999"
+	count, err := parseCountOption(userCommand.Args[4:])
+	if err != nil {
+		return fmt.Errorf("invalid command arguments for %s command: %w", userCommand.Args[0], err)
 	}
 
-	start, err := store.ToEntryId(input.start, 0)
+	start, err := parseRangeStart(startArg)
 	if err != nil {
-		return err
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
 	}
-	end, err := store.ToEntryId(input.end, int(^uint(0)>>1))
+	end, err := parseRangeEnd(endArg)
 	if err != nil {
-		return err
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
 	}
+
+	if h.db.StreamType.ExistsStream(string(streamId)) != nil {
+		h.notify(config.NotifyKeyMiss, "keymiss", string(streamId))
+	}
+
 	streamEntries := h.db.StreamType.FindStarEnd(streamId, start, end)
+	if reverse {
+		slices.Reverse(streamEntries)
+	}
+	if count >= 0 && len(streamEntries) > count {
+		streamEntries = streamEntries[:count]
+	}
+
 	lstEntries := []encoder.ListEntry{}
 
 	for _, v := range streamEntries {
@@ -55,3 +73,70 @@ func handleXrange(h *Handler, userCommand *Command) error {
 	h.WriteResponse(encoder.NewList(lstEntries))
 	return nil
 }
+
+// parseCountOption parses an optional `COUNT n` pair of arguments.
+// It returns -1 when no COUNT was given, meaning there is no limit.
+func parseCountOption(args []string) (int, error) {
+	if len(args) == 0 {
+		return -1, nil
+	}
+	if len(args) != 2 || strings.ToLower(args[0]) != Count {
+		return 0, fmt.Errorf("syntax error")
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, fmt.Errorf("value is not an integer or out of range")
+	}
+	// a negative COUNT returns no entries, the same as COUNT 0
+	if count < 0 {
+		count = 0
+	}
+	return count, nil
+}
+
+// parseRangeStart parses the first id of a range, that may be `-` or
+// an exclusive id prefixed with `(`.
+func parseRangeStart(arg string) (store.EntryId, error) {
+	switch {
+	case arg == "-":
+		return store.MinEntryId, nil
+	case arg == "+":
+		return store.MaxEntryId, nil
+	case strings.HasPrefix(arg, "("):
+		entryId, err := store.ToEntryId(arg[1:], 0)
+		if err != nil {
+			return store.EntryId{}, err
+		}
+		next, ok := entryId.Next()
+		if !ok {
+			return store.EntryId{}, fmt.Errorf("invalid start ID for the interval")
+		}
+		return next, nil
+	}
+
+	return store.ToEntryId(arg, 0)
+}
+
+// parseRangeEnd parses the last id of a range, that may be `+` or
+// an exclusive id prefixed with `(`.
+func parseRangeEnd(arg string) (store.EntryId, error) {
+	switch {
+	case arg == "-":
+		return store.MinEntryId, nil
+	case arg == "+":
+		return store.MaxEntryId, nil
+	case strings.HasPrefix(arg, "("):
+		entryId, err := store.ToEntryId(arg[1:], math.MaxUint64)
+		if err != nil {
+			return store.EntryId{}, err
+		}
+		prev, ok := entryId.Prev()
+		if !ok {
+			return store.EntryId{}, fmt.Errorf("invalid end ID for the interval")
+		}
+		return prev, nil
+	}
+
+	return store.ToEntryId(arg, math.MaxUint64)
+}
@@ -3,125 +3,145 @@ package command
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
 )
 
 func handleXread(h *Handler, userCommand *Command) error {
 	var input struct {
-		identifier string
-		streamIds  []string
-		entryIds   []string
-		blockTime  int
+		streamIds []string
+		entryIds  []string
+		count     int
+		blockTime int
+		block     bool
 	}
+	input.count = -1
 
-	type option int
-	const (
-		StreamsSingle option = iota
-		StreamsMultiple
-		Block
-		BlockWithTimeout
-	)
-	var opt option
-
-	fmt.Println("userCommand.Args:", userCommand.Args)
-	switch userCommand.Args[1] {
-	case "streams":
-		if len(userCommand.Args) == 4 {
-			opt = StreamsSingle
-		} else {
-			opt = StreamsMultiple
-			if len(userCommand.Args)%2 != 0 {
-				return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
-			}
+	args := userCommand.Args[1:]
+	for len(args) > 0 && strings.ToLower(args[0]) != Streams {
+		if len(args) < 2 {
+			return fmt.Errorf("invalid command arguments for %s command", userCommand.Args[0])
 		}
-	case "block":
-		if userCommand.Args[3] != "streams" {
+
+		var err error
+		switch strings.ToLower(args[0]) {
+		default:
 			return fmt.Errorf("invalid command arguments for %s command", userCommand.Args[0])
+		case Count:
+			input.count, err = strconv.Atoi(args[1])
+			if err != nil {
+				err = fmt.Errorf("value is not an integer or out of range")
+			}
+			// unlike XRANGE, a COUNT of 0 or less sets no limit
+			if input.count <= 0 {
+				input.count = -1
+			}
+		case Block:
+			input.block = true
+			input.blockTime, err = strconv.Atoi(args[1])
+			if err == nil && input.blockTime < 0 {
+				err = fmt.Errorf("timeout is negative")
+			}
 		}
-		if input.blockTime, _ = strconv.Atoi(userCommand.Args[2]); input.blockTime == 0 {
-			opt = Block
-		} else {
-			opt = BlockWithTimeout
+		if err != nil {
+			return fmt.Errorf("invalid command arguments for %s command: %w", userCommand.Args[0], err)
 		}
-		userCommand.Args = append(userCommand.Args[0:1], userCommand.Args[3:]...)
-	default:
-		return fmt.Errorf("invalid command arguments for %s command", userCommand.Args[0])
+		args = args[2:]
 	}
 
-	input.identifier = userCommand.Args[1]
+	// STREAMS key [key ...] id [id ...]
+	if len(args) < 3 || len(args)%2 != 1 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+	size := (len(args) - 1) / 2
+	input.streamIds = args[1 : size+1]
+	input.entryIds = args[size+1:]
 
-	if opt == StreamsMultiple {
-		offset := 2
-		size := len(userCommand.Args) - offset
-		for i := 2; i < size/2+offset; i++ {
-			input.streamIds = append(input.streamIds, userCommand.Args[i])
+	entryIds := make([]store.EntryId, len(input.entryIds))
+	for i, entryId := range input.entryIds {
+		// `$` stands for the last entry of each stream at the time XREAD was called
+		if entryId == "$" {
+			entryIds[i] = h.db.StreamType.FindLastEntryId(store.StreamId(input.streamIds[i]))
+			continue
 		}
-		for i := size/2 + offset; i < size+offset; i++ {
-			input.entryIds = append(input.entryIds, userCommand.Args[i])
+		var err error
+		entryIds[i], err = store.ToEntryId(entryId, 0)
+		if err != nil {
+			h.WriteResponse(encoder.NewError(err.Error()))
+			return nil
 		}
-	} else {
-		input.streamIds = []string{userCommand.Args[2]}
-		input.entryIds = []string{userCommand.Args[3]}
 	}
 
-	if input.entryIds[0] == "$" {
-		input.entryIds[0] = h.db.StreamType.FindLastEntryId(
-			store.StreamId(input.streamIds[0])).String()
+	// inside a transaction XREAD never blocks, replying at once like without BLOCK
+	if input.block && !h.inExec {
+		return doBlock(h, input.streamIds, entryIds, input.count, input.blockTime)
 	}
 
-	if opt == Block {
-		doBlock(input.streamIds[0])
-	}
+	writeXreadResponse(h, findXreadEntries(h, input.streamIds, entryIds, input.count))
+	return nil
+}
 
-	if opt == BlockWithTimeout {
-		err := doBlockWithTimeout(h, input.streamIds[0], input.blockTime)
-		if err != nil {
-			return err
-		}
+// doBlock waits until any of the streams has entries greater than the given ids,
+// or the block time expires. A block time of zero waits forever.
+func doBlock(h *Handler, streamIds []string, entryIds []store.EntryId, count int, blockTime int) error {
+	sub := util.NewSubscriber(1)
+	ps.Subscribe(sub, streamIds...)
+	defer ps.Unsubscribe(sub, streamIds...)
+
+	var timeout <-chan time.Time
+	if blockTime > 0 {
+		timer := time.NewTimer(time.Duration(blockTime) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	return writeXreadResponse(h, input.streamIds, input.entryIds)
-}
+	closed, stopWatching := h.watchDisconnect()
+	defer stopWatching()
 
-func doBlockWithTimeout(h *Handler, streamId string, blockTime int) error {
 	for {
-		ch := ps.Subscribe("xadd")
-		defer ps.Unsubscribe("xadd")
-		select {
-		case event := <-ch:
-			if event.Message == streamId {
-				return nil
+		// streams are checked after subscribing so no XADD is missed in between
+		if lstStreams := findXreadEntries(h, streamIds, entryIds, count); len(lstStreams) > 0 {
+			writeXreadResponse(h, lstStreams)
+			return nil
+		}
+
+		timedOut, disconnected := false, false
+		h.unlocked(func() {
+			select {
+			case <-sub.C:
+			case <-timeout:
+				timedOut = true
+			case <-closed:
+				disconnected = true
 			}
-		case <-time.After(time.Duration(blockTime) * time.Millisecond):
+		})
+		if timedOut {
 			h.WriteResponse(encoder.Null)
 			return nil
 		}
-	}
-}
-
-func doBlock(streamId string) {
-	ch := ps.Subscribe("xadd")
-	defer ps.Unsubscribe("xadd")
-	for {
-		event := <-ch
-		if event.Message == streamId {
-			return
+		if disconnected {
+			return nil
 		}
 	}
 }
 
-func writeXreadResponse(h *Handler, streamIds []string, entryIds []string) error {
+// findXreadEntries lists the entries greater than the given ids,
+// leaving out the streams without any of them.
+func findXreadEntries(h *Handler, streamIds []string, entryIds []store.EntryId, count int) []encoder.ListStream {
 	lstStreams := []encoder.ListStream{}
 	for s := 0; s < len(streamIds); s++ {
 		streamId := store.StreamId(streamIds[s])
-		entryId, err := store.ToEntryId(entryIds[s], 0)
-		if err != nil {
-			return err
+		streamEntries := h.db.StreamType.FindGreater(streamId, entryIds[s])
+		if count >= 0 && len(streamEntries) > count {
+			streamEntries = streamEntries[:count]
+		}
+		if len(streamEntries) == 0 {
+			continue
 		}
-		streamEntries := h.db.StreamType.FindGreater(streamId, entryId)
 		lstEntries := []encoder.ListEntry{}
 		for _, entry := range streamEntries {
 			i := encoder.ListEntry{
@@ -136,6 +156,13 @@ func writeXreadResponse(h *Handler, streamIds []string, entryIds []string) error
 		}
 		lstStreams = append(lstStreams, i)
 	}
+	return lstStreams
+}
+
+func writeXreadResponse(h *Handler, lstStreams []encoder.ListStream) {
+	if len(lstStreams) == 0 {
+		h.WriteResponse(encoder.Null)
+		return
+	}
 	h.WriteResponse(encoder.NewRead(lstStreams))
-	return nil
 }
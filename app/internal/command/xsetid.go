@@ -0,0 +1,58 @@
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/encoder"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+)
+
+func handleXsetid(h *Handler, userCommand *Command) error {
+	if len(userCommand.Args) < 3 || len(userCommand.Args)%2 != 1 {
+		return fmt.Errorf("the number of arguments for %s is incorrect", userCommand.Args[0])
+	}
+
+	streamId := store.StreamId(userCommand.Args[1])
+	lastId, err := store.ToEntryId(userCommand.Args[2], 0)
+	if err != nil {
+		return err
+	}
+
+	var entriesAdded *int
+	var maxDeletedId *store.EntryId
+
+	for i := 3; i < len(userCommand.Args); i += 2 {
+		option, value := strings.ToLower(userCommand.Args[i]), userCommand.Args[i+1]
+		switch option {
+		default:
+			return fmt.Errorf("invalid command arguments for %s command", userCommand.Args[0])
+		case EntriesAdded:
+			added, err := strconv.Atoi(value)
+			if err != nil || added < 0 {
+				h.WriteResponse(encoder.NewError("entries_added must be positive"))
+				return nil
+			}
+			entriesAdded = &added
+		case MaxDeletedId:
+			deletedId, err := store.ToEntryId(value, 0)
+			if err != nil {
+				return err
+			}
+			maxDeletedId = &deletedId
+		}
+	}
+
+	err = h.db.StreamType.SetId(streamId, lastId, entriesAdded, maxDeletedId)
+	if err != nil {
+		h.WriteResponse(encoder.NewError(err.Error()))
+		return nil
+	}
+
+	persistence.changed()
+	h.notify(config.NotifyStream, "xsetid", string(streamId))
+	h.WriteResponse(encoder.Ok)
+	return nil
+}
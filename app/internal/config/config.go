@@ -1,16 +1,81 @@
 package config
 
-import "fmt"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
 
 type Config struct {
-	port        int
-	role        string
-	replicaOf   string
-	replID      string
-	replOffset  int
-	slaves      []*Slave
-	dir         string
-	rdbFileName string
+	port       int
+	role       string
+	replicaOf  string
+	replID     string
+	replOffset int
+	// replID2 is the former replication ID, valid up to secondReplOffset,
+	// so replicas of the former master can partially resynchronize
+	replID2          string
+	secondReplOffset int
+	// cachedMaster is set once the replica synchronized with its master,
+	// replID and replOffset being then the ones it continues from
+	cachedMaster bool
+	// the replication backlog keeps the last bytes sent to the replicas,
+	// and is freed once there were no replicas for the ttl in seconds
+	replBacklogSize int64
+	replBacklogTTL  int
+	// replTimeout is how long in seconds the replication link stays up
+	// without receiving anything, the master pinging its replicas every
+	// replPingPeriod seconds so it doesn't happen while idle
+	replTimeout    int
+	replPingPeriod int
+	// replicaReadOnly makes a replica reject the writes of its clients
+	replicaReadOnly bool
+	// a master rejects writes unless it has minReplicasToWrite replicas
+	// which acknowledged their offset less than minReplicasMaxLag seconds ago
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+	// a diskless full resynchronization streams the snapshot to the replicas
+	// joining within the delay in seconds, which load it as set by
+	// replDisklessLoad
+	replDisklessSync      bool
+	replDisklessSyncDelay int
+	replDisklessLoad      string
+	slaves                []*Slave
+	dir                   string
+	rdbFileName           string
+	databases             int
+	savePoints            []SavePoint
+	// append only file settings, the file being used instead of the RDB
+	// file when appendOnly is set
+	appendOnly        bool
+	appendFilename    string
+	appendDirname     string
+	appendFsync       string
+	aofLoadTruncated  bool
+	aofUseRDBPreamble bool
+	// the append only file is rewritten once it grew by the percentage since
+	// the last rewrite, as long as it is larger than the minimum size in bytes
+	autoAOFRewritePercentage int
+	autoAOFRewriteMinSize    int64
+	// bytes a pub/sub client may have pending before being disconnected
+	pubsubBufferLimit int
+	keyspaceEvents    KeyspaceEvents
+	// bytes of replication stream a replica may have pending before being
+	// disconnected, making it resynchronize
+	replicaBufferLimit int
+	// milliseconds a script runs before other clients are told the server is busy
+	busyReplyThreshold int
+	// mu guards the parameters that can be changed with CONFIG SET
+	mu sync.RWMutex
+	// hash slots served by this node
+	slots   [util.ClusterSlots]bool
+	slotsMu sync.RWMutex
 }
 type Option func(c *Config)
 
@@ -19,15 +84,49 @@ const (
 	RoleSlave  = "slave"
 )
 
+// Ways a replica loads the snapshot of a full resynchronization: after
+// receiving all of it, straight from the connection when it has no data,
+// or straight from the connection while still serving its former data
+const (
+	DisklessLoadDisabled  = "disabled"
+	DisklessLoadOnEmptyDB = "on-empty-db"
+	DisklessLoadSwapDB    = "swapdb"
+)
+
 func NewConfig(options ...Option) *Config {
 	config := &Config{
-		port:        6379,
-		role:        "master",
-		replID:      "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
-		replOffset:  0,
-		slaves:      []*Slave{},
-		dir:         "/tmp/redis-files",
-		rdbFileName: "db.rdb",
+		port:                     6379,
+		role:                     "master",
+		replID:                   NewReplID(),
+		replOffset:               0,
+		replID2:                  strings.Repeat("0", 40),
+		secondReplOffset:         -1,
+		replBacklogSize:          1024 * 1024,
+		replBacklogTTL:           3600,
+		replTimeout:              60,
+		replPingPeriod:           10,
+		replicaReadOnly:          true,
+		minReplicasMaxLag:        10,
+		replDisklessSyncDelay:    5,
+		replDisklessLoad:         DisklessLoadDisabled,
+		slaves:                   []*Slave{},
+		dir:                      "/tmp/redis-files",
+		rdbFileName:              "db.rdb",
+		databases:                16,
+		savePoints:               []SavePoint{{3600, 1}, {300, 100}, {60, 10000}},
+		appendFilename:           "appendonly.aof",
+		appendDirname:            "appendonlydir",
+		appendFsync:              "everysec",
+		aofLoadTruncated:         true,
+		aofUseRDBPreamble:        true,
+		autoAOFRewritePercentage: 100,
+		autoAOFRewriteMinSize:    64 * 1024 * 1024,
+		pubsubBufferLimit:        32 * 1024 * 1024,
+		replicaBufferLimit:       256 * 1024 * 1024,
+		busyReplyThreshold:       5000,
+	}
+	for slot := range config.slots {
+		config.slots[slot] = true
 	}
 	for _, opt := range options {
 		opt(config)
@@ -39,22 +138,174 @@ func (c *Config) Port() int {
 	return c.port
 }
 
+// Role is either master or slave, changed by REPLICAOF
 func (c *Config) Role() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.role
 }
 
+// ReplID identifies the replication stream, either the one of the master or,
+// on a replica, the one of its master
 func (c *Config) ReplID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.replID
 }
 
+// ReplOffset is the number of bytes of the replication stream, sent to the
+// replicas by a master and processed by a replica
 func (c *Config) ReplOffset() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.replOffset
 }
 
+// SetReplication sets the replication ID and offset a replica continues
+// from, as given by its master on a full resynchronization
+func (c *Config) SetReplication(replID string, offset int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replID, c.replOffset = replID, offset
+	c.cachedMaster = true
+}
+
+// CachedMaster returns the replication ID and offset a replica asks its
+// master to continue from, false until it synchronized once
+func (c *Config) CachedMaster() (string, int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replID, c.replOffset, c.cachedMaster
+}
+
+// ReplID2 returns the former replication ID, and the offset up to which it
+// is valid, -1 when there is none
+func (c *Config) ReplID2() (string, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replID2, c.secondReplOffset
+}
+
+// ShiftReplID switches to a new replication ID, the current one becoming
+// the former one, valid up to the current offset
+func (c *Config) ShiftReplID(replID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.shiftReplID(replID)
+}
+
+func (c *Config) shiftReplID(replID string) {
+	c.replID2, c.secondReplOffset = c.replID, c.replOffset+1
+	c.replID = replID
+}
+
+// ResetReplID switches to a new random replication ID, forgetting the
+// former one, so no replica can continue from the current offsets
+func (c *Config) ResetReplID() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replID = NewReplID()
+	c.replID2, c.secondReplOffset = strings.Repeat("0", 40), -1
+}
+
+// ReplBacklog returns the size of the replication backlog in bytes, and how
+// long it is kept without replicas
+func (c *Config) ReplBacklog() (int64, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replBacklogSize, time.Duration(c.replBacklogTTL) * time.Second
+}
+
+// ReplTimeout is how long the replication link stays up without traffic
+func (c *Config) ReplTimeout() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return time.Duration(c.replTimeout) * time.Second
+}
+
+// ReplPingPeriod is how often a master pings its replicas
+func (c *Config) ReplPingPeriod() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return time.Duration(c.replPingPeriod) * time.Second
+}
+
+// ReplicaReadOnly tells whether a replica rejects the writes of its clients
+func (c *Config) ReplicaReadOnly() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replicaReadOnly
+}
+
+// MinReplicas returns the number of replicas a master needs to accept
+// writes, 0 when it needs none, and the lag they must stay under
+func (c *Config) MinReplicas() (int, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.minReplicasToWrite, time.Duration(c.minReplicasMaxLag) * time.Second
+}
+
+// ReplDisklessSync tells whether full resynchronizations stream the snapshot
+// to the replicas, and how long the first replica waits for others to join
+func (c *Config) ReplDisklessSync() (bool, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replDisklessSync, time.Duration(c.replDisklessSyncDelay) * time.Second
+}
+
+// ReplDisklessLoad is how a replica loads the snapshot of its master
+func (c *Config) ReplDisklessLoad() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.replDisklessLoad
+}
+
+// ReplicaOf is the address of the master of a replica
 func (c *Config) ReplicaOf() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.replicaOf
 }
 
+// SetReplicaOf makes the server a replica of the master at the address. A
+// former master asks it to continue from its own replication ID and offset,
+// which the new master knows when it was one of its replicas.
+func (c *Config) SetReplicaOf(master string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.role == RoleMaster {
+		c.cachedMaster = true
+	}
+	c.role, c.replicaOf = RoleSlave, master
+}
+
+// PromoteToMaster makes a replica a master, under a new replication ID, its
+// replicas continuing with the former one
+func (c *Config) PromoteToMaster() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.shiftReplID(NewReplID())
+	c.role, c.replicaOf = RoleMaster, ""
+}
+
 func (c *Config) Dir() string {
 	return c.dir
 }
@@ -63,18 +314,123 @@ func (c *Config) RDBFileName() string {
 	return c.rdbFileName
 }
 
+// Databases is the number of databases, selected with SELECT
+func (c *Config) Databases() int {
+	return c.databases
+}
+
+// SavePoints are the conditions triggering a background snapshot
+func (c *Config) SavePoints() []SavePoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.savePoints
+}
+
+func (c *Config) AppendOnly() bool {
+	return c.appendOnly
+}
+
+func (c *Config) AppendFilename() string {
+	return c.appendFilename
+}
+
+// AOFDir is the directory holding the files of the append only file
+func (c *Config) AOFDir() string {
+	return fmt.Sprintf("%s/%s", c.dir, c.appendDirname)
+}
+
+// AOFUseRDBPreamble tells whether the base file of the append only file is
+// written in the RDB format, rather than as commands
+func (c *Config) AOFUseRDBPreamble() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.aofUseRDBPreamble
+}
+
+// AutoAOFRewrite returns the growth percentage and the minimum size of the
+// append only file triggering a rewrite, a percentage of 0 disabling it
+func (c *Config) AutoAOFRewrite() (int, int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.autoAOFRewritePercentage, c.autoAOFRewriteMinSize
+}
+
+// AppendFsync is the policy syncing the append only file to disk: always,
+// everysec or no
+func (c *Config) AppendFsync() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.appendFsync
+}
+
+// AOFLoadTruncated tells whether an append only file ending with a partial
+// command is loaded, rather than refusing to start
+func (c *Config) AOFLoadTruncated() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.aofLoadTruncated
+}
+
+func (c *Config) PubSubBufferLimit() int {
+	return c.pubsubBufferLimit
+}
+
+func (c *Config) ReplicaBufferLimit() int {
+	return c.replicaBufferLimit
+}
+
+// BusyReplyThreshold is how long a script runs before the server replies
+// BUSY to other clients and lets SCRIPT KILL stop it
+func (c *Config) BusyReplyThreshold() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return time.Duration(c.busyReplyThreshold) * time.Millisecond
+}
+
 func (c *Config) Slaves() []*Slave {
-	return c.slaves
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.slaves)
 }
 
 func (c *Config) AddSlave(slave *Slave) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.slaves = append(c.slaves, slave)
 }
 
+// RemoveSlave forgets a replica once its connection is closed
+func (c *Config) RemoveSlave(slave *Slave) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.slaves = slices.DeleteFunc(c.slaves, func(s *Slave) bool {
+		return s == slave
+	})
+}
+
 func (c *Config) UpdateOffset(bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.replOffset += bytes
 }
 
+// NewReplID returns a random replication ID of 40 hexadecimal characters
+func NewReplID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 func (c *Config) RDBFilePath() string {
 	return fmt.Sprintf("%s/%s", c.dir, c.rdbFileName)
 }
@@ -103,3 +459,75 @@ func WithRDBFileName(fileName string) Option {
 		c.rdbFileName = fileName
 	}
 }
+
+func WithDatabases(databases int) Option {
+	return func(c *Config) {
+		c.databases = databases
+	}
+}
+
+func WithSavePoints(points []SavePoint) Option {
+	return func(c *Config) {
+		c.savePoints = points
+	}
+}
+
+func WithAppendOnly(appendOnly bool) Option {
+	return func(c *Config) {
+		c.appendOnly = appendOnly
+	}
+}
+
+func WithAppendFilename(fileName string) Option {
+	return func(c *Config) {
+		c.appendFilename = fileName
+	}
+}
+
+func WithAppendDirname(dirName string) Option {
+	return func(c *Config) {
+		c.appendDirname = dirName
+	}
+}
+
+func WithAppendFsync(policy string) Option {
+	return func(c *Config) {
+		c.appendFsync = policy
+	}
+}
+
+func WithReplDisklessSync(enabled bool) Option {
+	return func(c *Config) {
+		c.replDisklessSync = enabled
+	}
+}
+
+func WithReplDisklessSyncDelay(seconds int) Option {
+	return func(c *Config) {
+		c.replDisklessSyncDelay = seconds
+	}
+}
+
+func WithReplDisklessLoad(mode string) Option {
+	return func(c *Config) {
+		c.replDisklessLoad = mode
+	}
+}
+
+func WithAOFLoadTruncated(loadTruncated bool) Option {
+	return func(c *Config) {
+		c.aofLoadTruncated = loadTruncated
+	}
+}
+
+func WithPubSubBufferLimit(limit int) Option {
+	return func(c *Config) {
+		c.pubsubBufferLimit = limit
+	}
+}
+
+func WithReplicaBufferLimit(limit int) Option {
+	return func(c *Config) {
+		c.replicaBufferLimit = limit
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyspaceEvents selects the keyspace notifications published by the server,
+// as configured by `notify-keyspace-events`.
+type KeyspaceEvents int
+
+const (
+	NotifyKeyspace KeyspaceEvents = 1 << iota // K
+	NotifyKeyevent                            // E
+	NotifyGeneric                             // g
+	NotifyString                              // $
+	NotifyList                                // l
+	NotifySet                                 // s
+	NotifyHash                                // h
+	NotifyZset                                // z
+	NotifyExpired                             // x
+	NotifyEvicted                             // e
+	NotifyStream                              // t
+	NotifyKeyMiss                             // m
+	NotifyNew                                 // n
+
+	// NotifyAll is the `A` alias, it does not include key miss and new key events
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZset | NotifyExpired | NotifyEvicted | NotifyStream
+)
+
+// Order in which the event classes are listed when formatting the flags
+var keyspaceEventClasses = []struct {
+	flag  byte
+	class KeyspaceEvents
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZset},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'t', NotifyStream},
+}
+
+func ParseKeyspaceEvents(flags string) (KeyspaceEvents, error) {
+	events := KeyspaceEvents(0)
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case 'A':
+			events |= NotifyAll
+		case 'K':
+			events |= NotifyKeyspace
+		case 'E':
+			events |= NotifyKeyevent
+		case 'm':
+			events |= NotifyKeyMiss
+		case 'n':
+			events |= NotifyNew
+		default:
+			found := false
+			for _, c := range keyspaceEventClasses {
+				if c.flag == flags[i] {
+					events |= c.class
+					found = true
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("Invalid event class character. Use 'Ag$lshzxeKEtmn'.")
+			}
+		}
+	}
+	return events, nil
+}
+
+func (e KeyspaceEvents) String() string {
+	var flags strings.Builder
+	if e&NotifyAll == NotifyAll {
+		flags.WriteByte('A')
+	} else {
+		for _, c := range keyspaceEventClasses {
+			if e&c.class != 0 {
+				flags.WriteByte(c.flag)
+			}
+		}
+	}
+	if e&NotifyKeyspace != 0 {
+		flags.WriteByte('K')
+	}
+	if e&NotifyKeyevent != 0 {
+		flags.WriteByte('E')
+	}
+	if e&NotifyKeyMiss != 0 {
+		flags.WriteByte('m')
+	}
+	if e&NotifyNew != 0 {
+		flags.WriteByte('n')
+	}
+	return flags.String()
+}
+
+// KeyspaceEvents returns the keyspace notifications to be published
+func (c *Config) KeyspaceEvents() KeyspaceEvents {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.keyspaceEvents
+}
+
+func WithKeyspaceEvents(events KeyspaceEvents) Option {
+	return func(c *Config) {
+		c.keyspaceEvents = events
+	}
+}
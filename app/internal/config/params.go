@@ -0,0 +1,369 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// parameter is a configuration parameter exposed through CONFIG GET and CONFIG SET.
+// Parameters without a set function can only be given when starting the server.
+type parameter struct {
+	name string
+	get  func(c *Config) string
+	set  func(c *Config, value string) error
+}
+
+var parameters = []parameter{
+	{
+		name: "dir",
+		get:  func(c *Config) string { return c.dir },
+	},
+	{
+		name: "dbfilename",
+		get:  func(c *Config) string { return c.rdbFileName },
+	},
+	{
+		name: "databases",
+		get:  func(c *Config) string { return strconv.Itoa(c.databases) },
+	},
+	{
+		name: "save",
+		get:  func(c *Config) string { return formatSavePoints(c.savePoints) },
+		set: func(c *Config, value string) error {
+			points, err := ParseSavePoints(value)
+			if err != nil {
+				return err
+			}
+			c.savePoints = points
+			return nil
+		},
+	},
+	{
+		name: "appendonly",
+		get:  func(c *Config) string { return formatYesNo(c.appendOnly) },
+	},
+	{
+		name: "appendfilename",
+		get:  func(c *Config) string { return c.appendFilename },
+	},
+	{
+		name: "appenddirname",
+		get:  func(c *Config) string { return c.appendDirname },
+	},
+	{
+		name: "appendfsync",
+		get:  func(c *Config) string { return c.appendFsync },
+		set: func(c *Config, value string) error {
+			policy, err := ParseAppendFsync(value)
+			if err != nil {
+				return err
+			}
+			c.appendFsync = policy
+			return nil
+		},
+	},
+	{
+		name: "aof-load-truncated",
+		get:  func(c *Config) string { return formatYesNo(c.aofLoadTruncated) },
+		set: func(c *Config, value string) error {
+			loadTruncated, err := ParseYesNo(value)
+			if err != nil {
+				return err
+			}
+			c.aofLoadTruncated = loadTruncated
+			return nil
+		},
+	},
+	{
+		name: "aof-use-rdb-preamble",
+		get:  func(c *Config) string { return formatYesNo(c.aofUseRDBPreamble) },
+		set: func(c *Config, value string) error {
+			useRDBPreamble, err := ParseYesNo(value)
+			if err != nil {
+				return err
+			}
+			c.aofUseRDBPreamble = useRDBPreamble
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-percentage",
+		get:  func(c *Config) string { return strconv.Itoa(c.autoAOFRewritePercentage) },
+		set: func(c *Config, value string) error {
+			percentage, err := strconv.Atoi(value)
+			if err != nil || percentage < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.autoAOFRewritePercentage = percentage
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-min-size",
+		get:  func(c *Config) string { return strconv.FormatInt(c.autoAOFRewriteMinSize, 10) },
+		set: func(c *Config, value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			c.autoAOFRewriteMinSize = size
+			return nil
+		},
+	},
+	{
+		name: "repl-backlog-size",
+		get:  func(c *Config) string { return strconv.FormatInt(c.replBacklogSize, 10) },
+		set: func(c *Config, value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			if size < 1 {
+				return fmt.Errorf("argument must be a memory value greater than 0")
+			}
+			c.replBacklogSize = size
+			return nil
+		},
+	},
+	{
+		name: "repl-backlog-ttl",
+		get:  func(c *Config) string { return strconv.Itoa(c.replBacklogTTL) },
+		set: func(c *Config, value string) error {
+			ttl, err := strconv.Atoi(value)
+			if err != nil || ttl < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.replBacklogTTL = ttl
+			return nil
+		},
+	},
+	{
+		name: "repl-timeout",
+		get:  func(c *Config) string { return strconv.Itoa(c.replTimeout) },
+		set: func(c *Config, value string) error {
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout < 1 {
+				return fmt.Errorf("argument must be greater than 0")
+			}
+			c.replTimeout = timeout
+			return nil
+		},
+	},
+	{
+		name: "repl-ping-replica-period",
+		get:  func(c *Config) string { return strconv.Itoa(c.replPingPeriod) },
+		set: func(c *Config, value string) error {
+			period, err := strconv.Atoi(value)
+			if err != nil || period < 1 {
+				return fmt.Errorf("argument must be greater than 0")
+			}
+			c.replPingPeriod = period
+			return nil
+		},
+	},
+	{
+		name: "replica-read-only",
+		get:  func(c *Config) string { return formatYesNo(c.replicaReadOnly) },
+		set: func(c *Config, value string) error {
+			readOnly, err := ParseYesNo(value)
+			if err != nil {
+				return err
+			}
+			c.replicaReadOnly = readOnly
+			return nil
+		},
+	},
+	{
+		name: "min-replicas-to-write",
+		get:  func(c *Config) string { return strconv.Itoa(c.minReplicasToWrite) },
+		set: func(c *Config, value string) error {
+			replicas, err := strconv.Atoi(value)
+			if err != nil || replicas < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.minReplicasToWrite = replicas
+			return nil
+		},
+	},
+	{
+		name: "min-replicas-max-lag",
+		get:  func(c *Config) string { return strconv.Itoa(c.minReplicasMaxLag) },
+		set: func(c *Config, value string) error {
+			lag, err := strconv.Atoi(value)
+			if err != nil || lag < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.minReplicasMaxLag = lag
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-sync",
+		get:  func(c *Config) string { return formatYesNo(c.replDisklessSync) },
+		set: func(c *Config, value string) error {
+			enabled, err := ParseYesNo(value)
+			if err != nil {
+				return err
+			}
+			c.replDisklessSync = enabled
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-sync-delay",
+		get:  func(c *Config) string { return strconv.Itoa(c.replDisklessSyncDelay) },
+		set: func(c *Config, value string) error {
+			delay, err := strconv.Atoi(value)
+			if err != nil || delay < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			c.replDisklessSyncDelay = delay
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-load",
+		get:  func(c *Config) string { return c.replDisklessLoad },
+		set: func(c *Config, value string) error {
+			mode, err := ParseDisklessLoad(value)
+			if err != nil {
+				return err
+			}
+			c.replDisklessLoad = mode
+			return nil
+		},
+	},
+	{
+		name: "notify-keyspace-events",
+		get:  func(c *Config) string { return c.keyspaceEvents.String() },
+		set: func(c *Config, value string) error {
+			events, err := ParseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			c.keyspaceEvents = events
+			return nil
+		},
+	},
+	{
+		name: "busy-reply-threshold",
+		get:  func(c *Config) string { return strconv.Itoa(c.busyReplyThreshold) },
+		set:  setBusyReplyThreshold,
+	},
+	{
+		// lua-time-limit is the former name of busy-reply-threshold
+		name: "lua-time-limit",
+		get:  func(c *Config) string { return strconv.Itoa(c.busyReplyThreshold) },
+		set:  setBusyReplyThreshold,
+	},
+}
+
+func setBusyReplyThreshold(c *Config, value string) error {
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 {
+		return fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	c.busyReplyThreshold = threshold
+	return nil
+}
+
+// ParseYesNo parses the value of a boolean parameter
+func ParseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// ParseMemory parses a number of bytes, optionally followed by a unit such
+// as kb, mb or gb, powers of 1024
+func ParseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+// ParseAppendFsync parses the policy syncing the append only file to disk
+func ParseAppendFsync(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value != "always" && value != "everysec" && value != "no" {
+		return "", fmt.Errorf("argument(s) must be one of the following: always, everysec, no")
+	}
+	return value, nil
+}
+
+// ParseDisklessLoad parses how a replica loads the snapshot of its master
+func ParseDisklessLoad(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value != DisklessLoadDisabled && value != DisklessLoadOnEmptyDB && value != DisklessLoadSwapDB {
+		return "", fmt.Errorf("argument(s) must be one of the following: disabled, on-empty-db, swapdb")
+	}
+	return value, nil
+}
+
+// GetParameters returns the names and values of the parameters matching the
+// glob-style pattern, one after the other.
+func (c *Config) GetParameters(pattern string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	pattern = strings.ToLower(pattern)
+	output := []string{}
+	for _, param := range parameters {
+		if util.GlobMatch(pattern, param.name) {
+			output = append(output, param.name, param.get(c))
+		}
+	}
+	return output
+}
+
+func (c *Config) SetParameter(name, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = strings.ToLower(name)
+	for _, param := range parameters {
+		if param.name != name {
+			continue
+		}
+		if param.set == nil {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+		}
+		if err := param.set(c, value); err != nil {
+			return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err.Error())
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+}
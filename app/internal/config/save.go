@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SavePoint triggers a snapshot once Changes writes were made and Seconds
+// went by since the last one, as configured by `save <seconds> <changes>`.
+type SavePoint struct {
+	Seconds int
+	Changes int
+}
+
+// DefaultSavePoints are the save points of the server when none are given
+const DefaultSavePoints = "3600 1 300 100 60 10000"
+
+// ParseSavePoints parses pairs of seconds and changes, an empty string
+// disabling the snapshots
+func ParseSavePoints(s string) ([]SavePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("Invalid save parameters")
+	}
+
+	points := []SavePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("Invalid save parameters")
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+func formatSavePoints(points []SavePoint) string {
+	fields := make([]string, 0, 2*len(points))
+	for _, point := range points {
+		fields = append(fields, strconv.Itoa(point.Seconds), strconv.Itoa(point.Changes))
+	}
+	return strings.Join(fields, " ")
+}
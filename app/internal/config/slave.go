@@ -2,27 +2,214 @@ package config
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+// Slave is a replica connected to this server. The commands propagated to it
+// are kept in pending, and written to the connection by a goroutine of its
+// own, so a slow replica doesn't hold back the clients. Until it received the
+// snapshot of its full resynchronization, they are only kept, as they must
+// follow the snapshot. A replica with more than bufferLimit bytes pending is
+// disconnected, to resynchronize once it reconnects.
 type Slave struct {
 	conn net.Conn
-	mu   sync.Mutex
+	// listeningPort is the port the replica serves its clients on, given by
+	// REPLCONF listening-port
+	listeningPort int
+	mu            sync.Mutex
+	online        bool
+	pending       bytes.Buffer
+	bufferLimit   int
+	overflowed    bool
+	// ackOffset is the offset of the replication stream the replica
+	// reported to have processed, lastAck when it last did
+	ackOffset int
+	lastAck   time.Time
+	// wake tells the writer there is something pending
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewSlave(conn net.Conn) *Slave {
+func NewSlave(conn net.Conn, listeningPort int, bufferLimit int) *Slave {
 	return &Slave{
-		conn: conn,
+		conn:          conn,
+		listeningPort: listeningPort,
+		bufferLimit:   bufferLimit,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
 	}
 }
 
-func (s *Slave) PropagateCommand(command string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Addr returns the IP of the replica and the port it serves its clients on
+func (s *Slave) Addr() (string, int) {
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return host, s.listeningPort
+}
+
+func (s *Slave) AckOffset() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ackOffset
+}
+
+// Ack records the offset the replica reported with REPLCONF ACK
+func (s *Slave) Ack(offset int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackOffset = max(s.ackOffset, offset)
+	s.lastAck = time.Now()
+}
+
+// Online tells whether the replica is synchronized, being sent the
+// replication stream
+func (s *Slave) Online() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.online
+}
 
+// Lag is how long ago the replica last acknowledged its offset, or went
+// online when it didn't yet
+func (s *Slave) Lag() time.Duration {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Since(s.lastAck)
+}
+
+// Disconnect closes the connection with the replica
+func (s *Slave) Disconnect() {
+	s.conn.Close()
+}
+
+func (s *Slave) PropagateCommand(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.overflowed {
+		return
+	}
+	s.pending.WriteString(command)
+	if s.bufferLimit > 0 && s.pending.Len() > s.bufferLimit {
+		log.Printf("the replica %s is disconnected, having more than %d bytes pending\n", s.conn.RemoteAddr(), s.bufferLimit)
+		s.overflowed = true
+		s.pending = bytes.Buffer{}
+		s.conn.Close()
+		return
+	}
+	if s.online {
+		s.signal()
+	}
+}
+
+// SendSnapshot sends the RDB file of the full resynchronization, followed by
+// the commands propagated since the snapshot was taken
+func (s *Slave) SendSnapshot(data []byte) error {
+	// nothing else is written to the connection until the replica is online
 	writer := bufio.NewWriter(s.conn)
-	writer.WriteString(command)
-	writer.Flush()
-	s.mu.Unlock()
+	fmt.Fprintf(writer, "$%d\r\n", len(data))
+	writer.Write(data)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	s.goOnline()
+	return nil
+}
+
+// StreamSnapshot sends the reply to PSYNC followed by the RDB file of a
+// diskless full resynchronization, encoded straight to the connection. Its
+// size isn't known beforehand, so it ends with a random mark announced
+// before it. The commands propagated since the snapshot was taken follow.
+func (s *Slave) StreamSnapshot(reply string, encode func(io.Writer) error) error {
+	mark := NewReplID()
+	writer := bufio.NewWriter(s.conn)
+	writer.WriteString(reply)
+	fmt.Fprintf(writer, "$EOF:%s\r\n", mark)
+	if err := encode(writer); err != nil {
+		return err
+	}
+	writer.WriteString(mark)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	s.goOnline()
+	return nil
+}
+
+// Resume sends the part of the replication stream a replica missed, on a
+// partial resynchronization, followed by the commands propagated since
+func (s *Slave) Resume(data []byte) error {
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+	s.goOnline()
+	return nil
+}
+
+// Close stops writing to the replica, once its connection is closed
+func (s *Slave) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// Closed tells whether the connection with the replica was closed
+func (s *Slave) Closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Slave) goOnline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.online = true
+	s.lastAck = time.Now()
+	go s.write()
+	s.signal()
+}
+
+func (s *Slave) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write sends the pending commands until the replica is closed
+func (s *Slave) write() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+
+		s.mu.Lock()
+		data := bytes.Clone(s.pending.Bytes())
+		s.pending.Reset()
+		s.mu.Unlock()
+
+		if len(data) == 0 {
+			continue
+		}
+		if _, err := s.conn.Write(data); err != nil {
+			s.conn.Close()
+			return
+		}
+	}
 }
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
+)
+
+// OwnsSlot reports whether the hash slot is served by this node.
+// A node serves every slot until they are deleted with CLUSTER DELSLOTS.
+func (c *Config) OwnsSlot(slot int) bool {
+	c.slotsMu.RLock()
+	defer c.slotsMu.RUnlock()
+
+	return slot >= 0 && slot < util.ClusterSlots && c.slots[slot]
+}
+
+func (c *Config) AddSlots(slots []int) error {
+	c.slotsMu.Lock()
+	defer c.slotsMu.Unlock()
+
+	for _, slot := range slots {
+		if slot < 0 || slot >= util.ClusterSlots {
+			return fmt.Errorf("Invalid or out of range slot")
+		}
+		if c.slots[slot] {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = true
+	}
+	return nil
+}
+
+func (c *Config) DelSlots(slots []int) error {
+	c.slotsMu.Lock()
+	defer c.slotsMu.Unlock()
+
+	for _, slot := range slots {
+		if slot < 0 || slot >= util.ClusterSlots {
+			return fmt.Errorf("Invalid or out of range slot")
+		}
+		if !c.slots[slot] {
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = false
+	}
+	return nil
+}
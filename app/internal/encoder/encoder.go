@@ -3,10 +3,12 @@ package encoder
 import "fmt"
 
 const (
-	Null     = "$-1\r\n"
-	Ok       = "+OK\r\n"
-	Pong     = "+PONG\r\n"
-	Fullsync = "FULLRESYNC"
+	Null      = "$-1\r\n"
+	NullArray = "*-1\r\n"
+	Ok        = "+OK\r\n"
+	Pong      = "+PONG\r\n"
+	Fullsync  = "FULLRESYNC"
+	Continue  = "CONTINUE"
 )
 
 func NewString(data string) string {
@@ -30,18 +32,31 @@ func NewArray(data []string) string {
 	return array
 }
 
+// NewEncodedArray builds an array out of elements that are already encoded,
+// so replies can mix integers, bulk strings and nested arrays.
+func NewEncodedArray(data []string) string {
+	array := fmt.Sprintf("*%d\r\n", len(data))
+	for _, d := range data {
+		array += d
+	}
+
+	return array
+}
+
 type ListEntry struct {
 	EntryId string
 	Facts   []string
 }
 
+func NewListEntry(entry ListEntry) string {
+	return "*2\r\n" + NewBulkString(entry.EntryId) + NewArray(entry.Facts)
+}
+
 func NewList(data []ListEntry) string {
 	var list string
 	list += fmt.Sprintf("*%d\r\n", len(data))
 	for _, v := range data {
-		list += "*2\r\n"
-		list += NewBulkString(v.EntryId)
-		list += NewArray(v.Facts)
+		list += NewListEntry(v)
 	}
 	return list
 }
@@ -70,7 +85,3 @@ func NewRead(data []ListStream) string {
 func NewError(data string) string {
 	return fmt.Sprintf("-ERR %s\r\n", data)
 }
-
-func NewRDBFile(fileContent []byte) string {
-	return fmt.Sprintf("$%d\r\n%s", len(fileContent), fileContent)
-}
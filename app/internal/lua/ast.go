@@ -0,0 +1,175 @@
+package lua
+
+// The parser resolves every name while building the tree, so locals are
+// accessed by their slot in the frame and upvalues by their index in the
+// closure, with no lookups by name when running.
+
+type expr interface{}
+
+type (
+	constExpr struct {
+		value Value
+	}
+	varargExpr struct{}
+	localExpr  struct {
+		name string
+		slot int
+	}
+	upvalExpr struct {
+		name  string
+		index int
+	}
+	globalExpr struct {
+		name string
+	}
+	indexExpr struct {
+		obj  expr
+		key  expr
+		line int
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+		line int
+	}
+	methodCallExpr struct {
+		obj  expr
+		name string
+		args []expr
+		line int
+	}
+	functionExpr struct {
+		proto *funcProto
+	}
+	binaryExpr struct {
+		op   int
+		lhs  expr
+		rhs  expr
+		line int
+	}
+	andExpr struct {
+		lhs expr
+		rhs expr
+	}
+	orExpr struct {
+		lhs expr
+		rhs expr
+	}
+	unaryExpr struct {
+		op   int
+		expr expr
+		line int
+	}
+	// parenExpr truncates the values of a call or vararg expression to one
+	parenExpr struct {
+		expr expr
+	}
+	tableExpr struct {
+		fields []tableField
+	}
+)
+
+// tableField is an entry of a table constructor, positional when key is nil
+type tableField struct {
+	key   expr
+	value expr
+}
+
+type stmt interface{}
+
+type (
+	localStmt struct {
+		slots []int
+		exprs []expr
+		line  int
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call expr
+		line int
+	}
+	doStmt struct {
+		body []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+		line int
+	}
+	repeatStmt struct {
+		body []stmt
+		cond expr
+		line int
+	}
+	ifStmt struct {
+		conds    []expr
+		blocks   [][]stmt
+		elseBody []stmt
+		line     int
+	}
+	numericForStmt struct {
+		slot  int
+		start expr
+		limit expr
+		step  expr
+		body  []stmt
+		line  int
+	}
+	genericForStmt struct {
+		slots []int
+		exprs []expr
+		body  []stmt
+		line  int
+	}
+	localFunctionStmt struct {
+		slot  int
+		proto *funcProto
+	}
+	returnStmt struct {
+		exprs []expr
+		line  int
+	}
+	breakStmt struct{}
+)
+
+// upvalDesc tells where a closure takes an upvalue from when created: a local
+// of the enclosing function, or one of the upvalues of the enclosing function.
+type upvalDesc struct {
+	name      string
+	fromLocal bool
+	index     int
+}
+
+type funcProto struct {
+	name     string
+	chunk    string
+	line     int
+	params   []int
+	isVararg bool
+	numSlots int
+	upvals   []upvalDesc
+	body     []stmt
+}
+
+const (
+	opAdd = iota
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opConcat
+	opEq
+	opNe
+	opLt
+	opLe
+	opGt
+	opGe
+	opNeg
+	opNot
+	opLen
+)
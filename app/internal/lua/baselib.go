@@ -0,0 +1,426 @@
+package lua
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (s *State) register(t *Table, name string, fn GoFunction) {
+	t.Set(name, NewFunction(name, fn))
+}
+
+func (s *State) checkArg(args []Value, i int, fname string) Value {
+	if i >= len(args) {
+		s.Errorf("bad argument #%d to '%s' (value expected)", i+1, fname)
+	}
+	return args[i]
+}
+
+func (s *State) checkTable(args []Value, i int, fname string) *Table {
+	var v Value
+	if i < len(args) {
+		v = args[i]
+	}
+	t, ok := v.(*Table)
+	if !ok {
+		s.Errorf("bad argument #%d to '%s' (table expected, got %s)", i+1, fname, typeNameOrNoValue(args, i))
+	}
+	return t
+}
+
+func (s *State) checkNumber(args []Value, i int, fname string) float64 {
+	var v Value
+	if i < len(args) {
+		v = args[i]
+	}
+	n, ok := ToNumber(v)
+	if !ok {
+		s.Errorf("bad argument #%d to '%s' (number expected, got %s)", i+1, fname, typeNameOrNoValue(args, i))
+	}
+	return n
+}
+
+func (s *State) checkInt(args []Value, i int, fname string) int {
+	return int(s.checkNumber(args, i, fname))
+}
+
+func (s *State) optInt(args []Value, i int, fname string, def int) int {
+	if i >= len(args) || args[i] == nil {
+		return def
+	}
+	return s.checkInt(args, i, fname)
+}
+
+func (s *State) checkString(args []Value, i int, fname string) string {
+	var v Value
+	if i < len(args) {
+		v = args[i]
+	}
+	str, ok := toStringCoerce(v)
+	if !ok {
+		s.Errorf("bad argument #%d to '%s' (string expected, got %s)", i+1, fname, typeNameOrNoValue(args, i))
+	}
+	return str
+}
+
+func typeNameOrNoValue(args []Value, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return TypeName(args[i])
+}
+
+func openBase(s *State) {
+	g := s.Globals
+	g.Set("_G", g)
+	g.Set("_VERSION", "Lua 5.1")
+
+	s.register(g, "assert", func(s *State, args []Value) []Value {
+		if len(args) == 0 || !Truthy(args[0]) {
+			if len(args) > 1 {
+				s.RaiseError(args[1])
+			}
+			s.Errorf("assertion failed!")
+		}
+		return args
+	})
+	s.register(g, "error", func(s *State, args []Value) []Value {
+		var value Value
+		if len(args) > 0 {
+			value = args[0]
+		}
+		level := s.optInt(args, 1, "error", 1)
+		if msg, ok := value.(string); ok && level > 0 {
+			value = s.where() + msg
+		}
+		s.RaiseError(value)
+		return nil
+	})
+	s.register(g, "pcall", func(s *State, args []Value) []Value {
+		fn := s.checkArg(args, 0, "pcall")
+		results, err := s.protectedCall(fn, args[1:])
+		if err != nil {
+			return []Value{false, err.Value}
+		}
+		return append([]Value{true}, results...)
+	})
+	s.register(g, "xpcall", func(s *State, args []Value) []Value {
+		fn := s.checkArg(args, 0, "xpcall")
+		handler := s.checkArg(args, 1, "xpcall")
+		results, err := s.protectedCall(fn, nil)
+		if err != nil {
+			return append([]Value{false}, s.call(handler, []Value{err.Value})...)
+		}
+		return append([]Value{true}, results...)
+	})
+	s.register(g, "type", func(s *State, args []Value) []Value {
+		return []Value{TypeName(s.checkArg(args, 0, "type"))}
+	})
+	s.register(g, "tostring", func(s *State, args []Value) []Value {
+		return []Value{ToString(s.checkArg(args, 0, "tostring"))}
+	})
+	s.register(g, "tonumber", func(s *State, args []Value) []Value {
+		v := s.checkArg(args, 0, "tonumber")
+		base := s.optInt(args, 1, "tonumber", 10)
+		if base == 10 {
+			if n, ok := ToNumber(v); ok {
+				return []Value{n}
+			}
+			return []Value{nil}
+		}
+		str := strings.ToLower(strings.TrimSpace(s.checkString(args, 0, "tonumber")))
+		n, err := strconv.ParseInt(str, base, 64)
+		if err != nil {
+			return []Value{nil}
+		}
+		return []Value{float64(n)}
+	})
+	s.register(g, "ipairs", func(s *State, args []Value) []Value {
+		t := s.checkTable(args, 0, "ipairs")
+		iter := NewFunction("ipairs_iter", func(s *State, args []Value) []Value {
+			i := int(args[1].(float64)) + 1
+			v := t.GetInt(i)
+			if v == nil {
+				return []Value{nil}
+			}
+			return []Value{float64(i), v}
+		})
+		return []Value{iter, t, float64(0)}
+	})
+	next := NewFunction("next", func(s *State, args []Value) []Value {
+		t := s.checkTable(args, 0, "next")
+		var key Value
+		if len(args) > 1 {
+			key = args[1]
+		}
+		k, v, ok := t.Next(key)
+		if !ok {
+			s.Errorf("invalid key to 'next'")
+		}
+		if k == nil {
+			return []Value{nil}
+		}
+		return []Value{k, v}
+	})
+	g.Set("next", next)
+	s.register(g, "pairs", func(s *State, args []Value) []Value {
+		return []Value{next, s.checkTable(args, 0, "pairs"), nil}
+	})
+	s.register(g, "select", func(s *State, args []Value) []Value {
+		if n, ok := s.checkArg(args, 0, "select").(string); ok && n == "#" {
+			return []Value{float64(len(args) - 1)}
+		}
+		i := s.checkInt(args, 0, "select")
+		if i < 0 {
+			i = len(args) + i
+		} else if i == 0 {
+			s.Errorf("bad argument #1 to 'select' (index out of range)")
+		}
+		if i >= len(args) {
+			return nil
+		}
+		return args[i:]
+	})
+	s.register(g, "unpack", tableUnpack)
+	s.register(g, "rawget", func(s *State, args []Value) []Value {
+		return []Value{s.checkTable(args, 0, "rawget").Get(s.checkArg(args, 1, "rawget"))}
+	})
+	s.register(g, "rawset", func(s *State, args []Value) []Value {
+		t := s.checkTable(args, 0, "rawset")
+		key := s.checkArg(args, 1, "rawset")
+		s.checkKey(key)
+		t.Set(key, s.checkArg(args, 2, "rawset"))
+		return []Value{t}
+	})
+	s.register(g, "rawequal", func(s *State, args []Value) []Value {
+		return []Value{rawEqual(s.checkArg(args, 0, "rawequal"), s.checkArg(args, 1, "rawequal"))}
+	})
+	s.register(g, "setmetatable", func(s *State, args []Value) []Value {
+		t := s.checkTable(args, 0, "setmetatable")
+		if t.meta != nil && t.meta.Get("__metatable") != nil {
+			s.Errorf("cannot change a protected metatable")
+		}
+		switch meta := s.checkArg(args, 1, "setmetatable").(type) {
+		case nil:
+			t.meta = nil
+		case *Table:
+			t.meta = meta
+		default:
+			s.Errorf("bad argument #2 to 'setmetatable' (nil or table expected)")
+		}
+		return []Value{t}
+	})
+	s.register(g, "getmetatable", func(s *State, args []Value) []Value {
+		t, ok := s.checkArg(args, 0, "getmetatable").(*Table)
+		if !ok || t.meta == nil {
+			return []Value{nil}
+		}
+		if protected := t.meta.Get("__metatable"); protected != nil {
+			return []Value{protected}
+		}
+		return []Value{t.meta}
+	})
+}
+
+// protectedCall calls the function catching its errors, except the fatal ones
+func (s *State) protectedCall(fn Value, args []Value) (results []Value, err *Error) {
+	depth, line, chunk := s.depth, s.line, s.chunk
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*Error)
+			if !ok || luaErr.Fatal {
+				panic(r)
+			}
+			s.depth, s.line, s.chunk = depth, line, chunk
+			err = luaErr
+		}
+	}()
+
+	return s.call(fn, args), nil
+}
+
+func tableUnpack(s *State, args []Value) []Value {
+	t := s.checkTable(args, 0, "unpack")
+	i := s.optInt(args, 1, "unpack", 1)
+	j := s.optInt(args, 2, "unpack", t.Len())
+	if i > j {
+		return nil
+	}
+	if j-i >= 8000 {
+		s.Errorf("too many results to unpack")
+	}
+	values := make([]Value, 0, j-i+1)
+	for k := i; k <= j; k++ {
+		values = append(values, t.GetInt(k))
+	}
+	return values
+}
+
+func openTable(s *State) {
+	t := NewTable()
+	s.Globals.Set("table", t)
+
+	s.register(t, "insert", func(s *State, args []Value) []Value {
+		list := s.checkTable(args, 0, "insert")
+		n := list.Len()
+		switch len(args) {
+		case 2:
+			list.Set(float64(n+1), args[1])
+		case 3:
+			pos := s.checkInt(args, 1, "insert")
+			if pos < 1 || pos > n+1 {
+				s.Errorf("bad argument #2 to 'insert' (position out of bounds)")
+			}
+			for i := n; i >= pos; i-- {
+				list.Set(float64(i+1), list.GetInt(i))
+			}
+			list.Set(float64(pos), args[2])
+		default:
+			s.Errorf("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	s.register(t, "remove", func(s *State, args []Value) []Value {
+		list := s.checkTable(args, 0, "remove")
+		n := list.Len()
+		if n == 0 {
+			return []Value{nil}
+		}
+		pos := s.optInt(args, 1, "remove", n)
+		if pos < 1 || pos > n {
+			return []Value{nil}
+		}
+		removed := list.GetInt(pos)
+		for i := pos; i < n; i++ {
+			list.Set(float64(i), list.GetInt(i+1))
+		}
+		list.Set(float64(n), nil)
+		return []Value{removed}
+	})
+	s.register(t, "concat", func(s *State, args []Value) []Value {
+		list := s.checkTable(args, 0, "concat")
+		sep := ""
+		if len(args) > 1 && args[1] != nil {
+			sep = s.checkString(args, 1, "concat")
+		}
+		i := s.optInt(args, 2, "concat", 1)
+		j := s.optInt(args, 3, "concat", list.Len())
+		parts := []string{}
+		for k := i; k <= j; k++ {
+			str, ok := toStringCoerce(list.GetInt(k))
+			if !ok {
+				s.Errorf("invalid value (at index %d) in table for 'concat'", k)
+			}
+			parts = append(parts, str)
+		}
+		return []Value{strings.Join(parts, sep)}
+	})
+	s.register(t, "getn", func(s *State, args []Value) []Value {
+		return []Value{float64(s.checkTable(args, 0, "getn").Len())}
+	})
+	s.register(t, "sort", func(s *State, args []Value) []Value {
+		list := s.checkTable(args, 0, "sort")
+		var less Value
+		if len(args) > 1 {
+			less = args[1]
+		}
+		values := make([]Value, list.Len())
+		for i := range values {
+			values[i] = list.GetInt(i + 1)
+		}
+		sort.SliceStable(values, func(i, j int) bool {
+			if less != nil {
+				return Truthy(first(s.call(less, []Value{values[i], values[j]})))
+			}
+			return s.lessThan(values[i], values[j])
+		})
+		for i, v := range values {
+			list.Set(float64(i+1), v)
+		}
+		return nil
+	})
+	s.register(t, "unpack", tableUnpack)
+}
+
+func openMath(s *State) {
+	m := NewTable()
+	s.Globals.Set("math", m)
+	m.Set("pi", math.Pi)
+	m.Set("huge", math.Inf(1))
+
+	unary := map[string]func(float64) float64{
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+		"abs":   math.Abs,
+		"sqrt":  math.Sqrt,
+		"exp":   math.Exp,
+		"sin":   math.Sin,
+		"cos":   math.Cos,
+		"tan":   math.Tan,
+		"log10": math.Log10,
+	}
+	for name, fn := range unary {
+		s.register(m, name, func(s *State, args []Value) []Value {
+			return []Value{fn(s.checkNumber(args, 0, name))}
+		})
+	}
+	s.register(m, "log", func(s *State, args []Value) []Value {
+		x := s.checkNumber(args, 0, "log")
+		if len(args) > 1 {
+			return []Value{math.Log(x) / math.Log(s.checkNumber(args, 1, "log"))}
+		}
+		return []Value{math.Log(x)}
+	})
+	s.register(m, "pow", func(s *State, args []Value) []Value {
+		return []Value{math.Pow(s.checkNumber(args, 0, "pow"), s.checkNumber(args, 1, "pow"))}
+	})
+	s.register(m, "fmod", func(s *State, args []Value) []Value {
+		return []Value{math.Mod(s.checkNumber(args, 0, "fmod"), s.checkNumber(args, 1, "fmod"))}
+	})
+	s.register(m, "modf", func(s *State, args []Value) []Value {
+		i, f := math.Modf(s.checkNumber(args, 0, "modf"))
+		return []Value{i, f}
+	})
+	s.register(m, "max", func(s *State, args []Value) []Value {
+		max := s.checkNumber(args, 0, "max")
+		for i := 1; i < len(args); i++ {
+			max = math.Max(max, s.checkNumber(args, i, "max"))
+		}
+		return []Value{max}
+	})
+	s.register(m, "min", func(s *State, args []Value) []Value {
+		min := s.checkNumber(args, 0, "min")
+		for i := 1; i < len(args); i++ {
+			min = math.Min(min, s.checkNumber(args, i, "min"))
+		}
+		return []Value{min}
+	})
+
+	// scripts get the same sequence of random numbers on every run, so they
+	// have the same effects wherever they run
+	rng := rand.New(rand.NewSource(0))
+	s.register(m, "random", func(s *State, args []Value) []Value {
+		switch len(args) {
+		case 0:
+			return []Value{rng.Float64()}
+		case 1:
+			upper := s.checkInt(args, 0, "random")
+			if upper < 1 {
+				s.Errorf("bad argument #1 to 'random' (interval is empty)")
+			}
+			return []Value{float64(rng.Intn(upper) + 1)}
+		}
+		lower, upper := s.checkInt(args, 0, "random"), s.checkInt(args, 1, "random")
+		if lower > upper {
+			s.Errorf("bad argument #2 to 'random' (interval is empty)")
+		}
+		return []Value{float64(lower + rng.Intn(upper-lower+1))}
+	})
+	s.register(m, "randomseed", func(s *State, args []Value) []Value {
+		rng.Seed(int64(s.checkNumber(args, 0, "randomseed")))
+		return nil
+	})
+}
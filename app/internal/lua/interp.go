@@ -0,0 +1,675 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// maxCallDepth bounds recursion, raising "stack overflow" instead of
+	// exhausting the memory of the server
+	maxCallDepth = 200
+	// the interrupt hook is checked every hookInterval loop iterations or calls
+	hookInterval = 1000
+)
+
+// State is an isolated lua environment with its own globals
+type State struct {
+	Globals *Table
+	// Interrupt is called periodically while running, an error stops the
+	// running code with a fatal error that pcall can't catch
+	Interrupt func() error
+	// strings is the table of the string library, used to index strings
+	strings *Table
+	depth   int
+	steps   int
+	line    int
+	chunk   string
+	// protected rejects creating globals or reading missing ones
+	protected bool
+}
+
+// NewState creates an environment with the sandboxed standard library: the
+// base functions, string, table and math, but nothing to reach the system.
+func NewState() *State {
+	s := &State{Globals: NewTable()}
+	openBase(s)
+	openString(s)
+	openTable(s)
+	openMath(s)
+	return s
+}
+
+// ProtectGlobals makes scripts fail when creating a global variable or when
+// reading one that does not exist, as they are usually typos of locals.
+func (s *State) ProtectGlobals() {
+	s.protected = true
+}
+
+// Load compiles the source into a function, without running it
+func (s *State) Load(chunk, src string) (*Function, error) {
+	proto, err := parse(chunk, src)
+	if err != nil {
+		return nil, err
+	}
+	return &Function{name: proto.name, proto: proto}, nil
+}
+
+// Call runs the function, returning the lua error it raised if any
+func (s *State) Call(fn Value, args ...Value) (results []Value, err error) {
+	depth, line, chunk := s.depth, s.line, s.chunk
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			s.depth, s.line, s.chunk = depth, line, chunk
+			err = luaErr
+		}
+	}()
+
+	return s.call(fn, args), nil
+}
+
+// Errorf raises a lua error prefixed with the current position
+func (s *State) Errorf(format string, args ...any) {
+	panic(&Error{Value: s.where() + fmt.Sprintf(format, args...)})
+}
+
+// RaiseError raises the value as a lua error, as the `error` function does
+func (s *State) RaiseError(value Value) {
+	panic(&Error{Value: value})
+}
+
+func (s *State) where() string {
+	if s.chunk == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: ", s.chunk, s.line)
+}
+
+func (s *State) step() {
+	s.steps++
+	if s.steps%hookInterval != 0 || s.Interrupt == nil {
+		return
+	}
+	if err := s.Interrupt(); err != nil {
+		panic(&Error{Value: err.Error(), Fatal: true})
+	}
+}
+
+type frame struct {
+	slots   []*cell
+	upvals  []*cell
+	varargs []Value
+	ret     []Value
+}
+
+type flow int
+
+const (
+	flowNormal flow = iota
+	flowBreak
+	flowReturn
+)
+
+func (s *State) call(fn Value, args []Value) []Value {
+	f, ok := fn.(*Function)
+	if !ok {
+		s.Errorf("attempt to call a %s value", TypeName(fn))
+	}
+
+	s.step()
+	if s.depth >= maxCallDepth {
+		s.Errorf("stack overflow")
+	}
+	s.depth++
+	callerLine, callerChunk := s.line, s.chunk
+	defer func() {
+		s.depth--
+		s.line, s.chunk = callerLine, callerChunk
+	}()
+
+	if f.native != nil {
+		return f.native(s, args)
+	}
+
+	proto := f.proto
+	fr := &frame{slots: make([]*cell, proto.numSlots), upvals: f.upvals}
+	for i, slot := range proto.params {
+		c := &cell{}
+		if i < len(args) {
+			c.v = args[i]
+		}
+		fr.slots[slot] = c
+	}
+	if proto.isVararg && len(args) > len(proto.params) {
+		fr.varargs = args[len(proto.params):]
+	}
+
+	s.chunk, s.line = proto.chunk, proto.line
+	if s.execBlock(fr, proto.body) == flowReturn {
+		return fr.ret
+	}
+	return nil
+}
+
+func (s *State) execBlock(fr *frame, body []stmt) flow {
+	for _, st := range body {
+		if f := s.exec(fr, st); f != flowNormal {
+			return f
+		}
+	}
+	return flowNormal
+}
+
+func (s *State) exec(fr *frame, st stmt) flow {
+	switch st := st.(type) {
+	case *localStmt:
+		s.line = st.line
+		values := s.evalList(fr, st.exprs, len(st.slots))
+		for i, slot := range st.slots {
+			fr.slots[slot] = &cell{v: values[i]}
+		}
+
+	case *assignStmt:
+		s.line = st.line
+		if len(st.targets) == 1 && len(st.exprs) == 1 {
+			s.assign(fr, st.targets[0], s.eval(fr, st.exprs[0]))
+			return flowNormal
+		}
+		// every expression is evaluated before assigning any of them
+		type pending struct {
+			obj Value
+			key Value
+		}
+		targets := make([]pending, len(st.targets))
+		for i, target := range st.targets {
+			if index, ok := target.(*indexExpr); ok {
+				targets[i] = pending{obj: s.eval(fr, index.obj), key: s.eval(fr, index.key)}
+			}
+		}
+		values := s.evalList(fr, st.exprs, len(st.targets))
+		for i, target := range st.targets {
+			if _, ok := target.(*indexExpr); ok {
+				s.setIndex(targets[i].obj, targets[i].key, values[i])
+				continue
+			}
+			s.assign(fr, target, values[i])
+		}
+
+	case *callStmt:
+		s.line = st.line
+		s.evalMulti(fr, st.call)
+
+	case *doStmt:
+		return s.execBlock(fr, st.body)
+
+	case *whileStmt:
+		for {
+			s.line = st.line
+			if !Truthy(s.eval(fr, st.cond)) {
+				break
+			}
+			s.step()
+			if f := s.execBlock(fr, st.body); f == flowBreak {
+				break
+			} else if f == flowReturn {
+				return f
+			}
+		}
+
+	case *repeatStmt:
+		for {
+			s.step()
+			f := s.execBlock(fr, st.body)
+			if f == flowBreak {
+				break
+			} else if f == flowReturn {
+				return f
+			}
+			s.line = st.line
+			if Truthy(s.eval(fr, st.cond)) {
+				break
+			}
+		}
+
+	case *ifStmt:
+		s.line = st.line
+		for i, cond := range st.conds {
+			if Truthy(s.eval(fr, cond)) {
+				return s.execBlock(fr, st.blocks[i])
+			}
+		}
+		if st.elseBody != nil {
+			return s.execBlock(fr, st.elseBody)
+		}
+
+	case *numericForStmt:
+		return s.execNumericFor(fr, st)
+
+	case *genericForStmt:
+		return s.execGenericFor(fr, st)
+
+	case *localFunctionStmt:
+		c := &cell{}
+		fr.slots[st.slot] = c
+		c.v = s.closure(fr, st.proto)
+
+	case *returnStmt:
+		s.line = st.line
+		// a tail call returns every value of the called function
+		fr.ret = s.evalList(fr, st.exprs, -1)
+		return flowReturn
+
+	case *breakStmt:
+		return flowBreak
+	}
+	return flowNormal
+}
+
+func (s *State) execNumericFor(fr *frame, st *numericForStmt) flow {
+	s.line = st.line
+	start, ok1 := ToNumber(s.eval(fr, st.start))
+	limit, ok2 := ToNumber(s.eval(fr, st.limit))
+	step := 1.0
+	ok3 := true
+	if st.step != nil {
+		step, ok3 = ToNumber(s.eval(fr, st.step))
+	}
+	switch {
+	case !ok1:
+		s.Errorf("'for' initial value must be a number")
+	case !ok2:
+		s.Errorf("'for' limit must be a number")
+	case !ok3:
+		s.Errorf("'for' step must be a number")
+	}
+
+	for i := start; step > 0 && i <= limit || step <= 0 && i >= limit; i += step {
+		s.step()
+		fr.slots[st.slot] = &cell{v: i}
+		if f := s.execBlock(fr, st.body); f == flowBreak {
+			break
+		} else if f == flowReturn {
+			return f
+		}
+	}
+	return flowNormal
+}
+
+func (s *State) execGenericFor(fr *frame, st *genericForStmt) flow {
+	s.line = st.line
+	values := s.evalList(fr, st.exprs, 3)
+	iterator, state, control := values[0], values[1], values[2]
+
+	for {
+		s.line = st.line
+		results := s.call(iterator, []Value{state, control})
+		first := Value(nil)
+		if len(results) > 0 {
+			first = results[0]
+		}
+		if first == nil {
+			break
+		}
+		control = first
+		for i, slot := range st.slots {
+			c := &cell{}
+			if i < len(results) {
+				c.v = results[i]
+			}
+			fr.slots[slot] = c
+		}
+		if f := s.execBlock(fr, st.body); f == flowBreak {
+			break
+		} else if f == flowReturn {
+			return f
+		}
+	}
+	return flowNormal
+}
+
+func (s *State) closure(fr *frame, proto *funcProto) *Function {
+	f := &Function{name: proto.name, proto: proto, upvals: make([]*cell, len(proto.upvals))}
+	for i, desc := range proto.upvals {
+		if desc.fromLocal {
+			f.upvals[i] = fr.slots[desc.index]
+		} else {
+			f.upvals[i] = fr.upvals[desc.index]
+		}
+	}
+	return f
+}
+
+func (s *State) assign(fr *frame, target expr, value Value) {
+	switch t := target.(type) {
+	case *localExpr:
+		fr.slots[t.slot].v = value
+	case *upvalExpr:
+		fr.upvals[t.index].v = value
+	case *globalExpr:
+		if s.protected && s.Globals.Get(t.name) == nil {
+			s.Errorf("Script attempted to create global variable '%s'", t.name)
+		}
+		s.Globals.Set(t.name, value)
+	case *indexExpr:
+		s.line = t.line
+		s.setIndex(s.eval(fr, t.obj), s.eval(fr, t.key), value)
+	}
+}
+
+// evalList evaluates the expressions adjusting them to want values, the last
+// expression expanding to all its values. A negative want keeps them all.
+func (s *State) evalList(fr *frame, exprs []expr, want int) []Value {
+	values := make([]Value, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			values = append(values, s.evalMulti(fr, e)...)
+		} else {
+			values = append(values, s.eval(fr, e))
+		}
+	}
+	if want < 0 {
+		return values
+	}
+	for len(values) < want {
+		values = append(values, nil)
+	}
+	return values[:want]
+}
+
+// evalMulti evaluates an expression that may result in many values
+func (s *State) evalMulti(fr *frame, e expr) []Value {
+	switch e := e.(type) {
+	case *callExpr:
+		fn := s.eval(fr, e.fn)
+		args := s.evalList(fr, e.args, -1)
+		s.line = e.line
+		if _, ok := fn.(*Function); !ok {
+			s.Errorf("attempt to call %s", describe(e.fn, fn))
+		}
+		return s.call(fn, args)
+	case *methodCallExpr:
+		obj := s.eval(fr, e.obj)
+		s.line = e.line
+		fn := s.index(obj, e.name)
+		if _, ok := fn.(*Function); !ok {
+			s.Errorf("attempt to call method '%s' (a %s value)", e.name, TypeName(fn))
+		}
+		args := append([]Value{obj}, s.evalList(fr, e.args, -1)...)
+		s.line = e.line
+		return s.call(fn, args)
+	case *varargExpr:
+		return fr.varargs
+	}
+	return []Value{s.eval(fr, e)}
+}
+
+func (s *State) eval(fr *frame, e expr) Value {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.value
+	case *localExpr:
+		return fr.slots[e.slot].v
+	case *upvalExpr:
+		return fr.upvals[e.index].v
+	case *globalExpr:
+		v := s.Globals.Get(e.name)
+		if v == nil && s.protected {
+			s.Errorf("Script attempted to access nonexistent global variable '%s'", e.name)
+		}
+		return v
+	case *indexExpr:
+		obj := s.eval(fr, e.obj)
+		key := s.eval(fr, e.key)
+		s.line = e.line
+		if _, ok := obj.(*Table); !ok {
+			if _, ok := obj.(string); !ok {
+				s.Errorf("attempt to index %s", describe(e.obj, obj))
+			}
+		}
+		return s.index(obj, key)
+	case *callExpr, *methodCallExpr, *varargExpr:
+		values := s.evalMulti(fr, e)
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	case *parenExpr:
+		return s.eval(fr, e.expr)
+	case *functionExpr:
+		return s.closure(fr, e.proto)
+	case *andExpr:
+		lhs := s.eval(fr, e.lhs)
+		if !Truthy(lhs) {
+			return lhs
+		}
+		return s.eval(fr, e.rhs)
+	case *orExpr:
+		lhs := s.eval(fr, e.lhs)
+		if Truthy(lhs) {
+			return lhs
+		}
+		return s.eval(fr, e.rhs)
+	case *unaryExpr:
+		v := s.eval(fr, e.expr)
+		s.line = e.line
+		return s.unary(e.op, v, e.expr)
+	case *binaryExpr:
+		lhs := s.eval(fr, e.lhs)
+		rhs := s.eval(fr, e.rhs)
+		s.line = e.line
+		return s.arith(e.op, lhs, rhs, e)
+	case *tableExpr:
+		return s.evalTable(fr, e)
+	}
+	panic(fmt.Sprintf("lua: unknown expression %T", e))
+}
+
+func (s *State) evalTable(fr *frame, e *tableExpr) *Table {
+	t := NewTable()
+	n := 0
+	for i, field := range e.fields {
+		if field.key != nil {
+			key := s.eval(fr, field.key)
+			s.checkKey(key)
+			t.Set(key, s.eval(fr, field.value))
+			continue
+		}
+		values := []Value{nil}
+		if i == len(e.fields)-1 {
+			values = s.evalMulti(fr, field.value)
+		} else {
+			values[0] = s.eval(fr, field.value)
+		}
+		for _, v := range values {
+			n++
+			t.Set(float64(n), v)
+		}
+	}
+	return t
+}
+
+// describe names the expression a bad value came from in error messages
+func describe(e expr, v Value) string {
+	switch e := e.(type) {
+	case *globalExpr:
+		return fmt.Sprintf("global '%s' (a %s value)", e.name, TypeName(v))
+	case *localExpr:
+		return fmt.Sprintf("local '%s' (a %s value)", e.name, TypeName(v))
+	case *upvalExpr:
+		return fmt.Sprintf("upvalue '%s' (a %s value)", e.name, TypeName(v))
+	case *indexExpr:
+		if c, ok := e.key.(*constExpr); ok {
+			if name, ok := c.value.(string); ok {
+				return fmt.Sprintf("field '%s' (a %s value)", name, TypeName(v))
+			}
+		}
+	}
+	return fmt.Sprintf("a %s value", TypeName(v))
+}
+
+func (s *State) checkKey(key Value) {
+	if key == nil {
+		s.Errorf("table index is nil")
+	}
+	if n, ok := key.(float64); ok && math.IsNaN(n) {
+		s.Errorf("table index is NaN")
+	}
+}
+
+// index reads obj[key], following the __index metamethod
+func (s *State) index(obj Value, key Value) Value {
+	for loop := 0; loop < 100; loop++ {
+		switch o := obj.(type) {
+		case *Table:
+			v := o.Get(key)
+			if v != nil || o.meta == nil {
+				return v
+			}
+			handler := o.meta.Get("__index")
+			if handler == nil {
+				return nil
+			}
+			if fn, ok := handler.(*Function); ok {
+				return first(s.call(fn, []Value{o, key}))
+			}
+			obj = handler
+		case string:
+			return s.strings.Get(key)
+		default:
+			s.Errorf("attempt to index a %s value", TypeName(obj))
+		}
+	}
+	s.Errorf("loop in gettable")
+	return nil
+}
+
+// setIndex assigns obj[key], following the __newindex metamethod
+func (s *State) setIndex(obj Value, key Value, value Value) {
+	for loop := 0; loop < 100; loop++ {
+		t, ok := obj.(*Table)
+		if !ok {
+			s.Errorf("attempt to index a %s value", TypeName(obj))
+		}
+		if t.meta != nil && t.Get(key) == nil {
+			if handler := t.meta.Get("__newindex"); handler != nil {
+				if fn, ok := handler.(*Function); ok {
+					s.call(fn, []Value{t, key, value})
+					return
+				}
+				obj = handler
+				continue
+			}
+		}
+		s.checkKey(key)
+		t.Set(key, value)
+		return
+	}
+	s.Errorf("loop in settable")
+}
+
+func first(values []Value) Value {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+func (s *State) unary(op int, v Value, operand expr) Value {
+	switch op {
+	case opNot:
+		return !Truthy(v)
+	case opNeg:
+		n, ok := ToNumber(v)
+		if !ok {
+			s.Errorf("attempt to perform arithmetic on %s", describe(operand, v))
+		}
+		return -n
+	}
+
+	switch x := v.(type) {
+	case string:
+		return float64(len(x))
+	case *Table:
+		return float64(x.Len())
+	}
+	s.Errorf("attempt to get length of %s", describe(operand, v))
+	return nil
+}
+
+func (s *State) arith(op int, lhs, rhs Value, e *binaryExpr) Value {
+	switch op {
+	case opEq:
+		return rawEqual(lhs, rhs)
+	case opNe:
+		return !rawEqual(lhs, rhs)
+	case opLt:
+		return s.lessThan(lhs, rhs)
+	case opLe:
+		return !s.lessThan(rhs, lhs)
+	case opGt:
+		return s.lessThan(rhs, lhs)
+	case opGe:
+		return !s.lessThan(lhs, rhs)
+	case opConcat:
+		a, ok1 := toStringCoerce(lhs)
+		b, ok2 := toStringCoerce(rhs)
+		if !ok1 {
+			s.Errorf("attempt to concatenate %s", describe(e.lhs, lhs))
+		}
+		if !ok2 {
+			s.Errorf("attempt to concatenate %s", describe(e.rhs, rhs))
+		}
+		return a + b
+	}
+
+	a, ok1 := ToNumber(lhs)
+	b, ok2 := ToNumber(rhs)
+	if !ok1 {
+		s.Errorf("attempt to perform arithmetic on %s", describe(e.lhs, lhs))
+	}
+	if !ok2 {
+		s.Errorf("attempt to perform arithmetic on %s", describe(e.rhs, rhs))
+	}
+	switch op {
+	case opAdd:
+		return a + b
+	case opSub:
+		return a - b
+	case opMul:
+		return a * b
+	case opDiv:
+		return a / b
+	case opMod:
+		return a - math.Floor(a/b)*b
+	case opPow:
+		return math.Pow(a, b)
+	}
+	return nil
+}
+
+func rawEqual(a, b Value) bool {
+	return a == b
+}
+
+func (s *State) lessThan(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y) < 0
+		}
+	}
+	if TypeName(a) == TypeName(b) {
+		s.Errorf("attempt to compare two %s values", TypeName(a))
+	}
+	s.Errorf("attempt to compare %s with %s", TypeName(a), TypeName(b))
+	return false
+}
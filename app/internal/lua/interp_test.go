@@ -0,0 +1,229 @@
+package lua
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// run compiles and calls the source in a new state with protected globals
+func run(src string) ([]Value, error) {
+	s := NewState()
+	s.ProtectGlobals()
+	fn, err := s.Load("test", src)
+	if err != nil {
+		return nil, err
+	}
+	return s.Call(fn)
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Value
+	}{
+		{"precedence", "return 1 + 2 * 3 - 4 / 2", []Value{5.0}},
+		{"power", "return 2 ^ 10, 2 ^ 3 ^ 2, -2 ^ 2", []Value{1024.0, 512.0, -4.0}},
+		{"modulo", "return 7 % 3, -7 % 3, 7 % -3, 5.5 % 2", []Value{1.0, 2.0, -2.0, 1.5}},
+		{"division", "return 10 / 4, 1 / 0, -1 / 0", []Value{2.5, math.Inf(1), math.Inf(-1)}},
+		{"nan", "local nan = 0 / 0 return nan ~= nan", []Value{true}},
+		{"string coercion", "return '10' + 5, '0x10' * 1, 1 .. 2", []Value{15.0, 16.0, "12"}},
+		{"comparison", "return 1 < 2, 'a' < 'b', 'b' <= 'a', 1 == '1'", []Value{true, true, false, false}},
+		{"logic", "return nil or 'x', false and 1, 0 and 'zero is true', not nil", []Value{"x", false, "zero is true", true}},
+		{"length", "return #'abc', #{1, 2, 3}", []Value{3.0, 3.0}},
+		{"concat numbers", "return 1.5 .. '|' .. 10", []Value{"1.5|10"}},
+		{"escapes", `return "tab\tnew\nline\065\\"`, []Value{"tab\tnew\nlineA\\"}},
+		{
+			name: "numeric for",
+			src:  "local s = 0 for i = 10, 1, -2 do s = s + i end return s",
+			want: []Value{30.0},
+		},
+		{
+			name: "while and break",
+			src:  "local i = 0 while true do i = i + 1 if i == 5 then break end end return i",
+			want: []Value{5.0},
+		},
+		{
+			name: "repeat sees its body locals",
+			src:  "local n = 0 repeat local done = n >= 3 n = n + 1 until done return n",
+			want: []Value{4.0},
+		},
+		{
+			name: "closures keep their own upvalues",
+			src: `
+local function counter()
+	local n = 0
+	return function() n = n + 1 return n end
+end
+local a, b = counter(), counter()
+a() a()
+return a(), b()`,
+			want: []Value{3.0, 1.0},
+		},
+		{
+			name: "varargs",
+			src:  "local function f(...) return select('#', ...), ... end return f(1, nil, 3)",
+			want: []Value{3.0, 1.0, nil, 3.0},
+		},
+		{
+			name: "multiple results are truncated in the middle of a list",
+			src:  "local function f() return 1, 2 end local t = {f(), f()} return #t, (f())",
+			want: []Value{3.0, 1.0},
+		},
+		{
+			name: "generic for",
+			src:  "local t = {} for k, v in pairs({a = 1, b = 2}) do t[#t + 1] = k .. v end table.sort(t) return table.concat(t, ',')",
+			want: []Value{"a1,b2"},
+		},
+		{
+			name: "methods",
+			src:  "local obj = {n = 2} function obj:double() return self.n * 2 end return obj:double()",
+			want: []Value{4.0},
+		},
+		{
+			name: "metatables",
+			src:  "local t = setmetatable({}, {__index = function(_, k) return k .. '!' end}) return t.hi",
+			want: []Value{"hi!"},
+		},
+		{
+			name: "string library",
+			src:  "return string.format('%d-%s-%.2f', 3, 'x', 1.5), ('abc'):upper(), string.rep('ab', 3)",
+			want: []Value{"3-x-1.50", "ABC", "ababab"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(tt.src)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("run = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"arithmetic on a string", "return 'a' + 1", "test:1: attempt to perform arithmetic on a string value"},
+		{"arithmetic on a table", "return {} * 2", "test:1: attempt to perform arithmetic on a table value"},
+		{"comparing types", "return 1 < 'a'", "test:1: attempt to compare number with string"},
+		{"indexing nil", "local t\nreturn t.x", "test:2: attempt to index local 't' (a nil value)"},
+		{"calling nil", "local f = nil f()", "test:1: attempt to call local 'f' (a nil value)"},
+		{"error with a position", "error('boom')", "test:1: boom"},
+		{"error with level 0", "error('boom', 0)", "boom"},
+		{"error with a number", "error(42)", "42"},
+		{"missing global", "return missing", "test:1: Script attempted to access nonexistent global variable 'missing'"},
+		{"new global", "created = 1", "test:1: Script attempted to create global variable 'created'"},
+		{"stack overflow", "local function f() return f() + 1 end return f()", "test:1: stack overflow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(tt.src)
+			var luaErr *Error
+			if !errors.As(err, &luaErr) || err.Error() != tt.want {
+				t.Errorf("run: err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPcall(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Value
+	}{
+		{"success", "return pcall(function(a, b) return a + b, 'ok' end, 1, 2)", []Value{true, 3.0, "ok"}},
+		{"error", "return pcall(error, 'boom', 0)", []Value{false, "boom"}},
+		{"error with a position", "return pcall(function() error('boom') end)", []Value{false, "test:1: boom"}},
+		{"runtime error", "return pcall(function() local x return x.y end)", []Value{false, "test:1: attempt to index local 'x' (a nil value)"}},
+		{"error without a value", "return select('#', pcall(error))", []Value{2.0}},
+		{"error table", "local ok, err = pcall(error, {code = 7}) return ok, err.code", []Value{false, 7.0}},
+		{"nested", "return pcall(pcall, error, 'x', 0)", []Value{true, false, "x"}},
+		{
+			name: "the state is usable after an error",
+			src:  "local function f(n) if n == 0 then error('bottom') end return f(n - 1) end pcall(f, 50) return 1",
+			want: []Value{1.0},
+		},
+		{
+			name: "rethrowing",
+			src:  "local ok, err = pcall(error, 'first', 0) return pcall(error, err .. ' again', 0)",
+			want: []Value{false, "first again"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(tt.src)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("run = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	s := NewState()
+	stop := errors.New("stopped")
+	calls := 0
+	s.Interrupt = func() error {
+		calls++
+		return stop
+	}
+	fn, err := s.Load("test", "while true do pcall(function() end) end")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// the interrupt stops the loop, which pcall can't catch
+	_, err = s.Call(fn)
+	var luaErr *Error
+	if !errors.As(err, &luaErr) || !luaErr.Fatal || err.Error() != "stopped" {
+		t.Fatalf("Call: err = %v, want the fatal error %q", err, "stopped")
+	}
+	if calls != 1 {
+		t.Errorf("Interrupt called %d times, want 1", calls)
+	}
+
+	s.Interrupt = nil
+	fn, err = s.Load("test", "return 1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got, err := s.Call(fn); err != nil || !reflect.DeepEqual(got, []Value{1.0}) {
+		t.Errorf("Call after the interrupt = %v, %v, want [1]", got, err)
+	}
+}
+
+func TestGoFunctions(t *testing.T) {
+	s := NewState()
+	s.Globals.Set("fail", NewFunction("fail", func(s *State, args []Value) []Value {
+		s.Errorf("failed with %d arguments", len(args))
+		return nil
+	}))
+	s.Globals.Set("raise", NewFunction("raise", func(s *State, args []Value) []Value {
+		s.RaiseError(args[0])
+		return nil
+	}))
+	fn, err := s.Load("test", "local ok, err = pcall(fail, 1, 2) local t = {} return ok, err, select(2, pcall(raise, t)) == t")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	got, err := s.Call(fn)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if want := []Value{false, "test:1: failed with 2 arguments", true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Call = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,389 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokChar
+	tokName
+	tokNumber
+	tokString
+	// keywords
+	tokAnd
+	tokBreak
+	tokDo
+	tokElse
+	tokElseif
+	tokEnd
+	tokFalse
+	tokFor
+	tokFunction
+	tokIf
+	tokIn
+	tokLocal
+	tokNil
+	tokNot
+	tokOr
+	tokRepeat
+	tokReturn
+	tokThen
+	tokTrue
+	tokUntil
+	tokWhile
+	// operators made of more than one character, single characters are tokChar
+	tokConcat
+	tokDots
+	tokEq
+	tokGe
+	tokLe
+	tokNe
+)
+
+var keywords = map[string]tokenType{
+	"and":      tokAnd,
+	"break":    tokBreak,
+	"do":       tokDo,
+	"else":     tokElse,
+	"elseif":   tokElseif,
+	"end":      tokEnd,
+	"false":    tokFalse,
+	"for":      tokFor,
+	"function": tokFunction,
+	"if":       tokIf,
+	"in":       tokIn,
+	"local":    tokLocal,
+	"nil":      tokNil,
+	"not":      tokNot,
+	"or":       tokOr,
+	"repeat":   tokRepeat,
+	"return":   tokReturn,
+	"then":     tokThen,
+	"true":     tokTrue,
+	"until":    tokUntil,
+	"while":    tokWhile,
+}
+
+type token struct {
+	typ  tokenType
+	char byte
+	text string
+	num  float64
+	line int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "<eof>"
+	case tokChar:
+		return string(t.char)
+	}
+	return t.text
+}
+
+type lexer struct {
+	chunk string
+	src   string
+	pos   int
+	line  int
+}
+
+func newLexer(chunk, src string) *lexer {
+	// a first line starting with # is skipped, like the lua interpreter does
+	if strings.HasPrefix(src, "#") {
+		if i := strings.IndexByte(src, '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = ""
+		}
+	}
+	return &lexer{chunk: chunk, src: src, line: 1}
+}
+
+func (l *lexer) errorf(format string, args ...any) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", l.chunk, l.line, fmt.Sprintf(format, args...))})
+}
+
+func (l *lexer) peekByte(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *lexer) next() token {
+	l.skipSpaces()
+	if l.pos >= len(l.src) {
+		return token{typ: tokEOF, line: l.line}
+	}
+
+	c := l.src[l.pos]
+	tok := token{line: l.line}
+	switch {
+	case isAlpha(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		tok.text = l.src[start:l.pos]
+		if kw, ok := keywords[tok.text]; ok {
+			tok.typ = kw
+		} else {
+			tok.typ = tokName
+		}
+		return tok
+	case isDigit(c) || c == '.' && isDigit(l.peekByte(1)):
+		return l.readNumber(tok)
+	case c == '"' || c == '\'':
+		tok.typ = tokString
+		tok.text = l.readString(c)
+		return tok
+	case c == '[' && (l.peekByte(1) == '[' || l.peekByte(1) == '='):
+		if level, ok := l.longBracketLevel(); ok {
+			tok.typ = tokString
+			tok.text = l.readLongString(level)
+			return tok
+		}
+	}
+
+	two := ""
+	if l.pos+1 < len(l.src) {
+		two = l.src[l.pos : l.pos+2]
+	}
+	switch two {
+	case "==":
+		tok.typ, tok.text = tokEq, two
+	case "~=":
+		tok.typ, tok.text = tokNe, two
+	case "<=":
+		tok.typ, tok.text = tokLe, two
+	case ">=":
+		tok.typ, tok.text = tokGe, two
+	case "..":
+		if l.peekByte(2) == '.' {
+			l.pos += 3
+			return token{typ: tokDots, text: "...", line: l.line}
+		}
+		tok.typ, tok.text = tokConcat, two
+	}
+	if tok.text != "" {
+		l.pos += 2
+		return tok
+	}
+
+	if !strings.ContainsRune("+-*/%^#<>=(){}[];:,.", rune(c)) {
+		l.errorf("unexpected symbol near '%c'", c)
+	}
+	l.pos++
+	tok.typ = tokChar
+	tok.char = c
+	return tok
+}
+
+func (l *lexer) skipSpaces() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case c == '-' && l.peekByte(1) == '-':
+			l.pos += 2
+			if l.peekByte(0) == '[' {
+				if level, ok := l.longBracketLevel(); ok {
+					l.readLongString(level)
+					continue
+				}
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) readNumber(tok token) token {
+	start := l.pos
+	if l.src[l.pos] == '0' && (l.peekByte(1) == 'x' || l.peekByte(1) == 'X') {
+		l.pos += 2
+		for l.pos < len(l.src) && isHexDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	} else {
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if (c == '+' || c == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') {
+				l.pos++
+				continue
+			}
+			if !isDigit(c) && c != '.' && c != 'e' && c != 'E' {
+				break
+			}
+			l.pos++
+		}
+	}
+	for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+
+	tok.typ = tokNumber
+	tok.text = l.src[start:l.pos]
+	num, ok := parseNumber(tok.text)
+	if !ok {
+		l.errorf("malformed number near '%s'", tok.text)
+	}
+	tok.num = num
+	return tok
+}
+
+func (l *lexer) readString(quote byte) string {
+	l.pos++
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			l.errorf("unfinished string")
+		}
+		c := l.src[l.pos]
+		switch c {
+		case quote:
+			l.pos++
+			return sb.String()
+		case '\n':
+			l.errorf("unfinished string")
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				l.errorf("unfinished string")
+			}
+			e := l.src[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'a':
+				sb.WriteByte('\a')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'v':
+				sb.WriteByte('\v')
+			case '\n':
+				l.line++
+				sb.WriteByte('\n')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			default:
+				if !isDigit(e) {
+					l.errorf("invalid escape sequence '\\%c'", e)
+				}
+				n := int(e - '0')
+				for i := 0; i < 2 && l.pos < len(l.src) && isDigit(l.src[l.pos]); i++ {
+					n = n*10 + int(l.src[l.pos]-'0')
+					l.pos++
+				}
+				if n > 255 {
+					l.errorf("escape sequence too large")
+				}
+				sb.WriteByte(byte(n))
+			}
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+}
+
+// longBracketLevel checks for an opening long bracket like `[[` or `[==[`
+// at the current position, returning its number of `=`.
+func (l *lexer) longBracketLevel() (int, bool) {
+	level := 0
+	for l.peekByte(1+level) == '=' {
+		level++
+	}
+	return level, l.peekByte(1+level) == '['
+}
+
+func (l *lexer) readLongString(level int) string {
+	l.pos += level + 2
+	// a newline right after the opening bracket is skipped
+	if l.peekByte(0) == '\r' {
+		l.pos++
+	}
+	if l.peekByte(0) == '\n' {
+		l.line++
+		l.pos++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		l.errorf("unfinished long string")
+	}
+	text := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(text, "\n")
+	l.pos += end + len(closing)
+	return text
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// parseNumber converts a numeral, decimal or hexadecimal, as the lua tonumber does
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	// strconv accepts forms lua does not, like "inf", "nan" or underscores
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
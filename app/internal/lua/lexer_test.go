@@ -0,0 +1,155 @@
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// lexAll returns the tokens of the source up to the end, or the error raised
+// by the lexer
+func lexAll(src string) (tokens []token, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = luaErr
+		}
+	}()
+
+	l := newLexer("test", src)
+	for {
+		tok := l.next()
+		if tok.typ == tokEOF {
+			return tokens, nil
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+func TestLexerTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []token
+	}{
+		{
+			name: "keywords and names",
+			src:  "local x = nil and_or",
+			want: []token{
+				{typ: tokLocal, text: "local", line: 1},
+				{typ: tokName, text: "x", line: 1},
+				{typ: tokChar, char: '=', line: 1},
+				{typ: tokNil, text: "nil", line: 1},
+				{typ: tokName, text: "and_or", line: 1},
+			},
+		},
+		{
+			name: "operators",
+			src:  "a..b ... == ~= <= >= < #",
+			want: []token{
+				{typ: tokName, text: "a", line: 1},
+				{typ: tokConcat, text: "..", line: 1},
+				{typ: tokName, text: "b", line: 1},
+				{typ: tokDots, text: "...", line: 1},
+				{typ: tokEq, text: "==", line: 1},
+				{typ: tokNe, text: "~=", line: 1},
+				{typ: tokLe, text: "<=", line: 1},
+				{typ: tokGe, text: ">=", line: 1},
+				{typ: tokChar, char: '<', line: 1},
+				{typ: tokChar, char: '#', line: 1},
+			},
+		},
+		{
+			name: "numbers",
+			src:  "3 0.5 .5 1e3 2E-2 0xff",
+			want: []token{
+				{typ: tokNumber, text: "3", num: 3, line: 1},
+				{typ: tokNumber, text: "0.5", num: 0.5, line: 1},
+				{typ: tokNumber, text: ".5", num: 0.5, line: 1},
+				{typ: tokNumber, text: "1e3", num: 1000, line: 1},
+				{typ: tokNumber, text: "2E-2", num: 0.02, line: 1},
+				{typ: tokNumber, text: "0xff", num: 255, line: 1},
+			},
+		},
+		{
+			name: "comments and lines",
+			src:  "#!shebang\na -- comment\n--[==[ long\ncomment ]==]\nb",
+			want: []token{
+				{typ: tokName, text: "a", line: 2},
+				{typ: tokName, text: "b", line: 5},
+			},
+		},
+		{
+			name: "long strings",
+			src:  "[[\nfirst\nsecond]] [==[a]]b]==]",
+			want: []token{
+				{typ: tokString, text: "first\nsecond", line: 1},
+				{typ: tokString, text: "a]]b", line: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lexAll(tt.src)
+			if err != nil {
+				t.Fatalf("lexAll(%q): %v", tt.src, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lexAll(%q) = %+v, want %+v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexerStringEscapes(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`"plain"`, "plain"},
+		{`'single "quotes"'`, `single "quotes"`},
+		{`"a\nb\tc\rd"`, "a\nb\tc\rd"},
+		{`"\a\b\f\v"`, "\a\b\f\v"},
+		{`"\\ \" \'"`, `\ " '`},
+		{`"\65\066\0677"`, "ABC7"},
+		{`"\0end"`, "\x00end"},
+		{`"\255"`, "\xff"},
+		{"\"line\\\nnext\"", "line\nnext"},
+	}
+	for _, tt := range tests {
+		got, err := lexAll(tt.src)
+		if err != nil {
+			t.Errorf("lexAll(%s): %v", tt.src, err)
+			continue
+		}
+		if len(got) != 1 || got[0].typ != tokString || got[0].text != tt.want {
+			t.Errorf("lexAll(%s) = %+v, want the string %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`"unfinished`, "test:1: unfinished string"},
+		{"'new\nline'", "test:1: unfinished string"},
+		{`"\x41"`, `test:1: invalid escape sequence '\x'`},
+		{`"\256"`, "test:1: escape sequence too large"},
+		{"\n[[never closed", "test:2: unfinished long string"},
+		{"3x", "test:1: malformed number near '3x'"},
+		{"0xg", "test:1: malformed number near '0xg'"},
+		{"a @ b", "test:1: unexpected symbol near '@'"},
+	}
+	for _, tt := range tests {
+		_, err := lexAll(tt.src)
+		var luaErr *Error
+		if !errors.As(err, &luaErr) || err.Error() != tt.want {
+			t.Errorf("lexAll(%q): err = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package lua
+
+import "fmt"
+
+type localVar struct {
+	name string
+	slot int
+}
+
+// funcState holds the scopes of the function being parsed
+type funcState struct {
+	parent  *funcState
+	proto   *funcProto
+	actives []localVar
+	blocks  []int
+}
+
+func (fs *funcState) declare(name string) int {
+	slot := fs.proto.numSlots
+	fs.proto.numSlots++
+	fs.actives = append(fs.actives, localVar{name: name, slot: slot})
+	return slot
+}
+
+func (fs *funcState) openBlock() {
+	fs.blocks = append(fs.blocks, len(fs.actives))
+}
+
+func (fs *funcState) closeBlock() {
+	fs.actives = fs.actives[:fs.blocks[len(fs.blocks)-1]]
+	fs.blocks = fs.blocks[:len(fs.blocks)-1]
+}
+
+func (fs *funcState) findLocal(name string) (int, bool) {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return fs.actives[i].slot, true
+		}
+	}
+	return 0, false
+}
+
+func (fs *funcState) findUpval(name string) (int, bool) {
+	for i, upval := range fs.proto.upvals {
+		if upval.name == name {
+			return i, true
+		}
+	}
+	if fs.parent == nil {
+		return 0, false
+	}
+
+	desc := upvalDesc{name: name}
+	if slot, ok := fs.parent.findLocal(name); ok {
+		desc.fromLocal, desc.index = true, slot
+	} else if index, ok := fs.parent.findUpval(name); ok {
+		desc.index = index
+	} else {
+		return 0, false
+	}
+	fs.proto.upvals = append(fs.proto.upvals, desc)
+	return len(fs.proto.upvals) - 1, true
+}
+
+type parser struct {
+	lex   *lexer
+	tok   token
+	ahead *token
+	fs    *funcState
+}
+
+// parse compiles the source of a chunk into the prototype of its main function
+func parse(chunk, src string) (proto *funcProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = luaErr
+		}
+	}()
+
+	p := &parser{lex: newLexer(chunk, src)}
+	p.tok = p.lex.next()
+	p.fs = &funcState{proto: &funcProto{name: "main chunk", chunk: chunk, isVararg: true}}
+	p.fs.openBlock()
+	p.fs.proto.body = p.block()
+	if p.tok.typ != tokEOF {
+		p.errorf("'<eof>' expected near '%s'", p.tok)
+	}
+	return p.fs.proto, nil
+}
+
+func (p *parser) errorf(format string, args ...any) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", p.lex.chunk, p.tok.line, fmt.Sprintf(format, args...))})
+}
+
+func (p *parser) next() {
+	if p.ahead != nil {
+		p.tok = *p.ahead
+		p.ahead = nil
+		return
+	}
+	p.tok = p.lex.next()
+}
+
+func (p *parser) peek() token {
+	if p.ahead == nil {
+		tok := p.lex.next()
+		p.ahead = &tok
+	}
+	return *p.ahead
+}
+
+func (p *parser) isChar(c byte) bool {
+	return p.tok.typ == tokChar && p.tok.char == c
+}
+
+func (p *parser) acceptChar(c byte) bool {
+	if p.isChar(c) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectChar(c byte) {
+	if !p.acceptChar(c) {
+		p.errorf("'%c' expected near '%s'", c, p.tok)
+	}
+}
+
+func (p *parser) accept(typ tokenType) bool {
+	if p.tok.typ == typ {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(typ tokenType, what string) {
+	if !p.accept(typ) {
+		p.errorf("'%s' expected near '%s'", what, p.tok)
+	}
+}
+
+func (p *parser) expectName() string {
+	if p.tok.typ != tokName {
+		p.errorf("<name> expected near '%s'", p.tok)
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+func (p *parser) blockEnds() bool {
+	switch p.tok.typ {
+	case tokEOF, tokEnd, tokElse, tokElseif, tokUntil:
+		return true
+	}
+	return false
+}
+
+func (p *parser) block() []stmt {
+	stmts := []stmt{}
+	for !p.blockEnds() {
+		if p.tok.typ == tokReturn {
+			stmts = append(stmts, p.returnStatement())
+			break
+		}
+		if p.tok.typ == tokBreak {
+			p.next()
+			stmts = append(stmts, &breakStmt{})
+			p.acceptChar(';')
+			break
+		}
+		if s := p.statement(); s != nil {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+func (p *parser) scopedBlock() []stmt {
+	p.fs.openBlock()
+	defer p.fs.closeBlock()
+	return p.block()
+}
+
+func (p *parser) returnStatement() stmt {
+	line := p.tok.line
+	p.next()
+	ret := &returnStmt{line: line}
+	if !p.blockEnds() && !p.isChar(';') {
+		ret.exprs = p.exprList()
+	}
+	p.acceptChar(';')
+	return ret
+}
+
+func (p *parser) statement() stmt {
+	line := p.tok.line
+	switch p.tok.typ {
+	case tokIf:
+		return p.ifStatement()
+	case tokWhile:
+		p.next()
+		cond := p.expr()
+		p.expect(tokDo, "do")
+		body := p.scopedBlock()
+		p.expect(tokEnd, "end")
+		return &whileStmt{cond: cond, body: body, line: line}
+	case tokDo:
+		p.next()
+		body := p.scopedBlock()
+		p.expect(tokEnd, "end")
+		return &doStmt{body: body}
+	case tokFor:
+		return p.forStatement()
+	case tokRepeat:
+		p.next()
+		// the condition sees the locals of the body
+		p.fs.openBlock()
+		body := p.block()
+		p.expect(tokUntil, "until")
+		cond := p.expr()
+		p.fs.closeBlock()
+		return &repeatStmt{body: body, cond: cond, line: line}
+	case tokFunction:
+		return p.functionStatement()
+	case tokLocal:
+		p.next()
+		if p.accept(tokFunction) {
+			name := p.expectName()
+			slot := p.fs.declare(name)
+			return &localFunctionStmt{slot: slot, proto: p.functionBody(name, false, line)}
+		}
+		return p.localStatement(line)
+	}
+	if p.acceptChar(';') {
+		return nil
+	}
+	return p.exprStatement()
+}
+
+func (p *parser) ifStatement() stmt {
+	s := &ifStmt{line: p.tok.line}
+	p.next()
+	s.conds = append(s.conds, p.expr())
+	p.expect(tokThen, "then")
+	s.blocks = append(s.blocks, p.scopedBlock())
+	for p.accept(tokElseif) {
+		s.conds = append(s.conds, p.expr())
+		p.expect(tokThen, "then")
+		s.blocks = append(s.blocks, p.scopedBlock())
+	}
+	if p.accept(tokElse) {
+		s.elseBody = p.scopedBlock()
+	}
+	p.expect(tokEnd, "end")
+	return s
+}
+
+func (p *parser) forStatement() stmt {
+	line := p.tok.line
+	p.next()
+	first := p.expectName()
+
+	if p.acceptChar('=') {
+		s := &numericForStmt{line: line}
+		s.start = p.expr()
+		p.expectChar(',')
+		s.limit = p.expr()
+		if p.acceptChar(',') {
+			s.step = p.expr()
+		}
+		p.expect(tokDo, "do")
+		p.fs.openBlock()
+		s.slot = p.fs.declare(first)
+		s.body = p.block()
+		p.fs.closeBlock()
+		p.expect(tokEnd, "end")
+		return s
+	}
+
+	names := []string{first}
+	for p.acceptChar(',') {
+		names = append(names, p.expectName())
+	}
+	p.expect(tokIn, "in")
+	s := &genericForStmt{line: line, exprs: p.exprList()}
+	p.expect(tokDo, "do")
+	p.fs.openBlock()
+	for _, name := range names {
+		s.slots = append(s.slots, p.fs.declare(name))
+	}
+	s.body = p.block()
+	p.fs.closeBlock()
+	p.expect(tokEnd, "end")
+	return s
+}
+
+func (p *parser) functionStatement() stmt {
+	line := p.tok.line
+	p.next()
+	name := p.expectName()
+	target := p.resolve(name)
+	fullName := name
+	isMethod := false
+	for p.isChar('.') || p.isChar(':') {
+		isMethod = p.isChar(':')
+		p.next()
+		key := p.expectName()
+		fullName += "." + key
+		target = &indexExpr{obj: target, key: &constExpr{value: key}, line: line}
+		if isMethod {
+			break
+		}
+	}
+	proto := p.functionBody(fullName, isMethod, line)
+	return &assignStmt{targets: []expr{target}, exprs: []expr{&functionExpr{proto: proto}}, line: line}
+}
+
+func (p *parser) localStatement(line int) stmt {
+	names := []string{p.expectName()}
+	for p.acceptChar(',') {
+		names = append(names, p.expectName())
+	}
+	s := &localStmt{line: line}
+	if p.acceptChar('=') {
+		s.exprs = p.exprList()
+	}
+	// the new locals are only visible after the statement
+	for _, name := range names {
+		s.slots = append(s.slots, p.fs.declare(name))
+	}
+	return s
+}
+
+func (p *parser) exprStatement() stmt {
+	line := p.tok.line
+	e := p.suffixedExpr()
+	if p.isChar('=') || p.isChar(',') {
+		targets := []expr{e}
+		for p.acceptChar(',') {
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expectChar('=')
+		for _, target := range targets {
+			switch target.(type) {
+			case *localExpr, *upvalExpr, *globalExpr, *indexExpr:
+			default:
+				p.errorf("syntax error near '%s'", p.tok)
+			}
+		}
+		return &assignStmt{targets: targets, exprs: p.exprList(), line: line}
+	}
+
+	switch e.(type) {
+	case *callExpr, *methodCallExpr:
+		return &callStmt{call: e, line: line}
+	}
+	p.errorf("syntax error near '%s'", p.tok)
+	return nil
+}
+
+func (p *parser) functionBody(name string, isMethod bool, line int) *funcProto {
+	proto := &funcProto{name: name, chunk: p.lex.chunk, line: line}
+	fs := &funcState{parent: p.fs, proto: proto}
+	p.fs = fs
+	fs.openBlock()
+
+	if isMethod {
+		proto.params = append(proto.params, fs.declare("self"))
+	}
+	p.expectChar('(')
+	if !p.isChar(')') {
+		for {
+			if p.accept(tokDots) {
+				proto.isVararg = true
+				break
+			}
+			proto.params = append(proto.params, fs.declare(p.expectName()))
+			if !p.acceptChar(',') {
+				break
+			}
+		}
+	}
+	p.expectChar(')')
+	proto.body = p.block()
+	p.expect(tokEnd, "end")
+
+	p.fs = fs.parent
+	return proto
+}
+
+func (p *parser) resolve(name string) expr {
+	if slot, ok := p.fs.findLocal(name); ok {
+		return &localExpr{name: name, slot: slot}
+	}
+	if index, ok := p.fs.findUpval(name); ok {
+		return &upvalExpr{name: name, index: index}
+	}
+	return &globalExpr{name: name}
+}
+
+func (p *parser) exprList() []expr {
+	exprs := []expr{p.expr()}
+	for p.acceptChar(',') {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *parser) primaryExpr() expr {
+	if p.tok.typ == tokName {
+		return p.resolve(p.expectName())
+	}
+	if p.acceptChar('(') {
+		e := p.expr()
+		p.expectChar(')')
+		switch e.(type) {
+		case *callExpr, *methodCallExpr, *varargExpr:
+			return &parenExpr{expr: e}
+		}
+		return e
+	}
+	p.errorf("unexpected symbol near '%s'", p.tok)
+	return nil
+}
+
+func (p *parser) suffixedExpr() expr {
+	e := p.primaryExpr()
+	for {
+		line := p.tok.line
+		switch {
+		case p.isChar('.'):
+			p.next()
+			e = &indexExpr{obj: e, key: &constExpr{value: p.expectName()}, line: line}
+		case p.isChar('['):
+			p.next()
+			key := p.expr()
+			p.expectChar(']')
+			e = &indexExpr{obj: e, key: key, line: line}
+		case p.isChar(':'):
+			p.next()
+			name := p.expectName()
+			e = &methodCallExpr{obj: e, name: name, args: p.callArgs(), line: line}
+		case p.isChar('(') || p.isChar('{') || p.tok.typ == tokString:
+			e = &callExpr{fn: e, args: p.callArgs(), line: line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) callArgs() []expr {
+	switch {
+	case p.tok.typ == tokString:
+		s := p.tok.text
+		p.next()
+		return []expr{&constExpr{value: s}}
+	case p.isChar('{'):
+		return []expr{p.tableConstructor()}
+	}
+	p.expectChar('(')
+	if p.acceptChar(')') {
+		return nil
+	}
+	args := p.exprList()
+	p.expectChar(')')
+	return args
+}
+
+func (p *parser) tableConstructor() expr {
+	p.expectChar('{')
+	t := &tableExpr{}
+	for !p.isChar('}') {
+		switch {
+		case p.isChar('['):
+			p.next()
+			key := p.expr()
+			p.expectChar(']')
+			p.expectChar('=')
+			t.fields = append(t.fields, tableField{key: key, value: p.expr()})
+		case p.tok.typ == tokName && p.peek().typ == tokChar && p.peek().char == '=':
+			key := p.expectName()
+			p.expectChar('=')
+			t.fields = append(t.fields, tableField{key: &constExpr{value: key}, value: p.expr()})
+		default:
+			t.fields = append(t.fields, tableField{value: p.expr()})
+		}
+		if !p.acceptChar(',') && !p.acceptChar(';') {
+			break
+		}
+	}
+	p.expectChar('}')
+	return t
+}
+
+func (p *parser) simpleExpr() expr {
+	tok := p.tok
+	switch tok.typ {
+	case tokNumber:
+		p.next()
+		return &constExpr{value: tok.num}
+	case tokString:
+		p.next()
+		return &constExpr{value: tok.text}
+	case tokNil:
+		p.next()
+		return &constExpr{value: nil}
+	case tokTrue:
+		p.next()
+		return &constExpr{value: true}
+	case tokFalse:
+		p.next()
+		return &constExpr{value: false}
+	case tokDots:
+		if !p.fs.proto.isVararg {
+			p.errorf("cannot use '...' outside a vararg function near '...'")
+		}
+		p.next()
+		return &varargExpr{}
+	case tokFunction:
+		p.next()
+		return &functionExpr{proto: p.functionBody("anonymous", false, tok.line)}
+	}
+	if p.isChar('{') {
+		return p.tableConstructor()
+	}
+	return p.suffixedExpr()
+}
+
+// operator priorities as in lua 5.1, left and right
+var binaryPriority = map[int][2]int{
+	opAdd: {6, 6}, opSub: {6, 6},
+	opMul: {7, 7}, opDiv: {7, 7}, opMod: {7, 7},
+	opPow:    {10, 9},
+	opConcat: {5, 4},
+	opEq:     {3, 3}, opNe: {3, 3}, opLt: {3, 3}, opLe: {3, 3}, opGt: {3, 3}, opGe: {3, 3},
+}
+
+const (
+	opAnd         = 100
+	opOr          = 101
+	unaryPriority = 8
+)
+
+func (p *parser) binaryOp() (int, bool) {
+	switch p.tok.typ {
+	case tokAnd:
+		return opAnd, true
+	case tokOr:
+		return opOr, true
+	case tokConcat:
+		return opConcat, true
+	case tokEq:
+		return opEq, true
+	case tokNe:
+		return opNe, true
+	case tokLe:
+		return opLe, true
+	case tokGe:
+		return opGe, true
+	}
+	if p.tok.typ != tokChar {
+		return 0, false
+	}
+	switch p.tok.char {
+	case '+':
+		return opAdd, true
+	case '-':
+		return opSub, true
+	case '*':
+		return opMul, true
+	case '/':
+		return opDiv, true
+	case '%':
+		return opMod, true
+	case '^':
+		return opPow, true
+	case '<':
+		return opLt, true
+	case '>':
+		return opGt, true
+	}
+	return 0, false
+}
+
+func priorityOf(op int) [2]int {
+	switch op {
+	case opAnd:
+		return [2]int{2, 2}
+	case opOr:
+		return [2]int{1, 1}
+	}
+	return binaryPriority[op]
+}
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression whose binary operators bind tighter than limit
+func (p *parser) subExpr(limit int) expr {
+	var e expr
+	line := p.tok.line
+	switch {
+	case p.tok.typ == tokNot:
+		p.next()
+		e = &unaryExpr{op: opNot, expr: p.subExpr(unaryPriority), line: line}
+	case p.isChar('-'):
+		p.next()
+		operand := p.subExpr(unaryPriority)
+		if c, ok := operand.(*constExpr); ok {
+			if n, ok := c.value.(float64); ok {
+				e = &constExpr{value: -n}
+				break
+			}
+		}
+		e = &unaryExpr{op: opNeg, expr: operand, line: line}
+	case p.isChar('#'):
+		p.next()
+		e = &unaryExpr{op: opLen, expr: p.subExpr(unaryPriority), line: line}
+	default:
+		e = p.simpleExpr()
+	}
+
+	for {
+		op, ok := p.binaryOp()
+		if !ok || priorityOf(op)[0] <= limit {
+			return e
+		}
+		line := p.tok.line
+		p.next()
+		rhs := p.subExpr(priorityOf(op)[1])
+		switch op {
+		case opAnd:
+			e = &andExpr{lhs: e, rhs: rhs}
+		case opOr:
+			e = &orExpr{lhs: e, rhs: rhs}
+		default:
+			e = &binaryExpr{op: op, lhs: e, rhs: rhs, line: line}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	num := func(n float64) expr { return &constExpr{value: n} }
+	a, b, c := &globalExpr{name: "a"}, &globalExpr{name: "b"}, &globalExpr{name: "c"}
+	binary := func(op int, lhs, rhs expr) expr { return &binaryExpr{op: op, lhs: lhs, rhs: rhs, line: 1} }
+	unary := func(op int, e expr) expr { return &unaryExpr{op: op, expr: e, line: 1} }
+
+	tests := []struct {
+		src  string
+		want expr
+	}{
+		{"1 + 2 * 3", binary(opAdd, num(1), binary(opMul, num(2), num(3)))},
+		{"1 - 2 - 3", binary(opSub, binary(opSub, num(1), num(2)), num(3))},
+		{"(1 + 2) * 3", binary(opMul, binary(opAdd, num(1), num(2)), num(3))},
+		// parentheses are only kept around calls and varargs, to truncate them
+		{"(f())", &parenExpr{expr: &callExpr{fn: &globalExpr{name: "f"}, line: 1}}},
+		{"2 ^ 3 ^ 2", binary(opPow, num(2), binary(opPow, num(3), num(2)))},
+		{"-a ^ 2", unary(opNeg, binary(opPow, a, num(2)))},
+		{"a .. b .. c", binary(opConcat, a, binary(opConcat, b, c))},
+		{"a .. b == c", binary(opEq, binary(opConcat, a, b), c)},
+		{"not a == b", binary(opEq, unary(opNot, a), b)},
+		{"#a + 1", binary(opAdd, unary(opLen, a), num(1))},
+		{"a or b and c", &orExpr{lhs: a, rhs: &andExpr{lhs: b, rhs: c}}},
+		{"a < b and b <= c", &andExpr{lhs: binary(opLt, a, b), rhs: binary(opLe, b, c)}},
+	}
+	for _, tt := range tests {
+		proto, err := parse("test", "return "+tt.src)
+		if err != nil {
+			t.Errorf("parse(%q): %v", tt.src, err)
+			continue
+		}
+		ret, ok := proto.body[0].(*returnStmt)
+		if !ok || len(ret.exprs) != 1 {
+			t.Errorf("parse(%q) = %#v, want a return of one expression", tt.src, proto.body)
+			continue
+		}
+		if !reflect.DeepEqual(ret.exprs[0], tt.want) {
+			t.Errorf("parse(%q) = %#v, want %#v", tt.src, ret.exprs[0], tt.want)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	src := `
+local x = 1
+local function f()
+	local y = x
+	return function() return x, y, z end
+end
+do local x = 2 end
+return x`
+	proto, err := parse("test", src)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	// the local declared in the do block takes a slot of its own, the last
+	// statement still reading the first x
+	if proto.numSlots != 3 {
+		t.Errorf("main chunk slots = %d, want 3", proto.numSlots)
+	}
+	ret := proto.body[3].(*returnStmt)
+	if want := (&localExpr{name: "x", slot: 0}); !reflect.DeepEqual(ret.exprs[0], want) {
+		t.Errorf("return x = %#v, want %#v", ret.exprs[0], want)
+	}
+
+	f := proto.body[1].(*localFunctionStmt).proto
+	if want := []upvalDesc{{name: "x", fromLocal: true, index: 0}}; !reflect.DeepEqual(f.upvals, want) {
+		t.Errorf("upvalues of f = %+v, want %+v", f.upvals, want)
+	}
+	inner := f.body[1].(*returnStmt).exprs[0].(*functionExpr).proto
+	wantUpvals := []upvalDesc{{name: "x", index: 0}, {name: "y", fromLocal: true, index: 0}}
+	if !reflect.DeepEqual(inner.upvals, wantUpvals) {
+		t.Errorf("upvalues of the closure = %+v, want %+v", inner.upvals, wantUpvals)
+	}
+	wantExprs := []expr{&upvalExpr{name: "x", index: 0}, &upvalExpr{name: "y", index: 1}, &globalExpr{name: "z"}}
+	if got := inner.body[0].(*returnStmt).exprs; !reflect.DeepEqual(got, wantExprs) {
+		t.Errorf("closure returns %#v, want %#v", got, wantExprs)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"x =", "test:1: unexpected symbol near '<eof>'"},
+		{"x = 1 1", "test:1: unexpected symbol near '1'"},
+		{"local function", "test:1: <name> expected near '<eof>'"},
+		{"if x then\n", "test:2: 'end' expected near '<eof>'"},
+		{"for i = 1 do end", "test:1: ',' expected near 'do'"},
+		{"local t = {1, 2", "test:1: '}' expected near '<eof>'"},
+		{"a.b:c", "test:1: '(' expected near '<eof>'"},
+		{"return return", "test:1: unexpected symbol near 'return'"},
+		{"return 1\nx = 2", "test:2: '<eof>' expected near 'x'"},
+		{"function f() return ... end", "test:1: cannot use '...' outside a vararg function near '...'"},
+		{"goto done", "test:1: syntax error near 'done'"},
+		{"x = \"unfinished", "test:1: unfinished string"},
+	}
+	for _, tt := range tests {
+		_, err := parse("test", tt.src)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parse(%q): err = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+func openString(s *State) {
+	t := NewTable()
+	s.Globals.Set("string", t)
+	s.strings = t
+
+	s.register(t, "len", func(s *State, args []Value) []Value {
+		return []Value{float64(len(s.checkString(args, 0, "len")))}
+	})
+	s.register(t, "sub", func(s *State, args []Value) []Value {
+		str := s.checkString(args, 0, "sub")
+		i, j := stringRange(len(str), s.optInt(args, 1, "sub", 1), s.optInt(args, 2, "sub", -1))
+		if i > j {
+			return []Value{""}
+		}
+		return []Value{str[i-1 : j]}
+	})
+	s.register(t, "upper", func(s *State, args []Value) []Value {
+		return []Value{strings.ToUpper(s.checkString(args, 0, "upper"))}
+	})
+	s.register(t, "lower", func(s *State, args []Value) []Value {
+		return []Value{strings.ToLower(s.checkString(args, 0, "lower"))}
+	})
+	s.register(t, "rep", func(s *State, args []Value) []Value {
+		str := s.checkString(args, 0, "rep")
+		n := s.checkInt(args, 1, "rep")
+		if n <= 0 {
+			return []Value{""}
+		}
+		if len(str)*n > 512*1024*1024 {
+			s.Errorf("resulting string too large")
+		}
+		return []Value{strings.Repeat(str, n)}
+	})
+	s.register(t, "reverse", func(s *State, args []Value) []Value {
+		b := []byte(s.checkString(args, 0, "reverse"))
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []Value{string(b)}
+	})
+	s.register(t, "byte", func(s *State, args []Value) []Value {
+		str := s.checkString(args, 0, "byte")
+		start := s.optInt(args, 1, "byte", 1)
+		i, j := stringRange(len(str), start, s.optInt(args, 2, "byte", start))
+		values := []Value{}
+		for k := i; k <= j; k++ {
+			values = append(values, float64(str[k-1]))
+		}
+		return values
+	})
+	s.register(t, "char", func(s *State, args []Value) []Value {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := s.checkInt(args, i, "char")
+			if c < 0 || c > 255 {
+				s.Errorf("bad argument #%d to 'char' (invalid value)", i+1)
+			}
+			b[i] = byte(c)
+		}
+		return []Value{string(b)}
+	})
+	s.register(t, "format", stringFormat)
+	s.register(t, "find", func(s *State, args []Value) []Value {
+		return stringFind(s, args, true)
+	})
+	s.register(t, "match", func(s *State, args []Value) []Value {
+		return stringFind(s, args, false)
+	})
+	s.register(t, "gmatch", func(s *State, args []Value) []Value {
+		str := s.checkString(args, 0, "gmatch")
+		pattern := s.checkString(args, 1, "gmatch")
+		pos := 0
+		return []Value{NewFunction("gmatch_iter", func(s *State, _ []Value) []Value {
+			for pos <= len(str) {
+				m := &matcher{s: s, src: str, pattern: pattern}
+				end, ok := m.match(pos, 0)
+				if ok {
+					start := pos
+					pos = end
+					if end == start {
+						pos++
+					}
+					return m.captures(start, end, true)
+				}
+				pos++
+			}
+			return []Value{nil}
+		})}
+	})
+	s.register(t, "gsub", stringGsub)
+}
+
+// stringRange turns lua string positions, that may be negative, into a
+// range 1 based and within the string.
+func stringRange(length, i, j int) (int, int) {
+	if i < 0 {
+		i = length + i + 1
+	}
+	if j < 0 {
+		j = length + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > length {
+		j = length
+	}
+	return i, j
+}
+
+func stringFormat(s *State, args []Value) []Value {
+	format := s.checkString(args, 0, "format")
+	var sb strings.Builder
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && (isDigit(format[i]) || format[i] == '.') {
+			i++
+		}
+		if i >= len(format) {
+			s.Errorf("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		verb := format[i]
+		if arg >= len(args) {
+			s.Errorf("bad argument #%d to 'format' (no value)", arg+1)
+		}
+
+		switch verb {
+		case 'd', 'i':
+			sb.WriteString(fmt.Sprintf(spec+"d", int64(s.checkNumber(args, arg, "format"))))
+		case 'u':
+			sb.WriteString(fmt.Sprintf(spec+"d", uint64(s.checkNumber(args, arg, "format"))))
+		case 'c':
+			sb.WriteByte(byte(s.checkNumber(args, arg, "format")))
+		case 'x', 'X', 'o':
+			sb.WriteString(fmt.Sprintf(spec+string(verb), int64(s.checkNumber(args, arg, "format"))))
+		case 'e', 'E', 'f', 'g', 'G':
+			sb.WriteString(fmt.Sprintf(spec+string(verb), s.checkNumber(args, arg, "format")))
+		case 'q':
+			sb.WriteString(quoteString(s.checkString(args, arg, "format")))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec+"s", ToString(args[arg])))
+		default:
+			s.Errorf("invalid option '%%%c' to 'format'", verb)
+		}
+		arg++
+	}
+	return []Value{sb.String()}
+}
+
+// stringFind implements both find and match, which differ in what they return
+func stringFind(s *State, args []Value, find bool) []Value {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	str := s.checkString(args, 0, fname)
+	pattern := s.checkString(args, 1, fname)
+	init := s.optInt(args, 2, fname, 1)
+	if init < 0 {
+		init = len(str) + init + 1
+		if init < 1 {
+			init = 1
+		}
+	} else if init == 0 {
+		init = 1
+	}
+	if init > len(str)+1 {
+		return []Value{nil}
+	}
+
+	plain := len(args) > 3 && Truthy(args[3])
+	if find && (plain || !strings.ContainsAny(pattern, "^$*+?.([%-")) {
+		idx := strings.Index(str[init-1:], pattern)
+		if idx < 0 {
+			return []Value{nil}
+		}
+		return []Value{float64(init + idx), float64(init + idx + len(pattern) - 1)}
+	}
+
+	anchored := strings.HasPrefix(pattern, "^")
+	patStart := 0
+	if anchored {
+		patStart = 1
+	}
+	for pos := init - 1; pos <= len(str); pos++ {
+		m := &matcher{s: s, src: str, pattern: pattern}
+		if end, ok := m.match(pos, patStart); ok {
+			if find {
+				return append([]Value{float64(pos + 1), float64(end)}, m.captures(pos, end, false)...)
+			}
+			return m.captures(pos, end, true)
+		}
+		if anchored {
+			break
+		}
+	}
+	return []Value{nil}
+}
+
+func stringGsub(s *State, args []Value) []Value {
+	str := s.checkString(args, 0, "gsub")
+	pattern := s.checkString(args, 1, "gsub")
+	repl := s.checkArg(args, 2, "gsub")
+	maxN := s.optInt(args, 3, "gsub", len(str)+1)
+
+	anchored := strings.HasPrefix(pattern, "^")
+	patStart := 0
+	if anchored {
+		patStart = 1
+	}
+
+	var sb strings.Builder
+	pos, n := 0, 0
+	for n < maxN {
+		m := &matcher{s: s, src: str, pattern: pattern}
+		end, ok := m.match(pos, patStart)
+		if ok {
+			n++
+			whole := str[pos:end]
+			captures := m.captures(pos, end, true)
+			var value Value
+			switch r := repl.(type) {
+			case string, float64:
+				value = expandReplacement(s, ToString(r), whole, captures)
+			case *Table:
+				value = s.index(r, captures[0])
+			case *Function:
+				value = first(s.call(r, captures))
+			default:
+				s.Errorf("bad argument #3 to 'gsub' (string/function/table expected)")
+			}
+			if !Truthy(value) {
+				sb.WriteString(whole)
+			} else if str, ok := toStringCoerce(value); ok {
+				sb.WriteString(str)
+			} else {
+				s.Errorf("invalid replacement value (a %s)", TypeName(value))
+			}
+		}
+		if ok && end > pos {
+			pos = end
+		} else {
+			if pos < len(str) {
+				sb.WriteByte(str[pos])
+			}
+			pos++
+		}
+		if pos > len(str) || anchored {
+			break
+		}
+	}
+	if pos < len(str) {
+		sb.WriteString(str[pos:])
+	}
+	return []Value{sb.String(), float64(n)}
+}
+
+func expandReplacement(s *State, repl, whole string, captures []Value) string {
+	var sb strings.Builder
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '%' || i+1 >= len(repl) {
+			sb.WriteByte(repl[i])
+			continue
+		}
+		i++
+		c := repl[i]
+		switch {
+		case c == '0':
+			sb.WriteString(whole)
+		case c >= '1' && c <= '9':
+			idx := int(c - '1')
+			if idx >= len(captures) {
+				s.Errorf("invalid capture index")
+			}
+			sb.WriteString(ToString(captures[idx]))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+const maxCaptures = 32
+
+// capture positions: an unclosed capture has len capUnclosed, a position
+// capture has len capPosition
+const (
+	capUnclosed = -1
+	capPosition = -2
+)
+
+type capture struct {
+	start int
+	len   int
+}
+
+// matcher runs lua patterns, following the backtracking matcher of lstrlib.c
+type matcher struct {
+	s        *State
+	src      string
+	pattern  string
+	level    int
+	capture  [maxCaptures]capture
+	matchDep int
+}
+
+// captures returns the captured values, or the whole match when there are
+// no captures and whole is set
+func (m *matcher) captures(start, end int, whole bool) []Value {
+	if m.level == 0 {
+		if whole {
+			return []Value{m.src[start:end]}
+		}
+		return nil
+	}
+	values := make([]Value, m.level)
+	for i := 0; i < m.level; i++ {
+		values[i] = m.captureValue(i)
+	}
+	return values
+}
+
+func (m *matcher) captureValue(i int) Value {
+	c := m.capture[i]
+	if c.len == capPosition {
+		return float64(c.start + 1)
+	}
+	if c.len == capUnclosed {
+		m.s.Errorf("unfinished capture")
+	}
+	return m.src[c.start : c.start+c.len]
+}
+
+func (m *matcher) classEnd(p int) int {
+	if p >= len(m.pattern) {
+		m.s.Errorf("malformed pattern (ends with '%%')")
+	}
+	c := m.pattern[p]
+	p++
+	if c == '%' {
+		if p >= len(m.pattern) {
+			m.s.Errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(m.pattern) && m.pattern[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(m.pattern) {
+				m.s.Errorf("malformed pattern (missing ']')")
+			}
+			c := m.pattern[p]
+			p++
+			if c == '%' {
+				p++
+			}
+			if p < len(m.pattern) && m.pattern[p] == ']' {
+				return p + 1
+			}
+			if p >= len(m.pattern) {
+				m.s.Errorf("malformed pattern (missing ']')")
+			}
+		}
+	}
+	return p
+}
+
+func matchClass(c byte, class byte) bool {
+	var res bool
+	lower := class | 0x20
+	switch lower {
+	case 'a':
+		res = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = c >= '0' && c <= '9'
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > 32 && c < 127 && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9')
+	case 's':
+		res = c == ' ' || c >= '\t' && c <= '\r'
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	case 'x':
+		res = isHexDigit(c)
+	case 'z':
+		res = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass matches c against the set between p, at `[`, and ec, at `]`
+func (m *matcher) matchBracketClass(c byte, p, ec int) bool {
+	negate := false
+	p++
+	if m.pattern[p] == '^' {
+		negate = true
+		p++
+	}
+	for ; p < ec; p++ {
+		switch {
+		case m.pattern[p] == '%':
+			p++
+			if matchClass(c, m.pattern[p]) {
+				return !negate
+			}
+		case p+2 < ec && m.pattern[p+1] == '-':
+			if m.pattern[p] <= c && c <= m.pattern[p+2] {
+				return !negate
+			}
+			p += 2
+		case m.pattern[p] == c:
+			return !negate
+		}
+	}
+	return negate
+}
+
+func (m *matcher) singleMatch(si, p, ep int) bool {
+	if si >= len(m.src) {
+		return false
+	}
+	c := m.src[si]
+	switch m.pattern[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, m.pattern[p+1])
+	case '[':
+		return m.matchBracketClass(c, p, ep-1)
+	}
+	return m.pattern[p] == c
+}
+
+// match tries the pattern from p against the source from si, returning
+// where the match ends
+func (m *matcher) match(si, p int) (int, bool) {
+	m.matchDep++
+	defer func() { m.matchDep-- }()
+	if m.matchDep > 200 {
+		m.s.Errorf("pattern too complex")
+	}
+
+	for {
+		if p >= len(m.pattern) {
+			return si, true
+		}
+		switch m.pattern[p] {
+		case '(':
+			if p+1 < len(m.pattern) && m.pattern[p+1] == ')' {
+				return m.startCapture(si, p+2, capPosition)
+			}
+			return m.startCapture(si, p+1, capUnclosed)
+		case ')':
+			return m.endCapture(si, p+1)
+		case '$':
+			if p+1 == len(m.pattern) {
+				return si, si == len(m.src)
+			}
+		case '%':
+			if p+1 < len(m.pattern) {
+				switch next := m.pattern[p+1]; {
+				case next == 'b':
+					return m.matchBalance(si, p+2)
+				case next == 'f':
+					p += 2
+					if p >= len(m.pattern) || m.pattern[p] != '[' {
+						m.s.Errorf("missing '[' after '%%f' in pattern")
+					}
+					ep := m.classEnd(p)
+					var prev, cur byte
+					if si > 0 {
+						prev = m.src[si-1]
+					}
+					if si < len(m.src) {
+						cur = m.src[si]
+					}
+					if m.matchBracketClass(prev, p, ep-1) || !m.matchBracketClass(cur, p, ep-1) {
+						return 0, false
+					}
+					p = ep
+					continue
+				case next >= '0' && next <= '9':
+					si, ok := m.matchCapture(si, next)
+					if !ok {
+						return 0, false
+					}
+					return m.match(si, p+2)
+				}
+			}
+		}
+
+		ep := m.classEnd(p)
+		matches := m.singleMatch(si, p, ep)
+		if ep < len(m.pattern) {
+			switch m.pattern[ep] {
+			case '?':
+				if matches {
+					if end, ok := m.match(si+1, ep+1); ok {
+						return end, true
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return m.maxExpand(si, p, ep)
+			case '+':
+				if !matches {
+					return 0, false
+				}
+				return m.maxExpand(si+1, p, ep)
+			case '-':
+				return m.minExpand(si, p, ep)
+			}
+		}
+		if !matches {
+			return 0, false
+		}
+		si++
+		p = ep
+	}
+}
+
+func (m *matcher) maxExpand(si, p, ep int) (int, bool) {
+	i := 0
+	for m.singleMatch(si+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if end, ok := m.match(si+i, ep+1); ok {
+			return end, true
+		}
+	}
+	return 0, false
+}
+
+func (m *matcher) minExpand(si, p, ep int) (int, bool) {
+	for {
+		if end, ok := m.match(si, ep+1); ok {
+			return end, true
+		}
+		if !m.singleMatch(si, p, ep) {
+			return 0, false
+		}
+		si++
+	}
+}
+
+func (m *matcher) startCapture(si, p, what int) (int, bool) {
+	if m.level >= maxCaptures {
+		m.s.Errorf("too many captures")
+	}
+	m.capture[m.level] = capture{start: si, len: what}
+	m.level++
+	end, ok := m.match(si, p)
+	if !ok {
+		m.level--
+	}
+	return end, ok
+}
+
+func (m *matcher) endCapture(si, p int) (int, bool) {
+	l := -1
+	for i := m.level - 1; i >= 0; i-- {
+		if m.capture[i].len == capUnclosed {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		m.s.Errorf("invalid pattern capture")
+	}
+	m.capture[l].len = si - m.capture[l].start
+	end, ok := m.match(si, p)
+	if !ok {
+		m.capture[l].len = capUnclosed
+	}
+	return end, ok
+}
+
+func (m *matcher) matchBalance(si, p int) (int, bool) {
+	if p+1 >= len(m.pattern) {
+		m.s.Errorf("missing arguments to '%%b'")
+	}
+	if si >= len(m.src) || m.src[si] != m.pattern[p] {
+		return 0, false
+	}
+	open, close := m.pattern[p], m.pattern[p+1]
+	depth := 1
+	for i := si + 1; i < len(m.src); i++ {
+		switch m.src[i] {
+		case close:
+			depth--
+			if depth == 0 {
+				return m.match(i+1, p+2)
+			}
+		case open:
+			depth++
+		}
+	}
+	return 0, false
+}
+
+func (m *matcher) matchCapture(si int, index byte) (int, bool) {
+	l := int(index - '1')
+	if l < 0 || l >= m.level || m.capture[l].len == capUnclosed {
+		m.s.Errorf("invalid capture index")
+	}
+	captured := m.src[m.capture[l].start : m.capture[l].start+m.capture[l].len]
+	if strings.HasPrefix(m.src[si:], captured) {
+		return si + len(captured), true
+	}
+	return 0, false
+}
@@ -0,0 +1,357 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value is a lua value: nil, bool, float64, string, *Table or *Function
+type Value any
+
+// GoFunction is a function written in Go callable from scripts. It raises
+// lua errors by panicking through State.Errorf or State.RaiseError.
+type GoFunction func(s *State, args []Value) []Value
+
+type Function struct {
+	name   string
+	proto  *funcProto
+	upvals []*cell
+	native GoFunction
+}
+
+// NewFunction wraps a Go function so it can be stored in lua values
+func NewFunction(name string, fn GoFunction) *Function {
+	return &Function{name: name, native: fn}
+}
+
+// cell holds a local variable, shared with the closures capturing it
+type cell struct {
+	v Value
+}
+
+// Error is a lua error. Value is what was given to `error`, usually a string.
+type Error struct {
+	Value Value
+	// Fatal errors, like the ones stopping a killed script, can't be caught by pcall
+	Fatal bool
+}
+
+func (e *Error) Error() string {
+	if s, ok := e.Value.(string); ok {
+		return s
+	}
+	if n, ok := e.Value.(float64); ok {
+		return formatNumber(n)
+	}
+	if t, ok := e.Value.(*Table); ok {
+		// redis error tables carry their message in the err field
+		if msg, ok := t.Get("err").(string); ok {
+			return msg
+		}
+	}
+	return fmt.Sprintf("(error object is a %s value)", TypeName(e.Value))
+}
+
+type tableEntry struct {
+	key   Value
+	value Value
+}
+
+// Table keeps the values at keys 1..n in a slice and the other ones in an
+// insertion ordered list of entries, so `next` can walk it while it changes.
+type Table struct {
+	array   []Value
+	index   map[Value]int
+	entries []tableEntry
+	removed int
+	meta    *Table
+}
+
+func NewTable() *Table {
+	return &Table{index: make(map[Value]int)}
+}
+
+// NewArray creates a table with the values at keys 1..n
+func NewArray(values []Value) *Table {
+	t := NewTable()
+	for _, v := range values {
+		t.Append(v)
+	}
+	return t
+}
+
+func arrayIndex(key Value) (int, bool) {
+	n, ok := key.(float64)
+	if !ok || n != math.Trunc(n) || n < 1 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func normalizeKey(key Value) Value {
+	if n, ok := key.(float64); ok && n == 0 {
+		// -0 and 0 are the same key
+		return float64(0)
+	}
+	return key
+}
+
+func (t *Table) Get(key Value) Value {
+	if i, ok := arrayIndex(key); ok && i <= len(t.array) {
+		return t.array[i-1]
+	}
+	if pos, ok := t.index[normalizeKey(key)]; ok {
+		return t.entries[pos].value
+	}
+	return nil
+}
+
+func (t *Table) GetInt(i int) Value {
+	if i >= 1 && i <= len(t.array) {
+		return t.array[i-1]
+	}
+	return t.Get(float64(i))
+}
+
+// Set assigns the value to the key, removing the key when value is nil.
+// The caller checks the key is neither nil nor NaN.
+func (t *Table) Set(key Value, value Value) {
+	if i, ok := arrayIndex(key); ok {
+		if i <= len(t.array) {
+			t.array[i-1] = value
+			if i == len(t.array) && value == nil {
+				t.trimArray()
+			}
+			return
+		}
+		if i == len(t.array)+1 && value != nil {
+			t.removeEntry(key)
+			t.array = append(t.array, value)
+			t.migrateToArray()
+			return
+		}
+	}
+
+	key = normalizeKey(key)
+	if value == nil {
+		t.removeEntry(key)
+		return
+	}
+	if pos, ok := t.index[key]; ok {
+		t.entries[pos].value = value
+		return
+	}
+	t.compact()
+	t.index[key] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{key: key, value: value})
+}
+
+// Append adds the value after the last element of the array part
+func (t *Table) Append(value Value) {
+	t.Set(float64(len(t.array)+1), value)
+}
+
+// Len returns a border of the table, as the `#` operator does
+func (t *Table) Len() int {
+	if len(t.array) > 0 {
+		return len(t.array)
+	}
+	n := 0
+	for t.Get(float64(n+1)) != nil {
+		n++
+	}
+	return n
+}
+
+// removeEntry keeps the key in the entries, so a traversal can continue from it
+func (t *Table) removeEntry(key Value) {
+	if pos, ok := t.index[key]; ok && t.entries[pos].value != nil {
+		t.entries[pos].value = nil
+		t.removed++
+	}
+}
+
+func (t *Table) trimArray() {
+	for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+		t.array = t.array[:len(t.array)-1]
+	}
+}
+
+func (t *Table) migrateToArray() {
+	for {
+		key := float64(len(t.array) + 1)
+		pos, ok := t.index[key]
+		if !ok || t.entries[pos].value == nil {
+			return
+		}
+		t.array = append(t.array, t.entries[pos].value)
+		t.removeEntry(key)
+	}
+}
+
+// compact drops the removed entries, only done when inserting a new key as
+// lua does not allow adding keys while traversing a table
+func (t *Table) compact() {
+	if t.removed < 32 || t.removed < len(t.entries)/2 {
+		return
+	}
+	entries := make([]tableEntry, 0, len(t.entries)-t.removed)
+	clear(t.index)
+	for _, e := range t.entries {
+		if e.value != nil {
+			t.index[e.key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	t.entries = entries
+	t.removed = 0
+}
+
+// Next returns the key and value following the key in the traversal order,
+// starting with the first one when key is nil. ok is false for unknown keys.
+func (t *Table) Next(key Value) (Value, Value, bool) {
+	start := 0
+	if key != nil {
+		if i, isIndex := arrayIndex(key); isIndex && i <= len(t.array) {
+			start = i
+		} else {
+			pos, found := t.index[normalizeKey(key)]
+			if !found {
+				return nil, nil, false
+			}
+			start = len(t.array) + pos + 1
+		}
+	}
+
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], true
+		}
+	}
+	pos := start - len(t.array)
+	if pos < 0 {
+		pos = 0
+	}
+	for ; pos < len(t.entries); pos++ {
+		if t.entries[pos].value != nil {
+			return t.entries[pos].key, t.entries[pos].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+func (t *Table) Metatable() *Table {
+	return t.meta
+}
+
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Truthy reports whether the value counts as true in a condition
+func Truthy(v Value) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+func formatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// ToString converts the value as the lua tostring does, without metamethods
+func ToString(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatNumber(x)
+	case string:
+		return x
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	case *Function:
+		if x.native != nil {
+			return fmt.Sprintf("function: builtin: %p", x)
+		}
+		return fmt.Sprintf("function: %p", x)
+	}
+	return fmt.Sprint(v)
+}
+
+// ToNumber converts numbers and numeric strings to a number
+func ToNumber(v Value) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return parseNumber(x)
+	}
+	return 0, false
+}
+
+// toStringCoerce converts numbers and strings to a string, as concatenation does
+func toStringCoerce(v Value) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64:
+		return formatNumber(x), true
+	}
+	return "", false
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\000")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"sync"
 
 	"github.com/codecrafters-io/redis-starter-go/app/internal/command"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
+	"github.com/codecrafters-io/redis-starter-go/app/internal/util"
 )
 
 const (
@@ -17,13 +17,27 @@ const (
 
 type Server struct {
 	cfg *config.Config
-	db  *store.Store
+	dbs []*store.Store
+	// lock serializes the commands of every connection, including the one
+	// with the master, so each of them runs in isolation like in Redis
+	lock util.Lock
 }
 
-func NewServer(cfg *config.Config, db *store.Store) *Server {
+func NewServer(cfg *config.Config, dbs []*store.Store) *Server {
+	for _, db := range dbs {
+		db.OnExpire(func(key string) {
+			command.NotifyKeyspaceEvent(cfg, db.Index(), config.NotifyExpired, "expired", key)
+			command.PropagateExpired(cfg, db.Index(), key)
+		})
+		db.KeepExpired(func() bool {
+			return cfg.Role() == config.RoleSlave
+		})
+	}
+
 	return &Server{
-		cfg: cfg,
-		db:  db,
+		cfg:  cfg,
+		dbs:  dbs,
+		lock: util.NewLock(),
 	}
 }
 
@@ -37,10 +51,16 @@ func (s *Server) Run() error {
 	log.Println("server listenning at", s.cfg.Port())
 
 	// clean expired items
-	go s.db.DeleteExpiredItems()
-
-	acksChan := make(chan struct{}, 10)
-	locker := &sync.RWMutex{}
+	for _, db := range s.dbs {
+		go db.DeleteExpiredItems(s.lock)
+	}
+	go command.RunSavePoints(s.cfg, s.dbs, s.lock)
+	go command.SyncAOF(s.cfg)
+	go command.RunAOFRewrites(s.cfg, s.dbs, s.lock)
+	go command.RunReplicationCron(s.cfg, s.lock)
+	if s.cfg.Role() == config.RoleSlave {
+		command.StartReplication(s.cfg, s.dbs, s.lock)
+	}
 
 	for {
 		// block until we receive an incoming connection
@@ -50,29 +70,12 @@ func (s *Server) Run() error {
 			continue
 		}
 		// handle client connection
-		connHandler := command.NewHandler(s.db, conn, s.cfg, acksChan, locker)
+		connHandler := command.NewHandler(s.dbs, conn, s.cfg, s.lock)
 
 		go s.serveConnection(connHandler)
 	}
 }
 
-func (s *Server) Handshake() error {
-	conn, err := net.Dial("tcp", s.cfg.ReplicaOf())
-	if err != nil {
-		return fmt.Errorf("failed to dial with master error: %w", err)
-	}
-
-	acksChan := make(chan struct{}, 10)
-	connHandler := command.NewHandler(s.db, conn, s.cfg, acksChan, &sync.RWMutex{})
-	if err := connHandler.Handshake(); err != nil {
-		return fmt.Errorf("failed to handshake, error: %w", err)
-	}
-
-	go s.serveConnection(connHandler)
-
-	return nil
-}
-
 func (s *Server) serveConnection(connHandler *command.Handler) {
 	err := connHandler.HandleClientConnection()
 	if err != nil {
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// SortedSetMember is a member of a sorted set with its score
+type SortedSetMember struct {
+	Member string
+	Score  float64
+}
+
+// HashField is a field of a hash, which may expire on its own when
+// expires is set
+type HashField struct {
+	Field    string
+	Value    string
+	Expires  bool
+	ExpireAt time.Time
+}
+
+// ListType, SetType, SortedSetType and HashType keep the keys of these types,
+// loaded from the RDB file. Their elements are kept in the order they were
+// loaded in, so they are saved back as they were.
+type ListType struct {
+	collection[[]string]
+}
+
+type SetType struct {
+	collection[[]string]
+}
+
+type SortedSetType struct {
+	collection[[]SortedSetMember]
+}
+
+type HashType struct {
+	collection[[]HashField]
+}
+
+// collection keeps the keys of a type. Keys whose time to live expired are
+// left in place, but are never returned.
+type collection[T any] struct {
+	items    map[string]collectionItem[T]
+	mu       sync.Mutex
+	watchers *watchers
+	// shared is set while items is referenced by a snapshot, so it is
+	// copied before its next change. The values are never changed in place.
+	shared bool
+}
+
+type collectionItem[T any] struct {
+	value    T
+	expires  bool
+	expireAt time.Time
+}
+
+func (i collectionItem[T]) expired() bool {
+	return i.expires && i.expireAt.Before(time.Now())
+}
+
+func newCollection[T any](watchers *watchers) collection[T] {
+	return collection[T]{
+		items:    make(map[string]collectionItem[T]),
+		watchers: watchers,
+	}
+}
+
+// Load sets the value of the key, expiring at the unix time xp in milliseconds
+// when expires is set
+func (c *collection[T]) Load(key string, value T, expires bool, xp int64) {
+	var expireAt time.Time
+	if expires {
+		expireAt = time.UnixMilli(xp)
+	}
+
+	c.mu.Lock()
+	c.writable()
+	c.items[key] = collectionItem[T]{value: value, expires: expires, expireAt: expireAt}
+	c.mu.Unlock()
+	c.watchers.touch(key)
+}
+
+// Get returns the value of the key, along with its expire time when it has one
+func (c *collection[T]) Get(key string) (value T, expireAt time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
+	if !ok || item.expired() {
+		return value, time.Time{}, false
+	}
+	return item.value, item.expireAt, true
+}
+
+// Delete removes the key, reporting whether it existed and didn't expire
+func (c *collection[T]) Delete(key string) bool {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if ok {
+		c.writable()
+		delete(c.items, key)
+	}
+	c.mu.Unlock()
+	return ok && !item.expired()
+}
+
+func (c *collection[T]) clear() {
+	c.mu.Lock()
+	c.items = make(map[string]collectionItem[T])
+	c.shared = false
+	c.mu.Unlock()
+}
+
+// writable copies items when it is referenced by a snapshot, so it can be
+// changed. mu must be held by the caller.
+func (c *collection[T]) writable() {
+	if c.shared {
+		c.items = maps.Clone(c.items)
+		c.shared = false
+	}
+}
+
+// share returns items, which is copied before its next change
+func (c *collection[T]) share() map[string]collectionItem[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.shared = true
+	return c.items
+}
+
+func (c *collection[T]) Exists(key string) bool {
+	_, _, ok := c.Get(key)
+	return ok
+}
+
+func (c *collection[T]) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.items))
+	for key, item := range c.items {
+		if !item.expired() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// ReadRDBFile loads the keys of the RDB file into the databases, returning the
+// code of the function libraries it holds, which are loaded by the scripting engine.
+func ReadRDBFile(path string, dbs []*Store) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadRDB(file, dbs)
+}
+
+// LoadRDB loads the keys of an RDB file read from r into the databases, like ReadRDBFile
+func LoadRDB(r io.Reader, dbs []*Store) ([]string, error) {
+	content, err := rdb.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return LoadContent(content, dbs)
+}
+
+// LoadContent loads the keys of a parsed RDB file into the databases,
+// returning its function libraries
+func LoadContent(content *rdb.File, dbs []*Store) ([]string, error) {
+	for _, key := range content.Keys {
+		if key.DB >= len(dbs) {
+			return nil, fmt.Errorf("the file has keys in database %d, but there are only %d databases", key.DB, len(dbs))
+		}
+	}
+
+	for _, key := range content.Keys {
+		dbs[key.DB].loadKey(key)
+	}
+	for _, name := range content.Modules {
+		log.Printf("skipped the data of the %s module, as modules can't be loaded\n", name)
+	}
+	log.Printf("loaded %d keys from the RDB file (version %d)\n", len(content.Keys), content.Version)
+
+	return content.Functions, nil
+}
+
+func (s *Store) loadKey(key rdb.Key) {
+	switch value := key.Value.(type) {
+	case string:
+		s.StringType.Load(key.Key, value, key.Expires, key.ExpireAt)
+	case rdb.List:
+		s.Lists.Load(key.Key, []string(value), key.Expires, key.ExpireAt)
+	case rdb.Set:
+		s.Sets.Load(key.Key, []string(value), key.Expires, key.ExpireAt)
+	case rdb.SortedSet:
+		members := make([]SortedSetMember, len(value))
+		for i, member := range value {
+			members[i] = SortedSetMember{Member: member.Member, Score: member.Score}
+		}
+		s.SortedSets.Load(key.Key, members, key.Expires, key.ExpireAt)
+	case rdb.Hash:
+		fields := make([]HashField, len(value))
+		for i, field := range value {
+			fields[i] = HashField{Field: field.Field, Value: field.Value}
+			if field.ExpireAt != 0 {
+				fields[i].Expires, fields[i].ExpireAt = true, time.UnixMilli(field.ExpireAt)
+			}
+		}
+		s.Hashes.Load(key.Key, fields, key.Expires, key.ExpireAt)
+	case *rdb.Stream:
+		s.StreamType.Load(StreamId(key.Key), value)
+	}
+}
+
+// Snapshot is a view of the keys of a database at the time it was taken.
+// Taking it is cheap, as it shares the maps of the database, which copies
+// each of them before its next change, so the keys can be read while the
+// database keeps changing.
+type Snapshot struct {
+	index      int
+	taken      time.Time
+	strings    map[string]StoreItem
+	streams    map[StreamId]map[EntryId][]Fact
+	meta       map[StreamId]*streamMeta
+	lists      map[string]collectionItem[[]string]
+	sets       map[string]collectionItem[[]string]
+	sortedSets map[string]collectionItem[[]SortedSetMember]
+	hashes     map[string]collectionItem[[]HashField]
+}
+
+// Snapshot takes a view of the keys of the database
+func (s *Store) Snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		index:      s.index,
+		taken:      time.Now(),
+		strings:    s.StringType.share(),
+		lists:      s.Lists.share(),
+		sets:       s.Sets.share(),
+		sortedSets: s.SortedSets.share(),
+		hashes:     s.Hashes.share(),
+	}
+	snapshot.streams, snapshot.meta = s.StreamType.share()
+	return snapshot
+}
+
+// Keys returns the keys of the snapshot that didn't expire when it was taken
+func (s *Snapshot) Keys() []rdb.Key {
+	keys := []rdb.Key{}
+	add := func(key string, value any, expires bool, expireAt time.Time) {
+		if expires && !expireAt.After(s.taken) {
+			return
+		}
+		k := rdb.Key{DB: s.index, Key: key, Value: value, Expires: expires}
+		if expires {
+			k.ExpireAt = expireAt.UnixMilli()
+		}
+		keys = append(keys, k)
+	}
+
+	for key, item := range s.strings {
+		add(key, item.value, item.expires, item.expireAt)
+	}
+	for streamId, meta := range s.meta {
+		add(string(streamId), rdbStreamOf(s.streams[streamId], meta), false, time.Time{})
+	}
+	for key, item := range s.lists {
+		add(key, rdb.List(item.value), item.expires, item.expireAt)
+	}
+	for key, item := range s.sets {
+		add(key, rdb.Set(item.value), item.expires, item.expireAt)
+	}
+	for key, item := range s.sortedSets {
+		add(key, rdbSortedSetOf(item.value), item.expires, item.expireAt)
+	}
+	for key, item := range s.hashes {
+		add(key, rdbHashOf(item.value), item.expires, item.expireAt)
+	}
+	return keys
+}
+
+func rdbSortedSetOf(value []SortedSetMember) rdb.SortedSet {
+	members := make(rdb.SortedSet, len(value))
+	for i, member := range value {
+		members[i] = rdb.SortedSetMember{Member: member.Member, Score: member.Score}
+	}
+	return members
+}
+
+func rdbHashOf(value []HashField) rdb.Hash {
+	fields := make(rdb.Hash, len(value))
+	for i, field := range value {
+		fields[i] = rdb.HashField{Field: field.Field, Value: field.Value}
+		if field.Expires {
+			fields[i].ExpireAt = field.ExpireAt.UnixMilli()
+		}
+	}
+	return fields
+}
+
+// Dump copies the value of the key along with its expire time, as it is
+// saved in the RDB file, false when the key doesn't exist
+func (s *Store) Dump(key string) (rdb.Key, bool) {
+	dump := rdb.Key{DB: s.index, Key: key}
+	var expireAt time.Time
+	switch s.Type(key) {
+	case "string":
+		s.StringType.mu.Lock()
+		item := s.kv[key]
+		s.StringType.mu.Unlock()
+		dump.Value, expireAt = item.value, item.expireAt
+	case "stream":
+		stream, ok := s.StreamType.snapshotOf(StreamId(key))
+		if !ok {
+			return dump, false
+		}
+		dump.Value = stream
+	case "list":
+		var value []string
+		value, expireAt, _ = s.Lists.Get(key)
+		dump.Value = rdb.List(slices.Clone(value))
+	case "set":
+		var value []string
+		value, expireAt, _ = s.Sets.Get(key)
+		dump.Value = rdb.Set(slices.Clone(value))
+	case "zset":
+		var value []SortedSetMember
+		value, expireAt, _ = s.SortedSets.Get(key)
+		dump.Value = rdbSortedSetOf(value)
+	case "hash":
+		var value []HashField
+		value, expireAt, _ = s.Hashes.Get(key)
+		dump.Value = rdbHashOf(value)
+	default:
+		return dump, false
+	}
+	if !expireAt.IsZero() {
+		dump.Expires, dump.ExpireAt = true, expireAt.UnixMilli()
+	}
+	return dump, true
+}
+
+// Restore sets the key to the value, as loaded from the RDB file. Any
+// existing value of another type must be deleted first.
+func (s *Store) Restore(key rdb.Key) {
+	s.loadKey(key)
+}
+
+// WriteRDBFile saves the keys and the code of the function libraries into the
+// RDB file. It is written to a temporary file first, renamed once complete,
+// so the file is never left half written.
+func WriteRDBFile(path string, keys []rdb.Key, functions []string) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := WriteRDB(temp, keys, functions); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// WriteRDB writes the keys and the code of the function libraries in the RDB format
+func WriteRDB(w io.Writer, keys []rdb.Key, functions []string) error {
+	return rdb.Write(w, newRDBFile(keys, functions))
+}
+
+// ReplStreamDB is the auxiliary field of the snapshot sent to a replica
+// holding the database selected by the replication stream following it
+const ReplStreamDB = "repl-stream-db"
+
+// WriteReplicationRDB writes the snapshot of a full resynchronization, like
+// WriteRDB, along with the database the replication stream continues on
+func WriteReplicationRDB(w io.Writer, keys []rdb.Key, functions []string, streamDB int) error {
+	file := newRDBFile(keys, functions)
+	file.Aux[ReplStreamDB] = strconv.Itoa(streamDB)
+	return rdb.Write(w, file)
+}
+
+func newRDBFile(keys []rdb.Key, functions []string) *rdb.File {
+	return &rdb.File{
+		Aux: map[string]string{
+			"redis-ver":  "7.4.0",
+			"redis-bits": strconv.Itoa(strconv.IntSize),
+			"ctime":      strconv.FormatInt(time.Now().Unix(), 10),
+		},
+		Functions: functions,
+		Keys:      keys,
+	}
+}
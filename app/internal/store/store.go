@@ -1,25 +1,36 @@
 package store
 
 import (
-	"bufio"
-	"encoding/binary"
 	"fmt"
-	"io"
-	"os"
+	"maps"
 	"sync"
 	"time"
-
-	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
+// Store is a database, holding keys of every type
 type Store struct {
 	StringType
 	StreamType
+	Lists      ListType
+	Sets       SetType
+	SortedSets SortedSetType
+	Hashes     HashType
+	index      int
+	watchers   *watchers
 }
 
 type StringType struct {
-	kv map[string]StoreItem
-	mu sync.Mutex
+	kv       map[string]StoreItem
+	mu       sync.Mutex
+	watchers *watchers
+	// onExpire is called with every key removed because its time to live expired
+	onExpire func(key string)
+	// keepExpired tells whether the expired keys are only hidden, left for
+	// the master to delete
+	keepExpired func() bool
+	// shared is set while kv is referenced by a snapshot, so it is copied
+	// before its next change
+	shared bool
 }
 
 type StoreItem struct {
@@ -29,16 +40,118 @@ type StoreItem struct {
 }
 
 func NewStore() *Store {
+	watchers := newWatchers()
 	return &Store{
-		StringType{
-			kv: make(map[string]StoreItem),
+		StringType: StringType{
+			kv:       make(map[string]StoreItem),
+			watchers: watchers,
 		},
-		StreamType{
-			stream: make(map[StreamId]map[EntryId][]Fact),
+		StreamType: StreamType{
+			stream:   make(map[StreamId]map[EntryId][]Fact),
+			meta:     make(map[StreamId]*streamMeta),
+			watchers: watchers,
 		},
+		Lists:      ListType{newCollection[[]string](watchers)},
+		Sets:       SetType{newCollection[[]string](watchers)},
+		SortedSets: SortedSetType{newCollection[[]SortedSetMember](watchers)},
+		Hashes:     HashType{newCollection[[]HashField](watchers)},
+		watchers:   watchers,
+	}
+}
+
+// NewDatabases creates the given number of databases, selected by their index
+func NewDatabases(count int) []*Store {
+	dbs := make([]*Store, count)
+	for i := range dbs {
+		dbs[i] = NewStore()
+		dbs[i].index = i
+	}
+	return dbs
+}
+
+// Index returns the index the database is selected by
+func (s *Store) Index() int {
+	return s.index
+}
+
+// Keys returns the keys of every type
+func (s *Store) Keys() []string {
+	keys := s.StringType.GetKeys()
+	keys = append(keys, s.StreamType.GetKeys()...)
+	keys = append(keys, s.Lists.Keys()...)
+	keys = append(keys, s.Sets.Keys()...)
+	keys = append(keys, s.SortedSets.Keys()...)
+	keys = append(keys, s.Hashes.Keys()...)
+	return keys
+}
+
+// Type returns the type of the value of the key, as reported by TYPE
+func (s *Store) Type(key string) string {
+	switch {
+	case s.StreamType.ExistsStream(key) == nil:
+		return "stream"
+	case s.Lists.Exists(key):
+		return "list"
+	case s.Sets.Exists(key):
+		return "set"
+	case s.SortedSets.Exists(key):
+		return "zset"
+	case s.Hashes.Exists(key):
+		return "hash"
+	}
+	if _, err := s.StringType.Get(key); err == nil {
+		return "string"
+	}
+	return "none"
+}
+
+// Delete removes the key whatever its type, reporting whether it existed
+func (s *Store) Delete(key string) bool {
+	existed := s.Type(key) != "none"
+	s.StringType.DeleteItems([]string{key})
+	s.StreamType.Delete(StreamId(key))
+	s.Lists.Delete(key)
+	s.Sets.Delete(key)
+	s.SortedSets.Delete(key)
+	s.Hashes.Delete(key)
+	s.watchers.touch(key)
+	return existed
+}
+
+// Flush removes every key of the database
+func (s *Store) Flush() {
+	keys := s.Keys()
+
+	s.StringType.mu.Lock()
+	s.kv = make(map[string]StoreItem)
+	s.StringType.shared = false
+	s.StringType.mu.Unlock()
+	s.StreamType.mu.Lock()
+	s.stream = make(map[StreamId]map[EntryId][]Fact)
+	s.meta = make(map[StreamId]*streamMeta)
+	s.StreamType.shared, s.StreamType.unshared = false, nil
+	s.StreamType.mu.Unlock()
+	s.Lists.clear()
+	s.Sets.clear()
+	s.SortedSets.clear()
+	s.Hashes.clear()
+
+	for _, key := range keys {
+		s.watchers.touch(key)
 	}
 }
 
+// OnExpire registers the function to be called when a key expires
+func (s *Store) OnExpire(listener func(key string)) {
+	s.StringType.onExpire = listener
+}
+
+// KeepExpired registers the function telling whether the expired keys are
+// kept, as on a replica, which only hides them until its master deletes them
+func (s *Store) KeepExpired(keep func() bool) {
+	s.StringType.keepExpired = keep
+}
+
 func (s *StringType) Set(k, v string, expires bool, intTime int64) {
 	var expireAt time.Time
 	if expires {
@@ -59,12 +172,14 @@ func (s *StringType) Load(k, v string, expires bool, xp int64) {
 
 func (s *StringType) save(k, v string, expires bool, expireAt time.Time) {
 	s.mu.Lock()
+	s.writable()
 	s.kv[k] = StoreItem{
 		value:    v,
 		expires:  expires,
 		expireAt: expireAt,
 	}
 	s.mu.Unlock()
+	s.watchers.touch(k)
 }
 
 func (s *StringType) Get(k string) (string, error) {
@@ -76,156 +191,93 @@ func (s *StringType) Get(k string) (string, error) {
 	}
 
 	if item.expires && item.expireAt.Before(time.Now()) {
+		s.expireItems([]string{k})
 		return "", fmt.Errorf("%s expired", k)
 	}
 
 	return item.value, nil
 }
 
-func (s *StringType) DeleteExpiredItems() {
+// DeleteExpiredItems periodically removes the expired keys. It holds the lock
+// while doing it, so expirations are not interleaved with running commands.
+func (s *StringType) DeleteExpiredItems(lock sync.Locker) {
 	for {
 		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
 		keys := make([]string, 0)
+		s.mu.Lock()
 		for k, v := range s.kv {
 			if v.expires && v.expireAt.Before(time.Now()) {
 				keys = append(keys, k)
 			}
 		}
-		s.DeleteItems(keys)
+		s.mu.Unlock()
+		s.expireItems(keys)
+		lock.Unlock()
 	}
 }
 
-func (s *StringType) DeleteItems(keys []string) {
+// expireItems deletes the keys that are still expired, notifying the listener
+func (s *StringType) expireItems(keys []string) {
+	if s.keepExpired != nil && s.keepExpired() {
+		return
+	}
+	expired := make([]string, 0, len(keys))
 	s.mu.Lock()
 	for _, key := range keys {
-		delete(s.kv, key)
+		// the key may have been set again in the meantime
+		if item, ok := s.kv[key]; ok && item.expires && item.expireAt.Before(time.Now()) {
+			s.writable()
+			delete(s.kv, key)
+			expired = append(expired, key)
+		}
 	}
 	s.mu.Unlock()
-}
 
-func (s *StringType) GetKeys() []string {
-	keys := make([]string, 0, len(s.kv))
-	for k := range s.kv {
-		keys = append(keys, k)
+	for _, key := range expired {
+		s.watchers.touch(key)
+		if s.onExpire != nil {
+			s.onExpire(key)
+		}
 	}
-
-	return keys
 }
 
-func (s *StringType) ReadRDBFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	reader := bufio.NewReader(file)
-
-	err = rdb.CheckMagicNumber(reader)
-	if err != nil {
-		return err
-	}
-
-	err = rdb.SkipMetadata(reader)
-	if err != nil {
-		return err
-	}
-
-	// Read db number
-	// FE 00                       # Indicates database selector. db number = 00
-	_, err = reader.ReadByte()
-	if err != nil {
-		return err
-	}
-
-	err = s.loadFileContent(reader)
-	if err == io.EOF || err == nil {
-		return nil
+func (s *StringType) DeleteItems(keys []string) {
+	s.mu.Lock()
+	for _, key := range keys {
+		if _, ok := s.kv[key]; ok {
+			s.writable()
+			delete(s.kv, key)
+		}
 	}
-
-	return err
+	s.mu.Unlock()
 }
 
-func (s *StringType) loadFileContent(reader *bufio.Reader) error {
-	opcode, err := reader.ReadByte()
-	if err != nil {
-		return err
+// writable copies kv when it is referenced by a snapshot, so it can be
+// changed. mu must be held by the caller.
+func (s *StringType) writable() {
+	if s.shared {
+		s.kv = maps.Clone(s.kv)
+		s.shared = false
 	}
-	// End of the RDB file
-	if opcode == rdb.END_OPCODE {
-		return nil
-	}
-
-	for {
-		if opcode == rdb.OPCODE_SELECTDB {
-			err = rdb.ReadSelectDB(reader)
-			if err != nil {
-				return err
-			}
-		}
-
-		if opcode == rdb.OPCODE_RESIZEDB {
-			err = rdb.ReadResizeDB(reader)
-			if err != nil {
-				return err
-			}
-		}
-
-		// Exp time byte
-		opcode, err = reader.ReadByte()
-		if err != nil {
-			return err
-		}
-
-		// End of the RDB file
-		if opcode == rdb.END_OPCODE {
-			return nil
-		}
-
-		expires := false
-		xp := int64(0)
+}
 
-		if opcode == rdb.OPCODE_EXPIRETIME_MS {
-			expires = true
-			ex := make([]byte, 9)
-			_, err = reader.Read(ex)
-			if err != nil {
-				return err
-			}
-			xp = int64(binary.LittleEndian.Uint64(ex))
-		}
-		if opcode == rdb.OPCODE_EXPIRETIME {
-			expires = true
-			ex := make([]byte, 5)
-			_, err = reader.Read(ex)
-			if err != nil {
-				return err
-			}
-			xp = int64(binary.LittleEndian.Uint64(ex)) * 1000
-		}
+// share returns kv, which is copied before its next change
+func (s *StringType) share() map[string]StoreItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// Key Encoding
-		keyLength, err := rdb.LengthEncodedInt(reader)
-		if err != nil {
-			return err
-		}
-		keyBytes := make([]byte, keyLength)
-		_, err = reader.Read(keyBytes)
-		if err != nil {
-			return err
-		}
+	s.shared = true
+	return s.kv
+}
 
-		// Value Encoding
-		valueLength, err := rdb.LengthEncodedInt(reader)
-		if err != nil {
-			return err
-		}
-		valueBytes := make([]byte, valueLength)
-		_, err = reader.Read(valueBytes)
-		if err != nil {
-			return err
+func (s *StringType) GetKeys() []string {
+	keys := make([]string, 0, len(s.kv))
+	for k, v := range s.kv {
+		if !v.expires || v.expireAt.After(time.Now()) {
+			keys = append(keys, k)
 		}
-
-		s.Load(string(keyBytes), string(valueBytes), expires, xp)
 	}
+
+	return keys
 }
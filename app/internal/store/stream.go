@@ -3,11 +3,15 @@ package store
 import (
 	"cmp"
 	"fmt"
+	"maps"
+	"math"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
 type Entry struct {
@@ -16,25 +20,37 @@ type Entry struct {
 }
 
 type EntryId struct {
-	milli    string
-	sequence int
+	milli    uint64
+	sequence uint64
 }
 
-func NewEntryId(milli string, sequence int) EntryId {
+var (
+	// MinEntryId is the smallest possible entry id, referred as `-` in ranges
+	MinEntryId = EntryId{0, 0}
+	// MaxEntryId is the greatest possible entry id, referred as `+` in ranges
+	MaxEntryId = EntryId{math.MaxUint64, math.MaxUint64}
+)
+
+func NewEntryId(milli uint64, sequence uint64) EntryId {
 	return EntryId{milli: milli, sequence: sequence}
 }
 
-func ToEntryId(s string, defaultSequence int) (EntryId, error) {
+func ToEntryId(s string, defaultSequence uint64) (EntryId, error) {
 	parts := strings.Split(s, "-")
+	if len(parts) > 2 {
+		return EntryId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
+	}
 
-	milli := parts[0]
+	milli, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return EntryId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
+	}
 	sequence := defaultSequence
-	var err error
 
 	if len(parts) == 2 {
-		sequence, err = strconv.Atoi(parts[1])
+		sequence, err = strconv.ParseUint(parts[1], 10, 64)
 		if err != nil {
-			return EntryId{}, err
+			return EntryId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
 		}
 	}
 
@@ -42,24 +58,41 @@ func ToEntryId(s string, defaultSequence int) (EntryId, error) {
 }
 
 func (e EntryId) String() string {
-	return fmt.Sprintf("%s-%d", e.milli, e.sequence)
+	return fmt.Sprintf("%d-%d", e.milli, e.sequence)
 }
 
-// Compare returns -1 if e < other, 1 if e > other, and 0 if e == other
-func (e EntryId) Compare(other EntryId) int {
-	if e.milli > other.milli {
-		return 1
-	}
-	if e.milli < other.milli {
-		return -1
+func (e EntryId) IsZero() bool {
+	return e.milli == 0 && e.sequence == 0
+}
+
+// Next returns the entry id right after e, or false when e is MaxEntryId
+func (e EntryId) Next() (EntryId, bool) {
+	switch {
+	case e.sequence < math.MaxUint64:
+		return EntryId{e.milli, e.sequence + 1}, true
+	case e.milli < math.MaxUint64:
+		return EntryId{e.milli + 1, 0}, true
 	}
-	if e.sequence > other.sequence {
-		return 1
+	return e, false
+}
+
+// Prev returns the entry id right before e, or false when e is MinEntryId
+func (e EntryId) Prev() (EntryId, bool) {
+	switch {
+	case e.sequence > 0:
+		return EntryId{e.milli, e.sequence - 1}, true
+	case e.milli > 0:
+		return EntryId{e.milli - 1, math.MaxUint64}, true
 	}
-	if e.sequence < other.sequence {
-		return -1
+	return e, false
+}
+
+// Compare returns -1 if e < other, 1 if e > other, and 0 if e == other
+func (e EntryId) Compare(other EntryId) int {
+	if n := cmp.Compare(e.milli, other.milli); n != 0 {
+		return n
 	}
-	return 0
+	return cmp.Compare(e.sequence, other.sequence)
 }
 
 type Fact struct {
@@ -77,21 +110,121 @@ func (e Fact) GetKV() []string {
 
 type StreamId string
 
+// ConsumerGroup tracks the delivery state of a consumer group of a stream.
+// EntriesRead is -1 when the number of entries read by the group is unknown.
+type ConsumerGroup struct {
+	Name            string
+	LastDeliveredId EntryId
+	EntriesRead     int64
+	Pending         []PendingEntry
+	Consumers       []*Consumer
+}
+
+// PendingEntry is an entry delivered to a consumer and not acknowledged yet.
+type PendingEntry struct {
+	EntryId       EntryId
+	Consumer      string
+	DeliveryTime  time.Time
+	DeliveryCount int
+}
+
+type Consumer struct {
+	Name       string
+	SeenTime   time.Time
+	ActiveTime time.Time
+}
+
+// PendingOf returns the pending entries owned by the given consumer.
+func (g *ConsumerGroup) PendingOf(consumer string) (output []PendingEntry) {
+	for _, p := range g.Pending {
+		if p.Consumer == consumer {
+			output = append(output, p)
+		}
+	}
+	return
+}
+
+// StreamInfo holds the bookkeeping of a stream besides its entries.
+type StreamInfo struct {
+	Length          int
+	FirstEntryId    EntryId
+	LastGeneratedId EntryId
+	MaxDeletedId    EntryId
+	EntriesAdded    int
+	Groups          []*ConsumerGroup
+}
+
+// Lag returns how many entries of the stream were not delivered to the group yet.
+// The second return value is false when the lag cannot be computed, which happens
+// when entries were deleted after the group's last delivered id.
+func (info StreamInfo) Lag(group *ConsumerGroup) (int, bool) {
+	if info.EntriesAdded == 0 {
+		return 0, true
+	}
+
+	hasTombstones := info.Length > 0 && !info.MaxDeletedId.IsZero() &&
+		info.MaxDeletedId.Compare(group.LastDeliveredId) >= 0
+	if group.EntriesRead >= 0 && !hasTombstones {
+		return info.EntriesAdded - int(group.EntriesRead), true
+	}
+
+	// estimate the entries read by the group from its last delivered id
+	cmpLast := group.LastDeliveredId.Compare(info.LastGeneratedId)
+	if cmpLast == 0 {
+		return 0, true
+	}
+	if info.MaxDeletedId.IsZero() || info.MaxDeletedId.Compare(info.FirstEntryId) < 0 {
+		if group.LastDeliveredId.Compare(info.FirstEntryId) < 0 {
+			return info.Length, true
+		}
+	}
+	if cmpLast > 0 {
+		return 0, true
+	}
+
+	return 0, false
+}
+
+type streamMeta struct {
+	lastGeneratedId EntryId
+	maxDeletedId    EntryId
+	entriesAdded    int
+	groups          []*ConsumerGroup
+}
+
 type StreamType struct {
-	stream map[StreamId]map[EntryId][]Fact
-	mu     sync.Mutex
+	stream   map[StreamId]map[EntryId][]Fact
+	meta     map[StreamId]*streamMeta
+	mu       sync.Mutex
+	watchers *watchers
+	// shared is set while stream and meta are referenced by a snapshot, so
+	// they are copied before their next change. So are the entries and the
+	// bookkeeping of each stream, unless in unshared, which is nil when no
+	// snapshot was taken.
+	shared   bool
+	unshared map[StreamId]bool
 }
 
 func (s *StreamType) Set(streamId StreamId, entryId EntryId, entries []Fact) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.writableStream(streamId)
+
 	if _, ok := s.stream[streamId]; !ok {
 		s.stream[streamId] = make(map[EntryId][]Fact)
 	}
+	if _, ok := s.meta[streamId]; !ok {
+		s.meta[streamId] = &streamMeta{}
+	}
 	if _, ok := s.stream[streamId][entryId]; !ok {
 		s.stream[streamId][entryId] = []Fact{}
+		s.meta[streamId].entriesAdded++
+	}
+	if s.meta[streamId].lastGeneratedId.Compare(entryId) < 0 {
+		s.meta[streamId].lastGeneratedId = entryId
 	}
+	s.watchers.touch(string(streamId))
 
 	s.stream[streamId][entryId] = append(s.stream[streamId][entryId],
 		entries...)
@@ -113,15 +246,13 @@ func (s *StreamType) ValidateEntryId(streamId StreamId, entryId EntryId) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if entryId.milli == "0" && entryId.sequence == 0 {
+	if entryId.IsZero() {
 		return fmt.Errorf("The ID specified in XADD must be greater than 0-0")
 	}
 
-	entryIds := s.GetEntryIds(streamId)
-
 	lastEntryId := EntryId{}
-	for _, entry := range entryIds {
-		lastEntryId = entry
+	if meta, ok := s.meta[streamId]; ok {
+		lastEntryId = meta.lastGeneratedId
 	}
 
 	if entryId.milli > lastEntryId.milli {
@@ -140,51 +271,64 @@ func (s *StreamType) GenerateId(streamId StreamId, milli string) (EntryId, error
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if milli == "" {
-		timestamp := uint64(time.Now().UnixMilli())
-		milli = fmt.Sprintf("%d", timestamp)
+	timestamp := uint64(time.Now().UnixMilli())
+	if milli != "" {
+		var err error
+		timestamp, err = strconv.ParseUint(milli, 10, 64)
+		if err != nil {
+			return EntryId{}, fmt.Errorf("Invalid stream ID specified as stream command argument")
+		}
 	}
 
 	entryIDs := s.GetEntryIds(streamId)
 
-	sequence := 0
+	sequence := uint64(0)
 	foundMilli := false
 	for _, entryID := range entryIDs {
-		if entryID.milli == milli {
+		if entryID.milli == timestamp {
 			sequence = entryID.sequence
 			foundMilli = true
 		}
-		if entryID.milli > milli {
+		if entryID.milli > timestamp {
 			break
 		}
 	}
 
+	// XSETID may have moved the last generated id past the stored entries
+	if meta, ok := s.meta[streamId]; ok && meta.lastGeneratedId.milli == timestamp {
+		if !foundMilli || meta.lastGeneratedId.sequence > sequence {
+			sequence = meta.lastGeneratedId.sequence
+			foundMilli = true
+		}
+	}
+
 	if foundMilli {
 		sequence++
-	} else if milli == "0" {
+	} else if timestamp == 0 {
 		sequence = 1
 	}
 
-	return EntryId{milli, sequence}, nil
+	return EntryId{timestamp, sequence}, nil
 }
 
 func (s *StreamType) GetEntryIds(streamId StreamId) []EntryId {
-	keys := make([]EntryId, 0, len(s.stream[streamId]))
-	for k := range s.stream[streamId] {
+	return sortedEntryIds(s.stream[streamId])
+}
+
+func sortedEntryIds(entries map[EntryId][]Fact) []EntryId {
+	keys := make([]EntryId, 0, len(entries))
+	for k := range entries {
 		keys = append(keys, k)
 	}
 
-	slices.SortFunc(keys, func(a, b EntryId) int {
-		if n := cmp.Compare(a.milli, b.milli); n != 0 {
-			return n
-		}
-		// If millis are equal, order by sequence
-		return cmp.Compare(a.sequence, b.sequence)
-	})
+	slices.SortFunc(keys, EntryId.Compare)
 	return keys
 }
 
 func (s *StreamType) FindGreater(streamId StreamId, entry EntryId) (output []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, entryId := range s.GetEntryIds(streamId) {
 		if entryId.Compare(entry) > 0 {
 			output = append(output, Entry{entryId, s.stream[streamId][entryId]})
@@ -195,6 +339,9 @@ func (s *StreamType) FindGreater(streamId StreamId, entry EntryId) (output []Ent
 }
 
 func (s *StreamType) FindStarEnd(streamId StreamId, start EntryId, end EntryId) (output []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, entryId := range s.GetEntryIds(streamId) {
 		if entryId.Compare(start) >= 0 && entryId.Compare(end) <= 0 {
 			output = append(output, Entry{entryId, s.stream[streamId][entryId]})
@@ -204,7 +351,14 @@ func (s *StreamType) FindStarEnd(streamId StreamId, start EntryId, end EntryId)
 	return
 }
 
-func (s *StreamType) FindLastEntryId(streamId StreamId) (lastEntryId EntryId) {
+func (s *StreamType) FindLastEntryId(streamId StreamId) EntryId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.findLastEntryId(streamId)
+}
+
+func (s *StreamType) findLastEntryId(streamId StreamId) (lastEntryId EntryId) {
 	for entry := range s.stream[streamId] {
 		if lastEntryId.Compare(entry) == -1 {
 			lastEntryId = entry
@@ -213,6 +367,264 @@ func (s *StreamType) FindLastEntryId(streamId StreamId) (lastEntryId EntryId) {
 	return
 }
 
+func (s *StreamType) Info(streamId StreamId) (StreamInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.meta[streamId]
+	if !ok {
+		return StreamInfo{}, fmt.Errorf("no such key")
+	}
+
+	firstEntryId := EntryId{}
+	if entryIds := s.GetEntryIds(streamId); len(entryIds) > 0 {
+		firstEntryId = entryIds[0]
+	}
+
+	return StreamInfo{
+		Length:          len(s.stream[streamId]),
+		FirstEntryId:    firstEntryId,
+		LastGeneratedId: meta.lastGeneratedId,
+		MaxDeletedId:    meta.maxDeletedId,
+		EntriesAdded:    meta.entriesAdded,
+		Groups:          meta.groups,
+	}, nil
+}
+
+func (s *StreamType) FindGroup(streamId StreamId, name string) (*ConsumerGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.meta[streamId]
+	if ok {
+		for _, group := range meta.groups {
+			if group.Name == name {
+				return group, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("No such key '%s' or consumer group '%s'", streamId, name)
+}
+
+// SetId moves the last generated id of a stream, as XSETID does.
+// entriesAdded and maxDeletedId are only updated when not nil.
+func (s *StreamType) SetId(streamId StreamId, lastId EntryId, entriesAdded *int, maxDeletedId *EntryId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[streamId]; !ok {
+		return fmt.Errorf("no such key")
+	}
+	s.writableStream(streamId)
+	meta := s.meta[streamId]
+
+	length := len(s.stream[streamId])
+	if length > 0 && s.findLastEntryId(streamId).Compare(lastId) > 0 {
+		return fmt.Errorf("The ID specified in XSETID is smaller than the target stream top item")
+	}
+	if entriesAdded != nil && *entriesAdded < length {
+		return fmt.Errorf("The entries_added specified in XSETID is smaller than the target stream length")
+	}
+	if maxDeletedId != nil && lastId.Compare(*maxDeletedId) < 0 {
+		return fmt.Errorf("The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+	}
+
+	meta.lastGeneratedId = lastId
+	if entriesAdded != nil {
+		meta.entriesAdded = *entriesAdded
+	}
+	if maxDeletedId != nil {
+		meta.maxDeletedId = *maxDeletedId
+	}
+	s.watchers.touch(string(streamId))
+
+	return nil
+}
+
+func (s *StreamType) GetKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.stream))
+	for k := range s.stream {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// Load sets a stream read from the RDB file, along with its consumer groups
+func (s *StreamType) Load(streamId StreamId, stream *rdb.Stream) {
+	entries := make(map[EntryId][]Fact)
+	for _, entry := range stream.Entries {
+		facts := []Fact{}
+		for i := 0; i+1 < len(entry.Fields); i += 2 {
+			facts = append(facts, NewFact(entry.Fields[i], entry.Fields[i+1]))
+		}
+		entries[entryIdOf(entry.Id)] = facts
+	}
+
+	groups := []*ConsumerGroup{}
+	for _, g := range stream.Groups {
+		group := &ConsumerGroup{
+			Name:            g.Name,
+			LastDeliveredId: entryIdOf(g.LastId),
+			EntriesRead:     g.EntriesRead,
+		}
+		for _, p := range g.Pending {
+			group.Pending = append(group.Pending, PendingEntry{
+				EntryId:       entryIdOf(p.Id),
+				Consumer:      p.Consumer,
+				DeliveryTime:  time.UnixMilli(p.DeliveryTime),
+				DeliveryCount: int(p.DeliveryCount),
+			})
+		}
+		for _, c := range g.Consumers {
+			group.Consumers = append(group.Consumers, &Consumer{
+				Name:       c.Name,
+				SeenTime:   time.UnixMilli(c.SeenTime),
+				ActiveTime: time.UnixMilli(c.ActiveTime),
+			})
+		}
+		groups = append(groups, group)
+	}
+
+	s.mu.Lock()
+	s.writableMaps()
+	if s.unshared != nil {
+		s.unshared[streamId] = true
+	}
+	s.stream[streamId] = entries
+	s.meta[streamId] = &streamMeta{
+		lastGeneratedId: entryIdOf(stream.LastId),
+		maxDeletedId:    entryIdOf(stream.MaxDeletedId),
+		entriesAdded:    int(stream.EntriesAdded),
+		groups:          groups,
+	}
+	s.mu.Unlock()
+	s.watchers.touch(string(streamId))
+}
+
+// Delete removes the stream along with its consumer groups, reporting
+// whether it existed
+func (s *StreamType) Delete(streamId StreamId) bool {
+	s.mu.Lock()
+	_, ok := s.stream[streamId]
+	if ok {
+		s.writableMaps()
+		delete(s.stream, streamId)
+		delete(s.meta, streamId)
+	}
+	s.mu.Unlock()
+	return ok
+}
+
+// writableMaps copies stream and meta when they are referenced by a
+// snapshot, so streams can be added or removed. mu must be held by the caller.
+func (s *StreamType) writableMaps() {
+	if s.shared {
+		s.stream = maps.Clone(s.stream)
+		s.meta = maps.Clone(s.meta)
+		s.shared = false
+		s.unshared = make(map[StreamId]bool)
+	}
+}
+
+// writableStream also copies the entries and the bookkeeping of the stream
+// when they are referenced by a snapshot, so it can be changed. mu must be
+// held by the caller.
+func (s *StreamType) writableStream(streamId StreamId) {
+	s.writableMaps()
+	if s.unshared == nil || s.unshared[streamId] {
+		return
+	}
+	if entries, ok := s.stream[streamId]; ok {
+		s.stream[streamId] = maps.Clone(entries)
+	}
+	if meta, ok := s.meta[streamId]; ok {
+		copied := *meta
+		s.meta[streamId] = &copied
+	}
+	s.unshared[streamId] = true
+}
+
+// share returns stream and meta, which are copied before their next change
+func (s *StreamType) share() (map[StreamId]map[EntryId][]Fact, map[StreamId]*streamMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shared = true
+	return s.stream, s.meta
+}
+
+// snapshotOf copies a single stream, false when it doesn't exist
+func (s *StreamType) snapshotOf(streamId StreamId) (*rdb.Stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.meta[streamId]
+	if !ok {
+		return nil, false
+	}
+	return rdbStreamOf(s.stream[streamId], meta), true
+}
+
+// rdbStreamOf copies the entries of a stream along with its bookkeeping, in
+// the representation they are saved in
+func rdbStreamOf(entries map[EntryId][]Fact, meta *streamMeta) *rdb.Stream {
+	entryIds := sortedEntryIds(entries)
+	stream := &rdb.Stream{
+		Entries:      make([]rdb.StreamEntry, 0, len(entryIds)),
+		Length:       uint64(len(entryIds)),
+		LastId:       rdbStreamIdOf(meta.lastGeneratedId),
+		MaxDeletedId: rdbStreamIdOf(meta.maxDeletedId),
+		EntriesAdded: uint64(meta.entriesAdded),
+		Groups:       []rdb.StreamGroup{},
+	}
+	if len(entryIds) > 0 {
+		stream.FirstId = rdbStreamIdOf(entryIds[0])
+	}
+	for _, entryId := range entryIds {
+		stream.Entries = append(stream.Entries, rdb.StreamEntry{
+			Id:     rdbStreamIdOf(entryId),
+			Fields: ListEntriesFacts(entries[entryId]),
+		})
+	}
+
+	for _, g := range meta.groups {
+		group := rdb.StreamGroup{
+			Name:        g.Name,
+			LastId:      rdbStreamIdOf(g.LastDeliveredId),
+			EntriesRead: g.EntriesRead,
+		}
+		for _, p := range g.Pending {
+			group.Pending = append(group.Pending, rdb.StreamPendingEntry{
+				Id:            rdbStreamIdOf(p.EntryId),
+				Consumer:      p.Consumer,
+				DeliveryTime:  p.DeliveryTime.UnixMilli(),
+				DeliveryCount: uint64(p.DeliveryCount),
+			})
+		}
+		for _, c := range g.Consumers {
+			group.Consumers = append(group.Consumers, rdb.StreamConsumer{
+				Name:       c.Name,
+				SeenTime:   c.SeenTime.UnixMilli(),
+				ActiveTime: c.ActiveTime.UnixMilli(),
+			})
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream
+}
+
+func rdbStreamIdOf(id EntryId) rdb.StreamId {
+	return rdb.StreamId{Ms: id.milli, Seq: id.sequence}
+}
+
+func entryIdOf(id rdb.StreamId) EntryId {
+	return EntryId{milli: id.Ms, sequence: id.Seq}
+}
+
 func ListEntriesFacts(entries []Fact) (output []string) {
 	for _, entry := range entries {
 		output = append(output, entry.GetKV()...)
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Watch is the set of keys a client watches before running a transaction.
+// It becomes dirty as soon as any of its keys is modified or expires.
+type Watch struct {
+	// keys are the keys watched in each database, by the watchers of the database
+	keys  map[*watchers]map[string]struct{}
+	dirty atomic.Bool
+}
+
+func NewWatch() *Watch {
+	return &Watch{
+		keys: make(map[*watchers]map[string]struct{}),
+	}
+}
+
+func (w *Watch) Dirty() bool {
+	return w.dirty.Load()
+}
+
+type watchers struct {
+	mu   sync.Mutex
+	keys map[string]map[*Watch]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		keys: make(map[string]map[*Watch]struct{}),
+	}
+}
+
+// touch marks as dirty every watch including the key
+func (w *watchers) touch(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for watch := range w.keys[key] {
+		watch.dirty.Store(true)
+	}
+}
+
+// Watch adds the keys of the database to the watch
+func (s *Store) Watch(watch *Watch, keys ...string) {
+	s.watchers.mu.Lock()
+	defer s.watchers.mu.Unlock()
+
+	if _, ok := watch.keys[s.watchers]; !ok {
+		watch.keys[s.watchers] = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		if _, ok := s.watchers.keys[key]; !ok {
+			s.watchers.keys[key] = make(map[*Watch]struct{})
+		}
+		s.watchers.keys[key][watch] = struct{}{}
+		watch.keys[s.watchers][key] = struct{}{}
+	}
+}
+
+// Unwatch removes every key from the watch, in every database, leaving it
+// clean to be used again
+func (w *Watch) Unwatch() {
+	for watchers, keys := range w.keys {
+		watchers.mu.Lock()
+		for key := range keys {
+			delete(watchers.keys[key], w)
+			if len(watchers.keys[key]) == 0 {
+				delete(watchers.keys, key)
+			}
+		}
+		watchers.mu.Unlock()
+	}
+	clear(w.keys)
+	w.dirty.Store(false)
+}
@@ -0,0 +1,43 @@
+package util
+
+import "strings"
+
+// ClusterSlots is the number of hash slots the keyspace is divided into
+const ClusterSlots = 16384
+
+var crc16Table [256]uint16
+
+func init() {
+	// CRC16 CCITT (XMODEM): polynomial 0x1021, initial value 0
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func CRC16(data string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeyHashSlot returns the hash slot of a key. When the key has a non empty
+// hash tag, like `{user1000}.following`, only the tag is hashed so related
+// keys end up in the same slot.
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16(key)) & (ClusterSlots - 1)
+}
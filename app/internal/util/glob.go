@@ -0,0 +1,101 @@
+package util
+
+// GlobMatch reports whether s matches the glob-style pattern, following the
+// same rules Redis uses for KEYS and PSUBSCRIBE patterns:
+//
+//	h?llo     matches hello, hallo and hxllo
+//	h*llo     matches hllo and heeeello
+//	h[ae]llo  matches hello and hallo, but not hillo
+//	h[^e]llo  matches hallo, hbllo, ... but not hello
+//	h[a-b]llo matches hallo and hbllo
+//
+// Use \ to escape special characters.
+func GlobMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if GlobMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var matched bool
+			matched, pattern = matchSet(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			s = s[1:]
+			// matchSet leaves the pattern at the closing bracket
+			if len(pattern) == 0 {
+				return len(s) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+
+	return len(s) == 0
+}
+
+// matchSet matches c against the set that starts right after a `[`.
+// It returns whether c belongs to the set and the pattern from the `]`
+// that closes the set.
+func matchSet(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			pattern = pattern[1:]
+			if pattern[0] == c {
+				matched = true
+			}
+		case len(pattern) >= 3 && pattern[1] == '-':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case pattern[0] == c:
+			matched = true
+		}
+		pattern = pattern[1:]
+	}
+
+	if not {
+		matched = !matched
+	}
+	return matched, pattern
+}
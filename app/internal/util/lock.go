@@ -0,0 +1,34 @@
+package util
+
+// Lock is a mutual exclusion lock whose waiters may give up waiting
+type Lock chan struct{}
+
+func NewLock() Lock {
+	return make(Lock, 1)
+}
+
+func (l Lock) Lock() {
+	l <- struct{}{}
+}
+
+func (l Lock) Unlock() {
+	<-l
+}
+
+// LockOrCancel waits for the lock until cancel is closed, reporting whether
+// the lock was acquired.
+func (l Lock) LockOrCancel(cancel <-chan struct{}) bool {
+	// a free lock is always taken, even when cancel is already closed
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
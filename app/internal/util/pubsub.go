@@ -1,42 +1,259 @@
 package util
 
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
 type PubSub interface {
-	Subscribe(channel string) chan PubSubMessage
-	Unsubscribe(channel string)
-	Publish(channel, message string)
+	Subscribe(sub *Subscriber, topics ...string)
+	Unsubscribe(sub *Subscriber, topics ...string)
+	PSubscribe(sub *Subscriber, patterns ...string)
+	PUnsubscribe(sub *Subscriber, patterns ...string)
+	Publish(topic, message string) int
+	Topics(pattern string) []string
+	NumSub(topic string) int
+	NumPat() int
+	Evict(topic string)
 }
 
+// Kinds of messages delivered to subscribers
+const (
+	KindMessage      = "message"
+	KindPMessage     = "pmessage"
+	KindSMessage     = "smessage"
+	KindSUnsubscribe = "sunsubscribe"
+)
+
+// PubSubMessage is a message published to a topic. Pattern is set when the
+// message was delivered because the subscriber is listening to a pattern.
 type PubSubMessage struct {
+	Kind    string
 	Topic   string
 	Message string
+	Pattern string
+}
+
+func (m PubSubMessage) size() int64 {
+	return int64(len(m.Topic) + len(m.Message) + len(m.Pattern))
+}
+
+// Subscriber receives the messages published to the topics it is subscribed to.
+// Each subscriber owns its channel, so any number of them can listen to the same
+// topic without stealing messages from each other.
+type Subscriber struct {
+	C chan PubSubMessage
+
+	// limit is the amount of bytes allowed to wait in C before the subscriber
+	// is considered too slow and onOverflow is called
+	limit      int64
+	pending    atomic.Int64
+	onOverflow func()
+	overflowed sync.Once
+}
+
+// NewSubscriber creates a subscriber able to hold size messages not read yet.
+// Messages published while its channel is full are dropped for this subscriber.
+func NewSubscriber(size int) *Subscriber {
+	return &Subscriber{
+		C: make(chan PubSubMessage, size),
+	}
+}
+
+// NewLimitedSubscriber creates a subscriber that must keep up with the messages
+// published to it. onOverflow is called once when the messages waiting to be read
+// exceed limit bytes or size messages, and no more messages are delivered to it.
+func NewLimitedSubscriber(size int, limit int64, onOverflow func()) *Subscriber {
+	return &Subscriber{
+		C:          make(chan PubSubMessage, size),
+		limit:      limit,
+		onOverflow: onOverflow,
+	}
+}
+
+// Done must be called by limited subscribers after consuming a message from C,
+// releasing its bytes from the pending limit.
+func (s *Subscriber) Done(msg PubSubMessage) {
+	s.pending.Add(-msg.size())
+}
+
+func (s *Subscriber) deliver(msg PubSubMessage) bool {
+	if s.onOverflow == nil {
+		select {
+		case s.C <- msg:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if s.pending.Add(msg.size()) > s.limit {
+		s.overflow()
+		return false
+	}
+	select {
+	case s.C <- msg:
+		return true
+	default:
+		s.overflow()
+		return false
+	}
+}
+
+func (s *Subscriber) overflow() {
+	s.overflowed.Do(func() {
+		// keep the pending bytes over the limit, so nothing else is delivered
+		s.pending.Add(s.limit + 1)
+		s.onOverflow()
+	})
 }
 
 type PubSubImpl struct {
-	Channels map[string]chan PubSubMessage
+	Channels map[string]map[*Subscriber]struct{}
+	Patterns map[string]map[*Subscriber]struct{}
+	mu       sync.RWMutex
+	sharded  bool
 }
 
 func NewPubSub() PubSub {
 	return &PubSubImpl{
-		Channels: make(map[string]chan PubSubMessage),
+		Channels: make(map[string]map[*Subscriber]struct{}),
+		Patterns: make(map[string]map[*Subscriber]struct{}),
+	}
+}
+
+// NewShardedPubSub creates the registry of shard channels, whose messages
+// are delivered as `smessage` and are never matched against patterns.
+func NewShardedPubSub() PubSub {
+	return &PubSubImpl{
+		Channels: make(map[string]map[*Subscriber]struct{}),
+		Patterns: make(map[string]map[*Subscriber]struct{}),
+		sharded:  true,
+	}
+}
+
+func (ps *PubSubImpl) Subscribe(sub *Subscriber, topics ...string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	subscribe(ps.Channels, sub, topics)
+}
+
+// Unsubscribe removes the subscriber from the given topics.
+// The subscriber channel is never closed, as it may still be listening to other topics.
+func (ps *PubSubImpl) Unsubscribe(sub *Subscriber, topics ...string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	unsubscribe(ps.Channels, sub, topics)
+}
+
+func (ps *PubSubImpl) PSubscribe(sub *Subscriber, patterns ...string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	subscribe(ps.Patterns, sub, patterns)
+}
+
+func (ps *PubSubImpl) PUnsubscribe(sub *Subscriber, patterns ...string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	unsubscribe(ps.Patterns, sub, patterns)
+}
+
+// Publish delivers the message to every subscriber of the topic, and to every
+// subscriber of a pattern matching the topic, without blocking. It returns the
+// number of deliveries made.
+func (ps *PubSubImpl) Publish(topic, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	kind := KindMessage
+	if ps.sharded {
+		kind = KindSMessage
 	}
+
+	received := 0
+	for sub := range ps.Channels[topic] {
+		if sub.deliver(PubSubMessage{Kind: kind, Topic: topic, Message: message}) {
+			received++
+		}
+	}
+	if ps.sharded {
+		return received
+	}
+	for pattern, subs := range ps.Patterns {
+		if !GlobMatch(pattern, topic) {
+			continue
+		}
+		for sub := range subs {
+			if sub.deliver(PubSubMessage{Kind: KindPMessage, Topic: topic, Message: message, Pattern: pattern}) {
+				received++
+			}
+		}
+	}
+	return received
+}
+
+// Topics lists the topics with at least one subscriber matching the pattern.
+func (ps *PubSubImpl) Topics(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	topics := []string{}
+	for topic := range ps.Channels {
+		if GlobMatch(pattern, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
 }
 
-func (ps *PubSubImpl) Subscribe(topic string) chan PubSubMessage {
-	if _, ok := ps.Channels[topic]; !ok {
-		ps.Channels[topic] = make(chan PubSubMessage)
+func (ps *PubSubImpl) NumSub(topic string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.Channels[topic])
+}
+
+func (ps *PubSubImpl) NumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.Patterns)
+}
+
+// Evict unsubscribes every subscriber of the topic, letting each of them know
+// through a `sunsubscribe` message.
+func (ps *PubSubImpl) Evict(topic string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for sub := range ps.Channels[topic] {
+		sub.deliver(PubSubMessage{Kind: KindSUnsubscribe, Topic: topic})
 	}
-	return ps.Channels[topic]
+	delete(ps.Channels, topic)
 }
 
-func (ps *PubSubImpl) Unsubscribe(topic string) {
-	if _, ok := ps.Channels[topic]; ok {
-		close(ps.Channels[topic])
-		delete(ps.Channels, topic)
+func subscribe(registry map[string]map[*Subscriber]struct{}, sub *Subscriber, topics []string) {
+	for _, topic := range topics {
+		if _, ok := registry[topic]; !ok {
+			registry[topic] = make(map[*Subscriber]struct{})
+		}
+		registry[topic][sub] = struct{}{}
 	}
 }
 
-func (ps *PubSubImpl) Publish(topic, message string) {
-	if ch, ok := ps.Channels[topic]; ok {
-		ch <- PubSubMessage{Topic: topic, Message: message}
+func unsubscribe(registry map[string]map[*Subscriber]struct{}, sub *Subscriber, topics []string) {
+	for _, topic := range topics {
+		if subs, ok := registry[topic]; ok {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(registry, topic)
+			}
+		}
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/codecrafters-io/redis-starter-go/app/internal/command"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/config"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/server"
 	"github.com/codecrafters-io/redis-starter-go/app/internal/store"
@@ -15,23 +16,30 @@ import (
 func main() {
 	options := setServerOptions()
 	cfg := config.NewConfig(options...)
-	db := store.NewStore()
+	dbs := store.NewDatabases(cfg.Databases())
 
-	log.Println("searching for rdb file to load data...")
-	err := db.ReadRDBFile(cfg.RDBFilePath())
-	if err != nil {
-		log.Printf("Error: %s\n failed to read rdb file, starting the server with empty data...\n", err.Error())
-	}
-
-	server := server.NewServer(cfg, db)
-
-	if cfg.Role() == "slave" {
-		if err := server.Handshake(); err != nil {
-			log.Printf("failed handshake to %s, error: %s", cfg.ReplicaOf(), err.Error())
-			os.Exit(1)
+	if cfg.AppendOnly() {
+		// the append only file is more up to date than the rdb file
+		log.Println("loading the append only file...")
+		if err := command.LoadAOF(cfg, dbs); err != nil {
+			log.Fatalf("failed to load the append only file: %s", err.Error())
+		}
+	} else {
+		log.Println("searching for rdb file to load data...")
+		libraries, err := store.ReadRDBFile(cfg.RDBFilePath(), dbs)
+		if err != nil {
+			log.Printf("Error: %s\n failed to read rdb file, starting the server with empty data...\n", err.Error())
 		}
+		if err := command.LoadLibraries(libraries); err != nil {
+			log.Printf("failed to load the function libraries of the rdb file: %s\n", err.Error())
+		}
+	}
+	if err := command.OpenAOF(cfg, dbs); err != nil {
+		log.Fatalf("failed to open the append only file: %s", err.Error())
 	}
 
+	server := server.NewServer(cfg, dbs)
+
 	if err := server.Run(); err != nil {
 		log.Println("failed to start the server:\n", err.Error())
 		os.Exit(1)
@@ -45,11 +53,37 @@ func setServerOptions() []config.Option {
 	var replicaOfHost string
 	var dir string
 	var dbfilename string
+	var databases int
+	var save string
+	var appendOnly string
+	var appendFilename string
+	var appendDirname string
+	var appendFsync string
+	var aofLoadTruncated string
+	var pubsubBufferLimit int
+	var replicaBufferLimit int
+	var notifyKeyspaceEvents string
+	var replDisklessSync string
+	var replDisklessSyncDelay int
+	var replDisklessLoad string
 
 	flag.IntVar(&port, "port", 0, "server port")
 	flag.StringVar(&replicaOfHost, "replicaof", "", "replica of")
 	flag.StringVar(&dir, "dir", "", "data directory")
 	flag.StringVar(&dbfilename, "dbfilename", "", "database filename")
+	flag.IntVar(&databases, "databases", 0, "number of databases")
+	flag.StringVar(&save, "save", config.DefaultSavePoints, "snapshot after the given seconds and number of changes, an empty string disables it")
+	flag.StringVar(&appendOnly, "appendonly", "", "log every write command to the append only file, yes or no")
+	flag.StringVar(&appendFilename, "appendfilename", "", "append only filename")
+	flag.StringVar(&appendDirname, "appenddirname", "", "directory of the append only file")
+	flag.StringVar(&appendFsync, "appendfsync", "", "sync the append only file to disk always, everysec or no")
+	flag.StringVar(&aofLoadTruncated, "aof-load-truncated", "", "load an append only file ending with a partial command, yes or no")
+	flag.StringVar(&notifyKeyspaceEvents, "notify-keyspace-events", "", "keyspace notifications to publish")
+	flag.StringVar(&replDisklessSync, "repl-diskless-sync", "", "stream the snapshot of full resynchronizations to the replicas, yes or no")
+	flag.IntVar(&replDisklessSyncDelay, "repl-diskless-sync-delay", -1, "seconds to wait for more replicas before a diskless full resynchronization")
+	flag.StringVar(&replDisklessLoad, "repl-diskless-load", "", "how a replica loads the snapshot of its master, disabled, on-empty-db or swapdb")
+	flag.IntVar(&pubsubBufferLimit, "pubsub-buffer-limit", 0, "bytes a pub/sub client may have pending before being disconnected")
+	flag.IntVar(&replicaBufferLimit, "replica-buffer-limit", 0, "bytes a replica may have pending before being disconnected")
 
 	flag.Parse()
 
@@ -64,6 +98,78 @@ func setServerOptions() []config.Option {
 		options = append(options, config.WithRDBFileName(dbfilename))
 	}
 
+	if databases > 0 {
+		options = append(options, config.WithDatabases(databases))
+	}
+
+	savePoints, err := config.ParseSavePoints(save)
+	if err != nil {
+		log.Fatalf("error parsing save %s: %s", save, err.Error())
+	}
+	options = append(options, config.WithSavePoints(savePoints))
+
+	if appendOnly != "" {
+		enabled, err := config.ParseYesNo(appendOnly)
+		if err != nil {
+			log.Fatalf("error parsing appendonly %s: %s", appendOnly, err.Error())
+		}
+		options = append(options, config.WithAppendOnly(enabled))
+	}
+	if appendFilename != "" {
+		options = append(options, config.WithAppendFilename(appendFilename))
+	}
+	if appendDirname != "" {
+		options = append(options, config.WithAppendDirname(appendDirname))
+	}
+	if appendFsync != "" {
+		policy, err := config.ParseAppendFsync(appendFsync)
+		if err != nil {
+			log.Fatalf("error parsing appendfsync %s: %s", appendFsync, err.Error())
+		}
+		options = append(options, config.WithAppendFsync(policy))
+	}
+	if aofLoadTruncated != "" {
+		loadTruncated, err := config.ParseYesNo(aofLoadTruncated)
+		if err != nil {
+			log.Fatalf("error parsing aof-load-truncated %s: %s", aofLoadTruncated, err.Error())
+		}
+		options = append(options, config.WithAOFLoadTruncated(loadTruncated))
+	}
+
+	if replDisklessSync != "" {
+		enabled, err := config.ParseYesNo(replDisklessSync)
+		if err != nil {
+			log.Fatalf("error parsing repl-diskless-sync %s: %s", replDisklessSync, err.Error())
+		}
+		options = append(options, config.WithReplDisklessSync(enabled))
+	}
+	if replDisklessSyncDelay >= 0 {
+		options = append(options, config.WithReplDisklessSyncDelay(replDisklessSyncDelay))
+	}
+	if replDisklessLoad != "" {
+		mode, err := config.ParseDisklessLoad(replDisklessLoad)
+		if err != nil {
+			log.Fatalf("error parsing repl-diskless-load %s: %s", replDisklessLoad, err.Error())
+		}
+		options = append(options, config.WithReplDisklessLoad(mode))
+	}
+
+	if pubsubBufferLimit > 0 {
+		options = append(options, config.WithPubSubBufferLimit(pubsubBufferLimit))
+	}
+
+	if replicaBufferLimit > 0 {
+		options = append(options, config.WithReplicaBufferLimit(replicaBufferLimit))
+	}
+
+	if notifyKeyspaceEvents != "" {
+		events, err := config.ParseKeyspaceEvents(notifyKeyspaceEvents)
+		if err != nil {
+			log.Fatalf("error parsing notify-keyspace-events %s: %s", notifyKeyspaceEvents, err.Error())
+		}
+		options = append(options, config.WithKeyspaceEvents(events))
+	}
+
 	if replicaOfHost != "" {
 		replicaOfPort := 0
 		if len(flag.Args()) == 0 {
@@ -0,0 +1,160 @@
+// Command check-aof validates an append only file, either a single file or
+// the files listed by a manifest. With --fix, a file ending with a partial
+// command, an invalid one, or a transaction missing its EXEC is truncated to
+// its last valid command.
+//
+//	check-aof [--fix] <file.aof|file.manifest>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/aof"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func main() {
+	var fix bool
+	flag.BoolVar(&fix, "fix", false, "truncate the file to its last valid command")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: check-aof [--fix] <file.aof|file.manifest>")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := flag.Arg(0)
+	files := []string{path}
+	if strings.HasSuffix(path, ".manifest") {
+		dir, name := filepath.Dir(path), strings.TrimSuffix(filepath.Base(path), ".manifest")
+		manifest, err := aof.LoadManifest(dir, name)
+		if err != nil {
+			fmt.Printf("Invalid manifest %s: %s\n", path, err.Error())
+			os.Exit(1)
+		}
+		files = files[:0]
+		for _, info := range manifest.Files() {
+			files = append(files, filepath.Join(dir, info.Name))
+		}
+		fmt.Printf("Checking the %d files of the manifest %s\n", len(files), path)
+	}
+
+	for i, file := range files {
+		// only the last file, being appended to when the server stopped, can be fixed
+		if !check(file, fix && i == len(files)-1) {
+			os.Exit(1)
+		}
+	}
+}
+
+// check validates a file, truncating it when fix is set, and reports whether it is valid
+func check(path string, fix bool) bool {
+	isRDB, err := aof.IsRDBFile(path)
+	if err != nil {
+		fmt.Printf("Cannot open %s: %s\n", path, err.Error())
+		return false
+	}
+	if isRDB {
+		return checkRDB(path)
+	}
+
+	size, valid, err := checkCommands(path)
+	if err != nil && size < 0 {
+		fmt.Printf("Cannot open %s: %s\n", path, err.Error())
+		return false
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", path, size, valid, size-valid)
+	if err == nil {
+		fmt.Printf("AOF %s is valid\n", path)
+		return true
+	}
+
+	if !fix {
+		fmt.Printf("AOF %s is not valid. Use the --fix option to try fixing it.\n", path)
+		return false
+	}
+	if err := os.Truncate(path, valid); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %s\n", path, err.Error())
+		return false
+	}
+	fmt.Printf("Successfully truncated AOF %s from %d to %d bytes\n", path, size, valid)
+	return true
+}
+
+// checkCommands reads the commands of the file, returning its size and the
+// size of the part up to its last valid command outside of a transaction.
+// The size is -1 when the file can't be read.
+func checkCommands(path string) (size int64, valid int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return -1, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return -1, 0, err
+	}
+
+	reader := aof.NewReader(file)
+	multi := false
+	for {
+		args, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, aof.ErrTruncated) {
+			return info.Size(), valid, fmt.Errorf("0x%x: Expected more data, the file ends in the middle of a command", reader.Offset())
+		}
+		if err != nil {
+			return info.Size(), valid, err
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "multi":
+			if multi {
+				return info.Size(), valid, fmt.Errorf("0x%x: Unexpected MULTI", reader.Offset())
+			}
+			multi = true
+		case "exec":
+			if !multi {
+				return info.Size(), valid, fmt.Errorf("0x%x: Unexpected EXEC", reader.Offset())
+			}
+			multi = false
+		}
+		if !multi {
+			valid = reader.Offset()
+		}
+	}
+	if multi {
+		return info.Size(), valid, fmt.Errorf("Reached EOF before reading EXEC for MULTI")
+	}
+	return info.Size(), valid, nil
+}
+
+// checkRDB validates a base file in the RDB format, which can't be fixed
+func checkRDB(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Cannot open %s: %s\n", path, err.Error())
+		return false
+	}
+	defer file.Close()
+
+	if _, err := rdb.Parse(file); err != nil {
+		fmt.Printf("RDB base file %s is not valid: %s\n", path, err.Error())
+		return false
+	}
+	fmt.Printf("RDB base file %s is valid\n", path)
+	return true
+}
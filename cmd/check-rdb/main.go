@@ -0,0 +1,109 @@
+// Command check-rdb validates the structure and the checksum of an RDB file,
+// reporting the offset of the first failure.
+//
+//	check-rdb <file.rdb>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: check-rdb <file.rdb>")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := flag.Arg(0)
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %s\n", path, err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	fmt.Printf("[offset 0] Checking RDB file %s\n", path)
+	content, err := rdb.Parse(file)
+	if err != nil {
+		fmt.Println("--- RDB ERROR DETECTED ---")
+		var parseErr *rdb.ParseError
+		if errors.As(err, &parseErr) {
+			fmt.Printf("[offset %d] %s\n", parseErr.Offset, parseErr.Err.Error())
+		} else {
+			fmt.Println(err.Error())
+		}
+		os.Exit(1)
+	}
+
+	report(content)
+	fmt.Println("\\o/ RDB looks OK! \\o/")
+}
+
+// report prints what the file holds: its version, auxiliary fields, keys by
+// database and type, and whether its checksum was verified
+func report(content *rdb.File) {
+	fmt.Printf("[info] RDB version %d\n", content.Version)
+	fields := make([]string, 0, len(content.Aux))
+	for field := range content.Aux {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	for _, field := range fields {
+		fmt.Printf("[info] AUX FIELD %s = '%s'\n", field, content.Aux[field])
+	}
+	fmt.Printf("[info] %d function libraries\n", len(content.Functions))
+
+	keys, expires, types := map[int]int{}, 0, map[string]int{}
+	for _, key := range content.Keys {
+		keys[key.DB]++
+		if key.Expires {
+			expires++
+		}
+		types[rdb.TypeName(key.Value)]++
+	}
+	dbs := make([]int, 0, len(keys))
+	for db := range keys {
+		dbs = append(dbs, db)
+	}
+	slices.Sort(dbs)
+	for _, db := range dbs {
+		fmt.Printf("[info] database %d: %d keys\n", db, keys[db])
+	}
+	fmt.Printf("[info] %d keys read\n", len(content.Keys))
+	fmt.Printf("[info] %d expires\n", expires)
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	counts := make([]string, 0, len(names))
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%s=%d", name, types[name]))
+	}
+	if len(counts) > 0 {
+		fmt.Printf("[info] types: %s\n", strings.Join(counts, " "))
+	}
+	for _, name := range content.Modules {
+		fmt.Printf("[info] skipped the data of the %s module\n", name)
+	}
+
+	switch {
+	case content.Version < 5:
+		fmt.Println("[info] RDB version without checksum")
+	case content.Checksum == 0:
+		fmt.Println("[info] RDB file was saved with checksum disabled: no check performed.")
+	default:
+		fmt.Printf("[info] Checksum OK (%#016x)\n", content.Checksum)
+	}
+}
@@ -0,0 +1,210 @@
+// Command rdb-dump exports the content of an RDB file, either as JSON or as
+// the RESP commands rebuilding it, which can be piped to a server.
+//
+//	rdb-dump [-format json|resp] [-db n] <file.rdb>
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/aof"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func main() {
+	var format string
+	var db int
+	flag.StringVar(&format, "format", "json", "output format, json or resp")
+	flag.IntVar(&db, "db", -1, "only export the keys of the given database")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rdb-dump [-format json|resp] [-db n] <file.rdb>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || format != "json" && format != "resp" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := flag.Arg(0)
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %s\n", path, err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	content, err := rdb.Parse(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s: %s\n", path, err.Error())
+		os.Exit(1)
+	}
+	if db >= 0 {
+		keys := []rdb.Key{}
+		for _, key := range content.Keys {
+			if key.DB == db {
+				keys = append(keys, key)
+			}
+		}
+		content.Keys = keys
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if format == "resp" {
+		err = aof.WriteCommands(out, content.Keys, content.Functions)
+	} else {
+		err = writeJSON(out, content)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to export %s: %s\n", path, err.Error())
+		os.Exit(1)
+	}
+}
+
+type jsonFile struct {
+	Version   int               `json:"version"`
+	Aux       map[string]string `json:"aux"`
+	Functions []string          `json:"functions"`
+	Keys      []jsonKey         `json:"keys"`
+}
+
+// jsonKey is a key, ExpireAt being the unix time in milliseconds it expires at
+type jsonKey struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	ExpireAt int64  `json:"expireat,omitempty"`
+	Value    any    `json:"value"`
+}
+
+// Scores are strings, as JSON numbers can't be infinite
+type jsonMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+type jsonField struct {
+	Field    string `json:"field"`
+	Value    string `json:"value"`
+	ExpireAt int64  `json:"expireat,omitempty"`
+}
+
+type jsonStream struct {
+	Entries      []jsonEntry `json:"entries"`
+	LastId       string      `json:"last_id"`
+	EntriesAdded uint64      `json:"entries_added"`
+	MaxDeletedId string      `json:"max_deleted_id"`
+	Groups       []jsonGroup `json:"groups"`
+}
+
+type jsonEntry struct {
+	Id     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+type jsonGroup struct {
+	Name        string        `json:"name"`
+	LastId      string        `json:"last_id"`
+	EntriesRead int64         `json:"entries_read"`
+	Pending     []jsonPending `json:"pending"`
+	Consumers   []string      `json:"consumers"`
+}
+
+type jsonPending struct {
+	Id            string `json:"id"`
+	Consumer      string `json:"consumer"`
+	DeliveryTime  int64  `json:"delivery_time"`
+	DeliveryCount uint64 `json:"delivery_count"`
+}
+
+func writeJSON(w io.Writer, content *rdb.File) error {
+	file := jsonFile{
+		Version:   content.Version,
+		Aux:       content.Aux,
+		Functions: content.Functions,
+		Keys:      make([]jsonKey, 0, len(content.Keys)),
+	}
+	if file.Functions == nil {
+		file.Functions = []string{}
+	}
+	for _, key := range content.Keys {
+		jsonKey := jsonKey{DB: key.DB, Key: key.Key, Type: rdb.TypeName(key.Value), Value: jsonValue(key.Value)}
+		if key.Expires {
+			jsonKey.ExpireAt = key.ExpireAt
+		}
+		file.Keys = append(file.Keys, jsonKey)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
+
+// jsonValue converts a value to the form it is exported in
+func jsonValue(value any) any {
+	switch value := value.(type) {
+	case rdb.List:
+		return []string(value)
+	case rdb.Set:
+		return []string(value)
+	case rdb.SortedSet:
+		members := make([]jsonMember, len(value))
+		for i, member := range value {
+			members[i] = jsonMember{Member: member.Member, Score: strconv.FormatFloat(member.Score, 'g', -1, 64)}
+		}
+		return members
+	case rdb.Hash:
+		fields := make([]jsonField, len(value))
+		for i, field := range value {
+			fields[i] = jsonField{Field: field.Field, Value: field.Value, ExpireAt: field.ExpireAt}
+		}
+		return fields
+	case *rdb.Stream:
+		return jsonStreamValue(value)
+	}
+	return value
+}
+
+func jsonStreamValue(stream *rdb.Stream) jsonStream {
+	result := jsonStream{
+		Entries:      make([]jsonEntry, len(stream.Entries)),
+		LastId:       stream.LastId.String(),
+		EntriesAdded: stream.EntriesAdded,
+		MaxDeletedId: stream.MaxDeletedId.String(),
+		Groups:       make([]jsonGroup, len(stream.Groups)),
+	}
+	for i, entry := range stream.Entries {
+		result.Entries[i] = jsonEntry{Id: entry.Id.String(), Fields: entry.Fields}
+	}
+	for i, group := range stream.Groups {
+		jsonGroup := jsonGroup{
+			Name:        group.Name,
+			LastId:      group.LastId.String(),
+			EntriesRead: group.EntriesRead,
+			Pending:     make([]jsonPending, len(group.Pending)),
+			Consumers:   make([]string, len(group.Consumers)),
+		}
+		for j, pending := range group.Pending {
+			jsonGroup.Pending[j] = jsonPending{
+				Id:            pending.Id.String(),
+				Consumer:      pending.Consumer,
+				DeliveryTime:  pending.DeliveryTime,
+				DeliveryCount: pending.DeliveryCount,
+			}
+		}
+		for j, consumer := range group.Consumers {
+			jsonGroup.Consumers[j] = consumer.Name
+		}
+		result.Groups[i] = jsonGroup
+	}
+	return result
+}
@@ -8,8 +8,22 @@ const (
 	OPCODE_EXPIRETIME      = 0xFD
 	OPCODE_SELECTDB        = 0xFE
 	OPCODE_RESIZEDB        = 0xFB
+	OPCODE_AUX             = 0xFA
+	OPCODE_FREQ            = 0xF9
+	OPCODE_IDLE            = 0xF8
+	OPCODE_MODULE_AUX      = 0xF7
+	OPCODE_FUNCTION_PRE_GA = 0xF6
+	OPCODE_FUNCTION2       = 0xF5
+	OPCODE_SLOT_INFO       = 0xF4
 )
 
+// RDB_VERSION is the version of the RDB format written by the server
+const RDB_VERSION = 11
+
+// MAX_RDB_VERSION is the latest version of the RDB format the server can read,
+// which adds hash fields with their own time to live
+const MAX_RDB_VERSION = 12
+
 // Length Encoding Constants
 const (
 	// 00
@@ -21,3 +35,50 @@ const (
 	// 11
 	ENC_LZF = 0b11
 )
+
+// Value types, each one being a type of key stored in a given encoding
+const (
+	TYPE_STRING                  = 0
+	TYPE_LIST                    = 1
+	TYPE_SET                     = 2
+	TYPE_ZSET                    = 3
+	TYPE_HASH                    = 4
+	TYPE_ZSET_2                  = 5
+	TYPE_MODULE_PRE_GA           = 6
+	TYPE_MODULE_2                = 7
+	TYPE_HASH_ZIPMAP             = 9
+	TYPE_LIST_ZIPLIST            = 10
+	TYPE_SET_INTSET              = 11
+	TYPE_ZSET_ZIPLIST            = 12
+	TYPE_HASH_ZIPLIST            = 13
+	TYPE_LIST_QUICKLIST          = 14
+	TYPE_STREAM_LISTPACKS        = 15
+	TYPE_HASH_LISTPACK           = 16
+	TYPE_ZSET_LISTPACK           = 17
+	TYPE_LIST_QUICKLIST_2        = 18
+	TYPE_STREAM_LISTPACKS_2      = 19
+	TYPE_SET_LISTPACK            = 20
+	TYPE_STREAM_LISTPACKS_3      = 21
+	TYPE_HASH_METADATA_PRE_GA    = 22
+	TYPE_HASH_LISTPACK_EX_PRE_GA = 23
+	TYPE_HASH_METADATA           = 24
+	TYPE_HASH_LISTPACK_EX        = 25
+)
+
+// Special string encodings, given by the 6 bits following ENC_LZF
+const (
+	ENC_STR_INT8  = 0
+	ENC_STR_INT16 = 1
+	ENC_STR_INT32 = 2
+	ENC_STR_LZF   = 3
+)
+
+// Opcodes of the values saved by modules
+const (
+	MODULE_OPCODE_EOF    = 0
+	MODULE_OPCODE_SINT   = 1
+	MODULE_OPCODE_UINT   = 2
+	MODULE_OPCODE_FLOAT  = 3
+	MODULE_OPCODE_DOUBLE = 4
+	MODULE_OPCODE_STRING = 5
+)
@@ -0,0 +1,32 @@
+package rdb
+
+// crc64Poly is the reflected Jones polynomial redis uses to checksum RDB
+// files and DUMP payloads
+const crc64Poly = 0x95ac9329ac4bc9b5
+
+var crc64Table = makeCRC64Table()
+
+func makeCRC64Table() *[256]uint64 {
+	table := new([256]uint64)
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64Poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// CRC64 adds data to the checksum crc, which starts at 0. Unlike the
+// checksums of hash/crc64, redis neither inverts the initial nor the final value.
+func CRC64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
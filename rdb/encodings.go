@@ -0,0 +1,288 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+var (
+	errListpack = fmt.Errorf("invalid listpack")
+	errZiplist  = fmt.Errorf("invalid ziplist")
+	errIntset   = fmt.Errorf("invalid intset")
+	errZipmap   = fmt.Errorf("invalid zipmap")
+)
+
+/*
+ParseListpack returns the elements of a listpack, integers being formatted as strings.
+The listpack starts with its size in 4 bytes and its number of elements in 2 bytes,
+followed by the elements and an FF terminator. Each element is its encoding and
+data followed by their length, so listpacks can be walked backwards:
+- 0xxxxxxx: 7 bits unsigned integer
+- 10xxxxxx: string of up to 63 bytes
+- 110xxxxx yyyyyyyy: 13 bits signed integer
+- 1110xxxx yyyyyyyy: string of up to 4095 bytes
+- 11110000 <4 bytes>: string of a 32 bits length
+- 11110001, 11110010, 11110011, 11110100: 16, 24, 32 and 64 bits signed integers
+*/
+func ParseListpack(data []byte) ([]string, error) {
+	if len(data) < 7 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errListpack
+	}
+
+	elements := []string{}
+	p := 6
+	for {
+		if p >= len(data) {
+			return nil, errListpack
+		}
+		enc := data[p]
+		if enc == 0xFF {
+			break
+		}
+
+		var element string
+		var size int
+		switch {
+		case enc&0x80 == 0:
+			element, size = strconv.Itoa(int(enc)), 1
+		case enc&0xC0 == 0x80:
+			length := int(enc & 0x3F)
+			size = 1 + length
+			if p+size > len(data) {
+				return nil, errListpack
+			}
+			element = string(data[p+1 : p+size])
+		case enc&0xE0 == 0xC0:
+			if p+2 > len(data) {
+				return nil, errListpack
+			}
+			n := int64(enc&0x1F)<<8 | int64(data[p+1])
+			element, size = strconv.FormatInt(signExtend(n, 13), 10), 2
+		case enc&0xF0 == 0xE0:
+			if p+2 > len(data) {
+				return nil, errListpack
+			}
+			length := int(enc&0x0F)<<8 | int(data[p+1])
+			size = 2 + length
+			if p+size > len(data) {
+				return nil, errListpack
+			}
+			element = string(data[p+2 : p+size])
+		case enc == 0xF0:
+			if p+5 > len(data) {
+				return nil, errListpack
+			}
+			length := int(binary.LittleEndian.Uint32(data[p+1:]))
+			size = 5 + length
+			if length < 0 || p+size > len(data) {
+				return nil, errListpack
+			}
+			element = string(data[p+5 : p+size])
+		case enc >= 0xF1 && enc <= 0xF4:
+			bytes := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[enc]
+			if p+1+bytes > len(data) {
+				return nil, errListpack
+			}
+			n := readIntLE(data[p+1 : p+1+bytes])
+			element, size = strconv.FormatInt(n, 10), 1+bytes
+		default:
+			return nil, errListpack
+		}
+
+		elements = append(elements, element)
+		p += size + backlenSize(size)
+	}
+
+	if count := binary.LittleEndian.Uint16(data[4:]); count != 0xFFFF && int(count) != len(elements) {
+		return nil, errListpack
+	}
+	return elements, nil
+}
+
+// backlenSize is the number of bytes taken by the length of a listpack
+// element, stored after it in 7 bits chunks
+func backlenSize(size int) int {
+	// as in redis, the largest size of each number of chunks takes one more
+	switch {
+	case size < 1<<7:
+		return 1
+	case size < 1<<14-1:
+		return 2
+	case size < 1<<21-1:
+		return 3
+	case size < 1<<28-1:
+		return 4
+	}
+	return 5
+}
+
+/*
+ParseZiplist returns the elements of a ziplist, the encoding listpacks replaced.
+The ziplist starts with its size and the offset of its last element in 4 bytes
+each, and its number of elements in 2 bytes, followed by the elements and an FF
+terminator. Each element starts with the length of the previous one, in 1 byte
+or in FE followed by 4 bytes, then comes its encoding and data:
+- 00xxxxxx: string of up to 63 bytes
+- 01xxxxxx yyyyyyyy: string of up to 16383 bytes, the length being big endian
+- 10000000 <4 bytes>: string of a 32 bits big endian length
+- 11000000, 11010000, 11100000: 16, 32 and 64 bits signed integers
+- 11110000, 11111110: 24 and 8 bits signed integers
+- 1111xxxx: xxxx-1 is an integer between 0 and 12
+*/
+func ParseZiplist(data []byte) ([]string, error) {
+	if len(data) < 11 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errZiplist
+	}
+
+	elements := []string{}
+	p := 10
+	for {
+		if p >= len(data) {
+			return nil, errZiplist
+		}
+		if data[p] == 0xFF {
+			break
+		}
+		if data[p] == 0xFE {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(data) {
+			return nil, errZiplist
+		}
+
+		enc := data[p]
+		var element string
+		var size int
+		switch {
+		case enc>>6 == 0:
+			size = 1 + int(enc&0x3F)
+			if p+size > len(data) {
+				return nil, errZiplist
+			}
+			element = string(data[p+1 : p+size])
+		case enc>>6 == 1:
+			if p+2 > len(data) {
+				return nil, errZiplist
+			}
+			size = 2 + (int(enc&0x3F)<<8 | int(data[p+1]))
+			if p+size > len(data) {
+				return nil, errZiplist
+			}
+			element = string(data[p+2 : p+size])
+		case enc == 0x80:
+			if p+5 > len(data) {
+				return nil, errZiplist
+			}
+			size = 5 + int(binary.BigEndian.Uint32(data[p+1:]))
+			if size < 5 || p+size > len(data) {
+				return nil, errZiplist
+			}
+			element = string(data[p+5 : p+size])
+		case enc >= 0xF1 && enc <= 0xFD:
+			element, size = strconv.Itoa(int(enc&0x0F)-1), 1
+		default:
+			bytes, ok := map[byte]int{0xC0: 2, 0xD0: 4, 0xE0: 8, 0xF0: 3, 0xFE: 1}[enc]
+			if !ok || p+1+bytes > len(data) {
+				return nil, errZiplist
+			}
+			element = strconv.FormatInt(readIntLE(data[p+1:p+1+bytes]), 10)
+			size = 1 + bytes
+		}
+
+		elements = append(elements, element)
+		p += size
+	}
+
+	if count := binary.LittleEndian.Uint16(data[8:]); count != 0xFFFF && int(count) != len(elements) {
+		return nil, errZiplist
+	}
+	return elements, nil
+}
+
+/*
+ParseIntset returns the integers of an intset formatted as strings. The intset
+starts with the size of its integers and their number, in 4 bytes each,
+followed by the integers in little endian.
+*/
+func ParseIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errIntset
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if size != 2 && size != 4 && size != 8 || len(data) != 8+size*count {
+		return nil, errIntset
+	}
+
+	elements := make([]string, count)
+	for i := range elements {
+		offset := 8 + i*size
+		elements[i] = strconv.FormatInt(readIntLE(data[offset:offset+size]), 10)
+	}
+	return elements, nil
+}
+
+/*
+ParseZipmap returns the fields and values of a zipmap, the encoding of small
+hashes before ziplists. The zipmap starts with its number of fields in 1 byte,
+followed by the fields and values and an FF terminator. Each string starts with
+its length, in 1 byte or in FE followed by 4 bytes, and values have 1 more byte
+telling the number of unused bytes following them.
+*/
+func ParseZipmap(data []byte) ([]string, error) {
+	elements := []string{}
+	p := 1
+	for {
+		if p >= len(data) {
+			return nil, errZipmap
+		}
+		if data[p] == 0xFF {
+			break
+		}
+
+		length := int(data[p])
+		p++
+		if length == 0xFE {
+			if p+4 > len(data) {
+				return nil, errZipmap
+			}
+			length = int(binary.LittleEndian.Uint32(data[p:]))
+			p += 4
+		}
+
+		free := 0
+		if len(elements)%2 == 1 {
+			if p >= len(data) {
+				return nil, errZipmap
+			}
+			free = int(data[p])
+			p++
+		}
+		if length < 0 || p+length+free > len(data) {
+			return nil, errZipmap
+		}
+		elements = append(elements, string(data[p:p+length]))
+		p += length + free
+	}
+	if len(elements)%2 != 0 {
+		return nil, errZipmap
+	}
+	return elements, nil
+}
+
+// readIntLE reads a little endian signed integer of up to 8 bytes
+func readIntLE(data []byte) int64 {
+	var n uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(data[i])
+	}
+	return signExtend(int64(n), 8*len(data))
+}
+
+func signExtend(n int64, bits int) int64 {
+	shift := 64 - bits
+	return n << shift >> shift
+}
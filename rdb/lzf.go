@@ -0,0 +1,120 @@
+package rdb
+
+import "fmt"
+
+var errLZF = fmt.Errorf("invalid LZF compressed string")
+
+// lzfMaxRatio is the most compressed data can expand, the longest back
+// reference taking 3 bytes for 264 bytes
+const lzfMaxRatio = 88
+
+/*
+LZFDecompress expands data compressed with LZF into a string of size bytes.
+Each chunk starts with a control byte:
+- 000LLLLL: a run of L+1 literal bytes follows
+- LLLOOOOO OOOOOOOO: a back reference of L+2 bytes at an offset of O+1 bytes
+- 111OOOOO LLLLLLLL OOOOOOOO: a back reference of L+9 bytes at an offset of O+1 bytes
+*/
+func LZFDecompress(data []byte, size int) ([]byte, error) {
+	// the size comes from the file, so it is checked before being allocated
+	if size < 0 || size > len(data)*lzfMaxRatio {
+		return nil, errLZF
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < len(data); {
+		ctrl := int(data[i])
+		i++
+
+		if ctrl < 1<<5 {
+			length := ctrl + 1
+			if i+length > len(data) || len(out)+length > size {
+				return nil, errLZF
+			}
+			out = append(out, data[i:i+length]...)
+			i += length
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(data) {
+				return nil, errLZF
+			}
+			length += int(data[i])
+			i++
+		}
+		if i >= len(data) {
+			return nil, errLZF
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(data[i]) - 1
+		i++
+		length += 2
+		if ref < 0 || len(out)+length > size {
+			return nil, errLZF
+		}
+		// the reference may overlap the bytes being copied, so copy one at a time
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		return nil, errLZF
+	}
+	return out, nil
+}
+
+// lzfHashBits is the size of the table of the positions of the last 3 bytes sequences
+const lzfHashBits = 14
+
+/*
+LZFCompress compresses data with LZF, in the format read by LZFDecompress.
+Back references are looked up by hashing the next 3 bytes, and reach up to
+8192 bytes back. It returns nil when the compressed data isn't shorter.
+*/
+func LZFCompress(data []byte) []byte {
+	var table [1 << lzfHashBits]int
+	out := make([]byte, 0, len(data))
+	literals := []byte{}
+	flush := func() {
+		for len(literals) > 0 {
+			n := min(len(literals), 1<<5)
+			out = append(out, byte(n-1))
+			out = append(out, literals[:n]...)
+			literals = literals[n:]
+		}
+	}
+
+	for i := 0; i < len(data); {
+		if i+2 < len(data) {
+			h := (uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])) * 2654435761 >> (32 - lzfHashBits)
+			// positions are kept plus one, so 0 means none
+			ref := table[h] - 1
+			table[h] = i + 1
+			offset := i - ref - 1
+			if ref >= 0 && offset < 1<<13 &&
+				data[ref] == data[i] && data[ref+1] == data[i+1] && data[ref+2] == data[i+2] {
+				length, maxLength := 3, min(len(data)-i, 7+255+2)
+				for length < maxLength && data[ref+length] == data[i+length] {
+					length++
+				}
+				flush()
+				if length-2 < 7 {
+					out = append(out, byte((length-2)<<5|offset>>8), byte(offset))
+				} else {
+					out = append(out, byte(7<<5|offset>>8), byte(length-2-7), byte(offset))
+				}
+				i += length
+				continue
+			}
+		}
+		literals = append(literals, data[i])
+		i++
+	}
+	flush()
+
+	if len(out) >= len(data) {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ErrBadPayload is returned for a payload of an unknown version, or whose
+// checksum is wrong, and ErrBadFormat when its data can't be read
+var (
+	ErrBadPayload = fmt.Errorf("payload version or checksum are wrong")
+	ErrBadFormat  = fmt.Errorf("bad data format")
+)
+
+// DumpPayload wraps data serialized in the RDB format into the payload of
+// DUMP and FUNCTION DUMP, followed by the RDB version and a CRC64 checksum
+func DumpPayload(data []byte) []byte {
+	return dumpPayload(data, RDB_VERSION)
+}
+
+func dumpPayload(data []byte, version uint16) []byte {
+	payload := append([]byte{}, data...)
+	payload = binary.LittleEndian.AppendUint16(payload, version)
+	return binary.LittleEndian.AppendUint64(payload, CRC64(0, payload))
+}
+
+// ReadPayload checks the version and checksum of a payload made by
+// DumpPayload, returning the data it wraps
+func ReadPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, ErrBadPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > MAX_RDB_VERSION {
+		return nil, ErrBadPayload
+	}
+	crc := binary.LittleEndian.Uint64(footer[2:])
+	if crc != CRC64(0, payload[:len(payload)-8]) {
+		return nil, ErrBadPayload
+	}
+	return payload[:len(payload)-10], nil
+}
+
+// DumpFunctions serializes the code of function libraries into a payload
+func DumpFunctions(libraries []string) []byte {
+	data := []byte{}
+	for _, code := range libraries {
+		data = append(data, OPCODE_FUNCTION2)
+		data = append(data, EncodeString(code)...)
+	}
+	return DumpPayload(data)
+}
+
+// ReadFunctions returns the code of the function libraries in a payload
+// made by DumpFunctions
+func ReadFunctions(payload []byte) ([]string, error) {
+	data, err := ReadPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newReader(bytes.NewReader(data))
+	libraries := []string{}
+	for {
+		opcode, err := r.r.ReadByte()
+		if err == io.EOF {
+			return libraries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opcode != OPCODE_FUNCTION2 {
+			return nil, fmt.Errorf("given type is not a function")
+		}
+		code, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, code)
+	}
+}
+
+// DumpValue serializes a value into the payload of DUMP, made of its type
+// and its encoding in the RDB format. Like Write, the version is the one
+// hash fields with their own time to live were added in when it has any.
+func DumpValue(value any) ([]byte, error) {
+	valueType, data, err := EncodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	version := uint16(RDB_VERSION)
+	if hash, ok := value.(Hash); ok && hash.expires() {
+		version = MAX_RDB_VERSION
+	}
+	return dumpPayload(append([]byte{valueType}, data...), version), nil
+}
+
+// ReadValue returns the value in a payload made by DumpValue, which may
+// use any of the encodings of the RDB format. The payload is checked with
+// ReadPayload first, returning its error.
+func ReadValue(payload []byte) (any, error) {
+	data, err := ReadPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newReader(bytes.NewReader(data))
+	valueType, err := r.readByte()
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	if valueType == TYPE_MODULE_2 {
+		return nil, ErrBadFormat
+	}
+	value, err := r.readValue(valueType)
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	// the value must be the whole payload
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return nil, ErrBadFormat
+	}
+	return value, nil
+}
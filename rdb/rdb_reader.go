@@ -2,179 +2,641 @@ package rdb
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"math"
+	"strconv"
 )
 
-const (
-	rdbFile        = "rdb/data.txt"
-	rdbExtension   = ".rdb"
-	maxBytesToRead = 1024
-)
+var errChecksum = fmt.Errorf("wrong RDB checksum")
+
+// ParseError is returned by Parse when the file is invalid, Offset being the
+// number of bytes read when the failure was found
+type ParseError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (at offset %d)", e.Err.Error(), e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// reader reads the parts of an RDB file, keeping the CRC64 checksum of the
+// bytes read so far
+type reader struct {
+	r      *bufio.Reader
+	crc    uint64
+	offset int64
+}
 
-// Function to pass `Empty RDB Transfer` stage probably can be removed latter
-func GetEmptyRDBContent() ([]byte, error) {
-	content, err := os.ReadFile(rdbFile)
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReader(r)}
+}
+
+func (r *reader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
 	if err != nil {
-		return nil, err
+		return 0, unexpectedEOF(err)
 	}
+	r.offset++
+	r.crc = CRC64(r.crc, []byte{b})
+	return b, nil
+}
 
-	result := make([]byte, hex.DecodedLen(len(content)))
-	_, err = hex.Decode(result, content)
+// readFull reads n bytes, growing the buffer as they arrive so a corrupted
+// length can't allocate more memory than the file holds
+func (r *reader) readFull(n uint64) ([]byte, error) {
+	if n > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	buf := bytes.Buffer{}
+	read, err := io.CopyN(&buf, r.r, int64(n))
+	r.offset += read
 	if err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
+	r.crc = CRC64(r.crc, buf.Bytes())
+	return buf.Bytes(), nil
+}
 
-	return result, nil
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *reader) readUint64() (uint64, error) {
+	buf, err := r.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
 }
 
 /*
-The file header consists of two parts: the Magic Number and the version number
-- RDB files start with the ASCII-encoded 'REDIS' as the File Magic Number to represent their file type
-- The next 4 bytes represent the version number of the RDB file
+readLength reads a length, the 2 most significant bits of the first byte
+telling how it is encoded:
+- 00: the next 6 bits represent the length
+- 01: read one additional byte, the combined 14 bits represent the length
+- 10: the remaining 6 bits are 0 and the next 4 bytes represent the length in
+big endian, or they are 1 and the next 8 bytes do
+- 11: the next object is a string in a special format, given by the remaining
+6 bits, which are returned with special set
 */
-func CheckMagicNumber(reader *bufio.Reader) error {
-	// 52 45 44 49 53              # Magic String "REDIS"
-	magicNumber, err := reader.Peek(5)
+func (r *reader) readLength() (length uint64, special bool, err error) {
+	first, err := r.readByte()
 	if err != nil {
-		return err
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case ENC_INT8:
+		return uint64(first & 0x3F), false, nil
+	case ENC_INT16:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case ENC_INT32:
+		switch first {
+		case 0x80:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding %#x", first)
 	}
-	if string(magicNumber) != MAGIC_NUMBER {
-		return fmt.Errorf("invalid RDB file")
+	return uint64(first & 0x3F), true, nil
+}
+
+// readLen reads a length that can't be a string in a special format
+func (r *reader) readLen() (uint64, error) {
+	length, special, err := r.readLength()
+	if err == nil && special {
+		err = fmt.Errorf("unexpected string encoding")
 	}
+	return length, err
+}
 
-	_, err = reader.Discard(5)
+/*
+readString reads a string, which is either prefixed by its length or stored
+in one of the special formats:
+- C0 <1 byte>, C1 <2 bytes> and C2 <4 bytes> hold little endian integers
+- C3 <compressed length> <length> <data> holds an LZF compressed string
+*/
+func (r *reader) readString() (string, error) {
+	length, special, err := r.readLength()
 	if err != nil {
-		return err
+		return "", err
+	}
+	if !special {
+		data, err := r.readFull(length)
+		return string(data), err
 	}
 
-	// The next 4 bytes are the RDB Version Number
-	// 30 30 30 33                 # RDB Version Number as ASCII string. "0003" = 3
-	_, err = reader.Discard(4)
+	switch length {
+	case ENC_STR_INT8, ENC_STR_INT16, ENC_STR_INT32:
+		data, err := r.readFull(1 << length)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(readIntLE(data), 10), nil
+	case ENC_STR_LZF:
+		compressed, err := r.readLen()
+		if err != nil {
+			return "", err
+		}
+		size, err := r.readLen()
+		if err != nil {
+			return "", err
+		}
+		data, err := r.readFull(compressed)
+		if err != nil {
+			return "", err
+		}
+		data, err = LZFDecompress(data, int(size))
+		return string(data), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", length)
+}
+
+// readDoubleString reads a score of the old sorted set encoding, stored as
+// a string whose length is 1 byte, or 253, 254 and 255 for NaN, +inf and -inf
+func (r *reader) readDoubleString() (float64, error) {
+	length, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	data, err := r.readFull(uint64(length))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return strconv.ParseFloat(string(data), 64)
+}
+
+func (r *reader) readDouble() (float64, error) {
+	bits, err := r.readUint64()
+	return math.Float64frombits(bits), err
 }
 
-func SkipMetadata(reader *bufio.Reader) error {
-	currentBytesRead := 0
-	// skip to 0xFE opcode
+// Parse reads an RDB file, verifying its checksum unless it was saved
+// without one. The errors about an invalid file are a *ParseError.
+func Parse(in io.Reader) (*File, error) {
+	r := newReader(in)
+	file, err := r.parse()
+	if err != nil {
+		return nil, &ParseError{Offset: r.offset, Err: err}
+	}
+	return file, nil
+}
+
+func (r *reader) parse() (*File, error) {
+	/*
+		The file header consists of two parts: the Magic Number and the version number
+		- RDB files start with the ASCII-encoded 'REDIS' as the File Magic Number to represent their file type
+		- The next 4 bytes represent the version number of the RDB file
+	*/
+	header, err := r.readFull(9)
+	if err != nil || string(header[:5]) != MAGIC_NUMBER {
+		return nil, fmt.Errorf("invalid RDB file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > MAX_RDB_VERSION {
+		return nil, fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	file := &File{Version: version, Aux: make(map[string]string)}
+	db := 0
+	expires, expireAt := false, int64(0)
 	for {
-		opcode, err := reader.ReadByte()
+		opcode, err := r.readByte()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		currentBytesRead++
 
-		if opcode == DATABASE_SELECT_OPCODE {
-			return nil
+		switch opcode {
+		case OPCODE_EXPIRETIME_MS:
+			ms, err := r.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			expires, expireAt = true, int64(ms)
+		case OPCODE_EXPIRETIME:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return nil, err
+			}
+			expires, expireAt = true, int64(binary.LittleEndian.Uint32(buf))*1000
+		case OPCODE_FREQ:
+			// the LFU frequency of the next key, which isn't kept
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case OPCODE_IDLE:
+			// the LRU idle time of the next key, which isn't kept
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+		case OPCODE_SELECTDB:
+			n, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			if n > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid database index %d", n)
+			}
+			db = int(n)
+		case OPCODE_RESIZEDB, OPCODE_SLOT_INFO:
+			// hints about the size of the hash tables that follow
+			count := 2
+			if opcode == OPCODE_SLOT_INFO {
+				count = 3
+			}
+			for i := 0; i < count; i++ {
+				if _, err := r.readLen(); err != nil {
+					return nil, err
+				}
+			}
+		case OPCODE_AUX:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			file.Aux[key] = value
+		case OPCODE_MODULE_AUX:
+			name, err := r.skipModuleValue()
+			if err != nil {
+				return nil, err
+			}
+			file.Modules = append(file.Modules, name)
+		case OPCODE_FUNCTION_PRE_GA:
+			return nil, fmt.Errorf("pre-GA function format not supported")
+		case OPCODE_FUNCTION2:
+			code, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			file.Functions = append(file.Functions, code)
+		case END_OPCODE:
+			// files since version 5 end with the checksum of what precedes it,
+			// which is 0 when saved without checksum
+			if version < 5 {
+				return file, nil
+			}
+			crc := r.crc
+			checksum, err := r.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			if checksum != 0 && checksum != crc {
+				return nil, errChecksum
+			}
+			file.Checksum = checksum
+			return file, nil
+		default:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			if opcode == TYPE_MODULE_2 {
+				name, err := r.skipModuleValue()
+				if err != nil {
+					return nil, err
+				}
+				file.Modules = append(file.Modules, name)
+				expires, expireAt = false, 0
+				continue
+			}
+			value, err := r.readValue(opcode)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the value of %s: %w", key, err)
+			}
+			file.Keys = append(file.Keys, Key{DB: db, Key: key, Value: value, Expires: expires, ExpireAt: expireAt})
+			expires, expireAt = false, 0
 		}
-		if currentBytesRead >= maxBytesToRead {
-			return fmt.Errorf("invalid RDB file format")
+	}
+}
+
+// readValue reads a value of the given type
+func (r *reader) readValue(valueType byte) (any, error) {
+	switch valueType {
+	case TYPE_STRING:
+		return r.readString()
+	case TYPE_LIST, TYPE_SET:
+		elements, err := r.readStrings(1)
+		if valueType == TYPE_SET {
+			return Set(elements), err
 		}
-		if opcode == END_OPCODE {
-			return fmt.Errorf("invalid RDB file format")
+		return List(elements), err
+	case TYPE_ZSET, TYPE_ZSET_2:
+		return r.readSortedSet(valueType)
+	case TYPE_HASH:
+		elements, err := r.readStrings(2)
+		if err != nil {
+			return nil, err
 		}
+		return pairsToHash(elements)
+	case TYPE_LIST_QUICKLIST, TYPE_LIST_QUICKLIST_2:
+		return r.readQuicklist(valueType)
+	case TYPE_STREAM_LISTPACKS, TYPE_STREAM_LISTPACKS_2, TYPE_STREAM_LISTPACKS_3:
+		return r.readStream(valueType)
+	case TYPE_HASH_METADATA, TYPE_HASH_METADATA_PRE_GA:
+		return r.readHashMetadata(valueType)
+	case TYPE_HASH_LISTPACK_EX, TYPE_HASH_LISTPACK_EX_PRE_GA:
+		return r.readHashListpackEx(valueType)
+	case TYPE_MODULE_PRE_GA:
+		return nil, fmt.Errorf("pre-GA module values are not supported")
 	}
-}
 
-func ReadSelectDB(reader *bufio.Reader) error {
-	// FE <database-id>             # Select the database to associate the following keys with.
-	_, err := reader.ReadByte()
+	// the remaining types are a single string holding a compact encoding
+	parsers := map[byte]func([]byte) ([]string, error){
+		TYPE_HASH_ZIPMAP:   ParseZipmap,
+		TYPE_LIST_ZIPLIST:  ParseZiplist,
+		TYPE_SET_INTSET:    ParseIntset,
+		TYPE_ZSET_ZIPLIST:  ParseZiplist,
+		TYPE_HASH_ZIPLIST:  ParseZiplist,
+		TYPE_HASH_LISTPACK: ParseListpack,
+		TYPE_ZSET_LISTPACK: ParseListpack,
+		TYPE_SET_LISTPACK:  ParseListpack,
+	}
+	parse, ok := parsers[valueType]
+	if !ok {
+		return nil, fmt.Errorf("unknown value type %d", valueType)
+	}
+	data, err := r.readString()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	elements, err := parse([]byte(data))
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = reader.ReadByte()
+	switch valueType {
+	case TYPE_LIST_ZIPLIST:
+		return List(elements), nil
+	case TYPE_SET_INTSET, TYPE_SET_LISTPACK:
+		return Set(elements), nil
+	case TYPE_ZSET_ZIPLIST, TYPE_ZSET_LISTPACK:
+		return pairsToSortedSet(elements)
+	}
+	return pairsToHash(elements)
+}
+
+// readStrings reads a number of groups of size strings, followed by the strings
+func (r *reader) readStrings(size uint64) ([]string, error) {
+	n, err := r.readLen()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if n > math.MaxUint64/size {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	elements := []string{}
+	for i := uint64(0); i < n*size; i++ {
+		element, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
 	}
+	return elements, nil
+}
 
-	return nil
+// readSortedSet reads the members of a sorted set and their scores, stored
+// as strings by TYPE_ZSET and as binary doubles by TYPE_ZSET_2
+func (r *reader) readSortedSet(valueType byte) (SortedSet, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	zset := SortedSet{}
+	for i := uint64(0); i < n; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if valueType == TYPE_ZSET {
+			score, err = r.readDoubleString()
+		} else {
+			score, err = r.readDouble()
+		}
+		if err != nil {
+			return nil, err
+		}
+		zset = append(zset, SortedSetMember{Member: member, Score: score})
+	}
+	return zset, nil
 }
 
-func ReadResizeDB(reader *bufio.Reader) error {
-	// FB <length> <length>         # Resize database
-	// Number of keys in the database (Length Encoding)
-	numOfKeys, err := LengthEncodedInt(reader)
+// readQuicklist reads a list split in nodes. The nodes of TYPE_LIST_QUICKLIST
+// are ziplists, while the ones of TYPE_LIST_QUICKLIST_2 start with their
+// container: 1 for a plain element, 2 for a listpack.
+func (r *reader) readQuicklist(valueType byte) (List, error) {
+	n, err := r.readLen()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	list := List{}
+	for i := uint64(0); i < n; i++ {
+		container := uint64(2)
+		if valueType == TYPE_LIST_QUICKLIST_2 {
+			if container, err = r.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		data, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var elements []string
+		switch {
+		case valueType == TYPE_LIST_QUICKLIST:
+			elements, err = ParseZiplist([]byte(data))
+		case container == 1:
+			elements = []string{data}
+		case container == 2:
+			elements, err = ParseListpack([]byte(data))
+		default:
+			err = fmt.Errorf("unknown quicklist container %d", container)
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, elements...)
 	}
-	log.Println("Number of Keys in the Database: ", numOfKeys)
-	// Number of keys with an expire time set
-	numOfKeysWithExpireTime, err := LengthEncodedInt(reader)
+	return list, nil
+}
+
+// readHashMetadata reads a hash whose fields may expire. Each field starts
+// with its expire time, which TYPE_HASH_METADATA stores relative to the
+// minimum expire time of the hash, plus 1, leaving 0 for the fields without one.
+func (r *reader) readHashMetadata(valueType byte) (Hash, error) {
+	minExpire := uint64(0)
+	if valueType == TYPE_HASH_METADATA {
+		var err error
+		if minExpire, err = r.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := r.readLen()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	hash := Hash{}
+	for i := uint64(0); i < n; i++ {
+		ttl, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if valueType == TYPE_HASH_METADATA && ttl != 0 {
+			ttl += minExpire - 1
+		}
+		field, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		hash = append(hash, HashField{Field: field, Value: value, ExpireAt: int64(ttl)})
 	}
-	log.Println("Number of Keys with an Expire Time Set: ", numOfKeysWithExpireTime)
-	return nil
+	return hash, nil
 }
 
-/*
-Bits	How to parse
-00	The next 6 bits represent the length
-01	Read one additional byte. The combined 14 bits represent the length
-10	Discard the remaining 6 bits. The next 4 bytes from the stream represent the length
-11	The next object is encoded in a special format. The remaining 6 bits indicate the format. May be used to store numbers or Strings, see String Encoding
-*/
-func LengthEncodedInt(reader *bufio.Reader) (int, error) {
-	opcode, err := reader.ReadByte()
+// readHashListpackEx reads a small hash whose fields may expire, as a listpack
+// of fields, values and expire times, 0 for the fields without one
+func (r *reader) readHashListpackEx(valueType byte) (Hash, error) {
+	if valueType == TYPE_HASH_LISTPACK_EX {
+		// the minimum expire time of the fields, which can be recomputed
+		if _, err := r.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	data, err := r.readString()
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	// Represented the opcode in little endian -- 2 most significant bits
-	switch opcode >> 6 {
-	case ENC_INT8:
-		// It's 00, so read the next 6 bits
-		return int(binary.LittleEndian.Uint16([]byte{opcode, 00})), nil
-	case ENC_INT16:
-		// It's 01, so read one additional byte
-		int16Byte, err := reader.ReadByte()
+	elements, err := ParseListpack([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(elements)%3 != 0 {
+		return nil, errListpack
+	}
+
+	hash := Hash{}
+	for i := 0; i < len(elements); i += 3 {
+		expireAt, err := strconv.ParseInt(elements[i+2], 10, 64)
 		if err != nil {
-			return -1, err
+			return nil, errListpack
 		}
-		return int(binary.LittleEndian.Uint16([]byte{opcode & 0x3F, int16Byte})), nil
-	case ENC_INT32:
-		// It's 10, so discard the remaining 6 bits
-		int32Bytes, err := reader.Peek(4)
+		hash = append(hash, HashField{Field: elements[i], Value: elements[i+1], ExpireAt: expireAt})
+	}
+	return hash, nil
+}
+
+// skipModuleValue skips the data saved by a module, returning the module
+// name. It starts with the module id, followed by values each prefixed by
+// its opcode, up to MODULE_OPCODE_EOF.
+func (r *reader) skipModuleValue() (string, error) {
+	id, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	for {
+		opcode, err := r.readLen()
 		if err != nil {
-			return -1, err
+			return "", err
+		}
+		switch opcode {
+		case MODULE_OPCODE_EOF:
+			return moduleName(id), nil
+		case MODULE_OPCODE_SINT, MODULE_OPCODE_UINT:
+			_, err = r.readLen()
+		case MODULE_OPCODE_FLOAT:
+			_, err = r.readFull(4)
+		case MODULE_OPCODE_DOUBLE:
+			_, err = r.readFull(8)
+		case MODULE_OPCODE_STRING:
+			_, err = r.readString()
+		default:
+			err = fmt.Errorf("unknown module opcode %d", opcode)
 		}
-		_, err = reader.Discard(4)
 		if err != nil {
-			return -1, err
+			return "", err
 		}
-		return int(binary.LittleEndian.Uint32([]byte{opcode & 0x3F, int32Bytes[0], int32Bytes[1], int32Bytes[2], int32Bytes[3]})), nil
-	case ENC_LZF:
-		// It's 11, so the next object is encoded in a special format
-		// The remaining 6 bits indicate the format
-		switch opcode & 0x3F {
-		case 0:
-			buf := make([]byte, 1)
-			_, err := reader.Read(buf)
-			if err != nil {
-				return -1, err
-			}
-			return int(binary.LittleEndian.Uint16([]byte{buf[0], 00})), nil
-		case 1:
-			buf := make([]byte, 2)
-			_, err := reader.Read(buf)
-			if err != nil {
-				return -1, err
-			}
-			return int(binary.LittleEndian.Uint16(buf)), nil
-		case 2:
-			buf := make([]byte, 4)
-			_, err := reader.Read(buf)
-			if err != nil {
-				return -1, err
-			}
-			return int(binary.LittleEndian.Uint32(buf)), nil
+	}
+}
+
+// moduleName decodes the name of a module out of its id, whose 54 most
+// significant bits are the 9 characters of the name and the 10 others the
+// version of its encoding
+func moduleName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	id >>= 10
+	for i := 8; i >= 0; i-- {
+		name[i] = charset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+func pairsToHash(elements []string) (Hash, error) {
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("hash with a field without value")
+	}
+	hash := Hash{}
+	for i := 0; i < len(elements); i += 2 {
+		hash = append(hash, HashField{Field: elements[i], Value: elements[i+1]})
+	}
+	return hash, nil
+}
+
+func pairsToSortedSet(elements []string) (SortedSet, error) {
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("sorted set member without score")
+	}
+	zset := SortedSet{}
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return nil, err
 		}
+		zset = append(zset, SortedSetMember{Member: elements[i], Score: score})
 	}
-	return -1, nil
+	return zset, nil
 }
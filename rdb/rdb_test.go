@@ -0,0 +1,322 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testStream() *Stream {
+	// more entries than a listpack node holds, some with other fields
+	stream := &Stream{
+		Length:       150,
+		LastId:       StreamId{1000, 149},
+		FirstId:      StreamId{1000, 0},
+		MaxDeletedId: StreamId{999, 1},
+		EntriesAdded: 152,
+		Groups: []StreamGroup{{
+			Name:        "group",
+			LastId:      StreamId{1000, 1},
+			EntriesRead: 2,
+			Pending: []StreamPendingEntry{
+				{Id: StreamId{1000, 0}, Consumer: "alice", DeliveryTime: 1700000000000, DeliveryCount: 1},
+				{Id: StreamId{1000, 1}, Consumer: "bob", DeliveryTime: 1700000000001, DeliveryCount: 3},
+			},
+			Consumers: []StreamConsumer{
+				{Name: "alice", SeenTime: 1700000000000, ActiveTime: 1700000000000},
+				{Name: "bob", SeenTime: 1700000000002, ActiveTime: 1700000000001},
+			},
+		}},
+	}
+	for i := 0; i < 150; i++ {
+		fields := []string{"name", "n" + strconv.Itoa(i), "count", strconv.Itoa(i)}
+		if i%7 == 0 {
+			fields = []string{"other", strings.Repeat("x", i)}
+		}
+		stream.Entries = append(stream.Entries, StreamEntry{Id: StreamId{1000, uint64(i)}, Fields: fields})
+	}
+	return stream
+}
+
+func TestWriteParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []Key
+		version int
+	}{
+		{
+			name: "strings",
+			keys: []Key{
+				{Key: "short", Value: "value"},
+				{Key: "empty", Value: ""},
+				{Key: "int8", Value: "-12"},
+				{Key: "int16", Value: "1234"},
+				{Key: "int32", Value: "-123456789"},
+				{Key: "int64", Value: "12345678901234"},
+				{Key: "leading zero", Value: "0123"},
+				{Key: "compressed", Value: strings.Repeat("abcdefgh", 100)},
+				{Key: "not compressed", Value: "abcdefghijklmnopqrstuvwxyz0123456789"},
+				{Key: "expiring", Value: "value", Expires: true, ExpireAt: 1900000000000},
+			},
+			version: RDB_VERSION,
+		},
+		{
+			name: "collections",
+			keys: []Key{
+				{Key: "list", Value: List{"a", "1", strings.Repeat("long", 30), ""}},
+				{Key: "set", Value: Set{"x", "y", "100000"}},
+				{Key: "zset", Value: SortedSet{{Member: "a", Score: 1.5}, {Member: "b", Score: -3}}},
+				{Key: "hash", Value: Hash{{Field: "f", Value: "v"}, {Field: "g", Value: strings.Repeat("w", 64)}}},
+				{Key: "stream", Value: testStream()},
+			},
+			version: RDB_VERSION,
+		},
+		{
+			name: "hash fields with a time to live",
+			keys: []Key{
+				{Key: "hash", Value: Hash{{Field: "f", Value: "v", ExpireAt: 1900000000000}, {Field: "g", Value: "w"}}},
+			},
+			version: MAX_RDB_VERSION,
+		},
+		{
+			name: "databases",
+			keys: []Key{
+				{DB: 0, Key: "a", Value: "0"},
+				{DB: 3, Key: "b", Value: "3", Expires: true, ExpireAt: 1900000000000},
+				{DB: 15, Key: "c", Value: List{"15"}},
+			},
+			version: RDB_VERSION,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &File{
+				Aux:       map[string]string{"redis-ver": "7.4.0", "redis-bits": "64"},
+				Functions: []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"},
+				Keys:      tt.keys,
+			}
+			buf := bytes.Buffer{}
+			if err := Write(&buf, file); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			parsed, err := Parse(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if parsed.Version != tt.version {
+				t.Errorf("version = %d, want %d", parsed.Version, tt.version)
+			}
+			data := buf.Bytes()
+			if want := CRC64(0, data[:len(data)-8]); parsed.Checksum != want {
+				t.Errorf("checksum = %x, want %x", parsed.Checksum, want)
+			}
+			if !reflect.DeepEqual(parsed.Aux, file.Aux) {
+				t.Errorf("aux = %v, want %v", parsed.Aux, file.Aux)
+			}
+			if !reflect.DeepEqual(parsed.Functions, file.Functions) {
+				t.Errorf("functions = %q, want %q", parsed.Functions, file.Functions)
+			}
+			if !reflect.DeepEqual(parsed.Keys, tt.keys) {
+				t.Errorf("keys = %+v, want %+v", parsed.Keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestDumpValueRoundTrip(t *testing.T) {
+	values := []any{
+		strings.Repeat("compressed", 10),
+		List{"a", "b"},
+		Set{"1", "2"},
+		SortedSet{{Member: "a", Score: 2}},
+		Hash{{Field: "f", Value: "v", ExpireAt: 1900000000000}},
+		testStream(),
+	}
+	for _, value := range values {
+		t.Run(TypeName(value), func(t *testing.T) {
+			payload, err := DumpValue(value)
+			if err != nil {
+				t.Fatalf("DumpValue: %v", err)
+			}
+			got, err := ReadValue(payload)
+			if err != nil {
+				t.Fatalf("ReadValue: %v", err)
+			}
+			if !reflect.DeepEqual(got, value) {
+				t.Errorf("ReadValue = %+v, want %+v", got, value)
+			}
+		})
+	}
+}
+
+func TestLZF(t *testing.T) {
+	inputs := []string{
+		strings.Repeat("a", 1000),
+		strings.Repeat("abcdefgh", 500),
+		strings.Repeat("0123456789", 3) + strings.Repeat("x", 300) + "end",
+	}
+	for _, input := range inputs {
+		compressed := LZFCompress([]byte(input))
+		if compressed == nil {
+			t.Fatalf("LZFCompress(%.20q...) didn't compress", input)
+		}
+		got, err := LZFDecompress(compressed, len(input))
+		if err != nil {
+			t.Fatalf("LZFDecompress: %v", err)
+		}
+		if string(got) != input {
+			t.Errorf("LZFDecompress = %.20q..., want %.20q...", got, input)
+		}
+	}
+
+	if LZFCompress([]byte("abcdefghijklmnopqrstuvwxyz")) != nil {
+		t.Errorf("LZFCompress compressed data that doesn't repeat")
+	}
+
+	compressed := LZFCompress([]byte(strings.Repeat("a", 100)))
+	for _, size := range []int{-1, 99, 101, 1 << 40} {
+		if _, err := LZFDecompress(compressed, size); !errors.Is(err, errLZF) {
+			t.Errorf("LZFDecompress with size %d: err = %v, want %v", size, err, errLZF)
+		}
+	}
+}
+
+// validFile returns an RDB file holding a single string, ending with its
+// value, the END opcode and the checksum
+func validFile(t *testing.T) []byte {
+	buf := bytes.Buffer{}
+	if err := Write(&buf, &File{Keys: []Key{{Key: "key", Value: "value"}}}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// withChecksum replaces the checksum of a file by the one of its content
+func withChecksum(data []byte) []byte {
+	data = bytes.Clone(data)
+	binary.LittleEndian.PutUint64(data[len(data)-8:], CRC64(0, data[:len(data)-8]))
+	return data
+}
+
+func TestParseCorrupt(t *testing.T) {
+	header := []byte(MAGIC_NUMBER + "0011")
+	maxLength := append([]byte{0x81}, bytes.Repeat([]byte{0xFF}, 8)...)
+
+	tests := []struct {
+		name string
+		data func(valid []byte) []byte
+		err  error
+	}{
+		{
+			name: "bad magic number",
+			data: func(valid []byte) []byte { return append([]byte("RODIS"), valid[5:]...) },
+		},
+		{
+			name: "unknown version",
+			data: func(valid []byte) []byte { return append([]byte(MAGIC_NUMBER+"0099"), valid[9:]...) },
+		},
+		{
+			name: "truncated",
+			data: func(valid []byte) []byte { return valid[:len(valid)-12] },
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "flipped byte",
+			data: func(valid []byte) []byte {
+				data := bytes.Clone(valid)
+				data[len(data)-10] ^= 0xFF
+				return data
+			},
+			err: errChecksum,
+		},
+		{
+			name: "LZF size out of range",
+			data: func([]byte) []byte {
+				data := append(bytes.Clone(header), TYPE_STRING, 1, 'k', 0xC3, 1)
+				return append(append(data, maxLength...), 0)
+			},
+			err: errLZF,
+		},
+		{
+			name: "LZF size larger than the data can expand to",
+			data: func([]byte) []byte {
+				data := append(bytes.Clone(header), TYPE_STRING, 1, 'k', 0xC3, 1, 0x81)
+				return append(data, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0)
+			},
+			err: errLZF,
+		},
+		{
+			name: "LZF data not matching its size",
+			data: func(valid []byte) []byte {
+				data := append(bytes.Clone(header), TYPE_STRING, 1, 'k', 0xC3, 3, 10, 1, 'a', 'b')
+				return withChecksum(append(data, END_OPCODE, 0, 0, 0, 0, 0, 0, 0, 0))
+			},
+			err: errLZF,
+		},
+		{
+			name: "string length out of range",
+			data: func([]byte) []byte {
+				return append(append(bytes.Clone(header), TYPE_STRING, 1, 'k'), maxLength...)
+			},
+		},
+		{
+			name: "list length out of range",
+			data: func([]byte) []byte {
+				return append(append(bytes.Clone(header), TYPE_HASH, 1, 'k'), maxLength...)
+			},
+		},
+		{
+			name: "database index out of range",
+			data: func([]byte) []byte {
+				return append(append(bytes.Clone(header), OPCODE_SELECTDB), maxLength...)
+			},
+		},
+	}
+
+	valid := validFile(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(bytes.NewReader(tt.data(valid)))
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Parse: err = %v, want a *ParseError", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Parse: err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadValueCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"too short", []byte{1, 2, 3}, ErrBadPayload},
+		{"wrong checksum", append(DumpPayload([]byte{TYPE_STRING, 1, 'v'})[:12], 0), ErrBadPayload},
+		{"unknown type", DumpPayload([]byte{200, 1, 'v'}), ErrBadFormat},
+		{"trailing data", DumpPayload([]byte{TYPE_STRING, 1, 'v', 'w'}), ErrBadFormat},
+		{"LZF size out of range", DumpPayload([]byte{TYPE_STRING, 0xC3, 1, 0x81, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0}), ErrBadFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadValue(tt.payload); !errors.Is(err, tt.err) {
+				t.Errorf("ReadValue: err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	payload := DumpPayload([]byte{OPCODE_FUNCTION2, 0xC3, 1, 0x81, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0})
+	if _, err := ReadFunctions(payload); !errors.Is(err, errLZF) {
+		t.Errorf("ReadFunctions: err = %v, want %v", err, errLZF)
+	}
+}
@@ -0,0 +1,415 @@
+package rdb
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// streamNodeMaxEntries is the number of entries saved in each listpack of a stream
+const streamNodeMaxEntries = 100
+
+// writer writes to w, keeping the checksum of everything written so far
+type writer struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (w *writer) write(data []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = CRC64(w.crc, data)
+	_, w.err = w.w.Write(data)
+}
+
+/*
+Write saves the file in the RDB format:
+- the magic number and version, followed by the auxiliary fields
+- the code of the function libraries
+- the keys of each database, preceded by the database index and its number of keys
+- an FF terminator and the CRC64 checksum of the whole file
+The version is the one hash fields with their own time to live were added
+in when the file has any of them, and RDB_VERSION otherwise.
+*/
+func Write(w io.Writer, file *File) error {
+	version := RDB_VERSION
+	keys := slices.Clone(file.Keys)
+	for _, key := range keys {
+		if hash, ok := key.Value.(Hash); ok && hash.expires() {
+			version = MAX_RDB_VERSION
+		}
+	}
+	// keys are saved one database after the other
+	slices.SortStableFunc(keys, func(a, b Key) int {
+		return cmp.Compare(a.DB, b.DB)
+	})
+
+	out := &writer{w: bufio.NewWriter(w)}
+	out.write([]byte(fmt.Sprintf("%s%04d", MAGIC_NUMBER, version)))
+
+	auxKeys := make([]string, 0, len(file.Aux))
+	for key := range file.Aux {
+		auxKeys = append(auxKeys, key)
+	}
+	slices.Sort(auxKeys)
+	for _, key := range auxKeys {
+		buf := []byte{OPCODE_AUX}
+		buf = appendString(buf, key)
+		out.write(appendString(buf, file.Aux[key]))
+	}
+
+	for _, code := range file.Functions {
+		out.write(appendString([]byte{OPCODE_FUNCTION2}, code))
+	}
+
+	for start := 0; start < len(keys); {
+		db := keys[start].DB
+		end, expires := start, 0
+		for ; end < len(keys) && keys[end].DB == db; end++ {
+			if keys[end].Expires {
+				expires++
+			}
+		}
+
+		buf := append([]byte{OPCODE_SELECTDB}, EncodeLength(db)...)
+		buf = append(buf, OPCODE_RESIZEDB)
+		buf = append(buf, EncodeLength(end-start)...)
+		out.write(append(buf, EncodeLength(expires)...))
+
+		for _, key := range keys[start:end] {
+			buf := []byte{}
+			if key.Expires {
+				buf = append(buf, OPCODE_EXPIRETIME_MS)
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(key.ExpireAt))
+			}
+			valueType, data, err := EncodeValue(key.Value)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, valueType)
+			buf = appendString(buf, key.Key)
+			out.write(append(buf, data...))
+		}
+		start = end
+	}
+
+	out.write([]byte{END_OPCODE})
+	out.write(binary.LittleEndian.AppendUint64(nil, out.crc))
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+// EncodeValue serializes a value, one of the types a Key holds, returning
+// the type it is saved as
+func EncodeValue(value any) (byte, []byte, error) {
+	switch value := value.(type) {
+	case string:
+		return TYPE_STRING, appendString(nil, value), nil
+	case List:
+		return TYPE_LIST, appendStrings(nil, value), nil
+	case Set:
+		return TYPE_SET, appendStrings(nil, value), nil
+	case SortedSet:
+		buf := appendLength(nil, uint64(len(value)))
+		for _, member := range value {
+			buf = appendString(buf, member.Member)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(member.Score))
+		}
+		return TYPE_ZSET_2, buf, nil
+	case Hash:
+		if value.expires() {
+			return TYPE_HASH_METADATA, appendHashMetadata(nil, value), nil
+		}
+		buf := appendLength(nil, uint64(len(value)))
+		for _, field := range value {
+			buf = appendString(buf, field.Field)
+			buf = appendString(buf, field.Value)
+		}
+		return TYPE_HASH, buf, nil
+	case *Stream:
+		return TYPE_STREAM_LISTPACKS_3, appendStream(nil, value), nil
+	}
+	return 0, nil, fmt.Errorf("can't save a value of type %T", value)
+}
+
+func (h Hash) expires() bool {
+	for _, field := range h {
+		if field.ExpireAt != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// appendHashMetadata appends a hash whose fields may expire, their expire
+// times being relative to the minimum one and 0 for the fields without one
+func appendHashMetadata(buf []byte, hash Hash) []byte {
+	minExpire := int64(math.MaxInt64)
+	for _, field := range hash {
+		if field.ExpireAt != 0 {
+			minExpire = min(minExpire, field.ExpireAt)
+		}
+	}
+
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(minExpire))
+	buf = appendLength(buf, uint64(len(hash)))
+	for _, field := range hash {
+		ttl := uint64(0)
+		if field.ExpireAt != 0 {
+			ttl = uint64(field.ExpireAt-minExpire) + 1
+		}
+		buf = appendLength(buf, ttl)
+		buf = appendString(buf, field.Field)
+		buf = appendString(buf, field.Value)
+	}
+	return buf
+}
+
+// appendStream appends a stream as read by readStream, its entries being saved
+// in listpacks of up to streamNodeMaxEntries entries
+func appendStream(buf []byte, stream *Stream) []byte {
+	nodes := (len(stream.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	buf = appendLength(buf, uint64(nodes))
+	for start := 0; start < len(stream.Entries); start += streamNodeMaxEntries {
+		entries := stream.Entries[start:min(start+streamNodeMaxEntries, len(stream.Entries))]
+		buf = appendString(buf, string(rawStreamId(entries[0].Id)))
+		buf = appendString(buf, string(EncodeListpack(streamListpack(entries))))
+	}
+
+	buf = appendLength(buf, stream.Length)
+	buf = appendStreamId(buf, stream.LastId)
+	buf = appendStreamId(buf, stream.FirstId)
+	buf = appendStreamId(buf, stream.MaxDeletedId)
+	buf = appendLength(buf, stream.EntriesAdded)
+
+	buf = appendLength(buf, uint64(len(stream.Groups)))
+	for _, group := range stream.Groups {
+		buf = appendString(buf, group.Name)
+		buf = appendStreamId(buf, group.LastId)
+		// an unknown number of entries read is saved as -1
+		buf = appendLength(buf, uint64(group.EntriesRead))
+
+		buf = appendLength(buf, uint64(len(group.Pending)))
+		for _, entry := range group.Pending {
+			buf = append(buf, rawStreamId(entry.Id)...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.DeliveryTime))
+			buf = appendLength(buf, entry.DeliveryCount)
+		}
+
+		buf = appendLength(buf, uint64(len(group.Consumers)))
+		for _, consumer := range group.Consumers {
+			buf = appendString(buf, consumer.Name)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(consumer.SeenTime))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(consumer.ActiveTime))
+
+			owned := [][]byte{}
+			for _, entry := range group.Pending {
+				if entry.Consumer == consumer.Name {
+					owned = append(owned, rawStreamId(entry.Id))
+				}
+			}
+			buf = appendLength(buf, uint64(len(owned)))
+			for _, id := range owned {
+				buf = append(buf, id...)
+			}
+		}
+	}
+	return buf
+}
+
+// streamListpack returns the elements of a listpack holding the entries, in the
+// layout parsed by parseStreamListpack. The master entry has the fields of the
+// first entry, so the entries with the same fields only keep their values.
+func streamListpack(entries []StreamEntry) []string {
+	master := entries[0].Id
+	masterFields := streamFields(entries[0])
+
+	elements := []string{strconv.Itoa(len(entries)), "0", strconv.Itoa(len(masterFields))}
+	elements = append(elements, masterFields...)
+	elements = append(elements, "0")
+	for _, entry := range entries {
+		fields := streamFields(entry)
+		sameFields := slices.Equal(fields, masterFields)
+		flags := 0
+		if sameFields {
+			flags = streamItemSameFields
+		}
+		elements = append(elements,
+			strconv.Itoa(flags),
+			strconv.FormatInt(int64(entry.Id.Ms-master.Ms), 10),
+			strconv.FormatInt(int64(entry.Id.Seq-master.Seq), 10))
+
+		count := 3 + len(fields)
+		if sameFields {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				elements = append(elements, entry.Fields[i])
+			}
+		} else {
+			elements = append(elements, strconv.Itoa(len(fields)))
+			elements = append(elements, entry.Fields...)
+			count += len(fields) + 1
+		}
+		elements = append(elements, strconv.Itoa(count))
+	}
+	return elements
+}
+
+func streamFields(entry StreamEntry) []string {
+	fields := make([]string, 0, len(entry.Fields)/2)
+	for i := 0; i+1 < len(entry.Fields); i += 2 {
+		fields = append(fields, entry.Fields[i])
+	}
+	return fields
+}
+
+func appendStreamId(buf []byte, id StreamId) []byte {
+	buf = appendLength(buf, id.Ms)
+	return appendLength(buf, id.Seq)
+}
+
+// rawStreamId returns the id as 16 bytes in big endian
+func rawStreamId(id StreamId) []byte {
+	raw := binary.BigEndian.AppendUint64(nil, id.Ms)
+	return binary.BigEndian.AppendUint64(raw, id.Seq)
+}
+
+// EncodeListpack encodes the elements into a listpack, as parsed by ParseListpack.
+// The elements that are integers are saved as such.
+func EncodeListpack(elements []string) []byte {
+	data := make([]byte, 6)
+	for _, element := range elements {
+		start := len(data)
+		if n, ok := parseInteger(element); ok {
+			data = appendListpackInt(data, n)
+		} else {
+			switch length := len(element); {
+			case length < 1<<6:
+				data = append(data, 0x80|byte(length))
+			case length < 1<<12:
+				data = append(data, 0xE0|byte(length>>8), byte(length))
+			default:
+				data = append(data, 0xF0)
+				data = binary.LittleEndian.AppendUint32(data, uint32(length))
+			}
+			data = append(data, element...)
+		}
+		data = appendBacklen(data, len(data)-start)
+	}
+	data = append(data, 0xFF)
+
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	count := min(len(elements), 0xFFFF)
+	binary.LittleEndian.PutUint16(data[4:], uint16(count))
+	return data
+}
+
+func appendListpackInt(data []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 1<<7:
+		return append(data, byte(n))
+	case n >= -1<<12 && n < 1<<12:
+		u := uint64(n) & (1<<13 - 1)
+		return append(data, 0xC0|byte(u>>8), byte(u))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.LittleEndian.AppendUint16(append(data, 0xF1), uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		return append(data, 0xF2, byte(n), byte(n>>8), byte(n>>16))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.LittleEndian.AppendUint32(append(data, 0xF3), uint32(n))
+	}
+	return binary.LittleEndian.AppendUint64(append(data, 0xF4), uint64(n))
+}
+
+// appendBacklen appends the size of an element, in 7 bits chunks from the
+// most significant one, all but the first having their high bit set
+func appendBacklen(data []byte, size int) []byte {
+	chunks := backlenSize(size)
+	for i := chunks - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7F
+		if i != chunks-1 {
+			b |= 0x80
+		}
+		data = append(data, b)
+	}
+	return data
+}
+
+// parseInteger reports whether s is an integer in its canonical form, which
+// is saved as an integer and formatted back the same way
+func parseInteger(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// EncodeLength encodes n with the length encoding, in as few bytes as possible
+func EncodeLength(n int) []byte {
+	return appendLength(nil, uint64(n))
+}
+
+func appendLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(ENC_INT16<<6|n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0x80), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0x81), n)
+}
+
+// EncodeString encodes s as a length prefixed string. Integers of up to 32
+// bits are saved as such, and long strings compressed with LZF when it
+// makes them shorter.
+func EncodeString(s string) []byte {
+	return appendString(nil, s)
+}
+
+func appendString(buf []byte, s string) []byte {
+	if n, ok := parseInteger(s); ok {
+		switch {
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			return append(buf, ENC_LZF<<6|ENC_STR_INT8, byte(n))
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			return binary.LittleEndian.AppendUint16(append(buf, ENC_LZF<<6|ENC_STR_INT16), uint16(n))
+		case n >= math.MinInt32 && n <= math.MaxInt32:
+			return binary.LittleEndian.AppendUint32(append(buf, ENC_LZF<<6|ENC_STR_INT32), uint32(n))
+		}
+	}
+
+	// as redis does, only strings longer than 20 bytes are worth compressing
+	if len(s) > 20 {
+		if compressed := LZFCompress([]byte(s)); compressed != nil && len(compressed) < len(s)-4 {
+			buf = append(buf, ENC_LZF<<6|ENC_STR_LZF)
+			buf = appendLength(buf, uint64(len(compressed)))
+			buf = appendLength(buf, uint64(len(s)))
+			return append(buf, compressed...)
+		}
+	}
+
+	buf = appendLength(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendStrings(buf []byte, strings []string) []byte {
+	buf = appendLength(buf, uint64(len(strings)))
+	for _, s := range strings {
+		buf = appendString(buf, s)
+	}
+	return buf
+}
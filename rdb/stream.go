@@ -0,0 +1,293 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Flags of the entries in the listpacks of a stream
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+func (r *reader) readStreamId() (StreamId, error) {
+	ms, err := r.readLen()
+	if err != nil {
+		return StreamId{}, err
+	}
+	seq, err := r.readLen()
+	return StreamId{ms, seq}, err
+}
+
+// readRawStreamId reads an id stored as 16 bytes in big endian
+func (r *reader) readRawStreamId() (StreamId, error) {
+	raw, err := r.readFull(16)
+	if err != nil {
+		return StreamId{}, err
+	}
+	return StreamId{binary.BigEndian.Uint64(raw), binary.BigEndian.Uint64(raw[8:])}, nil
+}
+
+/*
+readStream reads a stream, made of:
+- its entries, in listpacks each one preceded by the raw id its entries are relative to
+- its length and last id, followed since TYPE_STREAM_LISTPACKS_2 by its first id,
+its max deleted id and the number of entries ever added
+- its consumer groups, with their pending entries and consumers. Since
+TYPE_STREAM_LISTPACKS_2 groups keep the number of entries read, and since
+TYPE_STREAM_LISTPACKS_3 consumers keep their active time.
+*/
+func (r *reader) readStream(valueType byte) (*Stream, error) {
+	stream := &Stream{Entries: []StreamEntry{}, Groups: []StreamGroup{}}
+
+	nodes, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		master, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(master) != 16 {
+			return nil, fmt.Errorf("stream node key entry is not the size of a stream ID")
+		}
+		masterId := StreamId{binary.BigEndian.Uint64([]byte(master)), binary.BigEndian.Uint64([]byte(master[8:]))}
+		data, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elements, err := ParseListpack([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseStreamListpack(masterId, elements)
+		if err != nil {
+			return nil, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	if stream.Length, err = r.readLen(); err != nil {
+		return nil, err
+	}
+	if stream.LastId, err = r.readStreamId(); err != nil {
+		return nil, err
+	}
+	if valueType >= TYPE_STREAM_LISTPACKS_2 {
+		if stream.FirstId, err = r.readStreamId(); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedId, err = r.readStreamId(); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, err = r.readLen(); err != nil {
+			return nil, err
+		}
+	} else {
+		stream.EntriesAdded = stream.Length
+		if len(stream.Entries) > 0 {
+			stream.FirstId = stream.Entries[0].Id
+		}
+	}
+
+	groups, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group, err := r.readStreamGroup(valueType)
+		if err != nil {
+			return nil, err
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream, nil
+}
+
+func (r *reader) readStreamGroup(valueType byte) (StreamGroup, error) {
+	group := StreamGroup{EntriesRead: -1, Pending: []StreamPendingEntry{}, Consumers: []StreamConsumer{}}
+	var err error
+	if group.Name, err = r.readString(); err != nil {
+		return group, err
+	}
+	if group.LastId, err = r.readStreamId(); err != nil {
+		return group, err
+	}
+	if valueType >= TYPE_STREAM_LISTPACKS_2 {
+		entriesRead, err := r.readLen()
+		if err != nil {
+			return group, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pending, err := r.readLen()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < pending; i++ {
+		entry := StreamPendingEntry{}
+		if entry.Id, err = r.readRawStreamId(); err != nil {
+			return group, err
+		}
+		deliveryTime, err := r.readUint64()
+		if err != nil {
+			return group, err
+		}
+		entry.DeliveryTime = int64(deliveryTime)
+		if entry.DeliveryCount, err = r.readLen(); err != nil {
+			return group, err
+		}
+		group.Pending = append(group.Pending, entry)
+	}
+
+	consumers, err := r.readLen()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		consumer := StreamConsumer{}
+		if consumer.Name, err = r.readString(); err != nil {
+			return group, err
+		}
+		seenTime, err := r.readUint64()
+		if err != nil {
+			return group, err
+		}
+		consumer.SeenTime, consumer.ActiveTime = int64(seenTime), int64(seenTime)
+		if valueType >= TYPE_STREAM_LISTPACKS_3 {
+			activeTime, err := r.readUint64()
+			if err != nil {
+				return group, err
+			}
+			consumer.ActiveTime = int64(activeTime)
+		}
+
+		// the pending entries owned by the consumer, given by their ids only
+		owned, err := r.readLen()
+		if err != nil {
+			return group, err
+		}
+		for j := uint64(0); j < owned; j++ {
+			id, err := r.readRawStreamId()
+			if err != nil {
+				return group, err
+			}
+			found := false
+			for k := range group.Pending {
+				if group.Pending[k].Id == id {
+					group.Pending[k].Consumer = consumer.Name
+					found = true
+				}
+			}
+			if !found {
+				return group, fmt.Errorf("consumer pending entry %s not found in the group pending entries", id)
+			}
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	return group, nil
+}
+
+/*
+parseStreamListpack returns the entries of a listpack of a stream. The listpack
+starts with a master entry: the number of valid and deleted entries, the
+fields of the first entry and a 0 terminator. Every entry follows as:
+- its flags and its id, relative to the master id
+- its values when it has the same fields as the master entry, otherwise its
+number of fields followed by its fields and values
+- its number of elements, used to walk the listpack backwards
+*/
+func parseStreamListpack(master StreamId, elements []string) ([]StreamEntry, error) {
+	p := 0
+	next := func() (string, error) {
+		if p >= len(elements) {
+			return "", fmt.Errorf("truncated stream listpack")
+		}
+		p++
+		return elements[p-1], nil
+	}
+	nextInt := func() (int64, error) {
+		element, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(element, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer in stream listpack")
+		}
+		return n, nil
+	}
+
+	// the valid and deleted entries are counted again when walking them
+	for i := 0; i < 2; i++ {
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+	}
+	masterFields, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{}
+	for i := int64(0); i < masterFields; i++ {
+		field, err := next()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+
+	entries := []StreamEntry{}
+	for p < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{Id: StreamId{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}}
+
+		if flags&streamItemSameFields != 0 {
+			for _, field := range fields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, field, value)
+			}
+		} else {
+			count, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for i := int64(0); i < 2*count; i++ {
+				element, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, element)
+			}
+		}
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,121 @@
+package rdb
+
+import "fmt"
+
+// File is the content of an RDB file
+type File struct {
+	Version int
+	// Aux holds the auxiliary fields, such as redis-ver or ctime
+	Aux map[string]string
+	// Functions holds the code of the function libraries
+	Functions []string
+	Keys      []Key
+	// Modules holds the names of the modules whose data was skipped, as
+	// modules can't be loaded
+	Modules []string
+	// Checksum is the CRC64 checksum the file ends with, 0 when it was saved
+	// without one or its version has none
+	Checksum uint64
+}
+
+// Key is a key of a database along with its value, which is one of:
+// string, List, Set, SortedSet, Hash or *Stream
+type Key struct {
+	DB      int
+	Key     string
+	Value   any
+	Expires bool
+	// ExpireAt is the unix time in milliseconds the key expires at
+	ExpireAt int64
+}
+
+// TypeName returns the name of the type of a value, as given by TYPE
+func TypeName(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case List:
+		return "list"
+	case Set:
+		return "set"
+	case SortedSet:
+		return "zset"
+	case Hash:
+		return "hash"
+	case *Stream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+type List []string
+
+type Set []string
+
+type SortedSet []SortedSetMember
+
+type SortedSetMember struct {
+	Member string
+	Score  float64
+}
+
+type Hash []HashField
+
+// HashField is a field of a hash, ExpireAt is the unix time in milliseconds
+// it expires at, or 0 when it doesn't expire
+type HashField struct {
+	Field    string
+	Value    string
+	ExpireAt int64
+}
+
+type StreamId struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamId) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+type Stream struct {
+	Entries []StreamEntry
+	// Length is the number of entries, as recorded in the file
+	Length       uint64
+	LastId       StreamId
+	FirstId      StreamId
+	MaxDeletedId StreamId
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+// StreamEntry is an entry of a stream, with its fields and values one after the other
+type StreamEntry struct {
+	Id     StreamId
+	Fields []string
+}
+
+// StreamGroup is a consumer group, EntriesRead is -1 when unknown
+type StreamGroup struct {
+	Name        string
+	LastId      StreamId
+	EntriesRead int64
+	Pending     []StreamPendingEntry
+	Consumers   []StreamConsumer
+}
+
+// StreamPendingEntry is an entry delivered to a consumer, not acknowledged
+// yet. Its delivery time is the unix time in milliseconds.
+type StreamPendingEntry struct {
+	Id            StreamId
+	Consumer      string
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a group, its times are unix times in milliseconds
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64
+	ActiveTime int64
+}